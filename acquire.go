@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	defaultAcquireThreshold = 50 * time.Millisecond
+	acquireWarnEvery        = 10 * time.Second
+	// a pool whose calls wait longer than the threshold this often is
+	// reported as saturated
+	acquireSaturatedShare = 0.01
+)
+
+// acquireWatch splits a pool's call latency into the time spent waiting to
+// acquire connections and the rest, and flags acquires slower than a
+// threshold. A call waits when every connection is in use, so slow acquires
+// on a pool at MaxConns mean the pool, not the database, is the bottleneck.
+type acquireWatch struct {
+	pool      string
+	threshold time.Duration // 0 => no slow acquires
+
+	acquires atomic.Int64
+	slow     atomic.Int64
+	wait     atomic.Int64 // nanoseconds, summed over calls' acquires
+	calls    atomic.Int64 // nanoseconds, summed over calls
+	lastWarn atomic.Int64 // unix nanos
+	query    latencyHistogram
+}
+
+// acquireSummary is one pool's acquire waits, as logged and written to
+// --results-out.
+type acquireSummary struct {
+	Threshold time.Duration     `json:"threshold_ns"`
+	Acquires  int64             `json:"acquires"`
+	Slow      int64             `json:"slow"`       // at least Threshold
+	WaitShare float64           `json:"wait_share"` // of the calls' time, spent acquiring
+	Query     *latencyHistogram `json:"query_latency"`
+	Saturated bool              `json:"saturated"`
+}
+
+// observe records one acquire; within a call, its wait is charged to it.
+func (w *acquireWatch) observe(ctx context.Context, pool *pgxpool.Pool, d time.Duration, err error) {
+	w.acquires.Add(1)
+	if c, ok := ctx.Value(callClockKey{}).(*callClock); ok {
+		c.acquireWait += d
+		if err == nil && c.acquired.IsZero() {
+			c.acquired = time.Now()
+			if c.report != nil && c.report.onAcquire != nil {
+				c.report.onAcquire()
+			}
+		}
+	}
+	if w.threshold == 0 || d < w.threshold {
+		return
+	}
+	w.slow.Add(1)
+	now := time.Now().UnixNano()
+	last := w.lastWarn.Load()
+	if now-last < int64(acquireWarnEvery) || !w.lastWarn.CompareAndSwap(last, now) {
+		return
+	}
+	s := pool.Stat()
+	slog.WarnContext(ctx, "slow acquire", "pool", w.pool, "wait", d, "threshold", w.threshold, "slow_acquires", w.slow.Load(),
+		"acquired", s.AcquiredConns(), "total", s.TotalConns(), "max", s.MaxConns(), "at_max_conns", s.AcquiredConns() >= s.MaxConns())
+}
+
+// call records a finished call and the part of it spent acquiring.
+func (w *acquireWatch) call(d, acquireWait time.Duration) {
+	w.calls.Add(int64(d))
+	w.wait.Add(int64(acquireWait))
+	w.query.observe(d - acquireWait)
+}
+
+func (w *acquireWatch) summary() acquireSummary {
+	out := acquireSummary{Threshold: w.threshold, Acquires: w.acquires.Load(), Slow: w.slow.Load(), Query: &latencyHistogram{}}
+	out.Query.merge(&w.query)
+	if calls := w.calls.Load(); calls > 0 {
+		out.WaitShare = float64(w.wait.Load()) / float64(calls)
+	}
+	out.Saturated = out.Acquires > 0 && float64(out.Slow)/float64(out.Acquires) >= acquireSaturatedShare
+	return out
+}
+
+func (s acquireSummary) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Duration("threshold", s.Threshold),
+		slog.Int64("acquires", s.Acquires),
+		slog.Int64("slow", s.Slow),
+		slog.Float64("wait_share", s.WaitShare),
+		slog.Any("query", s.Query),
+		slog.Bool("saturated", s.Saturated),
+	)
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const adminShutdownTimeout = 5 * time.Second
+
+// adminServer is the HTTP control API for a live run. Components register
+// their endpoints on mux before start is called; the workloads' own, which
+// only exist once the pools are warm, after (a ServeMux allows it).
+type adminServer struct {
+	addr string
+	mux  *http.ServeMux
+	srv  *http.Server
+}
+
+func newAdminServer(addr string) *adminServer {
+	mux := http.NewServeMux()
+	return &adminServer{addr: addr, mux: mux, srv: &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}}
+}
+
+// start listens on the configured address and serves until stop is called.
+func (a *adminServer) start() error {
+	ln, err := net.Listen("tcp", a.addr)
+	if err != nil {
+		return err
+	}
+	slog.Info("admin API listening", "url", "http://"+ln.Addr().String())
+	go func() {
+		if err := a.srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("admin API", "err", err)
+		}
+	}()
+	return nil
+}
+
+func (a *adminServer) stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), adminShutdownTimeout)
+	defer cancel()
+	if err := a.srv.Shutdown(ctx); err != nil {
+		slog.Warn("admin API shutdown", "err", err)
+	}
+}
+
+// registerFailpoints exposes the failpoints of the given pools:
+//
+//	GET    /failpoints                                    list armed failpoints per pool
+//	POST   /failpoints/{name}?pool=reader&count=1&delay=5s arm (pool defaults to all, count 0 => until disabled)
+//	DELETE /failpoints/{name}?pool=reader                 disarm
+func (a *adminServer) registerFailpoints(pools map[string]*testerPool) {
+	selectPools := func(w http.ResponseWriter, r *http.Request) ([]*testerPool, bool) {
+		name := r.URL.Query().Get("pool")
+		if name == "" || name == "all" {
+			out := make([]*testerPool, 0, len(pools))
+			for _, p := range pools {
+				out = append(out, p)
+			}
+			return out, true
+		}
+		p, ok := pools[name]
+		if !ok {
+			writeError(w, http.StatusNotFound, "unknown pool "+strconv.Quote(name))
+			return nil, false
+		}
+		return []*testerPool{p}, true
+	}
+
+	a.mux.HandleFunc("GET /failpoints", func(w http.ResponseWriter, r *http.Request) {
+		out := map[string][]failpointState{}
+		for name, p := range pools {
+			out[name] = p.fp.list()
+		}
+		writeJSON(w, http.StatusOK, out)
+	})
+	a.mux.HandleFunc("POST /failpoints/{name}", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		count := 1
+		if s := q.Get("count"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid count: "+err.Error())
+				return
+			}
+			count = n
+		}
+		var delay time.Duration
+		if s := q.Get("delay"); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid delay: "+err.Error())
+				return
+			}
+			delay = d
+		}
+		targets, ok := selectPools(w, r)
+		if !ok {
+			return
+		}
+		name := r.PathValue("name")
+		for _, p := range targets {
+			if err := p.fp.enable(name, count, delay); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			slog.Info("failpoint armed", "pool", p.name, "failpoint", name, "count", count, "delay", delay)
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"failpoint": name, "pools": len(targets), "count": count, "delay": delay.String()})
+	})
+	a.mux.HandleFunc("DELETE /failpoints/{name}", func(w http.ResponseWriter, r *http.Request) {
+		targets, ok := selectPools(w, r)
+		if !ok {
+			return
+		}
+		name := r.PathValue("name")
+		disabled := 0
+		for _, p := range targets {
+			if p.fp.disable(name) {
+				slog.Info("failpoint disarmed", "pool", p.name, "failpoint", name)
+				disabled++
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"failpoint": name, "disabled": disabled})
+	})
+}
+
+// registerWorkloads exposes pause/resume of the workload loops and the pools'
+// live state, so pools can be inspected quiescent vs. active:
+//
+//	GET  /workloads                   paused state per workload
+//	POST /workloads/pause?workload=w  pause (w: reader, writer or all; default all)
+//	POST /workloads/resume?workload=w resume
+//	GET  /pools                       pgxpool stats per pool
+func (a *adminServer) registerWorkloads(gates map[string]*pauseGate, pools map[string]*testerPool, tl *timeline) {
+	a.mux.HandleFunc("GET /workloads", func(w http.ResponseWriter, r *http.Request) {
+		out := map[string]bool{}
+		for name, g := range gates {
+			out[name] = g.paused()
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"paused": out})
+	})
+	for _, action := range []string{"pause", "resume"} {
+		a.mux.HandleFunc("POST /workloads/"+action, func(w http.ResponseWriter, r *http.Request) {
+			results, err := setPaused(gates, r.URL.Query().Get("workload"), action == "pause")
+			if err != nil {
+				writeError(w, http.StatusNotFound, err.Error())
+				return
+			}
+			tl.record("control", "%s via admin API: %s", action, strings.Join(results, ", "))
+			writeJSON(w, http.StatusOK, map[string]any{"results": results})
+		})
+	}
+	a.mux.HandleFunc("GET /pools", func(w http.ResponseWriter, r *http.Request) {
+		out := map[string]any{}
+		for name, p := range pools {
+			out[name] = map[string]any{"settings": p.settings(), "stat": newPoolStat(p.Stat())}
+		}
+		writeJSON(w, http.StatusOK, out)
+	})
+}
+
+// registerLive exposes the running workloads, to turn the load up or down
+// and inject faults during a game day without restarting:
+//
+//	GET  /stats                                     live stats per workload and retries per pool
+//	POST /workloads/pace?workload=w&conc=16&sleep=5ms set the concurrency and/or sleep between batches (w defaults to all)
+//	POST /chaos/{action}?target=writer              run a scenario action now: kill-conns, pause, resume, or note (with text=...)
+//
+// A pace change applies from the next batch; the timeline records it.
+func (a *adminServer) registerLive(workloads []*workload, gates map[string]*pauseGate, pools map[string]*testerPool, tl *timeline) {
+	a.mux.HandleFunc("GET /stats", func(w http.ResponseWriter, r *http.Request) {
+		type liveWorkload struct {
+			opSummary
+			Conc       int     `json:"conc"`
+			Sleep      string  `json:"sleep"`
+			Rate       float64 `json:"target_qps,omitempty"`
+			Iterations int64   `json:"iterations_done"`
+			Paused     bool    `json:"paused"`
+			Finished   bool    `json:"finished"`
+		}
+		out := struct {
+			Workloads map[string]liveWorkload `json:"workloads"`
+			Retries   map[string]retrySummary `json:"retries"`
+		}{map[string]liveWorkload{}, map[string]retrySummary{}}
+		for _, wl := range workloads {
+			conc, sleep, rate := wl.pace()
+			out.Workloads[wl.name] = liveWorkload{opSummary: wl.stats.summary(), Conc: conc, Sleep: sleep.String(), Rate: rate,
+				Iterations: wl.done.Load(), Paused: wl.gate.paused(), Finished: wl.finished.Load()}
+		}
+		for name, p := range pools {
+			out.Retries[name] = p.retries.summary()
+		}
+		writeJSON(w, http.StatusOK, out)
+	})
+	a.mux.HandleFunc("POST /workloads/pace", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		conc, sleep := 0, time.Duration(-1)
+		if s := q.Get("conc"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				writeError(w, http.StatusBadRequest, "conc must be a number > 0")
+				return
+			}
+			conc = n
+		}
+		if s := q.Get("sleep"); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d < 0 {
+				writeError(w, http.StatusBadRequest, "sleep must be a duration >= 0")
+				return
+			}
+			sleep = d
+		}
+		if conc == 0 && sleep < 0 {
+			writeError(w, http.StatusBadRequest, "set conc, sleep or both")
+			return
+		}
+		target := q.Get("workload")
+		out := map[string]any{}
+		for _, wl := range workloads {
+			if target != "" && target != "all" && target != wl.name {
+				continue
+			}
+			wl.setPace(conc, sleep)
+			c, s, _ := wl.pace()
+			out[wl.name] = map[string]any{"conc": c, "sleep": s.String()}
+			tl.record("control", "pace via admin API: %s conc=%d sleep=%s", wl.name, c, s)
+		}
+		if len(out) == 0 {
+			writeError(w, http.StatusNotFound, "unknown workload "+strconv.Quote(target))
+			return
+		}
+		writeJSON(w, http.StatusOK, out)
+	})
+	targets := scenarioTargets{pools: pools, gates: gates}
+	a.mux.HandleFunc("POST /chaos/{action}", func(w http.ResponseWriter, r *http.Request) {
+		ev := scenarioEvent{Action: r.PathValue("action")}
+		targeted, known := scenarioActions[ev.Action]
+		if !known {
+			writeError(w, http.StatusNotFound, "unknown action "+strconv.Quote(ev.Action))
+			return
+		}
+		q := r.URL.Query()
+		switch target := q.Get("target"); {
+		case !targeted:
+			ev.Args = strings.Fields(q.Get("text"))
+		case target != "" && !validScenarioTarget(target):
+			writeError(w, http.StatusBadRequest, "unknown target "+strconv.Quote(target)+" (want reader, writer or all)")
+			return
+		case target != "":
+			ev.Args = []string{target}
+		}
+		result := targets.apply(ev)
+		tl.record("chaos", "via admin API: %s -> %s", ev, result)
+		writeJSON(w, http.StatusOK, map[string]any{"action": ev.String(), "result": result})
+	})
+}
+
+// registerReload exposes hot reload of the pools:
+//
+//	POST /pools/reload?pool=writer&max-conns=8&retry-attempts=5&retry-backoff=100ms
+//
+// pool may be repeated and defaults to every pool; omitted settings keep
+// their current values.
+func (a *adminServer) registerReload(ctx context.Context, pools map[string]*testerPool, tl *timeline) {
+	a.mux.HandleFunc("POST /pools/reload", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		kvs := map[string]string{}
+		for k, v := range q {
+			if k != "pool" && len(v) > 0 {
+				kvs[k] = v[0]
+			}
+		}
+		if err := reloadPools(ctx, pools, q["pool"], kvs, tl); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		out := map[string]poolSettings{}
+		for name, p := range pools {
+			out[name] = p.settings()
+		}
+		writeJSON(w, http.StatusOK, out)
+	})
+}
+
+// registerHealth exposes the node health tracker's view:
+//
+//	GET /health healthy node count and each known node's health since its last transition
+func (a *adminServer) registerHealth(h *healthWatch) {
+	a.mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, h.snapshot())
+	})
+}
+
+// registerPprof exposes the tester's own runtime profiles, to measure what
+// the tool itself costs (tracing, stats) in a high-concurrency run:
+//
+//	GET /debug/pprof/                   index of the profiles
+//	GET /debug/pprof/profile?seconds=30 CPU profile
+//	GET /debug/pprof/{name}             heap, goroutine, allocs, block, mutex, ...
+//	GET /debug/pprof/trace?seconds=5    execution trace
+func (a *adminServer) registerPprof() {
+	a.mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+	a.mux.HandleFunc("GET /debug/pprof/cmdline", func(w http.ResponseWriter, r *http.Request) {
+		// pprof.Cmdline would serve the DSN flags' passwords
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, strings.Join(append([]string{os.Args[0]}, redactArgs(os.Args[1:])...), "\x00"))
+	})
+	a.mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+	a.mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+	a.mux.HandleFunc("POST /debug/pprof/symbol", pprof.Symbol)
+	a.mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+}
+
+// registerWindows lets operators label periods of the run; the report breaks
+// stats down per window:
+//
+//	GET    /windows        open windows
+//	POST   /windows/{name} open a window
+//	DELETE /windows/{name} close it
+func (a *adminServer) registerWindows(windows *windowTracker, tl *timeline) {
+	a.mux.HandleFunc("GET /windows", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"open": windows.names()})
+	})
+	a.mux.HandleFunc("POST /windows/{name}", func(w http.ResponseWriter, r *http.Request) {
+		if err := windows.openWindow(r.PathValue("name"), tl); err != nil {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"open": windows.names()})
+	})
+	a.mux.HandleFunc("DELETE /windows/{name}", func(w http.ResponseWriter, r *http.Request) {
+		if err := windows.closeWindow(r.PathValue("name"), tl); err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"open": windows.names()})
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("admin API: encode response", "err", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
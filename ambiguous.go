@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	crdbpool "github.com/authzed/crdbpool/pkg"
+)
+
+const (
+	ambiguousVerifyTimeout = time.Minute
+	maxAmbiguousWrites     = 10000 // ambiguous writes kept for verification
+	maxAmbiguousReported   = 20    // duplicates kept for the results
+)
+
+// isAmbiguous reports whether err is CockroachDB's "result is ambiguous"
+// (40003): the statement may or may not have committed, typically because
+// the node serving it shut down mid-commit.
+func isAmbiguous(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == crdbpool.CrdbAmbiguousErrorCode
+}
+
+// ambiguousStats counts a pool's 40003 results. crdbpool treats 40003 as
+// resettable and retries the call on another node, so a call whose attempt
+// was ambiguous and which then succeeded may have been applied twice.
+type ambiguousStats struct {
+	mu        sync.Mutex
+	attempts  int64            // attempts that ended with 40003
+	byNode    map[uint32]int64 // ... per node of the attempt
+	surfaced  int64            // calls that returned 40003 to the caller
+	retriedOK int64            // calls that succeeded after an ambiguous attempt
+}
+
+// ambiguousSummary is one pool's 40003 results, as logged and written to
+// --results-out.
+type ambiguousSummary struct {
+	Attempts  int64            `json:"attempts"`
+	ByNode    map[string]int64 `json:"by_node,omitempty"`
+	Surfaced  int64            `json:"surfaced"`
+	RetriedOK int64            `json:"retried_ok"`
+}
+
+func (s *ambiguousStats) recordAttempt(node uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.byNode == nil {
+		s.byNode = map[uint32]int64{}
+	}
+	s.attempts++
+	s.byNode[node]++
+}
+
+func (s *ambiguousStats) recordCall(ambiguousAttempts int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case isAmbiguous(err):
+		s.surfaced++
+	case err == nil && ambiguousAttempts > 0:
+		s.retriedOK++
+	}
+}
+
+func (s *ambiguousStats) summary() ambiguousSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := ambiguousSummary{Attempts: s.attempts, Surfaced: s.surfaced, RetriedOK: s.retriedOK}
+	if len(s.byNode) > 0 {
+		out.ByNode = map[string]int64{}
+		for node, n := range s.byNode {
+			out.ByNode[strconv.FormatUint(uint64(node), 10)] = n
+		}
+	}
+	return out
+}
+
+// ambiguousVerifier backs --verify-ambiguous: the writer inserts a row with a
+// unique token per call instead of upserting, so after the run every write
+// can be counted. Calls that returned 40003, or succeeded after an ambiguous
+// attempt, are looked up to see whether they committed once, not at all, or
+// more than once; any token in the table twice is a write a retry applied
+// again after it had committed.
+type ambiguousVerifier struct {
+	runID  string
+	insert string
+	table  runTable
+
+	mu      sync.Mutex
+	seq     int64
+	writes  []ambiguousWrite
+	dropped int // ambiguous writes beyond maxAmbiguousWrites
+}
+
+type ambiguousWrite struct {
+	token   string
+	retried bool // succeeded after an ambiguous attempt; else returned 40003
+	at      time.Time
+}
+
+// ambiguousDuplicate is a token found in the table more than once.
+type ambiguousDuplicate struct {
+	Token string    `json:"token"`
+	Count int       `json:"count"`
+	Kind  string    `json:"kind"`        // "surfaced", "retried" or "other" (not seen as ambiguous)
+	At    time.Time `json:"at,omitzero"` // when the call returned, if known
+}
+
+// ambiguousVerdict is written to --results-out.
+type ambiguousVerdict struct {
+	Writes       int64                `json:"writes"`
+	Surfaced     int                  `json:"surfaced"`           // calls that returned 40003 ...
+	Committed    int                  `json:"surfaced_committed"` // ... and had committed anyway
+	Retried      int                  `json:"retried"`            // calls that succeeded after an ambiguous attempt
+	Unverified   int                  `json:"unverified,omitempty"`
+	Duplicates   int                  `json:"duplicates"` // tokens in the table more than once
+	DuplicateLog []ambiguousDuplicate `json:"duplicate_writes,omitempty"`
+}
+
+func newAmbiguousVerifier(runID string, table runTable) *ambiguousVerifier {
+	return &ambiguousVerifier{runID: runID, table: table, insert: table.insertTokenSQL()}
+}
+
+// resume carries the tokens on after seq, the last one of the run resumed.
+func (v *ambiguousVerifier) resume(seq int64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.seq = max(v.seq, seq)
+}
+
+// query returns the writer query: insert a row with a fresh token.
+func (v *ambiguousVerifier) query(writer querier) func(ctx context.Context, i int) error {
+	return func(ctx context.Context, i int) error {
+		v.mu.Lock()
+		v.seq++
+		token := fmt.Sprintf("%s-%d", v.runID, v.seq)
+		v.mu.Unlock()
+		report := &callReport{}
+		err := writer.ExecFunc(withCallReport(ctx, report), func(_ context.Context, _ pgconn.CommandTag, err error) error { return err }, v.insert, token)
+		switch {
+		case isAmbiguous(err):
+			slog.WarnContext(ctx, "ambiguous write", "workload", "writer", "iteration", i+1, "token", token, "err", err)
+			v.record(ambiguousWrite{token: token, at: time.Now()})
+		case err == nil && report.ambiguous > 0:
+			slog.WarnContext(ctx, "write retried after an ambiguous result", "workload", "writer", "iteration", i+1, "token", token, "attempts", report.attempts)
+			v.record(ambiguousWrite{token: token, retried: true, at: time.Now()})
+		case err == nil:
+			logQuery(ctx, "insert ok", "workload", "writer", "iteration", i+1, "token", token)
+		}
+		return err
+	}
+}
+
+func (v *ambiguousVerifier) record(w ambiguousWrite) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.writes) >= maxAmbiguousWrites {
+		v.dropped++
+		return
+	}
+	v.writes = append(v.writes, w)
+}
+
+// verify counts every token through db; duplicates fail the run.
+func (v *ambiguousVerifier) verify(ctx context.Context, db querier) (*ambiguousVerdict, error) {
+	ctx, cancel := context.WithTimeout(ctx, ambiguousVerifyTimeout)
+	defer cancel()
+	v.mu.Lock()
+	writes := slices.Clone(v.writes)
+	out := &ambiguousVerdict{Writes: v.seq, Unverified: v.dropped}
+	v.mu.Unlock()
+
+	tokens := make([]string, len(writes))
+	for i, w := range writes {
+		tokens[i] = w.token
+	}
+	counts := map[string]int{}
+	scan := func(ctx context.Context, rows pgx.Rows) error {
+		for rows.Next() {
+			var token string
+			var n int
+			if err := rows.Scan(&token, &n); err != nil {
+				return err
+			}
+			counts[token] = n
+		}
+		return rows.Err()
+	}
+	if len(tokens) > 0 {
+		if err := db.QueryFunc(ctx, scan, fmt.Sprintf("select token, count(*) from %s where token = any($1) group by token", v.table.ident), tokens); err != nil {
+			return nil, fmt.Errorf("verify ambiguous writes: %w", err)
+		}
+	}
+	if err := db.QueryFunc(ctx, scan, fmt.Sprintf("select token, count(*) from %s where token is not null group by token having count(*) > 1", v.table.ident)); err != nil {
+		return nil, fmt.Errorf("verify ambiguous writes: find duplicates: %w", err)
+	}
+
+	known := map[string]ambiguousWrite{}
+	for _, w := range writes {
+		known[w.token] = w
+		if w.retried {
+			out.Retried++
+		} else {
+			out.Surfaced++
+			if counts[w.token] > 0 {
+				out.Committed++
+			}
+		}
+	}
+	for _, token := range slices.Sorted(maps.Keys(counts)) {
+		n := counts[token]
+		if n < 2 {
+			continue
+		}
+		out.Duplicates++
+		d := ambiguousDuplicate{Token: token, Count: n, Kind: "other"}
+		if w, ok := known[token]; ok {
+			d.Kind, d.At = "surfaced", w.at
+			if w.retried {
+				d.Kind = "retried"
+			}
+		}
+		slog.Error("duplicate write", "token", token, "count", n, "kind", d.Kind)
+		if len(out.DuplicateLog) < maxAmbiguousReported {
+			out.DuplicateLog = append(out.DuplicateLog, d)
+		}
+	}
+	slog.Info("ambiguous writes", "writes", out.Writes, "surfaced", out.Surfaced, "surfaced_committed", out.Committed,
+		"retried", out.Retried, "duplicates", out.Duplicates, "unverified", out.Unverified)
+	if out.Duplicates > 0 {
+		return out, violation(fmt.Errorf("%d writes applied more than once", out.Duplicates))
+	}
+	return out, nil
+}
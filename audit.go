@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	auditTimeout     = time.Minute
+	maxAuditFindings = 20 // findings kept for the results
+)
+
+// ledger backs --ledger: the writer inserts a row with a unique token per
+// call, and every insert the server acknowledged is appended to a local
+// file, one JSON object per line after a header naming the run and table.
+// The audit reconciles the table against it once the workloads are done, or
+// later with the audit command on a --keep-table run. Lines are buffered;
+// a crash loses the last few, which the audit then counts as
+// unacknowledged rows rather than findings.
+type ledger struct {
+	path   string
+	insert string
+	runID  string
+
+	mu     sync.Mutex
+	f      *os.File
+	w      *bufio.Writer
+	enc    *json.Encoder
+	seq    int64
+	n      int64
+	err    error // first write error; later entries are dropped
+	closed bool
+}
+
+// ledgerHeader is the ledger's first line.
+type ledgerHeader struct {
+	RunID     string    `json:"run_id"`
+	Table     string    `json:"table"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// ledgerEntry is one acknowledged write.
+type ledgerEntry struct {
+	ID    int64     `json:"id"`
+	Token string    `json:"token"`
+	TS    time.Time `json:"ts"`
+}
+
+// auditFinding is one row, or acknowledged write, that doesn't reconcile.
+type auditFinding struct {
+	Kind  string    `json:"kind"` // "missing", "duplicate" or "torn"
+	Token string    `json:"token,omitempty"`
+	ID    int64     `json:"id,omitempty"`
+	Want  time.Time `json:"want_ts,omitzero"`
+	Got   time.Time `json:"got_ts,omitzero"`
+	Count int       `json:"count,omitempty"` // rows holding the token, for duplicates
+}
+
+// auditSummary is logged and written to --results-out.
+type auditSummary struct {
+	Table          string         `json:"table"`
+	Acked          int            `json:"acked"` // writes in the ledger
+	Rows           int            `json:"rows"`
+	Missing        int            `json:"missing"`        // acknowledged, not in the table
+	Duplicates     int            `json:"duplicates"`     // tokens in more than one row
+	Torn           int            `json:"torn"`           // rows whose columns don't match their write
+	Unacknowledged int            `json:"unacknowledged"` // rows no acknowledged write explains, e.g. ambiguous ones
+	Findings       []auditFinding `json:"findings,omitempty"`
+}
+
+// openLedger opens path for appending, writing the header if it is new; a
+// resumed run keeps adding to the ledger of the run it resumes, its tokens
+// carrying on after the ledger's last. A ledger of another run is refused.
+func openLedger(path, runID string, table runTable, startedAt time.Time) (*ledger, error) {
+	var seq int64
+	if st, err := os.Stat(path); err == nil && st.Size() > 0 {
+		h, entries, err := readLedger(path)
+		if err != nil {
+			return nil, fmt.Errorf("open ledger: %w", err)
+		}
+		if h.RunID != runID {
+			return nil, fmt.Errorf("open ledger: %s is the ledger of run %s; remove it or pick another path", path, h.RunID)
+		}
+		for _, e := range entries {
+			if n, ok := tokenSeq(runID, e.Token); ok {
+				seq = max(seq, n)
+			}
+		}
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open ledger: %w", err)
+	}
+	l := &ledger{path: path, insert: table.insertTokenReturningSQL(), runID: runID, f: f, w: bufio.NewWriter(f), seq: seq}
+	l.enc = json.NewEncoder(l.w)
+	if st, err := f.Stat(); err == nil && st.Size() > 0 {
+		return l, nil
+	}
+	if err := l.enc.Encode(ledgerHeader{RunID: runID, Table: table.name, StartedAt: startedAt}); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("write ledger header: %w", err)
+	}
+	return l, nil
+}
+
+// resume carries the tokens on after seq, the last one of the run resumed.
+func (l *ledger) resume(seq int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seq = max(l.seq, seq)
+}
+
+// query returns the writer query: insert a row with a fresh token and
+// record it once the server has acknowledged it.
+func (l *ledger) query(writer querier) func(ctx context.Context, i int) error {
+	return func(ctx context.Context, i int) error {
+		l.mu.Lock()
+		l.seq++
+		token := fmt.Sprintf("%s-%d", l.runID, l.seq)
+		l.mu.Unlock()
+		e := ledgerEntry{Token: token}
+		if err := writer.QueryRowFunc(ctx, func(ctx context.Context, row pgx.Row) error { return row.Scan(&e.ID, &e.TS) }, l.insert, token); err != nil {
+			return err
+		}
+		l.append(e)
+		logQuery(ctx, "insert ok", "workload", "writer", "iteration", i+1, "id", e.ID, "token", token)
+		return nil
+	}
+}
+
+func (l *ledger) append(e ledgerEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil || l.closed {
+		return
+	}
+	if err := l.enc.Encode(e); err != nil {
+		l.err = err
+		slog.Error("write ledger", "path", l.path, "err", err)
+		return
+	}
+	l.n++
+}
+
+// close flushes the ledger; it is safe to call more than once.
+func (l *ledger) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return l.err
+	}
+	l.closed = true
+	err := errors.Join(l.err, l.w.Flush(), l.f.Close())
+	slog.Info("ledger written", "path", l.path, "writes", l.n)
+	return err
+}
+
+// readLedger returns the ledger's header and entries.
+func readLedger(path string) (ledgerHeader, []ledgerEntry, error) {
+	var h ledgerHeader
+	f, err := os.Open(path)
+	if err != nil {
+		return h, nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	var entries []ledgerEntry
+	for line := 1; sc.Scan(); line++ {
+		if line == 1 {
+			if err := json.Unmarshal(sc.Bytes(), &h); err != nil || h.Table == "" {
+				return h, nil, fmt.Errorf("%s: not a ledger (bad header)", path)
+			}
+			continue
+		}
+		var e ledgerEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return h, nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		entries = append(entries, e)
+	}
+	if err := sc.Err(); err != nil {
+		return h, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if h.Table == "" {
+		return h, nil, fmt.Errorf("%s: empty ledger", path)
+	}
+	return h, entries, nil
+}
+
+// rowsQuerier is what the audit reads the table through: a pool, or the
+// audit command's single connection.
+type rowsQuerier interface {
+	QueryFunc(ctx context.Context, rowsFunc func(ctx context.Context, rows pgx.Rows) error, sql string, optionsAndArgs ...any) error
+}
+
+// connQuerier adapts a plain connection to rowsQuerier and sqlDB.
+type connQuerier struct{ conn *pgx.Conn }
+
+func (c connQuerier) ExecFunc(ctx context.Context, tagFunc func(ctx context.Context, tag pgconn.CommandTag, err error) error, sql string, arguments ...any) error {
+	tag, err := c.conn.Exec(ctx, sql, arguments...)
+	return tagFunc(ctx, tag, err)
+}
+
+func (c connQuerier) QueryFunc(ctx context.Context, rowsFunc func(ctx context.Context, rows pgx.Rows) error, sql string, optionsAndArgs ...any) error {
+	rows, err := c.conn.Query(ctx, sql, optionsAndArgs...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	return rowsFunc(ctx, rows)
+}
+
+type auditRow struct {
+	id    int64
+	ts    *time.Time
+	token *string
+}
+
+// audit scans the ledger's table through db and reconciles every row with
+// the acknowledged writes: an acknowledged write with no row is missing, a
+// token in more than one row a duplicate, and a row whose id or ts differs
+// from what its insert returned, or with a column missing, torn. Any of
+// them fails the audit; rows the ledger doesn't explain are only counted.
+func audit(ctx context.Context, db rowsQuerier, path string) (*auditSummary, error) {
+	h, entries, err := readLedger(path)
+	if err != nil {
+		return nil, fmt.Errorf("audit: read ledger: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, auditTimeout)
+	defer cancel()
+	var rows []auditRow
+	err = db.QueryFunc(ctx, func(ctx context.Context, r pgx.Rows) error {
+		rows = rows[:0]
+		for r.Next() {
+			var row auditRow
+			if err := r.Scan(&row.id, &row.ts, &row.token); err != nil {
+				return err
+			}
+			rows = append(rows, row)
+		}
+		return r.Err()
+	}, fmt.Sprintf("select id, ts, token from %s", tableIdent(h.Table)))
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "42P01" {
+		return nil, fmt.Errorf("audit: table %s is gone (audit after the run needs --keep-table): %w", h.Table, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("audit: scan %s: %w", h.Table, err)
+	}
+
+	s := &auditSummary{Table: h.Table, Acked: len(entries), Rows: len(rows)}
+	finding := func(f auditFinding) {
+		slog.Error("audit finding", "kind", f.Kind, "token", f.Token, "id", f.ID, "want_ts", f.Want, "got_ts", f.Got, "count", f.Count)
+		if len(s.Findings) < maxAuditFindings {
+			s.Findings = append(s.Findings, f)
+		}
+	}
+	byToken := map[string][]auditRow{}
+	for _, row := range rows {
+		if row.token == nil || row.ts == nil {
+			s.Torn++
+			f := auditFinding{Kind: "torn", ID: row.id}
+			if row.token != nil {
+				f.Token = *row.token
+			}
+			finding(f)
+			continue
+		}
+		byToken[*row.token] = append(byToken[*row.token], row)
+	}
+	acked := map[string]bool{}
+	for _, e := range entries {
+		acked[e.Token] = true
+		got := byToken[e.Token]
+		switch {
+		case len(got) == 0:
+			s.Missing++
+			finding(auditFinding{Kind: "missing", Token: e.Token, ID: e.ID, Want: e.TS})
+		case len(got) > 1:
+			s.Duplicates++
+			finding(auditFinding{Kind: "duplicate", Token: e.Token, ID: e.ID, Count: len(got)})
+		case got[0].id != e.ID || !got[0].ts.Equal(e.TS):
+			s.Torn++
+			finding(auditFinding{Kind: "torn", Token: e.Token, ID: got[0].id, Want: e.TS, Got: *got[0].ts})
+		}
+	}
+	for _, token := range slices.Sorted(maps.Keys(byToken)) {
+		got := byToken[token]
+		if acked[token] {
+			continue
+		}
+		s.Unacknowledged += len(got)
+		if len(got) > 1 {
+			s.Duplicates++
+			finding(auditFinding{Kind: "duplicate", Token: token, ID: got[0].id, Count: len(got)})
+		}
+	}
+	slog.Info("audit", "table", s.Table, "acked", s.Acked, "rows", s.Rows, "missing", s.Missing,
+		"duplicates", s.Duplicates, "torn", s.Torn, "unacknowledged", s.Unacknowledged)
+	if n := s.Missing + s.Duplicates + s.Torn; n > 0 {
+		return s, violation(fmt.Errorf("audit: %d findings in %s (%d missing, %d duplicate, %d torn)", n, s.Table, s.Missing, s.Duplicates, s.Torn))
+	}
+	return s, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// middlewareBackoffCap bounds the middleware's sleep between retries,
+// whatever the strategy.
+const middlewareBackoffCap = 2 * time.Second
+
+// retryStrategies are the backoffs --retry-strategy puts between the
+// middleware's retries, each starting from middlewareBackoff:
+//
+//	constant      the base every time
+//	exponential   doubling: base << attempt
+//	exp-jitter    a random share of the doubling one ("full jitter")
+//	decorrelated  random between the base and three times the previous sleep
+var retryStrategies = []string{"constant", "exponential", "exp-jitter", "decorrelated"}
+
+const defaultRetryStrategy = "exponential"
+
+func validateRetryStrategy(s string) error {
+	if !slices.Contains(retryStrategies, s) {
+		return fmt.Errorf("unknown retry-strategy %q (want one of %s)", s, strings.Join(retryStrategies, ", "))
+	}
+	return nil
+}
+
+// backoff draws the middleware's sleeps between retries of a call by its
+// strategy and meters them, so runs of each strategy under the same fault
+// schedule can be compared by what the retries cost on top of the attempt
+// that ended the call.
+type backoff struct {
+	strategy  string
+	base, cap time.Duration
+	rng       *lockedRand // draws the jittered strategies' sleeps
+
+	calls    atomic.Int64 // calls that were retried
+	ok       atomic.Int64 // of those, calls that succeeded in the end
+	slept    atomic.Int64 // total backoff, in nanoseconds
+	overhead latencyHistogram
+}
+
+// newBackoff returns pool's backoff, drawing from a stream of seed of its
+// own so every run of a seed sleeps the same.
+func newBackoff(strategy string, seed uint64, pool string) *backoff {
+	return &backoff{strategy: strategy, base: middlewareBackoff, cap: middlewareBackoffCap, rng: newLockedRand(seed, "retry-strategy-"+pool)}
+}
+
+// next is the sleep before retry attempt+1 of a call (attempt 0 being its
+// first try), given the sleep before the previous retry, 0 for the first.
+func (b *backoff) next(attempt int, prev time.Duration) time.Duration {
+	attempt = min(attempt, 16) // past the cap already; keeps the shift from overflowing
+	var d time.Duration
+	switch b.strategy {
+	case "constant":
+		d = b.base
+	case "exp-jitter":
+		d = time.Duration(b.rng.Float64() * float64(b.base<<attempt))
+	case "decorrelated":
+		d = b.base + time.Duration(b.rng.Float64()*float64(max(3*prev, b.base)-b.base))
+	default: // exponential
+		d = b.base << attempt
+	}
+	return min(d, b.cap)
+}
+
+// record meters a retried call: overhead is its time beyond its last
+// attempt's, backoff and failed attempts included.
+func (b *backoff) record(overhead, slept time.Duration, err error) {
+	b.calls.Add(1)
+	if err == nil {
+		b.ok.Add(1)
+	}
+	b.slept.Add(int64(slept))
+	b.overhead.observe(overhead)
+}
+
+// backoffSummary is a pool's retry overhead under its strategy, as written
+// to --results-out.
+type backoffSummary struct {
+	Strategy string            `json:"strategy"`
+	Calls    int64             `json:"retried_calls"`
+	OK       int64             `json:"retried_ok"`
+	Backoff  time.Duration     `json:"backoff_ns"` // total slept between retries
+	P50      time.Duration     `json:"overhead_p50_ns"`
+	P99      time.Duration     `json:"overhead_p99_ns"`
+	Mean     time.Duration     `json:"overhead_mean_ns"`
+	Overhead *latencyHistogram `json:"overhead"`
+}
+
+func (b *backoff) summary() backoffSummary {
+	s := backoffSummary{Strategy: b.strategy, Calls: b.calls.Load(), OK: b.ok.Load(), Backoff: time.Duration(b.slept.Load()),
+		P50: b.overhead.quantile(0.5), P99: b.overhead.quantile(0.99), Mean: b.overhead.mean(), Overhead: &latencyHistogram{}}
+	s.Overhead.merge(&b.overhead)
+	return s
+}
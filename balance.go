@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	crdbpool "github.com/authzed/crdbpool/pkg"
+)
+
+const (
+	defaultBalanceWarmup    = 30 * time.Second
+	defaultBalanceTolerance = 0.25
+	balanceTick             = time.Second
+)
+
+// poolBalancers runs a crdbpool connection balancer per pool. A reload swaps
+// the pool underneath; a balancer is bound to a single RetryPool, so sync
+// follows the current generation. A plainPool has no balancer. sync runs in
+// the balance check's goroutine and close in the run's, hence the mutex.
+type poolBalancers struct {
+	ht    *crdbpool.NodeHealthTracker
+	pools map[string]*testerPool
+
+	mu      sync.Mutex
+	current map[string]basePool
+	stop    map[string]context.CancelFunc
+	closed  bool
+}
+
+func newPoolBalancers(ht *crdbpool.NodeHealthTracker, pools map[string]*testerPool) *poolBalancers {
+	return &poolBalancers{ht: ht, pools: pools, current: map[string]basePool{}, stop: map[string]context.CancelFunc{}}
+}
+
+// sync starts a balancer for every pool generation that has none yet.
+func (b *poolBalancers) sync(ctx context.Context) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	for name, p := range b.pools {
+		rp := p.pool()
+		if b.current[name] == rp {
+			continue
+		}
+		if stop := b.stop[name]; stop != nil {
+			stop()
+		}
+		b.current[name], b.stop[name] = rp, nil
+		retryPool, ok := rp.(*crdbpool.RetryPool)
+		if !ok {
+			continue
+		}
+		bctx, stop := context.WithCancel(ctx)
+		go crdbpool.NewNodeConnectionBalancer(retryPool, b.ht, balancerInterval).Prune(bctx)
+		b.stop[name] = stop
+	}
+}
+
+func (b *poolBalancers) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for _, stop := range b.stop {
+		if stop != nil {
+			stop()
+		}
+	}
+}
+
+// balanceCheck verifies the property crdbpool's balancer exists for: after a
+// warm-up, each pool's connections are spread evenly over the healthy nodes.
+// Each connection's gateway node is the one it reported when it connected
+// (crdb_internal.node_id()), checked against the node crdbpool attributes it
+// to.
+type balanceCheck struct {
+	ht        *crdbpool.NodeHealthTracker
+	pools     map[string]*testerPool
+	warmup    time.Duration
+	tolerance float64 // allowed deviation from an even share, relative to it
+	tl        *timeline
+
+	mu      sync.Mutex
+	results []balanceResult // nil until checked
+}
+
+// balanceResult is one pool's verdict, as written to --results-out.
+type balanceResult struct {
+	Pool          string         `json:"pool"`
+	Conns         int            `json:"conns"`
+	HealthyNodes  int            `json:"healthy_nodes"`
+	Nodes         map[string]int `json:"nodes"` // connections per healthy gateway node
+	Expected      float64        `json:"expected_per_node"`
+	MaxDeviation  float64        `json:"max_deviation"` // relative to Expected
+	Unhealthy     int            `json:"unhealthy_conns,omitempty"`
+	Misattributed int            `json:"misattributed_conns,omitempty"` // crdbpool's node differs from the gateway's
+	Passed        bool           `json:"passed"`
+	Reason        string         `json:"reason,omitempty"`
+}
+
+func newBalanceCheck(ht *crdbpool.NodeHealthTracker, pools map[string]*testerPool, warmup time.Duration, tolerance float64, tl *timeline) *balanceCheck {
+	return &balanceCheck{ht: ht, pools: pools, warmup: warmup, tolerance: tolerance, tl: tl}
+}
+
+// run keeps a balancer on every pool until ctx is done and checks the
+// balance once the warm-up is over.
+func (c *balanceCheck) run(ctx context.Context, balancers *poolBalancers) {
+	checkAt := time.Now().Add(c.warmup)
+	t := time.NewTicker(balanceTick)
+	defer t.Stop()
+	for {
+		if balancers != nil {
+			balancers.sync(ctx)
+		}
+		if !checkAt.IsZero() && !time.Now().Before(checkAt) {
+			c.check()
+			checkAt = time.Time{}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (c *balanceCheck) check() {
+	healthy := c.ht.HealthyNodeCount()
+	var results []balanceResult
+	for _, name := range slices.Sorted(maps.Keys(c.pools)) {
+		r := c.evaluate(name, c.pools[name].pool(), healthy)
+		status := "PASS"
+		if !r.Passed {
+			status = "FAIL: " + r.Reason
+		}
+		c.tl.record("balance", "%s: %s (%d conns over %d healthy nodes: %s)", name, status, r.Conns, r.HealthyNodes, formatBalanceNodes(r.Nodes))
+		results = append(results, r)
+	}
+	c.mu.Lock()
+	c.results = results
+	c.mu.Unlock()
+}
+
+func (c *balanceCheck) evaluate(name string, rp basePool, healthy int) balanceResult {
+	r := balanceResult{Pool: name, HealthyNodes: healthy, Nodes: map[string]int{}, Passed: true}
+	counts := map[uint32]int{}
+	rp.Range(func(conn *pgx.Conn, node uint32) {
+		r.Conns++
+		gateway := node
+		if info, ok := lookupConn(conn); ok && info.node != 0 {
+			gateway = info.node
+			if node != 0 && node != gateway {
+				r.Misattributed++
+			}
+		}
+		if !c.ht.IsHealthy(gateway) {
+			r.Unhealthy++
+			return
+		}
+		counts[gateway]++
+	})
+	fail := func(format string, args ...any) {
+		if !r.Passed {
+			r.Reason += "; "
+		}
+		r.Passed = false
+		r.Reason += fmt.Sprintf(format, args...)
+	}
+
+	if healthy == 0 {
+		fail("no healthy nodes")
+		return r
+	}
+	balanced := r.Conns - r.Unhealthy
+	if balanced < healthy {
+		fail("%d connections can't cover %d healthy nodes; raise the pool size", balanced, healthy)
+	}
+	r.Expected = float64(balanced) / float64(healthy)
+	allowed := max(c.tolerance*r.Expected, 1)
+	devs := make([]float64, 0, healthy)
+	for node, n := range counts {
+		r.Nodes[fmt.Sprintf("n%d", node)] = n
+		devs = append(devs, math.Abs(float64(n)-r.Expected))
+	}
+	for range max(healthy-len(counts), 0) {
+		devs = append(devs, r.Expected) // a healthy node without connections
+	}
+	if missing := healthy - len(counts); missing > 0 {
+		fail("%d healthy nodes have no connection", missing)
+	}
+	worst := slices.Max(append(devs, 0))
+	if r.Expected > 0 {
+		r.MaxDeviation = worst / r.Expected
+	}
+	if worst > allowed {
+		fail("a node is %.1f connections off the even share of %.1f (allowed %.1f)", worst, r.Expected, allowed)
+	}
+	if r.Unhealthy > 0 {
+		fail("%d connections to unhealthy nodes", r.Unhealthy)
+	}
+	if r.Misattributed > 0 {
+		fail("%d connections attributed by crdbpool to another node than their gateway", r.Misattributed)
+	}
+	return r
+}
+
+func formatBalanceNodes(m map[string]int) string {
+	parts := make([]string, 0, len(m))
+	for _, k := range slices.Sorted(maps.Keys(m)) {
+		parts = append(parts, fmt.Sprintf("%s=%d", k, m[k]))
+	}
+	return strings.Join(parts, " ")
+}
+
+// verdict returns the results and an error naming the pools that failed; an
+// unchecked balance (a run shorter than the warm-up) is logged, not failed.
+func (c *balanceCheck) verdict() ([]balanceResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.results == nil {
+		slog.Warn("balance not verified: the run ended before the warm-up", "warmup", c.warmup)
+		return nil, nil
+	}
+	var failed []string
+	for _, r := range c.results {
+		slog.Info("balance", "pool", r.Pool, "passed", r.Passed, "conns", r.Conns, "healthy_nodes", r.HealthyNodes,
+			"nodes", formatBalanceNodes(r.Nodes), "max_deviation", r.MaxDeviation, "reason", r.Reason)
+		if !r.Passed {
+			failed = append(failed, r.Pool+": "+r.Reason)
+		}
+	}
+	if len(failed) > 0 {
+		return c.results, fmt.Errorf("connections not balanced: %s", strings.Join(failed, "; "))
+	}
+	return c.results, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	defaultBankAccounts   = 10
+	defaultBankBalance    = 1000
+	defaultBankCheckEvery = 10 * time.Second
+	bankMaxTransfer       = 10
+	bankCheckTimeout      = 30 * time.Second
+	maxBankViolations     = 20 // violations kept for the results
+)
+
+// bank is the classic bank workload: accounts with a fixed total balance and
+// writers moving random amounts between random pairs of them, both updates
+// in one transaction. Every checkEvery the reader sums the balances, and
+// once more after the workloads finish; any total but the initial one means
+// a transfer was applied in part, or twice.
+type bank struct {
+	accounts int
+	balance  int64 // initial balance of each account
+	every    time.Duration
+	tx       pgx.TxOptions // the transfers'
+	table    runTable
+	rng      *lockedRand
+	tl       *timeline
+
+	seeded    atomic.Bool
+	transfers atomic.Int64 // committed
+	failed    atomic.Int64
+
+	mu         sync.Mutex
+	checks     int
+	violations []bankViolation
+}
+
+// bankViolation is one check whose totals were off.
+type bankViolation struct {
+	At       time.Time `json:"at"`
+	Total    int64     `json:"total"`
+	Accounts int       `json:"accounts"`
+	Final    bool      `json:"final"` // the end-of-run check
+}
+
+// bankSummary is logged and written to --results-out.
+type bankSummary struct {
+	Accounts   int             `json:"accounts"`
+	Total      int64           `json:"total"` // expected at every check
+	Transfers  int64           `json:"transfers"`
+	Failed     int64           `json:"failed"`
+	Checks     int             `json:"checks"`
+	Violations []bankViolation `json:"violations,omitempty"`
+}
+
+func newBank(table runTable, accounts int, balance int64, every time.Duration, tx pgx.TxOptions, rng *lockedRand, tl *timeline) *bank {
+	return &bank{accounts: accounts, balance: balance, every: every, tx: tx, table: table, rng: rng, tl: tl}
+}
+
+func (b *bank) total() int64 { return int64(b.accounts) * b.balance }
+
+// seed opens the accounts; it runs as part of the writer's setup.
+func (b *bank) seed(ctx context.Context, db querier) error {
+	sql := fmt.Sprintf("upsert into %s (id, ts, n) select i, now(), $2 from generate_series(0, $1 - 1) as g(i)", b.table.ident)
+	if err := db.ExecFunc(ctx, func(_ context.Context, _ pgconn.CommandTag, err error) error { return err }, sql, b.accounts, b.balance); err != nil {
+		return fmt.Errorf("bank: open accounts: %w", err)
+	}
+	b.seeded.Store(true)
+	slog.Info("bank accounts opened", "accounts", b.accounts, "balance", b.balance, "total", b.total())
+	return nil
+}
+
+// query returns the writer query: one transfer in a transaction.
+func (b *bank) query(writer querier) func(ctx context.Context, i int) error {
+	debit := fmt.Sprintf("update %s set n = n - $2, ts = now() where id = $1", b.table.ident)
+	credit := fmt.Sprintf("update %s set n = n + $2, ts = now() where id = $1", b.table.ident)
+	return func(ctx context.Context, i int) error {
+		from := b.rng.IntN(b.accounts)
+		to := (from + 1 + b.rng.IntN(b.accounts-1)) % b.accounts
+		amount := 1 + b.rng.IntN(bankMaxTransfer)
+		err := writer.BeginTxFunc(ctx, b.tx, func(tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, debit, from, amount); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, credit, to, amount)
+			return err
+		})
+		if err != nil {
+			b.failed.Add(1)
+			return err
+		}
+		b.transfers.Add(1)
+		logQuery(ctx, "transfer ok", "workload", "writer", "iteration", i+1, "from", from, "to", to, "amount", amount)
+		return nil
+	}
+}
+
+// run checks the totals through db every b.every once the accounts exist.
+func (b *bank) run(ctx context.Context, db querier) {
+	t := time.NewTicker(b.every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if !b.seeded.Load() {
+			continue
+		}
+		if err := b.check(ctx, db, false); err != nil && ctx.Err() == nil {
+			slog.Warn("bank check failed", "err", err)
+		}
+	}
+}
+
+// check sums the balances in one statement and records a violation if the
+// total or the number of accounts changed.
+func (b *bank) check(ctx context.Context, db querier, final bool) error {
+	ctx, cancel := context.WithTimeout(ctx, bankCheckTimeout)
+	defer cancel()
+	var total int64
+	var accounts int
+	err := db.QueryRowFunc(ctx, func(ctx context.Context, row pgx.Row) error {
+		return row.Scan(&total, &accounts)
+	}, fmt.Sprintf("select coalesce(sum(n), 0)::int, count(*) from %s", b.table.ident))
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.checks++
+	if total == b.total() && accounts == b.accounts {
+		slog.Debug("bank check", "total", total, "accounts", accounts, "final", final)
+		return nil
+	}
+	slog.Error("bank invariant violated", "total", total, "want_total", b.total(), "accounts", accounts, "want_accounts", b.accounts, "final", final)
+	b.tl.record("bank", "total %d over %d accounts, want %d over %d", total, accounts, b.total(), b.accounts)
+	if len(b.violations) < maxBankViolations {
+		b.violations = append(b.violations, bankViolation{At: time.Now(), Total: total, Accounts: accounts, Final: final})
+	}
+	return nil
+}
+
+// verify runs the final check and fails the run on any violation.
+func (b *bank) verify(ctx context.Context, db querier) (*bankSummary, error) {
+	if !b.seeded.Load() {
+		return nil, nil
+	}
+	if err := b.check(ctx, db, true); err != nil {
+		return nil, fmt.Errorf("bank: final check: %w", err)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := &bankSummary{Accounts: b.accounts, Total: b.total(), Transfers: b.transfers.Load(), Failed: b.failed.Load(), Checks: b.checks, Violations: b.violations}
+	slog.Info("bank", "accounts", s.Accounts, "total", s.Total, "transfers", s.Transfers, "failed", s.Failed, "checks", s.Checks, "violations", len(s.Violations))
+	if len(s.Violations) > 0 {
+		return s, violation(fmt.Errorf("bank: total balance changed in %d of %d checks", len(s.Violations), s.Checks))
+	}
+	return s, nil
+}
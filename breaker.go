@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	defaultBreakerErrorRate = 0.5
+	defaultBreakerWindow    = 10 * time.Second
+	defaultBreakerMinCalls  = 20
+	defaultBreakerCooldown  = 5 * time.Second
+	defaultBreakerProbes    = 3
+	// breakerBuckets are the slices of the window the error rate is kept
+	// in, so old calls age out of it a slice at a time.
+	breakerBuckets = 10
+)
+
+// errBreakerOpen is what a call the breaker rejects fails with.
+var errBreakerOpen = errors.New("circuit breaker open")
+
+// breakerOptions are the --breaker flags: a client-side circuit breaker in
+// front of each pool, to see whether failing fast during an outage does
+// better than letting crdbpool retry around it.
+type breakerOptions struct {
+	Enabled   bool
+	ErrorRate float64       // share of failed calls over the window that opens the breaker
+	Window    time.Duration // the error rate is taken over
+	MinCalls  int           // calls in the window before the rate counts
+	Cooldown  time.Duration // open, before calls are let through again
+	Probes    int           // half-open: trial calls, all of which must succeed to close
+}
+
+func (o *breakerOptions) register(fs *flag.FlagSet) {
+	fs.BoolVar(&o.Enabled, "breaker", false, "put a client-side circuit breaker in front of each pool: open at --breaker-error-rate over --breaker-window, reject calls (breaker-open) for --breaker-cooldown, then let --breaker-probes trial calls through (half-open) before closing again")
+	o.ErrorRate = defaultBreakerErrorRate
+	fs.Func("breaker-error-rate", "with --breaker, the share of failed calls over the window that opens it, as a percentage (50%) or fraction (default: 50%)", func(s string) (err error) {
+		o.ErrorRate, err = parseRate(s)
+		return err
+	})
+	fs.DurationVar(&o.Window, "breaker-window", defaultBreakerWindow, "with --breaker, the rolling window the error rate is taken over")
+	fs.IntVar(&o.MinCalls, "breaker-min-calls", defaultBreakerMinCalls, "with --breaker, the calls in the window before the error rate can open it")
+	fs.DurationVar(&o.Cooldown, "breaker-cooldown", defaultBreakerCooldown, "with --breaker, how long it stays open before trial calls")
+	fs.IntVar(&o.Probes, "breaker-probes", defaultBreakerProbes, "with --breaker, the trial calls let through half-open; one failing reopens it, all succeeding close it")
+}
+
+func (o breakerOptions) validate() error {
+	if !o.Enabled {
+		return nil
+	}
+	switch {
+	case o.ErrorRate <= 0:
+		return errors.New("breaker-error-rate must be > 0")
+	case o.Window < breakerBuckets*time.Millisecond || o.Cooldown <= 0:
+		return fmt.Errorf("breaker-window must be >= %s and breaker-cooldown > 0 (got %s, %s)", breakerBuckets*time.Millisecond, o.Window, o.Cooldown)
+	case o.MinCalls <= 0 || o.Probes <= 0:
+		return fmt.Errorf("breaker-min-calls and breaker-probes must be > 0 (got %d, %d)", o.MinCalls, o.Probes)
+	}
+	return nil
+}
+
+// String summarizes the settings for the results, "" without --breaker.
+func (o breakerOptions) String() string {
+	if !o.Enabled {
+		return ""
+	}
+	return fmt.Sprintf("error-rate=%g,window=%s,min-calls=%d,cooldown=%s,probes=%d", o.ErrorRate, o.Window, o.MinCalls, o.Cooldown, o.Probes)
+}
+
+type breakerState string
+
+const (
+	breakerClosed   breakerState = "closed"
+	breakerOpen     breakerState = "open"
+	breakerHalfOpen breakerState = "half-open"
+)
+
+// breakerBucket counts the calls of one slice of the window.
+type breakerBucket struct {
+	slice     int64 // which slice of time it counts; stale once the window moved past it
+	ok, fails int
+}
+
+// breaker is a circuit breaker in front of a pool. Closed, it lets every
+// call through and counts them; once the calls of the window fail at the
+// error rate it opens and rejects every call for the cooldown, after which
+// it's half-open: the first probes calls go through, the others are still
+// rejected, and it closes once all of them succeed or opens again when one
+// fails. Calls cancelled by their caller don't count either way.
+type breaker struct {
+	next querier
+	name string
+	o    breakerOptions
+	tl   *timeline
+
+	mu          sync.Mutex
+	state       breakerState
+	since       time.Time // of the state
+	buckets     [breakerBuckets]breakerBucket
+	probing     int // half-open: trial calls let through
+	probeOK     int // of those, succeeded
+	transitions map[string]int
+	notClosed   time.Duration // open and half-open, up to the last close
+
+	calls    atomic.Int64
+	rejected atomic.Int64
+	errs     atomic.Int64
+}
+
+// breakerSummary is a pool's breaker record, as written to --results-out.
+type breakerSummary struct {
+	Calls    int64 `json:"calls"` // rejected included
+	Rejected int64 `json:"rejected"`
+	Errors   int64 `json:"errors"` // of the calls let through
+	// Availability is the share of calls that succeeded, the rejected ones
+	// counting as failed, to set against a run without the breaker.
+	Availability float64        `json:"availability"`
+	Transitions  map[string]int `json:"transitions"` // "closed->open": count
+	NotClosed    time.Duration  `json:"not_closed_ns"`
+	State        breakerState   `json:"state"` // at the end of the run
+}
+
+func newBreaker(next querier, name string, o breakerOptions, tl *timeline) *breaker {
+	return &breaker{next: next, name: name, o: o, tl: tl, state: breakerClosed, since: time.Now(), transitions: map[string]int{}}
+}
+
+func (b *breaker) QueryRowFunc(ctx context.Context, rowFunc func(ctx context.Context, row pgx.Row) error, sql string, optionsAndArgs ...any) error {
+	return b.call(ctx, func() error { return b.next.QueryRowFunc(ctx, rowFunc, sql, optionsAndArgs...) })
+}
+
+func (b *breaker) QueryFunc(ctx context.Context, rowsFunc func(ctx context.Context, rows pgx.Rows) error, sql string, optionsAndArgs ...any) error {
+	return b.call(ctx, func() error { return b.next.QueryFunc(ctx, rowsFunc, sql, optionsAndArgs...) })
+}
+
+func (b *breaker) ExecFunc(ctx context.Context, tagFunc func(ctx context.Context, tag pgconn.CommandTag, err error) error, sql string, arguments ...any) error {
+	return b.call(ctx, func() error { return b.next.ExecFunc(ctx, tagFunc, sql, arguments...) })
+}
+
+func (b *breaker) BeginTxFunc(ctx context.Context, txOptions pgx.TxOptions, txFunc func(pgx.Tx) error) error {
+	return b.call(ctx, func() error { return b.next.BeginTxFunc(ctx, txOptions, txFunc) })
+}
+
+func (b *breaker) call(ctx context.Context, f func() error) error {
+	b.calls.Add(1)
+	probe, ok := b.allow()
+	if !ok {
+		b.rejected.Add(1)
+		return errBreakerOpen
+	}
+	err := f()
+	if err != nil {
+		b.errs.Add(1)
+	}
+	if errors.Is(err, context.Canceled) && ctx.Err() != nil {
+		b.cancelled(probe)
+	} else {
+		b.done(probe, err != nil)
+	}
+	return err
+}
+
+// allow reports whether a call may go through and if so, whether it's one
+// of the half-open state's probes.
+func (b *breaker) allow() (probe, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen && time.Since(b.since) >= b.o.Cooldown {
+		b.transitionLocked(breakerHalfOpen, "cooldown over")
+	}
+	switch b.state {
+	case breakerClosed:
+		return false, true
+	case breakerHalfOpen:
+		if b.probing < b.o.Probes {
+			b.probing++
+			return true, true
+		}
+	}
+	return false, false
+}
+
+// cancelled gives back the probe slot of a call its caller cancelled.
+func (b *breaker) cancelled(probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe && b.state == breakerHalfOpen && b.probing > 0 {
+		b.probing--
+	}
+}
+
+// done counts a call's outcome towards the window, or the probes.
+func (b *breaker) done(probe, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		if b.state != breakerHalfOpen {
+			return
+		}
+		if failed {
+			b.transitionLocked(breakerOpen, "trial call failed")
+			return
+		}
+		if b.probeOK++; b.probeOK >= b.o.Probes {
+			b.transitionLocked(breakerClosed, fmt.Sprintf("%d trial calls succeeded", b.probeOK))
+		}
+		return
+	}
+	if b.state != breakerClosed {
+		return // started before the breaker opened
+	}
+	slice := time.Now().UnixNano() / int64(b.o.Window/breakerBuckets)
+	bk := &b.buckets[slice%breakerBuckets]
+	if bk.slice != slice {
+		*bk = breakerBucket{slice: slice}
+	}
+	if failed {
+		bk.fails++
+	} else {
+		bk.ok++
+	}
+	var ok, fails int
+	for _, bk := range b.buckets {
+		if bk.slice > slice-breakerBuckets {
+			ok, fails = ok+bk.ok, fails+bk.fails
+		}
+	}
+	if n := ok + fails; n >= b.o.MinCalls && float64(fails)/float64(n) >= b.o.ErrorRate {
+		b.transitionLocked(breakerOpen, fmt.Sprintf("%d of %d calls failed over %s", fails, n, b.o.Window))
+	}
+}
+
+func (b *breaker) transitionLocked(to breakerState, why string) {
+	from, now := b.state, time.Now()
+	if from != breakerClosed {
+		b.notClosed += now.Sub(b.since)
+	}
+	if to == breakerClosed {
+		b.buckets = [breakerBuckets]breakerBucket{} // start afresh
+	}
+	b.transitions[string(from)+"->"+string(to)]++
+	b.state, b.since, b.probing, b.probeOK = to, now, 0, 0
+	if to == breakerOpen {
+		slog.Warn("circuit breaker", "pool", b.name, "from", from, "to", to, "reason", why)
+	} else {
+		slog.Info("circuit breaker", "pool", b.name, "from", from, "to", to, "reason", why)
+	}
+	b.tl.record("breaker", "%s: %s -> %s, %s", b.name, from, to, why)
+}
+
+func (b *breaker) summary() breakerSummary {
+	b.mu.Lock()
+	s := breakerSummary{Calls: b.calls.Load(), Rejected: b.rejected.Load(), Errors: b.errs.Load(), Transitions: map[string]int{}, NotClosed: b.notClosed, State: b.state}
+	for k, v := range b.transitions {
+		s.Transitions[k] = v
+	}
+	if b.state != breakerClosed {
+		s.NotClosed += time.Since(b.since)
+	}
+	b.mu.Unlock()
+	if s.Calls > 0 {
+		s.Availability = float64(s.Calls-s.Rejected-s.Errors) / float64(s.Calls)
+	}
+	slog.Info("circuit breaker summary", "pool", b.name, "calls", s.Calls, "rejected", s.Rejected, "errors", s.Errors,
+		"availability", s.Availability, "transitions", s.Transitions, "not_closed", s.NotClosed, "state", s.State)
+	return s
+}
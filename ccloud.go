@@ -0,0 +1,171 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	defaultCCloudServer = "https://cockroachlabs.cloud"
+	ccloudAPITimeout    = 30 * time.Second
+)
+
+// The environment --ccloud-cluster takes its credentials from: an API key
+// of a service account allowed to read the cluster, and the SQL user.
+const (
+	ccloudAPIKeyEnv   = "COCKROACH_API_KEY"
+	ccloudServerEnv   = "COCKROACH_SERVER" // the Cloud API, for testing against a mock
+	ccloudSQLUserEnv  = "COCKROACH_SQL_USER"
+	ccloudSQLPassEnv  = "COCKROACH_SQL_PASSWORD"
+	ccloudDefaultUser = "crdbpool_tester"
+)
+
+// ccloudCluster is the subset of the Cloud API's cluster object the
+// connection needs.
+type ccloudCluster struct {
+	ID      string         `json:"id"`
+	Name    string         `json:"name"`
+	Plan    string         `json:"plan"` // SERVERLESS, STANDARD, DEDICATED, ...
+	State   string         `json:"state"`
+	Regions []ccloudRegion `json:"regions"`
+}
+
+type ccloudRegion struct {
+	Name   string `json:"name"`
+	SQLDNS string `json:"sql_dns"`
+}
+
+// ccloudClient calls the CockroachDB Cloud API with a service account's key.
+type ccloudClient struct {
+	base   string
+	apiKey string
+	http   *http.Client
+}
+
+func newCCloudClient() (*ccloudClient, error) {
+	key := os.Getenv(ccloudAPIKeyEnv)
+	if key == "" {
+		return nil, fmt.Errorf("--ccloud-cluster needs $%s, a service account's API key", ccloudAPIKeyEnv)
+	}
+	return &ccloudClient{
+		base:   strings.TrimRight(cmp.Or(os.Getenv(ccloudServerEnv), defaultCCloudServer), "/"),
+		apiKey: key,
+		http:   &http.Client{Timeout: ccloudAPITimeout},
+	}, nil
+}
+
+// get fetches path, decoding the JSON response into out, or returning the
+// raw body when out is nil.
+func (c *ccloudClient) get(ctx context.Context, path string, out any) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.base+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		_ = json.Unmarshal(body, &apiErr)
+		return nil, fmt.Errorf("%s: %s", resp.Status, cmp.Or(apiErr.Message, strings.TrimSpace(string(body))))
+	}
+	if out != nil {
+		return body, json.Unmarshal(body, out)
+	}
+	return body, nil
+}
+
+// resolveCCloud points the run at a CockroachDB Cloud cluster: it looks the
+// cluster up, saves its CA certificate, and sets DATABASE_URL to its SQL
+// endpoint with the user and password from the environment, sslmode
+// verify-full and the CA as sslrootcert unless --sslmode or --sslrootcert
+// say otherwise.
+func resolveCCloud(ctx context.Context, cfg *Config) error {
+	if len(cfg.Clusters) > 0 || cfg.ReaderDSN != "" || cfg.WriterDSN != "" {
+		return errors.New("--ccloud-cluster builds the DSN and can't be combined with --dsn, --reader-dsn or --writer-dsn")
+	}
+	c, err := newCCloudClient()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, ccloudAPITimeout)
+	defer cancel()
+	id := url.PathEscape(cfg.CCloudCluster)
+	var cl ccloudCluster
+	if _, err := c.get(ctx, "/api/v1/clusters/"+id, &cl); err != nil {
+		return fmt.Errorf("ccloud cluster %s: %w", cfg.CCloudCluster, err)
+	}
+	region, err := cl.region(cfg.CCloudRegion)
+	if err != nil {
+		return err
+	}
+	ca, err := c.get(ctx, "/api/v1/clusters/"+id+"/cert", nil)
+	if err != nil {
+		return fmt.Errorf("ccloud cluster %s: CA certificate: %w", cfg.CCloudCluster, err)
+	}
+	caPath := filepath.Join(os.TempDir(), "crdbpool-tester", "ccloud-"+cl.ID+".crt")
+	if err := os.MkdirAll(filepath.Dir(caPath), 0o700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(caPath, ca, 0o600); err != nil {
+		return fmt.Errorf("ccloud CA certificate: %w", err)
+	}
+	user := cmp.Or(os.Getenv(ccloudSQLUserEnv), ccloudDefaultUser)
+	u := url.URL{
+		Scheme: "postgresql",
+		User:   url.User(user),
+		Host:   net.JoinHostPort(region.SQLDNS, defaultCRDBPort),
+		Path:   "/" + cfg.CCloudDatabase,
+	}
+	if pass, ok := os.LookupEnv(ccloudSQLPassEnv); ok {
+		u.User = url.UserPassword(user, pass)
+	}
+	if cfg.DSN != "" {
+		slog.Info("--ccloud-cluster replaces DATABASE_URL")
+	}
+	cfg.DSN = u.String()
+	cfg.TLS.Mode = cmp.Or(cfg.TLS.Mode, "verify-full")
+	cfg.TLS.RootCert = cmp.Or(cfg.TLS.RootCert, caPath)
+	slog.Info("ccloud cluster", "id", cl.ID, "name", cl.Name, "plan", cl.Plan, "state", cl.State, "region", region.Name,
+		"dsn", redactedDSNInfo(cfg.DSN), "sslrootcert", cfg.TLS.RootCert)
+	return nil
+}
+
+// region is the named region, or the cluster's first one.
+func (cl ccloudCluster) region(name string) (ccloudRegion, error) {
+	var names []string
+	for _, r := range cl.Regions {
+		if name == "" || r.Name == name {
+			if r.SQLDNS == "" {
+				return r, fmt.Errorf("ccloud cluster %s: region %s has no SQL endpoint yet (cluster state %s)", cl.ID, r.Name, cl.State)
+			}
+			return r, nil
+		}
+		names = append(names, r.Name)
+	}
+	if name == "" {
+		return ccloudRegion{}, fmt.Errorf("ccloud cluster %s has no regions", cl.ID)
+	}
+	return ccloudRegion{}, fmt.Errorf("ccloud cluster %s has no region %q (has %s)", cl.ID, name, strings.Join(names, ", "))
+}
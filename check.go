@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	crdbpool "github.com/authzed/crdbpool/pkg"
+)
+
+const (
+	defaultCheckConns    = 16
+	defaultCheckDiscover = 5 * time.Second
+)
+
+// checkCommand is a deployment gate: it connects through a crdbpool pool
+// the way a run would, lists the nodes crdbpool's health checker considers
+// healthy, and requires one round trip over a connection to each of them.
+func checkCommand(args []string) error {
+	e := newCommandEnv("check", "[flags]")
+	conns := e.fs.Int("conns", defaultCheckConns, "connections to open, so that every node behind a load balancer gets at least one")
+	discover := e.fs.Duration("discover", defaultCheckDiscover, "how long to let the health checker and the pool find nodes")
+	e.retryFlags()
+	ctx, cancel, err := e.parse(args)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	if *conns <= 0 {
+		return fmt.Errorf("conns must be > 0 (got %d)", *conns)
+	}
+	attempts, backoff, err := e.retries()
+	if err != nil {
+		return err
+	}
+	dsn, err := e.dsn()
+	if err != nil {
+		return err
+	}
+	slog.Info("connecting", "dsn", redactedDSNInfo(dsn), "conns", *conns)
+
+	ht, err := crdbpool.NewNodeHealthChecker(dsn)
+	if err != nil {
+		return fmt.Errorf("create health tracker: %w", err)
+	}
+	go ht.Poll(ctx, defaultHealthInterval)
+
+	pcfg, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return err
+	}
+	pcfg.MaxConns, pcfg.MinConns = int32(*conns), int32(*conns)
+	rp, err := crdbpool.NewRetryPool(ctx, "check", pcfg, ht, attempts, backoff)
+	if err != nil {
+		return fmt.Errorf("create pool: %w", err)
+	}
+	defer rp.Close()
+
+	// MinConns has the pool open every connection in the background; wait for
+	// them, or for the discovery window to pass
+	wctx, stop := context.WithTimeout(ctx, *discover)
+	for rp.Stat().TotalConns() < int32(*conns) && sleepCtx(wctx, 100*time.Millisecond) {
+	}
+	stop()
+	if ctx.Err() != nil {
+		return fmt.Errorf("discover nodes: %w", ctx.Err())
+	}
+
+	held := rp.AcquireAllIdle(ctx)
+	defer func() {
+		for _, c := range held {
+			c.Release()
+		}
+	}()
+	byNode := map[uint32]*pgxpool.Conn{}
+	for _, c := range held {
+		if node := rp.Node(c.Conn()); node != 0 && byNode[node] == nil {
+			byNode[node] = c
+		}
+	}
+
+	candidates := map[uint32]bool{}
+	for node := range byNode {
+		candidates[node] = true
+	}
+	if len(held) > 0 {
+		nodes, err := gossipNodes(ctx, held[0].Conn())
+		if err != nil {
+			slog.Warn("list nodes", "err", err)
+		}
+		for _, n := range nodes {
+			candidates[uint32(n.id)] = true
+		}
+	}
+	var healthy []uint32
+	for _, node := range slices.Sorted(maps.Keys(candidates)) {
+		if ht.IsHealthy(node) {
+			healthy = append(healthy, node)
+		}
+	}
+	slog.Info("healthy nodes", "nodes", healthy, "connections", len(held))
+
+	passed := 0
+	for _, node := range healthy {
+		c := byNode[node]
+		if c == nil {
+			slog.Error("check", "node", node, "ok", false, "err", "no connection landed on this node; raise --conns")
+			continue
+		}
+		start := time.Now()
+		var got int64
+		err := c.QueryRow(ctx, sqlNodeID).Scan(&got)
+		if err == nil && uint32(got) != node {
+			err = fmt.Errorf("connection attributed to node %d answered from node %d", node, got)
+		}
+		if err != nil {
+			slog.Error("check", "node", node, "ok", false, "conn", safeRemoteAddr(c.Conn()), "err", err)
+			continue
+		}
+		passed++
+		slog.Info("check", "node", node, "ok", true, "conn", safeRemoteAddr(c.Conn()), "round_trip", time.Since(start))
+	}
+
+	switch {
+	case len(healthy) == 0:
+		fmt.Fprintln(os.Stdout, "check: FAIL (no healthy node)")
+		return errors.New("no healthy node")
+	case passed < len(healthy):
+		fmt.Fprintf(os.Stdout, "check: FAIL (%d/%d healthy nodes answered)\n", passed, len(healthy))
+		return fmt.Errorf("%d of %d healthy nodes failed", len(healthy)-passed, len(healthy))
+	}
+	fmt.Fprintf(os.Stdout, "check: PASS (%d/%d healthy nodes answered)\n", passed, len(healthy))
+	return nil
+}
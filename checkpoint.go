@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const defaultCheckpointInterval = time.Minute
+
+// checkpoint is the on-disk progress of a long run: enough to resume it with
+// the same run ID, remaining iterations and time budget, and accumulated
+// stats and timeline.
+type checkpoint struct {
+	RunID      string                        `json:"run_id"`
+	StartedAt  time.Time                     `json:"started_at"`
+	SavedAt    time.Time                     `json:"saved_at"`
+	Elapsed    time.Duration                 `json:"elapsed_ns"` // workload time consumed, across resumes
+	Components map[string]string             `json:"components,omitempty"`
+	Workloads  map[string]workloadCheckpoint `json:"workloads"`
+	Timeline   []timelineEvent               `json:"timeline,omitempty"`
+}
+
+type workloadCheckpoint struct {
+	Iterations int       `json:"iterations_done"`
+	Stats      opSummary `json:"stats"`
+}
+
+func readCheckpoint(path string) (*checkpoint, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(b, &cp); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &cp, nil
+}
+
+// writeCheckpoint writes atomically (temp file + rename) so a kill during
+// the write never leaves a truncated checkpoint behind.
+func writeCheckpoint(path string, cp *checkpoint) error {
+	b, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// checkpointer snapshots the workloads and timeline of a run.
+type checkpointer struct {
+	path      string
+	res       *runResult
+	prior     time.Duration // elapsed before this process started the workload
+	start     time.Time     // when this process started the workload
+	workloads []*workload
+	tl        *timeline
+}
+
+func (c *checkpointer) snapshot() *checkpoint {
+	cp := &checkpoint{
+		RunID:      c.res.RunID,
+		StartedAt:  c.res.StartedAt,
+		SavedAt:    time.Now(),
+		Elapsed:    c.prior + time.Since(c.start),
+		Components: c.res.Components,
+		Workloads:  map[string]workloadCheckpoint{},
+		Timeline:   c.tl.snapshot(),
+	}
+	for _, w := range c.workloads {
+		cp.Workloads[w.name] = workloadCheckpoint{Iterations: int(w.done.Load()), Stats: w.stats.summary()}
+	}
+	return cp
+}
+
+func (c *checkpointer) save() {
+	if err := writeCheckpoint(c.path, c.snapshot()); err != nil {
+		slog.Error("write checkpoint", "path", c.path, "err", err)
+	}
+}
+
+// run saves a checkpoint every interval until ctx is done.
+func (c *checkpointer) run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			c.save()
+		}
+	}
+}
+
+// resumeWorkload restores a workload's progress and stats from a checkpoint.
+func resumeWorkload(w *workload, cp workloadCheckpoint) {
+	w.startIter = cp.Iterations
+	w.done.Store(int64(cp.Iterations))
+	w.stats.restore(cp.Stats)
+}
+
+// lastTokenSeq returns the highest n of the <runID>-<n> tokens in table, so
+// that a resumed run's writer carries on after the tokens of the process it
+// resumes, acknowledged or not, rather than writing them again.
+func lastTokenSeq(ctx context.Context, db querier, table runTable, runID string) (int64, error) {
+	var n int64
+	err := db.QueryRowFunc(ctx, func(_ context.Context, row pgx.Row) error { return row.Scan(&n) },
+		table.lastTokenSeqSQL(), "^"+regexp.QuoteMeta(runID)+"-[0-9]+$", len(runID)+2)
+	if err != nil {
+		return 0, fmt.Errorf("resume tokens: %w", err)
+	}
+	return n, nil
+}
+
+// tokenSeq returns the n of a <runID>-<n> token.
+func tokenSeq(runID, token string) (int64, bool) {
+	s, ok := strings.CutPrefix(token, runID+"-")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n, err == nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const defaultChurnEvery = 1
+
+// connChurn recycles every connection of the pools once it has served every
+// calls: the pool destroys it on release, so the next acquire has to dial a
+// new one through the load balancer. Calls are split by whether they ran on
+// a connection's first acquire, which with every > 1 puts the cost of a
+// reconnect and the latency on a warm connection side by side.
+type connChurn struct {
+	every int64
+
+	mu    sync.Mutex
+	pools map[string]*churnStats
+}
+
+type churnStats struct {
+	recycled atomic.Int64
+	fresh    opStats // calls on a connection's first acquire
+	reused   opStats
+}
+
+// churnSummary is one pool's churn, as logged and written to --results-out.
+type churnSummary struct {
+	Every    int64     `json:"every"`
+	Recycled int64     `json:"recycled_conns"`
+	PerSec   float64   `json:"recycled_per_sec"`
+	Fresh    opSummary `json:"fresh"`
+	Reused   opSummary `json:"reused"`
+}
+
+func newConnChurn(every int) *connChurn {
+	return &connChurn{every: int64(every), pools: map[string]*churnStats{}}
+}
+
+func (c *connChurn) stats(pool string) *churnStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.pools[pool]
+	if s == nil {
+		s = &churnStats{}
+		s.fresh.begin()
+		s.reused.begin()
+		c.pools[pool] = s
+	}
+	return s
+}
+
+// acquire counts a use of conn and marks the call acquiring it as fresh when
+// it is the connection's first.
+func (c *connChurn) acquire(ctx context.Context, conn *pgx.Conn) {
+	info, ok := lookupConn(conn)
+	if !ok {
+		return
+	}
+	n := info.uses.Add(1)
+	if clock, ok := ctx.Value(callClockKey{}).(*callClock); ok {
+		clock.fresh = n == 1
+	}
+}
+
+// release reports whether conn may go back to the pool; false recycles it.
+func (c *connChurn) release(pool string, conn *pgx.Conn) bool {
+	info, ok := lookupConn(conn)
+	if !ok || info.uses.Load() < c.every {
+		return true
+	}
+	c.stats(pool).recycled.Add(1)
+	return false
+}
+
+func (c *connChurn) record(pool string, fresh bool, d time.Duration, err error) {
+	s := c.stats(pool)
+	if fresh {
+		s.fresh.record(d, err)
+	} else {
+		s.reused.record(d, err)
+	}
+}
+
+func (c *connChurn) summary() map[string]churnSummary {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := map[string]churnSummary{}
+	for _, name := range slices.Sorted(maps.Keys(c.pools)) {
+		s := c.pools[name]
+		s.fresh.end()
+		s.reused.end()
+		sum := churnSummary{Every: c.every, Recycled: s.recycled.Load(), Fresh: s.fresh.summary(), Reused: s.reused.summary()}
+		if d := sum.Fresh.Duration; d > 0 {
+			sum.PerSec = float64(sum.Recycled) / d.Seconds()
+		}
+		out[name] = sum
+		slog.Info("conn churn", "pool", name, "every", sum.Every, "recycled", sum.Recycled, "recycled_per_sec", sum.PerSec, "fresh", sum.Fresh, "reused", sum.Reused)
+	}
+	return out
+}
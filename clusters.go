@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// clusterTarget is one --dsn value: a label for reports and the DSN.
+type clusterTarget struct {
+	name string
+	dsn  string
+}
+
+// parseClusterTarget accepts "postgres://..." or "label=postgres://..."; a
+// keyword/value DSN ("host=... user=...") is taken as a whole.
+func parseClusterTarget(s string, n int) clusterTarget {
+	if name, dsn, ok := strings.Cut(s, "="); ok && !strings.ContainsAny(name, " /:") &&
+		(strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://")) {
+		return clusterTarget{name: name, dsn: dsn}
+	}
+	return clusterTarget{name: fmt.Sprintf("cluster%d", n), dsn: s}
+}
+
+// clusterChildSkipFlags are the flags a per-cluster child run must not
+// inherit: the targets themselves, the flags already expanded into the
+// arguments, and the per-cluster result and report files.
+var clusterChildSkipFlags = []string{"-dsn", "-config", "-preset", "-from-bundle", "-results-out", "-junit-out", "-summary-md"}
+
+// clusterUnsupportedFlags name a single listener or file that concurrent
+// per-cluster runs would fight over, or an endpoint that would take the
+// pools away from the cluster under test.
+var clusterUnsupportedFlags = []string{"admin-addr", "checkpoint", "resume", "outliers-out", "toxiproxy-addr", "ledger", "reader-dsn", "writer-dsn"}
+
+// runClusters runs the workload against every target at once, each in a
+// child process of its own (the pools, signal handlers and logger are
+// process-wide), then prints the per-cluster results side by side. Child
+// log lines are prefixed with the target's label. Their result files go
+// next to --results-out, as <name>-<label>.json, or to a temporary
+// directory; their --junit-out and --summary-md reports next to those, as
+// <name>-<label>.xml and <name>-<label>.md. It fails with the children's
+// most severe exit code.
+func runClusters(ctx context.Context, cfg Config) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(cfg.ResultsOut)
+	base := strings.TrimSuffix(filepath.Base(cfg.ResultsOut), filepath.Ext(cfg.ResultsOut))
+	if cfg.ResultsOut == "" {
+		if dir, err = os.MkdirTemp("", "crdbpool-tester-clusters-"); err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		base = "results"
+	}
+	args := append([]string{"run"}, withoutOverridden(cfg.Args, clusterChildSkipFlags)...)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		mu       sync.Mutex // serializes the children's log lines
+		children = make([]*exec.Cmd, len(cfg.Clusters))
+		paths    = map[string]string{}
+	)
+	for i, t := range cfg.Clusters {
+		path := filepath.Join(dir, base+"-"+t.name+".json")
+		paths[t.name] = path
+		childArgs := append(slices.Clip(args), "-results-out="+path)
+		if cfg.JUnitOut != "" {
+			childArgs = append(childArgs, "-junit-out="+clusterPath(cfg.JUnitOut, t.name))
+		}
+		if cfg.SummaryMD != "" {
+			childArgs = append(childArgs, "-summary-md="+clusterPath(cfg.SummaryMD, t.name))
+		}
+		cmd := exec.CommandContext(ctx, exe, childArgs...)
+		cmd.Env = append(os.Environ(), "DATABASE_URL="+t.dsn)
+		cmd.Stdout = &prefixWriter{mu: &mu, w: os.Stdout, prefix: "[" + t.name + "] "}
+		cmd.Stderr = &prefixWriter{mu: &mu, w: os.Stderr, prefix: "[" + t.name + "] "}
+		cmd.WaitDelay = cfg.ShutdownGrace + time.Second
+		children[i] = cmd
+	}
+	stopSignals := forwardTermSignal(children)
+	defer stopSignals()
+
+	slog.Info("running against clusters", "clusters", len(cfg.Clusters))
+	var (
+		g    errgroup.Group
+		errs = make([]error, len(children))
+	)
+	for i, cmd := range children {
+		t := cfg.Clusters[i]
+		slog.Info("cluster", "name", t.name, "dsn", redactedDSNInfo(t.dsn))
+		g.Go(func() error {
+			err := cmd.Run()
+			if err == nil {
+				return nil
+			}
+			err = fmt.Errorf("%s: %w", t.name, err)
+			// the child's own code, so --dsn runs exit like a single one
+			var ee *exec.ExitError
+			if errors.As(err, &ee) && ee.ExitCode() > 0 {
+				err = withExit(ee.ExitCode(), err)
+			}
+			errs[i] = err
+			return nil
+		})
+	}
+	_ = g.Wait()
+	runErr := mostSevere(errs)
+
+	results := map[string]runResult{}
+	var names []string
+	for _, t := range cfg.Clusters {
+		res, err := readResults(paths[t.name])
+		if err != nil {
+			slog.Warn("no results", "cluster", t.name, "err", err)
+			continue
+		}
+		results[t.name] = res
+		names = append(names, t.name)
+		if cfg.ResultsOut != "" {
+			slog.Info("cluster results written", "cluster", t.name, "path", paths[t.name])
+		}
+	}
+	if len(results) > 0 {
+		writeClusterComparison(os.Stdout, names, results)
+	}
+	return runErr
+}
+
+// clusterPath is the child's path for a report file path: label appended
+// to its name, before the extension.
+func clusterPath(path, label string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + label + ext
+}
+
+// forwardTermSignal passes SIGTERM on to the children. Ctrl-C needs no
+// forwarding, the terminal sends SIGINT to the children as well; the parent
+// only has to outlive them.
+func forwardTermSignal(children []*exec.Cmd) (stop func()) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case sig := <-ch:
+				if sig == os.Interrupt {
+					continue
+				}
+				for _, c := range children {
+					if c.Process != nil {
+						_ = c.Process.Signal(sig)
+					}
+				}
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(ch)
+		close(done)
+	}
+}
+
+// prefixWriter prefixes every line written to w, writing whole lines only so
+// concurrent writers sharing mu don't interleave.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+		p.mu.Lock()
+		_, err := fmt.Fprintf(p.w, "%s%s", p.prefix, p.buf[:i+1])
+		p.mu.Unlock()
+		p.buf = p.buf[i+1:]
+		if err != nil {
+			return len(b), err
+		}
+	}
+}
+
+// writeClusterComparison prints one row per workload and metric with a column
+// per cluster; clusters after the first show their change relative to it.
+func writeClusterComparison(w io.Writer, names []string, results map[string]runResult) {
+	fmt.Fprintf(w, "\n%d clusters, baseline %s\n\n", len(names), names[0])
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "WORKLOAD\tMETRIC\t%s\n", strings.Join(names, "\t"))
+	workloads := map[string]bool{}
+	for _, res := range results {
+		for name := range res.Workloads {
+			workloads[name] = true
+		}
+	}
+	metrics := []struct {
+		name   string
+		value  func(opSummary) float64
+		format func(float64) string
+	}{
+		{"qps", func(s opSummary) float64 { return s.Throughput }, func(v float64) string { return fmt.Sprintf("%.1f", v) }},
+		{"err%", func(s opSummary) float64 { return 100 * opErrorRate(s) }, func(v float64) string { return fmt.Sprintf("%.2f", v) }},
+		{"p50", func(s opSummary) float64 { return float64(s.P50) }, formatDurationMetric},
+		{"p95", func(s opSummary) float64 { return float64(s.P95) }, formatDurationMetric},
+		{"p99", func(s opSummary) float64 { return float64(s.P99) }, formatDurationMetric},
+	}
+	for _, wl := range slices.Sorted(maps.Keys(workloads)) {
+		for _, m := range metrics {
+			cells := make([]string, 0, len(names))
+			var baseline float64
+			for i, name := range names {
+				s, ok := results[name].Workloads[wl]
+				if !ok {
+					cells = append(cells, "-")
+					continue
+				}
+				v := m.value(s)
+				cell := m.format(v)
+				if i == 0 {
+					baseline = v
+				} else if baseline != 0 {
+					cell += fmt.Sprintf(" (%+.1f%%)", 100*(v-baseline)/baseline)
+				}
+				cells = append(cells, cell)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", wl, m.name, strings.Join(cells, "\t"))
+		}
+	}
+	tw.Flush()
+}
+
+func opErrorRate(s opSummary) float64 {
+	if s.Queries == 0 {
+		return 0
+	}
+	return float64(s.Errors) / float64(s.Queries)
+}
+
+func formatDurationMetric(v float64) string {
+	return time.Duration(v).Round(time.Microsecond).String()
+}
+
+// validateClusters rejects settings concurrent per-cluster runs can't share.
+func validateClusters(cfg *Config) error {
+	seen := map[string]bool{}
+	for _, t := range cfg.Clusters {
+		if seen[t.name] {
+			return fmt.Errorf("dsn label %q used twice", t.name)
+		}
+		seen[t.name] = true
+	}
+	set := flagsSet(cfg.Args)
+	for _, name := range clusterUnsupportedFlags {
+		if set[name] {
+			return fmt.Errorf("--%s is not supported with more than one --dsn", name)
+		}
+	}
+	for _, ps := range cfg.Pools {
+		if ps.DSN != "" {
+			return fmt.Errorf("pool %s: a dsn of its own is not supported with more than one --dsn", ps.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,571 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	crdbpool "github.com/authzed/crdbpool/pkg"
+)
+
+const (
+	defaultCommandTimeout  = 30 * time.Second
+	defaultCleanupAge      = time.Hour
+	defaultHealthDuration  = 30 * time.Second
+	defaultHealthInterval  = time.Second
+	sqlGossipNodes         = "select node_id, address, is_live from crdb_internal.gossip_nodes order by node_id"
+	preflightHealthWaitMax = 10 * time.Second
+)
+
+// command is one subcommand. run is the default: a command line that starts
+// with a flag (or is empty) runs the workload as before subcommands existed.
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands = []command{
+	{"run", "run the reader/writer workload (default)", runCommand},
+	{"preflight", "check the cluster is reachable and usable before a run", preflightCommand},
+	{"cleanup", "drop workload tables left behind by crashed or --keep-table runs", cleanupCommand},
+	{"audit", "reconcile a --keep-table run's table against its --ledger", auditCommand},
+	{"report", "compare result files grouped by component version", reportCommand},
+	{"dashboard", "print a Grafana dashboard for the --pushgateway-url metrics", dashboardCommand},
+	{"worker", "run a share of a --coordinate run's load", workerCommand},
+	{"check", "deployment gate: one round trip through crdbpool to every healthy node", checkCommand},
+	{"version", "print the version, commit and build date, and the crdbpool and pgx versions", versionCommand},
+	{"health", "watch crdbpool's node health tracker against the cluster", healthCommand},
+	{"replay", "replay a captured statement log through a crdbpool pool", replayCommand},
+}
+
+func lookupCommand(name string) (command, bool) {
+	for _, c := range commands {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return command{}, false
+}
+
+// splitCommand returns the subcommand named by args and the arguments for it.
+func splitCommand(args []string) (string, []string) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return "run", args
+	}
+	return args[0], args[1:]
+}
+
+func printCommands() {
+	fmt.Fprintf(os.Stderr, "usage: %s [command] [flags]\n\ncommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nrun '%s <command> -h' for the command's flags\n", os.Args[0])
+}
+
+// runCommand is the workload, configured by the full flag set.
+func runCommand(args []string) error {
+	cfg := parseFlags(args)
+	if cfg.ShowVersion {
+		currentBuild().write(os.Stdout)
+		return nil
+	}
+	if err := setupLogging(cfg.LogFormat, cfg.LogLevel, cfg.LogBuffer); err != nil {
+		return withExit(exitConfig, fmt.Errorf("invalid flags: %w", err))
+	}
+	logQueries = !cfg.Quiet && !cfg.Measure
+	measuring = cfg.Measure
+	if len(cfg.ReportPaths) > 0 {
+		return versionReport(append(cfg.ReportPaths, flag.Args()...), cfg.ReportComponent, cfg.ReportThreshold)
+	}
+	if err := resolveDSN(context.Background(), &cfg); err != nil {
+		return withExit(exitConfig, err)
+	}
+	if err := validateConfig(&cfg); err != nil {
+		return withExit(exitConfig, fmt.Errorf("invalid config: %w", err))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if cfg.CoordinateAddr != "" {
+		return runCoordinator(ctx, cfg)
+	}
+	if len(cfg.Clusters) > 1 {
+		if err := validateClusters(&cfg); err != nil {
+			return withExit(exitConfig, fmt.Errorf("invalid config: %w", err))
+		}
+		return runClusters(ctx, cfg)
+	}
+	return run(ctx, cfg)
+}
+
+func versionCommand(args []string) error {
+	currentBuild().write(os.Stdout)
+	return nil
+}
+
+// setupLogging installs the process logger, writing through a queue of
+// buffer lines unless buffer is 0.
+func setupLogging(format, level string, buffer int) error {
+	if buffer < 0 {
+		return fmt.Errorf("log-buffer must be >= 0 (got %d)", buffer)
+	}
+	logger, err := newLogger(format, level, os.Stderr)
+	if err != nil {
+		return err
+	}
+	if buffer > 0 {
+		logSink = newAsyncWriter(os.Stderr, buffer)
+		logger, _ = newLogger(format, level, logSink)
+	}
+	slog.SetDefault(logger)
+	return nil
+}
+
+// commandEnv is what the subcommands other than run share: logging flags,
+// the cluster from DATABASE_URL and an overall deadline.
+type commandEnv struct {
+	fs        *flag.FlagSet
+	logFormat string
+	logLevel  string
+	timeout   time.Duration
+	tls       tlsOptions
+
+	// with retryFlags, the settings of the command's crdbpool pool
+	retryAttempts int
+	retryBackoff  time.Duration
+}
+
+func newCommandEnv(name, usage string) *commandEnv {
+	e := &commandEnv{fs: flag.NewFlagSet(name, flag.ExitOnError)}
+	e.fs.Usage = func() {
+		fmt.Fprintf(e.fs.Output(), "usage: %s %s %s\n", os.Args[0], name, usage)
+		e.fs.PrintDefaults()
+	}
+	e.fs.StringVar(&e.logFormat, "log-format", defaultLogFormat, "log output format: text or json")
+	e.fs.StringVar(&e.logLevel, "log-level", defaultLogLevel, "minimum log level: debug, info, warn or error")
+	e.fs.DurationVar(&e.timeout, "timeout", defaultCommandTimeout, "give up after this long")
+	e.tls.register(e.fs)
+	return e
+}
+
+// parse parses args and sets up logging; the returned context carries the
+// command's deadline. Flags may follow the arguments (`report merge a.json
+// b.json -o merged.json`), up to a "--".
+func (e *commandEnv) parse(args []string) (context.Context, context.CancelFunc, error) {
+	var positional []string
+	for {
+		_ = e.fs.Parse(args) // exits on error
+		rest := e.fs.Args()
+		if len(rest) == 0 {
+			break
+		}
+		if consumed := len(args) - len(rest); consumed > 0 && args[consumed-1] == "--" {
+			positional = append(positional, rest...)
+			break
+		}
+		positional, args = append(positional, rest[0]), rest[1:]
+	}
+	_ = e.fs.Parse(append([]string{"--"}, positional...))
+	if err := setupLogging(e.logFormat, e.logLevel, 0); err != nil {
+		return nil, nil, withExit(exitConfig, fmt.Errorf("invalid flags: %w", err))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	return ctx, cancel, nil
+}
+
+// retryFlags registers --retry-attempts and --retry-backoff, for the
+// commands that go through a crdbpool pool as a run does.
+func (e *commandEnv) retryFlags() {
+	e.fs.IntVar(&e.retryAttempts, "retry-attempts", defaultRetryAttempts, "retries crdbpool makes of a call after a retryable error, 0-254")
+	e.fs.DurationVar(&e.retryBackoff, "retry-backoff", defaultRetryBackoff, "crdbpool's backoff between retries, also its connect rate interval")
+}
+
+// retries returns the pool's retry settings from retryFlags.
+func (e *commandEnv) retries() (uint8, time.Duration, error) {
+	if err := validateRetries(e.retryAttempts, e.retryBackoff); err != nil {
+		return 0, 0, withExit(exitConfig, err)
+	}
+	return uint8(e.retryAttempts), e.retryBackoff, nil
+}
+
+func (e *commandEnv) dsn() (string, error) {
+	dsn := os.Getenv("DATABASE_URL")
+	if dsn == "" {
+		return "", errors.New("DATABASE_URL is required")
+	}
+	if err := validateTLS(e.tls, dsn); err != nil {
+		return "", withExit(exitConfig, err)
+	}
+	return e.tls.apply(dsn), nil
+}
+
+func (e *commandEnv) connect(ctx context.Context) (*pgx.Conn, error) {
+	dsn, err := e.dsn()
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("connecting", "dsn", redactedDSNInfo(dsn))
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+	return conn, nil
+}
+
+// preflightCommand runs the checks a workload run depends on, reporting each,
+// and fails if any required one does.
+func preflightCommand(args []string) error {
+	e := newCommandEnv("preflight", "[flags]")
+	ctx, cancel, err := e.parse(args)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	start := time.Now()
+	conn, err := e.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+	slog.Info("preflight", "check", "connect", "ok", true, "duration", time.Since(start))
+
+	failed := 0
+	check := func(name string, required bool, f func() ([]any, error)) {
+		start := time.Now()
+		attrs, err := f()
+		attrs = append([]any{"check", name, "ok", err == nil, "duration", time.Since(start)}, attrs...)
+		switch {
+		case err == nil:
+			slog.Info("preflight", attrs...)
+		case required:
+			failed++
+			slog.Error("preflight", append(attrs, "err", err)...)
+		default:
+			slog.Warn("preflight", append(attrs, "err", err)...)
+		}
+	}
+	check("version", true, func() ([]any, error) {
+		var v string
+		if err := conn.QueryRow(ctx, sqlCrdbVersion).Scan(&v); err != nil {
+			return nil, fmt.Errorf("not CockroachDB? %w", err)
+		}
+		return []any{"version", shortVersion(v)}, nil
+	})
+	check("node-id", true, func() ([]any, error) {
+		var id int64
+		err := conn.QueryRow(ctx, sqlNodeID).Scan(&id)
+		return []any{"node", id}, err
+	})
+	check("ddl", true, func() ([]any, error) {
+		_, err := conn.Exec(ctx, sqlEnsureRegistry)
+		return []any{"table", registryTable}, err
+	})
+	check("nodes", false, func() ([]any, error) {
+		nodes, err := gossipNodes(ctx, conn)
+		live := 0
+		for _, n := range nodes {
+			if n.live {
+				live++
+			}
+		}
+		return []any{"nodes", len(nodes), "live", live}, err
+	})
+	check("health-tracker", true, func() ([]any, error) {
+		dsn, _ := e.dsn()
+		ht, err := crdbpool.NewNodeHealthChecker(dsn)
+		if err != nil {
+			return nil, err
+		}
+		wctx, stop := context.WithTimeout(ctx, preflightHealthWaitMax)
+		defer stop()
+		go ht.Poll(wctx, defaultHealthInterval)
+		for ht.HealthyNodeCount() == 0 {
+			if !sleepCtx(wctx, 100*time.Millisecond) {
+				return nil, errors.New("no healthy node seen")
+			}
+		}
+		return []any{"healthy_nodes", ht.HealthyNodeCount()}, nil
+	})
+	if failed > 0 {
+		return fmt.Errorf("%d preflight checks failed", failed)
+	}
+	slog.Info("preflight passed")
+	return nil
+}
+
+type gossipNode struct {
+	id      int64
+	address string
+	live    bool
+}
+
+func gossipNodes(ctx context.Context, conn *pgx.Conn) ([]gossipNode, error) {
+	rows, err := conn.Query(ctx, sqlGossipNodes)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (gossipNode, error) {
+		var n gossipNode
+		err := row.Scan(&n.id, &n.address, &n.live)
+		return n, err
+	})
+}
+
+// cleanupCommand drops registered workload tables older than --older-than,
+// which keeps it clear of tables that running runs still use.
+func cleanupCommand(args []string) error {
+	e := newCommandEnv("cleanup", "[flags]")
+	opts := cleanupOptions{prefix: tablePrefix}
+	e.fs.DurationVar(&opts.olderThan, "older-than", defaultCleanupAge, "only drop tables created at least this long ago")
+	e.fs.BoolVar(&opts.dryRun, "dry-run", false, "list the tables that would be dropped without dropping them")
+	e.fs.BoolVar(&opts.unregistered, "unregistered", false, "also drop tables named like workload tables (<table>_<run ID>, in any schema) that are missing from the registry")
+	e.fs.StringVar(&opts.prefix, "table", opts.prefix, "with --unregistered, the --table of the runs whose tables are dropped")
+	ctx, cancel, err := e.parse(args)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	conn, err := e.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+	n, err := cleanupTables(ctx, connQuerier{conn}, opts)
+	slog.Info("cleanup", "tables", n, "dry_run", opts.dryRun)
+	return err
+}
+
+// auditCommand runs the end-of-run audit on its own, against a table a
+// --keep-table run left behind, taking the table from the ledger.
+func auditCommand(args []string) error {
+	e := newCommandEnv("audit", "[flags] ledger.jsonl")
+	ctx, cancel, err := e.parse(args)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	if e.fs.NArg() != 1 {
+		e.fs.Usage()
+		return errors.New("want one ledger file")
+	}
+	conn, err := e.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+	_, err = audit(ctx, connQuerier{conn}, e.fs.Arg(0))
+	return err
+}
+
+// dashboardCommand writes a Grafana dashboard wired to the pushed metric
+// names, to stdout or --out.
+func dashboardCommand(args []string) error {
+	e := newCommandEnv("dashboard", "[flags]")
+	title := e.fs.String("title", defaultDashboardTitle, "dashboard title")
+	datasource := e.fs.String("datasource", "", "UID of the Prometheus datasource; empty asks for one on import")
+	job := e.fs.String("job", defaultPushgatewayJob, "job label the runs push with (--pushgateway-job)")
+	out := e.fs.String("out", "", "write the dashboard JSON to this file instead of stdout")
+	_, cancel, err := e.parse(args)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	d := grafanaDashboardFor(*title, *datasource, *job)
+	if *out == "" {
+		return writeDashboard(os.Stdout, d)
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err := writeDashboard(f, d); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// reportCommand is --report as a subcommand: result files as arguments.
+// "report compare" diffs two of them instead, and "report merge" combines
+// them into one.
+func reportCommand(args []string) error {
+	if len(args) > 0 && args[0] == "compare" {
+		return reportCompareCommand(args[1:])
+	}
+	if len(args) > 0 && args[0] == "merge" {
+		return reportMergeCommand(args[1:])
+	}
+	e := newCommandEnv("report", "[flags] result.json|dir ...")
+	component := e.fs.String("component", "crdbpool", "component whose version groups the runs")
+	threshold := e.fs.Float64("threshold", defaultReportThreshold, "relative change between versions that is highlighted (0.10 = 10%)")
+	_, cancel, err := e.parse(args)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	if e.fs.NArg() == 0 {
+		e.fs.Usage()
+		return errors.New("no result files given")
+	}
+	return versionReport(e.fs.Args(), *component, *threshold)
+}
+
+// reportCompareCommand compares a result file against a baseline and fails
+// on any regression beyond the tolerances, for gating a crdbpool bump.
+func reportCompareCommand(args []string) error {
+	e := newCommandEnv("report compare", "[flags] old.json new.json")
+	tol := compareTolerances{latency: defaultCompareLatencyTolerance, throughput: defaultCompareThroughputTolerance, errorRate: defaultCompareErrorRateTolerance}
+	e.fs.Float64Var(&tol.latency, "latency-tolerance", tol.latency, "relative p50, p95 or p99 increase that is a regression (0.10 = 10%)")
+	e.fs.Float64Var(&tol.throughput, "throughput-tolerance", tol.throughput, "relative throughput decrease that is a regression (0.10 = 10%)")
+	e.fs.Func("error-rate-tolerance", "error rate increase that is a regression, in percentage points (0.1%) or as a fraction (0.001) (default 0.1%)", func(s string) (err error) {
+		tol.errorRate, err = parseRate(s)
+		return err
+	})
+	_, cancel, err := e.parse(args)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	if e.fs.NArg() != 2 {
+		e.fs.Usage()
+		return errors.New("want two result files, old and new")
+	}
+	old, err := readResults(e.fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	cur, err := readResults(e.fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	if n := compareResults(os.Stdout, old, cur, tol); n > 0 {
+		return fmt.Errorf("%d regressions", n)
+	}
+	return nil
+}
+
+// reportMergeCommand merges result files into one: the runs of a
+// --shard-count Job or a distributed run, which ran at the same time, or
+// repeated runs, one after another.
+func reportMergeCommand(args []string) error {
+	e := newCommandEnv("report merge", "[flags] result.json|dir ...")
+	out := e.fs.String("out", "", "write the merged result here instead of stdout")
+	e.fs.StringVar(out, "o", "", "short for --out")
+	mode := e.fs.String("mode", mergeAuto, "auto, concurrent or sequential: whether the runs' durations overlap (the merged throughput is over the longest run's) or add up; auto picks sequential if no two runs overlap in time")
+	_, cancel, err := e.parse(args)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	if e.fs.NArg() == 0 {
+		e.fs.Usage()
+		return errors.New("no result files given")
+	}
+	parts, err := loadResultFiles(e.fs.Args())
+	if err != nil {
+		return fmt.Errorf("load results: %w", err)
+	}
+	if len(parts) == 0 {
+		return errors.New("no result files found")
+	}
+	slices.SortStableFunc(parts, func(a, b runResult) int { return a.StartedAt.Compare(b.StartedAt) })
+	var sequential bool
+	switch *mode {
+	case mergeAuto:
+		sequential = isSequential(parts)
+	case mergeConcurrent, mergeSequential:
+		sequential = *mode == mergeSequential
+	default:
+		return withExit(exitConfig, fmt.Errorf("mode must be auto, concurrent or sequential (got %q)", *mode))
+	}
+	names := make([]string, len(parts))
+	for i, p := range parts {
+		names[i] = mergeName(p)
+	}
+	res := mergeRunResults(newRunID(), names, parts, sequential)
+	for _, name := range slices.Sorted(maps.Keys(res.Workloads)) {
+		slog.Info("summary", "workload", name, "runs", len(parts), "sequential", sequential, "stats", res.Workloads[name])
+	}
+	if *out == "" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(res)
+	}
+	if err := writeResults(*out, res); err != nil {
+		return err
+	}
+	slog.Info("merged results written", "path", *out, "runs", len(parts))
+	return nil
+}
+
+func versionReport(paths []string, component string, threshold float64) error {
+	results, err := loadResultFiles(paths)
+	if err != nil {
+		return fmt.Errorf("load results: %w", err)
+	}
+	writeVersionReport(os.Stdout, results, component, threshold)
+	return nil
+}
+
+// healthCommand runs crdbpool's node health tracker on its own and logs what
+// it sees, for checking the cluster's nodes are reachable the way the pools
+// would reach them.
+func healthCommand(args []string) error {
+	e := newCommandEnv("health", "[flags]")
+	e.fs.DurationVar(&e.timeout, "for", defaultHealthDuration, "how long to watch")
+	interval := e.fs.Duration("interval", defaultHealthInterval, "health tracker poll interval")
+	ctx, cancel, err := e.parse(args)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	conn, err := e.connect(ctx)
+	if err != nil {
+		return err
+	}
+	nodes, err := gossipNodes(ctx, conn)
+	conn.Close(context.Background())
+	if err != nil {
+		slog.Warn("list nodes", "err", err)
+	}
+	for _, n := range nodes {
+		slog.Info("node", "node", n.id, "address", n.address, "live", n.live)
+	}
+
+	dsn, _ := e.dsn()
+	ht, err := crdbpool.NewNodeHealthChecker(dsn)
+	if err != nil {
+		return fmt.Errorf("create health tracker: %w", err)
+	}
+	go ht.Poll(ctx, *interval)
+	healthy, seen := 0, 0
+	t := time.NewTicker(*interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("health", "healthy_nodes", healthy, "max_healthy", seen)
+			if seen == 0 {
+				return errors.New("no healthy node seen")
+			}
+			return nil
+		case <-t.C:
+		}
+		if n := ht.HealthyNodeCount(); n != healthy {
+			slog.Info("healthy nodes", "from", healthy, "to", n)
+			healthy, seen = n, max(seen, n)
+		}
+	}
+}
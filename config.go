@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// loadConfigFile reads a YAML (.yaml, .yml) or TOML (.toml) file of flag
+// values and renders them as command-line arguments. Keys are long flag
+// names, with '-' or '_' as separator:
+//
+//	iterations: 5000
+//	reader-max-conns: 24
+//	toxic: ["latency@1m+2m latency=200", "reset_peer@5m"]
+//	component-versions: {lb: haproxy-2.8}
+//
+// Lists repeat a flag and maps become comma-separated key=value pairs.
+func loadConfigFile(fs *flag.FlagSet, path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &m)
+	case ".toml":
+		err = toml.Unmarshal(data, &m)
+	default:
+		return nil, fmt.Errorf("config %s: want a .yaml, .yml or .toml file", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+	var args []string
+	for _, key := range slices.Sorted(maps.Keys(m)) {
+		name := strings.ReplaceAll(key, "_", "-")
+		f := fs.Lookup(name)
+		if f == nil || name == "config" || name == "from-bundle" {
+			return nil, fmt.Errorf("config %s: unknown option %q", path, key)
+		}
+		vals, err := configValues(m[key])
+		if err != nil {
+			return nil, fmt.Errorf("config %s: %s: %w", path, key, err)
+		}
+		for _, v := range vals {
+			args = append(args, "-"+name+"="+v)
+		}
+	}
+	return args, nil
+}
+
+// configValues renders one config value as the flag values it stands for.
+func configValues(v any) ([]string, error) {
+	switch v := v.(type) {
+	case []any:
+		var out []string
+		for _, e := range v {
+			vals, err := configValues(e)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, vals...)
+		}
+		return out, nil
+	case map[string]any:
+		pairs := make([]string, 0, len(v))
+		for _, k := range slices.Sorted(maps.Keys(v)) {
+			pairs = append(pairs, fmt.Sprintf("%s=%v", k, v[k]))
+		}
+		return []string{strings.Join(pairs, ",")}, nil
+	case nil:
+		return nil, errors.New("missing value")
+	default:
+		return []string{fmt.Sprint(v)}, nil
+	}
+}
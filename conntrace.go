@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// TLS record types, as seen in the first byte of a write.
+const (
+	tlsRecordHandshake   = 0x16
+	tlsRecordApplication = 0x17
+)
+
+// connTimings meters a pool's connection establishment, split into the TCP
+// dial, the TLS handshake and the whole connect (startup and authentication
+// included), and the time calls wait to acquire a connection, so latency
+// spikes can be told apart from slow queries.
+type connTimings struct {
+	dial    latencyHistogram
+	tls     latencyHistogram
+	connect latencyHistogram
+	acquire latencyHistogram
+
+	connects atomic.Uint64
+	failures atomic.Uint64
+}
+
+// connTimingTracer feeds one pool's connTimings from pgx's connect and
+// pgxpool's acquire trace hooks.
+type connTimingTracer struct {
+	pool string
+	t    *connTimings
+	w    *acquireWatch
+}
+
+type connectStartKey struct{}
+
+type acquireStartKey struct{}
+
+func (ct connTimingTracer) TraceConnectStart(ctx context.Context, _ pgx.TraceConnectStartData) context.Context {
+	return context.WithValue(ctx, connectStartKey{}, time.Now())
+}
+
+func (ct connTimingTracer) TraceConnectEnd(ctx context.Context, data pgx.TraceConnectEndData) {
+	start, ok := ctx.Value(connectStartKey{}).(time.Time)
+	if !ok {
+		return
+	}
+	total := time.Since(start)
+	if data.Err != nil {
+		ct.t.failures.Add(1)
+		slog.WarnContext(ctx, "connect failed", "pool", ct.pool, "duration", total, "err", data.Err)
+		return
+	}
+	ct.t.connects.Add(1)
+	ct.t.connect.observe(total)
+	args := []any{"pool", ct.pool, "conn", safeRemoteAddr(data.Conn), "duration", total}
+	if tc := timedNetConn(data.Conn.PgConn()); tc != nil {
+		ct.t.dial.observe(tc.dial)
+		args = append(args, "dial", tc.dial)
+		if hs, ok := tc.handshake(); ok {
+			ct.t.tls.observe(hs)
+			args = append(args, "tls", hs)
+		}
+	}
+	logQuery(ctx, "connect", args...)
+}
+
+func (ct connTimingTracer) TraceAcquireStart(ctx context.Context, _ *pgxpool.Pool, _ pgxpool.TraceAcquireStartData) context.Context {
+	return context.WithValue(ctx, acquireStartKey{}, time.Now())
+}
+
+func (ct connTimingTracer) TraceAcquireEnd(ctx context.Context, pool *pgxpool.Pool, data pgxpool.TraceAcquireEndData) {
+	start, ok := ctx.Value(acquireStartKey{}).(time.Time)
+	if !ok {
+		return
+	}
+	d := time.Since(start)
+	ct.t.acquire.observe(d)
+	ct.w.observe(ctx, pool, d, data.Err)
+	if data.Err != nil {
+		slog.DebugContext(ctx, "acquire failed", "pool", ct.pool, "duration", d, "err", data.Err)
+	}
+}
+
+func (ct connTimingTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, _ pgx.TraceQueryStartData) context.Context {
+	return ctx
+}
+
+func (ct connTimingTracer) TraceQueryEnd(context.Context, *pgx.Conn, pgx.TraceQueryEndData) {}
+
+// timedConn records how long its dial took and when the TLS handshake, if
+// any, started and finished from the client's side: the ClientHello is the
+// first handshake record written, and the first application-data record
+// (TLS 1.3's encrypted Finished, or TLS 1.2's first message after the
+// handshake) marks its end.
+type timedConn struct {
+	net.Conn
+	dial time.Duration
+
+	helloAt atomic.Int64 // unix nanos; 0 => not seen
+	doneAt  atomic.Int64
+}
+
+func (c *timedConn) Write(b []byte) (int, error) {
+	if len(b) > 0 && c.doneAt.Load() == 0 {
+		now := time.Now().UnixNano()
+		switch b[0] {
+		case tlsRecordHandshake:
+			c.helloAt.CompareAndSwap(0, now)
+		case tlsRecordApplication:
+			if c.helloAt.Load() != 0 {
+				c.doneAt.CompareAndSwap(0, now)
+			}
+		}
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *timedConn) handshake() (time.Duration, bool) {
+	hello, done := c.helloAt.Load(), c.doneAt.Load()
+	if hello == 0 || done == 0 {
+		return 0, false
+	}
+	return time.Duration(done - hello), true
+}
+
+// timedDialer wraps dial so the connections it makes are timedConns.
+func timedDialer(dial pgconn.DialFunc) pgconn.DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		start := time.Now()
+		c, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &timedConn{Conn: c, dial: time.Since(start)}, nil
+	}
+}
+
+// timedNetConn digs the timedConn out of a connection, TLS or not.
+func timedNetConn(pc *pgconn.PgConn) *timedConn {
+	nc := pc.Conn()
+	if t, ok := nc.(*tls.Conn); ok {
+		nc = t.NetConn()
+	}
+	tc, _ := nc.(*timedConn)
+	return tc
+}
+
+// connectSummary is the reportable form of connTimings.
+type connectSummary struct {
+	Connects uint64            `json:"connects"`
+	Failures uint64            `json:"failures"`
+	Dial     *latencyHistogram `json:"dial_latency"`
+	TLS      *latencyHistogram `json:"tls_latency"`
+	Connect  *latencyHistogram `json:"connect_latency"`
+	Acquire  *latencyHistogram `json:"acquire_latency"`
+}
+
+func (t *connTimings) summary() connectSummary {
+	out := connectSummary{
+		Connects: t.connects.Load(),
+		Failures: t.failures.Load(),
+		Dial:     &latencyHistogram{},
+		TLS:      &latencyHistogram{},
+		Connect:  &latencyHistogram{},
+		Acquire:  &latencyHistogram{},
+	}
+	out.Dial.merge(&t.dial)
+	out.TLS.merge(&t.tls)
+	out.Connect.merge(&t.connect)
+	out.Acquire.merge(&t.acquire)
+	return out
+}
+
+func (s connectSummary) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Uint64("connects", s.Connects),
+		slog.Uint64("failures", s.Failures),
+		slog.Any("dial", s.Dial),
+		slog.Any("tls", s.TLS),
+		slog.Any("connect", s.Connect),
+		slog.Any("acquire", s.Acquire),
+	)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+const defaultDashboardTitle = "crdbpool-tester"
+
+// grafanaDashboard is the subset of Grafana's dashboard JSON model the
+// dashboard command emits.
+type grafanaDashboard struct {
+	Inputs        []grafanaInput  `json:"__inputs,omitempty"`
+	Title         string          `json:"title"`
+	UID           string          `json:"uid"`
+	Tags          []string        `json:"tags"`
+	SchemaVersion int             `json:"schemaVersion"`
+	Time          grafanaTime     `json:"time"`
+	Refresh       string          `json:"refresh"`
+	Templating    grafanaTemplate `json:"templating"`
+	Panels        []grafanaPanel  `json:"panels"`
+}
+
+type grafanaInput struct {
+	Name     string `json:"name"`
+	Label    string `json:"label"`
+	Type     string `json:"type"`
+	PluginID string `json:"pluginId"`
+}
+
+type grafanaTime struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type grafanaTemplate struct {
+	List []grafanaVariable `json:"list"`
+}
+
+type grafanaVariable struct {
+	Name       string         `json:"name"`
+	Label      string         `json:"label"`
+	Type       string         `json:"type"`
+	Datasource map[string]any `json:"datasource,omitempty"`
+	Query      any            `json:"query"`
+	Multi      bool           `json:"multi"`
+	IncludeAll bool           `json:"includeAll"`
+	Refresh    int            `json:"refresh,omitempty"` // 2 => on time range change
+	Current    map[string]any `json:"current,omitempty"`
+}
+
+type grafanaPanel struct {
+	ID          int             `json:"id"`
+	Type        string          `json:"type"`
+	Title       string          `json:"title"`
+	Description string          `json:"description,omitempty"`
+	GridPos     grafanaGridPos  `json:"gridPos"`
+	Datasource  map[string]any  `json:"datasource,omitempty"`
+	Targets     []grafanaTarget `json:"targets,omitempty"`
+	FieldConfig map[string]any  `json:"fieldConfig"`
+}
+
+type grafanaGridPos struct {
+	H int `json:"h"`
+	W int `json:"w"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type grafanaTarget struct {
+	RefID        string `json:"refId"`
+	Expr         string `json:"expr"`
+	LegendFormat string `json:"legendFormat"`
+}
+
+// dashboardPanel is one panel of the generated dashboard: a title, a unit
+// and its queries, as expr, legend pairs.
+type dashboardPanel struct {
+	title, description, unit string
+	typ                      string // timeseries unless set
+	queries                  [][2]string
+}
+
+// dashboardPanels are the panels, laid out two per row. Every query selects
+// the job and run_id variables; the pushed stats are cumulative since the
+// run started, so rate() over the counters is the live view.
+func dashboardPanels() []dashboardPanel {
+	const run = `job="$job",run_id=~"$run_id"`
+	const wl = run + `,workload=~"$workload"`
+	const pool = run + `,pool=~"$pool"`
+	return []dashboardPanel{
+		{title: "Queries/s", unit: "reqps", queries: [][2]string{
+			{fmt.Sprintf("sum by (run_id, workload) (rate(%s{%s}[$__rate_interval]))", metricQueries, wl), "{{workload}} {{run_id}}"},
+		}},
+		{title: "Error rate", unit: "percentunit", description: "Failed share of the queries since the run started.", queries: [][2]string{
+			{fmt.Sprintf("sum by (run_id, workload) (%s{%s}) / sum by (run_id, workload) (%s{%s})", metricErrors, wl, metricQueries, wl), "{{workload}} {{run_id}}"},
+		}},
+		{title: "Latency", unit: "s", description: "Quantiles over the run so far.", queries: [][2]string{
+			{fmt.Sprintf(`%s{%s,quantile=~"0.5|0.95|0.99"}`, metricQueryDuration, wl), "{{workload}} p{{quantile}} {{run_id}}"},
+		}},
+		{title: "Errors by class", unit: "reqps", queries: [][2]string{
+			{fmt.Sprintf("sum by (run_id, workload, class) (rate(%s{%s}[$__rate_interval]))", metricErrorsByClass, wl), "{{workload}} {{class}} {{run_id}}"},
+		}},
+		{title: "Retried calls", unit: "percentunit", description: "Share of each pool's logical calls crdbpool retried at least once.", queries: [][2]string{
+			{fmt.Sprintf("sum by (run_id, pool) (%s{%s}) / sum by (run_id, pool) (%s{%s})", metricPoolRetriedCalls, pool, metricPoolCalls, pool), "{{pool}} {{run_id}}"},
+		}},
+		{title: "Pool connections", unit: "short", queries: [][2]string{
+			{fmt.Sprintf(`%s{%s,state=~"acquired|idle|constructing"}`, metricPoolConns, pool), "{{pool}} {{state}} {{run_id}}"},
+			{fmt.Sprintf("%s{%s}", metricPoolMaxConns, pool), "{{pool}} max {{run_id}}"},
+		}},
+		{title: "Healthy nodes", unit: "short", description: "Nodes crdbpool's health tracker considers healthy, and each known node's state.", queries: [][2]string{
+			{fmt.Sprintf("%s{%s}", metricHealthyNodes, run), "healthy {{run_id}}"},
+			{fmt.Sprintf("%s{%s}", metricNodeHealthy, run), "n{{node}} {{run_id}}"},
+		}},
+		{title: "Health transitions", unit: "short", queries: [][2]string{
+			{fmt.Sprintf("increase(%s{%s}[$__rate_interval])", metricNodeTransitions, run), "n{{node}} {{run_id}}"},
+		}},
+		{title: "Run result", typ: "stat", description: "1 passed, 0 failed; set by the final push.", queries: [][2]string{
+			{fmt.Sprintf("%s{%s}", metricRunSuccess, run), "{{run_id}}"},
+		}},
+		{title: "Last push", typ: "stat", unit: "dateTimeFromNow", queries: [][2]string{
+			{fmt.Sprintf("max by (run_id) (%s{%s}) * 1000", metricLastPushTimestamp, run), "{{run_id}}"},
+		}},
+	}
+}
+
+// grafanaDashboardFor builds the dashboard. datasource is the Prometheus
+// datasource's UID; empty leaves it an input chosen on import.
+func grafanaDashboardFor(title, datasource, job string) grafanaDashboard {
+	ds := map[string]any{"type": "prometheus", "uid": datasource}
+	d := grafanaDashboard{
+		Title:         title,
+		UID:           "crdbpool-tester",
+		Tags:          []string{"crdbpool", "cockroachdb"},
+		SchemaVersion: 39,
+		Time:          grafanaTime{From: "now-1h", To: "now"},
+		Refresh:       "30s",
+	}
+	if datasource == "" {
+		ds["uid"] = "${DS_PROMETHEUS}"
+		d.Inputs = []grafanaInput{{Name: "DS_PROMETHEUS", Label: "Prometheus", Type: "datasource", PluginID: "prometheus"}}
+	}
+	variable := func(name, label, query string, multi bool) grafanaVariable {
+		v := grafanaVariable{Name: name, Label: label, Type: "query", Datasource: ds, Refresh: 2, Multi: multi, IncludeAll: multi,
+			Query: map[string]any{"query": query, "refId": name}}
+		if multi {
+			v.Current = map[string]any{"text": "All", "value": "$__all"}
+		}
+		return v
+	}
+	d.Templating.List = []grafanaVariable{
+		{Name: "job", Label: "Job", Type: "custom", Query: job, Current: map[string]any{"text": job, "value": job}},
+		variable("run_id", "Run", fmt.Sprintf(`label_values(%s{job="$job"}, run_id)`, metricQueries), true),
+		variable("workload", "Workload", fmt.Sprintf(`label_values(%s{job="$job",run_id=~"$run_id"}, workload)`, metricQueries), true),
+		variable("pool", "Pool", fmt.Sprintf(`label_values(%s{job="$job",run_id=~"$run_id"}, pool)`, metricPoolCalls), true),
+	}
+	for i, p := range dashboardPanels() {
+		panel := grafanaPanel{
+			ID:          i + 1,
+			Type:        p.typ,
+			Title:       p.title,
+			Description: p.description,
+			GridPos:     grafanaGridPos{H: 8, W: 12, X: 12 * (i % 2), Y: 8 * (i / 2)},
+			Datasource:  ds,
+			FieldConfig: map[string]any{"defaults": map[string]any{"unit": p.unit}, "overrides": []any{}},
+		}
+		if panel.Type == "" {
+			panel.Type = "timeseries"
+		}
+		for j, q := range p.queries {
+			panel.Targets = append(panel.Targets, grafanaTarget{RefID: string(rune('A' + j)), Expr: q[0], LegendFormat: q[1]})
+		}
+		d.Panels = append(d.Panels, panel)
+	}
+	return d
+}
+
+func writeDashboard(w io.Writer, d grafanaDashboard) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(d)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// pgxKeepAlive is the keepalive pgx's default dialer uses, for both the
+// idle time and the probe interval.
+const pgxKeepAlive = 5 * time.Minute
+
+// dialOptions are the network settings of the pools' connections, to match
+// a service's when diagnosing resets around node restarts. The zero value
+// keeps pgx's defaults.
+type dialOptions struct {
+	NoKeepAlive       bool
+	KeepAliveIdle     time.Duration // before the first probe
+	KeepAliveInterval time.Duration // between probes
+	KeepAliveCount    int           // unanswered probes before the connection is dropped
+	ConnectTimeout    time.Duration
+	IPFamily          string // "", 4 or 6
+}
+
+func (o *dialOptions) register(fs *flag.FlagSet) {
+	fs.BoolFunc("no-tcp-keepalive", "disable TCP keepalive on the pools' connections", func(string) error {
+		o.NoKeepAlive = true
+		return nil
+	})
+	fs.DurationVar(&o.KeepAliveIdle, "tcp-keepalive-idle", 0, "idle time before a connection's first TCP keepalive probe (default: pgx's 5m)")
+	fs.DurationVar(&o.KeepAliveInterval, "tcp-keepalive-interval", 0, "time between TCP keepalive probes (default: pgx's 5m)")
+	fs.IntVar(&o.KeepAliveCount, "tcp-keepalive-count", 0, "unanswered TCP keepalive probes before the connection is dropped (default: 9)")
+	fs.DurationVar(&o.ConnectTimeout, "connect-timeout", 0, "give up on a connection attempt after this long, overriding the DSN's connect_timeout (default: none, or the DSN's)")
+	fs.StringVar(&o.IPFamily, "ip-family", "", "connect over IPv4 (4) or IPv6 (6) only, resolving host names to that family (default: either)")
+}
+
+func (o dialOptions) validate() error {
+	if o.IPFamily != "" && o.IPFamily != "4" && o.IPFamily != "6" {
+		return fmt.Errorf("ip-family must be 4 or 6 (got %q)", o.IPFamily)
+	}
+	if o.KeepAliveIdle < 0 || o.KeepAliveInterval < 0 || o.KeepAliveCount < 0 || o.ConnectTimeout < 0 {
+		return errors.New("tcp-keepalive-idle, tcp-keepalive-interval, tcp-keepalive-count and connect-timeout must be >= 0")
+	}
+	if o.NoKeepAlive && o.keepAliveSet() {
+		return errors.New("--no-tcp-keepalive can't be combined with the --tcp-keepalive-* settings")
+	}
+	return nil
+}
+
+func (o dialOptions) keepAliveSet() bool {
+	return o.KeepAliveIdle > 0 || o.KeepAliveInterval > 0 || o.KeepAliveCount > 0
+}
+
+// String summarizes the settings for the results, "" for pgx's defaults.
+func (o dialOptions) String() string {
+	var parts []string
+	switch {
+	case o.NoKeepAlive:
+		parts = append(parts, "keepalive=off")
+	case o.keepAliveSet():
+		parts = append(parts, fmt.Sprintf("keepalive=%s/%s/%d", cmp.Or(o.KeepAliveIdle, pgxKeepAlive), cmp.Or(o.KeepAliveInterval, pgxKeepAlive), o.KeepAliveCount))
+	}
+	if o.ConnectTimeout > 0 {
+		parts = append(parts, "connect-timeout="+o.ConnectTimeout.String())
+	}
+	if o.IPFamily != "" {
+		parts = append(parts, "ip"+o.IPFamily)
+	}
+	return strings.Join(parts, ",")
+}
+
+// apply installs the settings in c: a dialer of their own, and a resolver
+// of the one family with --ip-family. Unix sockets are dialed as they are.
+func (o dialOptions) apply(c *pgxpool.Config) {
+	if o.ConnectTimeout > 0 {
+		c.ConnConfig.ConnectTimeout = o.ConnectTimeout
+	}
+	if !o.NoKeepAlive && !o.keepAliveSet() && o.IPFamily == "" {
+		return
+	}
+	d := &net.Dialer{KeepAlive: pgxKeepAlive}
+	switch {
+	case o.NoKeepAlive:
+		d.KeepAlive = -1
+	case o.keepAliveSet():
+		d.KeepAliveConfig = net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     cmp.Or(o.KeepAliveIdle, pgxKeepAlive),
+			Interval: cmp.Or(o.KeepAliveInterval, pgxKeepAlive),
+			Count:    o.KeepAliveCount, // 0 => 9
+		}
+	}
+	c.ConnConfig.DialFunc = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if o.IPFamily != "" && network == "tcp" {
+			network += o.IPFamily
+		}
+		return d.DialContext(ctx, network, addr)
+	}
+	if o.IPFamily != "" {
+		c.ConnConfig.LookupFunc = func(ctx context.Context, host string) ([]string, error) {
+			if ip := net.ParseIP(host); ip != nil {
+				return []string{host}, nil
+			}
+			ips, err := net.DefaultResolver.LookupIP(ctx, "ip"+o.IPFamily, host)
+			if err != nil {
+				return nil, err
+			}
+			addrs := make([]string, len(ips))
+			for i, ip := range ips {
+				addrs[i] = ip.String()
+			}
+			return addrs, nil
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lockedRand is a *rand.Rand safe for use by concurrent workers.
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+// newLockedRand returns the named stream of the run's seed. Every consumer
+// of randomness has a stream of its own, so a run is reproduced by its seed
+// alone and adding a consumer doesn't change what the others draw.
+func newLockedRand(seed uint64, stream string) *lockedRand {
+	h := fnv.New64a()
+	h.Write([]byte(stream))
+	return &lockedRand{r: rand.New(rand.NewPCG(seed, h.Sum64()))}
+}
+
+func (l *lockedRand) Float64() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Float64()
+}
+
+func (l *lockedRand) IntN(n int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.IntN(n)
+}
+
+func (l *lockedRand) ExpFloat64() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.ExpFloat64()
+}
+
+// durationDist is a distribution of durations. Spec syntax:
+//
+//	fixed:500ms
+//	uniform:100ms-2s
+//	exp:300ms[,max=5s]         exponential with the given mean, optionally capped
+//	mix:10ms@90,2s@10          weighted choice between fixed values
+type durationDist interface {
+	sample(r *lockedRand) time.Duration
+	String() string
+}
+
+func parseDurationDist(spec string) (durationDist, error) {
+	kind, args, ok := strings.Cut(strings.TrimSpace(spec), ":")
+	if !ok || args == "" {
+		return nil, fmt.Errorf("distribution %q: want kind:args (fixed, uniform, exp or mix)", spec)
+	}
+	switch kind {
+	case "fixed":
+		d, err := parsePositiveDuration(args)
+		if err != nil {
+			return nil, fmt.Errorf("distribution %q: %w", spec, err)
+		}
+		return fixedDist(d), nil
+	case "uniform":
+		lo, hi, ok := strings.Cut(args, "-")
+		if !ok {
+			return nil, fmt.Errorf("distribution %q: want uniform:MIN-MAX", spec)
+		}
+		min, err := parsePositiveDuration(lo)
+		if err != nil {
+			return nil, fmt.Errorf("distribution %q: %w", spec, err)
+		}
+		max, err := parsePositiveDuration(hi)
+		if err != nil {
+			return nil, fmt.Errorf("distribution %q: %w", spec, err)
+		}
+		if max < min {
+			return nil, fmt.Errorf("distribution %q: max < min", spec)
+		}
+		return uniformDist{min: min, max: max}, nil
+	case "exp":
+		mean, opt, _ := strings.Cut(args, ",")
+		m, err := parsePositiveDuration(mean)
+		if err != nil {
+			return nil, fmt.Errorf("distribution %q: %w", spec, err)
+		}
+		e := expDist{mean: m}
+		if opt != "" {
+			v, found := strings.CutPrefix(opt, "max=")
+			if !found {
+				return nil, fmt.Errorf("distribution %q: unknown option %q", spec, opt)
+			}
+			if e.max, err = parsePositiveDuration(v); err != nil {
+				return nil, fmt.Errorf("distribution %q: %w", spec, err)
+			}
+		}
+		return e, nil
+	case "mix":
+		var m mixDist
+		for _, part := range strings.Split(args, ",") {
+			v, w, ok := strings.Cut(part, "@")
+			if !ok {
+				return nil, fmt.Errorf("distribution %q: want value@weight, got %q", spec, part)
+			}
+			d, err := parsePositiveDuration(v)
+			if err != nil {
+				return nil, fmt.Errorf("distribution %q: %w", spec, err)
+			}
+			weight, err := strconv.ParseFloat(w, 64)
+			if err != nil || weight <= 0 {
+				return nil, fmt.Errorf("distribution %q: weight must be > 0, got %q", spec, w)
+			}
+			m.values = append(m.values, d)
+			m.weights = append(m.weights, weight)
+			m.total += weight
+		}
+		return m, nil
+	default:
+		return nil, fmt.Errorf("distribution %q: unknown kind %q (want fixed, uniform, exp or mix)", spec, kind)
+	}
+}
+
+func parsePositiveDuration(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("duration %s must be > 0", d)
+	}
+	return d, nil
+}
+
+type fixedDist time.Duration
+
+func (d fixedDist) sample(*lockedRand) time.Duration { return time.Duration(d) }
+func (d fixedDist) String() string                   { return "fixed:" + time.Duration(d).String() }
+
+type uniformDist struct{ min, max time.Duration }
+
+func (d uniformDist) sample(r *lockedRand) time.Duration {
+	return d.min + time.Duration(r.Float64()*float64(d.max-d.min))
+}
+func (d uniformDist) String() string { return fmt.Sprintf("uniform:%s-%s", d.min, d.max) }
+
+type expDist struct{ mean, max time.Duration }
+
+func (d expDist) sample(r *lockedRand) time.Duration {
+	v := time.Duration(r.ExpFloat64() * float64(d.mean))
+	if d.max > 0 && v > d.max {
+		return d.max
+	}
+	return v
+}
+
+func (d expDist) String() string {
+	if d.max > 0 {
+		return fmt.Sprintf("exp:%s,max=%s", d.mean, d.max)
+	}
+	return "exp:" + d.mean.String()
+}
+
+type mixDist struct {
+	values  []time.Duration
+	weights []float64
+	total   float64
+}
+
+func (d mixDist) sample(r *lockedRand) time.Duration {
+	x := r.Float64() * d.total
+	for i, w := range d.weights {
+		if x < w {
+			return d.values[i]
+		}
+		x -= w
+	}
+	return d.values[len(d.values)-1]
+}
+
+func (d mixDist) String() string {
+	parts := make([]string, len(d.values))
+	for i := range d.values {
+		parts[i] = fmt.Sprintf("%s@%g", d.values[i], d.weights[i])
+	}
+	return "mix:" + strings.Join(parts, ",")
+}
+
+// thinkDist is how a workload's think time, the interval between its
+// batches, is drawn around the mean the sleep or target rate sets: fixed,
+// uniform over [0, 2×mean], or exponential, which makes the batches of a
+// rate-paced workload Poisson arrivals.
+type thinkDist string
+
+const (
+	thinkFixed   thinkDist = "fixed"
+	thinkUniform thinkDist = "uniform"
+	thinkExp     thinkDist = "exp"
+)
+
+// parseThinkDist parses --think-dist; poisson is an alias of exp.
+func parseThinkDist(s string) (thinkDist, error) {
+	switch d := thinkDist(strings.TrimSpace(s)); d {
+	case thinkFixed, thinkUniform, thinkExp:
+		return d, nil
+	case "poisson":
+		return thinkExp, nil
+	default:
+		return "", fmt.Errorf("think-dist %q: want fixed, uniform or exp (poisson)", s)
+	}
+}
+
+func (d thinkDist) sample(r *lockedRand, mean time.Duration) time.Duration {
+	switch d {
+	case thinkUniform:
+		return time.Duration(2 * r.Float64() * float64(mean))
+	case thinkExp:
+		return time.Duration(r.ExpFloat64() * float64(mean))
+	default:
+		return mean
+	}
+}
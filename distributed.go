@@ -0,0 +1,545 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math/rand/v2"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/peer"
+)
+
+const (
+	defaultWorkersWait     = 10 * time.Minute
+	workerProgressInterval = 10 * time.Second
+	coordinatorMaxMsgSize  = 64 << 20 // a worker's result, timeline and histograms included
+	coordinatorService     = "crdbpooltester.Coordinator"
+	// workerReportGrace is how long past the run's timeout the coordinator
+	// waits for results: the workers' setup, drain and checks.
+	workerReportGrace = 2 * time.Minute
+)
+
+// The coordinator and its workers speak gRPC with JSON messages, the types
+// below, so no generated code is needed.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                       { return "json" }
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+// registerRequest is a worker's hello.
+type registerRequest struct {
+	Hostname string `json:"hostname"`
+	Version  string `json:"version"`
+}
+
+// workerPlan is a worker's share of the run: the coordinator's effective
+// flags (never its DSNs; workers connect with their own DATABASE_URL) and
+// the worker's shard.
+type workerPlan struct {
+	RunID string   `json:"run_id"`
+	Index int      `json:"index"`
+	Count int      `json:"count"`
+	Seed  uint64   `json:"seed"`
+	Args  []string `json:"args"`
+}
+
+// workerReport is streamed by a worker: progress while it runs, then its
+// result.
+type workerReport struct {
+	Index    int                  `json:"index"`
+	Progress map[string]opSummary `json:"progress,omitempty"`
+	Result   *runResult           `json:"result,omitempty"`
+	Err      string               `json:"err,omitempty"`
+	ExitCode int                  `json:"exit_code,omitempty"`
+}
+
+type reportAck struct{}
+
+// coordinatorServer is the gRPC service; HandlerType for grpc's check.
+type coordinatorServer interface {
+	register(ctx context.Context, req *registerRequest) (*workerPlan, error)
+	report(stream grpc.ServerStream) error
+}
+
+var coordinatorServiceDesc = grpc.ServiceDesc{
+	ServiceName: coordinatorService,
+	HandlerType: (*coordinatorServer)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Register",
+		Handler: func(srv any, ctx context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+			var req registerRequest
+			if err := dec(&req); err != nil {
+				return nil, err
+			}
+			return srv.(coordinatorServer).register(ctx, &req)
+		},
+	}},
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Report",
+		ClientStreams: true,
+		Handler:       func(srv any, stream grpc.ServerStream) error { return srv.(coordinatorServer).report(stream) },
+	}},
+}
+
+// workerState is what the coordinator knows about one worker.
+type workerState struct {
+	host     string
+	progress map[string]opSummary
+	result   *runResult
+	err      error
+	done     bool
+}
+
+// coordinator hands out the shards of a run to --workers workers, once all
+// of them have registered, and collects their results.
+type coordinator struct {
+	plan  workerPlan // Index set per worker
+	ready chan struct{}
+	done  chan struct{} // closed once every worker has reported or dropped
+
+	mu      sync.Mutex
+	workers []*workerState
+}
+
+func newCoordinator(plan workerPlan) *coordinator {
+	return &coordinator{plan: plan, ready: make(chan struct{}), done: make(chan struct{})}
+}
+
+func (c *coordinator) register(ctx context.Context, req *registerRequest) (*workerPlan, error) {
+	host := req.Hostname
+	if p, ok := peer.FromContext(ctx); ok {
+		host += " (" + p.Addr.String() + ")"
+	}
+	c.mu.Lock()
+	if len(c.workers) == c.plan.Count {
+		c.mu.Unlock()
+		return nil, errors.New("all workers have registered")
+	}
+	w := &workerState{host: host}
+	c.workers = append(c.workers, w)
+	slog.Info("worker registered", "host", host, "version", req.Version, "registered", len(c.workers), "workers", c.plan.Count)
+	if len(c.workers) == c.plan.Count {
+		close(c.ready)
+	}
+	c.mu.Unlock()
+	// everyone starts together
+	select {
+	case <-c.ready:
+	case <-ctx.Done():
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.ready:
+	default:
+		// gone before the run started: its slot goes to the next worker
+		c.workers = slices.DeleteFunc(c.workers, func(o *workerState) bool { return o == w })
+		slog.Warn("worker left before the run started", "host", host, "registered", len(c.workers), "workers", c.plan.Count, "err", ctx.Err())
+		return nil, ctx.Err()
+	}
+	// the shards are handed out once the slots are final
+	plan := c.plan
+	plan.Index = slices.Index(c.workers, w)
+	return &plan, nil
+}
+
+func (c *coordinator) report(stream grpc.ServerStream) error {
+	index := -1
+	for {
+		var r workerReport
+		err := stream.RecvMsg(&r)
+		if errors.Is(err, io.EOF) {
+			return stream.SendMsg(&reportAck{})
+		}
+		if err != nil {
+			if index >= 0 {
+				c.finish(index, nil, fmt.Errorf("worker %d dropped: %w", index, err))
+			}
+			return err
+		}
+		if r.Index < 0 || r.Index >= c.plan.Count {
+			return fmt.Errorf("no worker %d", r.Index)
+		}
+		index = r.Index
+		switch {
+		case r.Result != nil || r.Err != "":
+			var werr error
+			if r.Err != "" {
+				werr = withExit(cmp.Or(r.ExitCode, exitInternal), errors.New(r.Err))
+			}
+			c.finish(index, r.Result, werr)
+		case r.Progress != nil:
+			c.mu.Lock()
+			c.workers[index].progress = r.Progress
+			c.mu.Unlock()
+		}
+	}
+}
+
+func (c *coordinator) finish(index int, res *runResult, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := c.workers[index]
+	if w.done {
+		return
+	}
+	w.result, w.err, w.done = res, err, true
+	slog.Info("worker finished", "worker", index, "host", w.host, "err", err)
+	for _, w := range c.workers {
+		if !w.done {
+			return
+		}
+	}
+	if len(c.workers) == c.plan.Count {
+		close(c.done)
+	}
+}
+
+// logProgress logs the workers' combined progress every interval until done.
+func (c *coordinator) logProgress(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.done:
+			return
+		case <-t.C:
+		}
+		c.mu.Lock()
+		byWorkload := map[string][]opSummary{}
+		for _, w := range c.workers {
+			for name, s := range w.progress {
+				byWorkload[name] = append(byWorkload[name], s)
+			}
+		}
+		c.mu.Unlock()
+		for _, name := range slices.Sorted(maps.Keys(byWorkload)) {
+			var queries, errs uint64
+			var qps float64
+			for _, s := range byWorkload[name] {
+				queries, errs, qps = queries+s.Queries, errs+s.Errors, qps+s.Throughput
+			}
+			slog.Info("workers progress", "workload", name, "workers", len(byWorkload[name]), "queries", queries, "errors", errs, "qps", fmt.Sprintf("%.1f", qps))
+		}
+	}
+}
+
+// coordinatorSkipFlags are the coordinator's own flags, not passed on in the
+// plan.
+var coordinatorSkipFlags = []string{"-coordinate", "-workers", "-workers-wait"}
+
+// runCoordinator serves the run's plan to --workers workers and waits for
+// their results, then reports the merged result as a run of its own would:
+// the summaries, --results-out, the SLO gates, --junit-out and --summary-md.
+// Each worker's own result is written next to --results-out, as
+// <name>-w<index>.json. The coordinator generates no load itself.
+func runCoordinator(ctx context.Context, cfg Config) error {
+	if cfg.Seed == 0 {
+		cfg.Seed = rand.Uint64()
+	}
+	plan := workerPlan{
+		RunID: newRunID(),
+		Count: cfg.Workers,
+		Seed:  cfg.Seed,
+		Args:  withoutOverridden(reproArgs(flag.CommandLine, cfg, cfg.Args), coordinatorSkipFlags),
+	}
+	c := newCoordinator(plan)
+	ln, err := net.Listen("tcp", cfg.CoordinateAddr)
+	if err != nil {
+		return withExit(exitConfig, fmt.Errorf("coordinate: %w", err))
+	}
+	srv := grpc.NewServer(grpc.MaxRecvMsgSize(coordinatorMaxMsgSize))
+	srv.RegisterService(&coordinatorServiceDesc, c)
+	go func() {
+		if err := srv.Serve(ln); err != nil {
+			slog.Error("coordinator", "err", err)
+		}
+	}()
+	defer srv.Stop()
+	slog.Info("coordinator listening; start the workers with: crdbpool-tester worker --coordinator <this host>:<port>",
+		"addr", ln.Addr().String(), "run_id", plan.RunID, "workers", plan.Count, "seed", plan.Seed)
+
+	wait := time.NewTimer(cfg.WorkersWait)
+	defer wait.Stop()
+	select {
+	case <-c.ready:
+		slog.Info("all workers registered; run started", "workers", plan.Count)
+	case <-wait.C:
+		c.mu.Lock()
+		n := len(c.workers)
+		c.mu.Unlock()
+		return withExit(exitConnectivity, fmt.Errorf("only %d of %d workers registered within %s", n, plan.Count, cfg.WorkersWait))
+	case <-ctx.Done():
+		return withExit(exitInterrupted, ctx.Err())
+	}
+	go c.logProgress(ctx, workerProgressInterval)
+	// a worker that died without reporting would otherwise be waited for
+	// forever
+	deadline := cfg.Timeout + cfg.Drain + workerReportGrace
+	late := time.NewTimer(deadline)
+	defer late.Stop()
+	select {
+	case <-c.done:
+	case <-late.C:
+		c.abandon(deadline)
+	case <-ctx.Done():
+		return withExit(exitInterrupted, ctx.Err())
+	}
+	return c.merge(cfg)
+}
+
+// abandon fails the workers that haven't reported within d of the start.
+func (c *coordinator) abandon(d time.Duration) {
+	c.mu.Lock()
+	var missing []int
+	for i, w := range c.workers {
+		if !w.done {
+			missing = append(missing, i)
+		}
+	}
+	c.mu.Unlock()
+	for _, i := range missing {
+		c.finish(i, nil, withExit(exitConnectivity, fmt.Errorf("worker %d: no result within %s", i, d)))
+	}
+}
+
+// merge writes the workers' merged result and returns the first worker's
+// failure, or the SLO's.
+func (c *coordinator) merge(cfg Config) error {
+	var (
+		names []string
+		parts []runResult
+		err   error
+	)
+	for i, w := range c.workers {
+		name := fmt.Sprintf("w%d", i)
+		if w.err != nil && err == nil {
+			err = withExit(exitCode(w.err), fmt.Errorf("worker %d (%s): %w", i, w.host, w.err))
+		}
+		if w.result == nil {
+			continue
+		}
+		names, parts = append(names, name), append(parts, *w.result)
+		if cfg.ResultsOut != "" {
+			path := workerResultsPath(cfg.ResultsOut, i)
+			if werr := writeResults(path, *w.result); werr != nil {
+				slog.Error("write worker results", "worker", i, "path", path, "err", werr)
+			}
+		}
+	}
+	if len(parts) == 0 {
+		if err == nil {
+			err = errors.New("no worker reported a result")
+		}
+		return err
+	}
+	res := mergeRunResults(c.plan.RunID, names, parts, false)
+	res.Settings = newResultSettings(cfg)
+	res.Components = defaultComponentVersions(cfg.Components)
+	for _, name := range slices.Sorted(maps.Keys(res.Workloads)) {
+		slog.Info("summary", "workload", name, "workers", len(parts), "stats", res.Workloads[name])
+	}
+	for _, name := range slices.Sorted(maps.Keys(res.Retries)) {
+		slog.Info("retries", "pool", name, "workers", len(parts), "stats", res.Retries[name])
+	}
+	if cfg.SLO.set() {
+		var sloErr error
+		res.SLO, sloErr = cfg.SLO.evaluate(res.Workloads)
+		if err == nil {
+			err = withExit(exitSLO, sloErr)
+		}
+	}
+	if err != nil && res.Outcome == "ok" {
+		res.Outcome = err.Error()
+	}
+	if cfg.ResultsOut != "" {
+		if werr := writeResults(cfg.ResultsOut, res); werr != nil {
+			slog.Error("write results", "path", cfg.ResultsOut, "err", werr)
+		} else {
+			slog.Info("merged results written", "path", cfg.ResultsOut, "workers", len(parts))
+		}
+	}
+	if cfg.JUnitOut != "" {
+		if werr := writeJUnit(cfg.JUnitOut, res); werr != nil {
+			slog.Error("write junit report", "path", cfg.JUnitOut, "err", werr)
+		}
+	}
+	if cfg.SummaryMD != "" {
+		if werr := writeMarkdownFile(cfg.SummaryMD, res); werr != nil {
+			slog.Error("write markdown summary", "path", cfg.SummaryMD, "err", werr)
+		}
+	}
+	if cfg.NotifyURL != "" {
+		notifyRunEnd(cfg, res, err)
+	}
+	return err
+}
+
+// workerResultsPath is where the coordinator writes worker i's own result:
+// results.json => results-w0.json.
+func workerResultsPath(resultsPath string, i int) string {
+	return fmt.Sprintf("%s-w%d.json", strings.TrimSuffix(resultsPath, ".json"), i)
+}
+
+// workerCommand registers with a coordinator, runs the shard of the plan it
+// gets against DATABASE_URL, streaming progress, and reports its result.
+func workerCommand(args []string) error {
+	e := newCommandEnv("worker", "--coordinator host:port [flags]")
+	e.timeout = defaultWorkersWait
+	addr := e.fs.String("coordinator", "", "address of the coordinator (crdbpool-tester --coordinate)")
+	resultsOut := e.fs.String("results-out", "", "also write this worker's own JSON result file here")
+	_, cancel, err := e.parse(args)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	if *addr == "" {
+		e.fs.Usage()
+		return withExit(exitConfig, errors.New("--coordinator is required"))
+	}
+	conn, err := grpc.NewClient(*addr, grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.CallContentSubtype(jsonCodec{}.Name())))
+	if err != nil {
+		return withExit(exitConfig, fmt.Errorf("coordinator: %w", err))
+	}
+	defer conn.Close()
+
+	// registration waits for every worker; --timeout bounds it
+	regCtx, cancelReg := context.WithTimeout(context.Background(), e.timeout)
+	defer cancelReg()
+	host, _ := os.Hostname()
+	var plan workerPlan
+	slog.Info("registering with coordinator", "addr", *addr)
+	if err := conn.Invoke(regCtx, "/"+coordinatorService+"/Register", &registerRequest{Hostname: host, Version: currentBuild().Version}, &plan); err != nil {
+		return withExit(exitConnectivity, fmt.Errorf("register: %w", err))
+	}
+	slog.Info("plan received", "run_id", plan.RunID, "worker", plan.Index, "workers", plan.Count, "args", redactArgs(plan.Args))
+
+	// the stream opens first so the coordinator hears of every failure,
+	// even an invalid plan (a worker's DATABASE_URL missing)
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	stream, err := conn.NewStream(ctx, &coordinatorServiceDesc.Streams[0], "/"+coordinatorService+"/Report")
+	if err != nil {
+		return withExit(exitConnectivity, fmt.Errorf("report: %w", err))
+	}
+	var sendMu sync.Mutex
+	send := func(r *workerReport) error {
+		sendMu.Lock()
+		defer sendMu.Unlock()
+		r.Index = plan.Index
+		return stream.SendMsg(r)
+	}
+	finish := func(res *runResult, runErr error) {
+		final := &workerReport{Result: res}
+		if runErr != nil {
+			final.Err, final.ExitCode = runErr.Error(), exitCode(runErr)
+		}
+		if err := send(final); err != nil {
+			slog.Error("report result", "err", err)
+		} else if err := stream.CloseSend(); err == nil {
+			var ack reportAck
+			if err := stream.RecvMsg(&ack); err != nil {
+				slog.Error("report result", "err", err)
+			}
+		}
+	}
+
+	cfg := parseFlags(plan.Args)
+	applyShard(&cfg, plan.Index, plan.Count)
+	cfg.Seed = plan.Seed + uint64(plan.Index)
+	cfg.runID = fmt.Sprintf("%s-w%d", plan.RunID, plan.Index)
+	cfg.ResultsOut = *resultsOut
+	if err := resolveDSN(ctx, &cfg); err != nil {
+		err = withExit(exitConfig, fmt.Errorf("invalid plan: %w", err))
+		finish(nil, err)
+		return err
+	}
+	if err := validateConfig(&cfg); err != nil {
+		err = withExit(exitConfig, fmt.Errorf("invalid plan: %w", err))
+		finish(nil, err)
+		return err
+	}
+	cfg.onProgress = func(workloads map[string]opSummary) {
+		for name, s := range workloads {
+			s.Latency = nil // the quantiles are enough for progress
+			workloads[name] = s
+		}
+		if err := send(&workerReport{Progress: workloads}); err != nil {
+			slog.Warn("progress report", "err", err)
+		}
+	}
+	var res *runResult
+	cfg.onResult = func(r runResult) { res = &r }
+
+	runErr := run(ctx, cfg)
+	finish(res, runErr)
+	return runErr
+}
+
+// applyShard gives a worker or --shard-index its share, index of count, of
+// the load: the concurrency and connections of every workload divided
+// between the shards (each keeps at least one), and a range of the writer's
+// keys, the last one shared by the shards past it when there are fewer keys
+// than shards; iterations and pacing are the run's.
+func applyShard(cfg *Config, index, count int) {
+	share := func(total int) int { return max(1, total/count+btoi(index < total%count)) }
+	cfg.keyBase += min(index*(cfg.Keys/count)+min(index, cfg.Keys%count), cfg.Keys-1)
+	cfg.Keys = share(cfg.Keys)
+	cfg.ReaderConc, cfg.WriterConc = share(cfg.ReaderConc), share(cfg.WriterConc)
+	cfg.ReaderMax = share(cfg.ReaderMax)
+	if cfg.WriterMax > 0 {
+		cfg.WriterMax = share(cfg.WriterMax)
+	}
+	for i := range cfg.Pools {
+		cfg.Pools[i].Conc = share(cfg.Pools[i].Conc)
+		cfg.Pools[i].MaxConns = int32(share(int(cfg.Pools[i].MaxConns)))
+	}
+}
+
+// shardIndexEnv is set to each pod's index in a Kubernetes indexed Job.
+const shardIndexEnv = "JOB_COMPLETION_INDEX"
+
+// shardIndexFromEnv is --shard-index's default: $JOB_COMPLETION_INDEX, or 0;
+// -1, rejected with --shard-count, if it isn't a number.
+func shardIndexFromEnv() int {
+	s, ok := os.LookupEnv(shardIndexEnv)
+	if !ok {
+		return 0
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return -1
+	}
+	return i
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// drainWatch follows the end of a run with --drain: once the workloads stop
+// starting iterations, at the timeout or when the steps or spikes end them,
+// their queries in flight get the drain period to finish before they are
+// cancelled. It counts what was in flight, what the end of the period cut
+// off, and samples the pools once the workloads are done, before they are
+// torn down.
+type drainWatch struct {
+	drain     time.Duration
+	workloads []*workload
+	tl        *timeline
+
+	mu       sync.Mutex
+	started  time.Time
+	inFlight int64
+}
+
+// drainSummary is the drain's record, as written to --results-out.
+type drainSummary struct {
+	Drain    time.Duration       `json:"drain_ns"`          // allowed
+	Took     time.Duration       `json:"took_ns,omitempty"` // from the workloads' stop to their last query's end
+	InFlight int64               `json:"in_flight"`         // queries running when the workloads stopped
+	CutOff   map[string]int64    `json:"cut_off"`           // per workload, queries cancelled by the run's end
+	Pools    map[string]poolStat `json:"pools"`             // once the workloads were done
+}
+
+func newDrainWatch(drain time.Duration, workloads []*workload, tl *timeline) *drainWatch {
+	return &drainWatch{drain: drain, workloads: workloads, tl: tl}
+}
+
+// begin marks the workloads' stop: from here, only their queries in flight
+// run.
+func (d *drainWatch) begin() {
+	var n int64
+	for _, w := range d.workloads {
+		n += w.inFlight.Load()
+	}
+	d.mu.Lock()
+	d.started, d.inFlight = time.Now(), n
+	d.mu.Unlock()
+	slog.Info("draining", "in_flight", n, "drain", d.drain)
+	d.tl.record("drain", "%d queries in flight, %s to finish", n, d.drain)
+}
+
+// summary samples the pools and reports the drain; call it once the
+// workloads have returned.
+func (d *drainWatch) summary(pools map[string]*testerPool) *drainSummary {
+	d.mu.Lock()
+	out := &drainSummary{Drain: d.drain, InFlight: d.inFlight, CutOff: map[string]int64{}, Pools: snapshotPools(pools)}
+	if !d.started.IsZero() {
+		out.Took = time.Since(d.started)
+	}
+	d.mu.Unlock()
+	var cut int64
+	for _, w := range d.workloads {
+		out.CutOff[w.name] = w.cutOff.Load()
+		cut += out.CutOff[w.name]
+	}
+	for _, name := range slices.Sorted(maps.Keys(out.Pools)) {
+		st := out.Pools[name]
+		slog.Info("drain pool", "pool", name, "total_conns", st.TotalConns, "acquired_conns", st.AcquiredConns, "idle_conns", st.IdleConns)
+	}
+	slog.Info("drain summary", "in_flight", out.InFlight, "took", out.Took, "cut_off", out.CutOff)
+	if cut > 0 {
+		slog.Warn("drain: queries cut off by the end of the run", "cut_off", cut, "drain", d.drain)
+	}
+	return out
+}
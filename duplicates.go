@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	duplicateScanTimeout = time.Minute
+	duplicateContext     = 10 * time.Second // timeline events reported this far around a duplicate
+	maxDuplicateKeys     = 20               // duplicates kept for the results
+)
+
+// duplicateDetector backs --detect-duplicates: every writer operation
+// inserts a row carrying an idempotency key of its own, so once the
+// workloads are done any key in the table more than once is a statement a
+// retry executed again after it had committed. Each duplicate is reported
+// with the timeline events around it: the health changes, faults and
+// restarts that made the retry happen.
+type duplicateDetector struct {
+	runID  string
+	insert string
+	table  runTable
+	tl     *timeline
+	seq    atomic.Int64
+}
+
+// duplicateKey is one idempotency key found in more than one row.
+type duplicateKey struct {
+	Key    string          `json:"key"`
+	Count  int             `json:"count"`
+	First  time.Time       `json:"first_ts"` // ts of the key's rows: when the statements ran
+	Last   time.Time       `json:"last_ts"`
+	Events []timelineEvent `json:"events,omitempty"` // from duplicateContext before First to after Last
+}
+
+// duplicateSummary is logged and written to --results-out.
+type duplicateSummary struct {
+	Rows       int64          `json:"rows"`
+	Duplicates int            `json:"duplicates"` // keys in more than one row
+	Extra      int64          `json:"extra_rows"` // rows beyond the first of each such key
+	Keys       []duplicateKey `json:"keys,omitempty"`
+}
+
+func newDuplicateDetector(runID string, table runTable, tl *timeline) *duplicateDetector {
+	return &duplicateDetector{runID: runID, insert: table.insertTokenSQL(), table: table, tl: tl}
+}
+
+// resume carries the keys on after seq, the last one of the run resumed.
+func (d *duplicateDetector) resume(seq int64) {
+	if seq > d.seq.Load() {
+		d.seq.Store(seq)
+	}
+}
+
+// query returns the writer query: insert a row with a fresh idempotency key.
+func (d *duplicateDetector) query(writer querier) func(ctx context.Context, i int) error {
+	return func(ctx context.Context, i int) error {
+		key := fmt.Sprintf("%s-%d", d.runID, d.seq.Add(1))
+		if err := writer.ExecFunc(ctx, func(_ context.Context, _ pgconn.CommandTag, err error) error { return err }, d.insert, key); err != nil {
+			return err
+		}
+		logQuery(ctx, "insert ok", "workload", "writer", "iteration", i+1, "key", key)
+		return nil
+	}
+}
+
+// scan counts the keys in the table through db; any duplicate fails the
+// run. It works on any writer that inserts one token per call, so with
+// --verify-ambiguous or --ledger it only scans.
+func (d *duplicateDetector) scan(ctx context.Context, db querier) (*duplicateSummary, error) {
+	ctx, cancel := context.WithTimeout(ctx, duplicateScanTimeout)
+	defer cancel()
+	s := &duplicateSummary{}
+	err := db.QueryRowFunc(ctx, func(ctx context.Context, row pgx.Row) error { return row.Scan(&s.Rows) },
+		fmt.Sprintf("select count(*) from %s", d.table.ident))
+	if err != nil {
+		return nil, fmt.Errorf("detect duplicates: count rows: %w", err)
+	}
+	var keys []duplicateKey
+	err = db.QueryFunc(ctx, func(ctx context.Context, rows pgx.Rows) error {
+		keys = keys[:0]
+		for rows.Next() {
+			var k duplicateKey
+			if err := rows.Scan(&k.Key, &k.Count, &k.First, &k.Last); err != nil {
+				return err
+			}
+			keys = append(keys, k)
+		}
+		return rows.Err()
+	}, fmt.Sprintf("select token, count(*), min(ts), max(ts) from %s where token is not null group by token having count(*) > 1 order by min(ts)", d.table.ident))
+	if err != nil {
+		return nil, fmt.Errorf("detect duplicates: %w", err)
+	}
+
+	events := d.tl.snapshot()
+	for _, k := range keys {
+		s.Duplicates++
+		s.Extra += int64(k.Count - 1)
+		from, to := k.First.Add(-duplicateContext), k.Last.Add(duplicateContext)
+		for _, ev := range events {
+			if !ev.At.Before(from) && !ev.At.After(to) {
+				k.Events = append(k.Events, ev)
+			}
+		}
+		slog.Error("duplicate idempotency key", "key", k.Key, "count", k.Count, "first_ts", k.First, "last_ts", k.Last, "events", len(k.Events))
+		for _, ev := range k.Events {
+			slog.Error("duplicate idempotency key event", "key", k.Key, "offset", d.tl.offset(ev.At), "kind", ev.Kind, "detail", ev.Detail)
+		}
+		if len(s.Keys) < maxDuplicateKeys {
+			s.Keys = append(s.Keys, k)
+		}
+	}
+	slog.Info("duplicates", "rows", s.Rows, "duplicates", s.Duplicates, "extra_rows", s.Extra)
+	if s.Duplicates > 0 {
+		return s, violation(fmt.Errorf("%d idempotency keys written more than once (%d extra rows)", s.Duplicates, s.Extra))
+	}
+	return s, nil
+}
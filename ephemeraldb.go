@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ephemeralDBPrefix starts the name of the database --ephemeral-db creates
+// for a run, followed by its run ID.
+const ephemeralDBPrefix = "crdbpool_tester_"
+
+// ephemeralDB is a database created for one run: every pool connects to it,
+// so the workload table and the table registry live there, and dropping it
+// at exit removes all of the run's artifacts at once.
+type ephemeralDB struct {
+	name string
+	dsn  string // where it is created and dropped from
+}
+
+func ephemeralDBName(runID string) string {
+	return ephemeralDBPrefix + strings.NewReplacer("-", "_").Replace(strings.ToLower(runID))
+}
+
+// createEphemeralDB creates the run's database through dsn's own database.
+func createEphemeralDB(ctx context.Context, dsn, runID string) (*ephemeralDB, error) {
+	db := &ephemeralDB{name: ephemeralDBName(runID), dsn: dsn}
+	if err := db.exec(ctx, "create database "+pgx.Identifier{db.name}.Sanitize()); err != nil {
+		return nil, fmt.Errorf("create database %s: %w", db.name, err)
+	}
+	slog.Info("created ephemeral database", "database", db.name)
+	return db, nil
+}
+
+// use points c's connections at the database.
+func (db *ephemeralDB) use(c *pgxpool.Config) {
+	c.ConnConfig.Database = db.name
+}
+
+// drop drops the database and everything in it. It runs after the pools
+// are closed, on a connection of its own, and a failure leaves the database
+// for the operator to drop.
+func (db *ephemeralDB) drop() {
+	ctx, cancel := context.WithTimeout(context.Background(), tableDropTimeout)
+	defer cancel()
+	if err := db.exec(ctx, "drop database if exists "+pgx.Identifier{db.name}.Sanitize()+" cascade"); err != nil {
+		slog.Warn("drop ephemeral database failed; drop it with `drop database ... cascade`", "database", db.name, "err", err)
+		return
+	}
+	slog.Info("dropped ephemeral database", "database", db.name)
+}
+
+func (db *ephemeralDB) exec(ctx context.Context, sql string) error {
+	conn, err := pgx.Connect(ctx, db.dsn)
+	if err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Close(context.Background())
+	_, err = conn.Exec(ctx, sql)
+	return err
+}
+
+// validateEphemeralDB rejects what doesn't survive the database's drop or
+// needs one it can't be.
+func validateEphemeralDB(cfg Config) error {
+	switch {
+	case !cfg.EphemeralDB:
+		return nil
+	case cfg.ReadOnly:
+		return errors.New("--ephemeral-db creates a database, which --read-only rules out")
+	case cfg.KeepTable:
+		return errors.New("--keep-table can't keep the table of an --ephemeral-db run: it is dropped with the database")
+	case cfg.Ledger != "" && (cfg.CheckpointPath != "" || cfg.ResumePath != ""):
+		return errors.New("--ledger's audit of a resumed run needs the first process's table, which --ephemeral-db drops with the database")
+	case cfg.Table.Locality != "":
+		return errors.New("--table-locality needs a multi-region database, which --ephemeral-db's isn't")
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	defaultExhaustFactor         = 2.0
+	defaultExhaustHold           = 500 * time.Millisecond
+	defaultExhaustAcquireTimeout = 2 * time.Second
+)
+
+// exhaustion runs the reader with more concurrent calls than its pool has
+// connections, each holding its connection for hold with pg_sleep, and
+// measures how the pool queues the rest: acquire waits, calls that give up
+// waiting after acquireTimeout, and whether connections are handed out in
+// arrival order. Every iteration starts its calls together, so its waits
+// come in waves of MaxConns.
+type exhaustion struct {
+	conc           int
+	maxConns       int32
+	hold           time.Duration
+	acquireTimeout time.Duration
+
+	mu       sync.Mutex
+	batches  map[int][]exhaustArrival
+	wait     latencyHistogram
+	calls    int64
+	timeouts int64 // calls that never got a connection
+	errs     int64
+	pairs    int64 // same-iteration pairs compared for order
+	inverted int64 // ... where the later arrival got its connection first
+}
+
+// The states of an exhaustion call's race between its acquire and the
+// acquire timeout.
+const (
+	exhaustWaiting int32 = iota
+	exhaustAcquired
+	exhaustTimedOut
+)
+
+type exhaustArrival struct {
+	start    time.Time
+	acquired time.Time // zero when it never got a connection
+}
+
+// exhaustionSummary is written to --results-out.
+type exhaustionSummary struct {
+	Conc           int               `json:"conc"`
+	MaxConns       int32             `json:"max_conns"`
+	Hold           time.Duration     `json:"hold_ns"`
+	AcquireTimeout time.Duration     `json:"acquire_timeout_ns"`
+	Calls          int64             `json:"calls"`
+	Timeouts       int64             `json:"acquire_timeouts"`
+	Errors         int64             `json:"errors"` // other than acquire timeouts
+	Wait           *latencyHistogram `json:"acquire_wait"`
+	Inversions     float64           `json:"inversions"` // share of same-iteration pairs served out of arrival order
+}
+
+func newExhaustion(conc int, maxConns int32, hold, acquireTimeout time.Duration) *exhaustion {
+	return &exhaustion{conc: conc, maxConns: maxConns, hold: hold, acquireTimeout: acquireTimeout, batches: map[int][]exhaustArrival{}}
+}
+
+// query returns the reader query: pg_sleep(hold), cancelled if it hasn't
+// got a connection after acquireTimeout, and bounded by acquireTimeout plus
+// hold overall.
+func (e *exhaustion) query(p querier) func(ctx context.Context, i int) error {
+	secs := e.hold.Seconds()
+	return func(ctx context.Context, i int) error {
+		ctx, cancel := context.WithTimeout(ctx, e.acquireTimeout+e.hold)
+		defer cancel()
+		// the pool acquires and queries under the one context: it's
+		// cancelled at acquireTimeout unless the acquire won the race
+		var state atomic.Int32 // exhaustWaiting, then exhaustAcquired or exhaustTimedOut
+		report := &callReport{onAcquire: func() { state.CompareAndSwap(exhaustWaiting, exhaustAcquired) }}
+		t := time.AfterFunc(e.acquireTimeout, func() {
+			if state.CompareAndSwap(exhaustWaiting, exhaustTimedOut) {
+				cancel()
+			}
+		})
+		defer t.Stop()
+		start := time.Now()
+		var slept bool
+		err := p.QueryRowFunc(withCallReport(ctx, report), func(ctx context.Context, row pgx.Row) error {
+			return row.Scan(&slept)
+		}, sqlSleep, secs)
+		timedOut := state.Load() == exhaustTimedOut
+		if timedOut && err != nil {
+			err = fmt.Errorf("no connection within %s: %w", e.acquireTimeout, context.DeadlineExceeded)
+		}
+		e.record(i, start, report, err, timedOut)
+		if err == nil {
+			logQuery(ctx, "exhaustion query", "workload", "reader", "iteration", i+1, "acquire_wait", report.acquireWait, "duration", time.Since(start))
+		}
+		return err
+	}
+}
+
+func (e *exhaustion) record(iter int, start time.Time, r *callReport, err error, timedOut bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.calls++
+	switch {
+	case timedOut && err != nil:
+		e.timeouts++
+	case err != nil:
+		e.errs++
+	}
+	if !r.acquired.IsZero() {
+		e.wait.observe(r.acquired.Sub(start))
+	}
+	b := append(e.batches[iter], exhaustArrival{start: start, acquired: r.acquired})
+	if len(b) < e.conc {
+		e.batches[iter] = b
+		return
+	}
+	delete(e.batches, iter)
+	e.order(b)
+}
+
+// order counts the pairs of a finished iteration's calls that were served
+// out of arrival order; calls that never got a connection are left out.
+func (e *exhaustion) order(b []exhaustArrival) {
+	b = slices.DeleteFunc(b, func(a exhaustArrival) bool { return a.acquired.IsZero() })
+	slices.SortFunc(b, func(x, y exhaustArrival) int { return x.start.Compare(y.start) })
+	for i := range b {
+		for j := i + 1; j < len(b); j++ {
+			e.pairs++
+			if b[j].acquired.Before(b[i].acquired) {
+				e.inverted++
+			}
+		}
+	}
+}
+
+func (e *exhaustion) summary() *exhaustionSummary {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	s := &exhaustionSummary{
+		Conc:           e.conc,
+		MaxConns:       e.maxConns,
+		Hold:           e.hold,
+		AcquireTimeout: e.acquireTimeout,
+		Calls:          e.calls,
+		Timeouts:       e.timeouts,
+		Errors:         e.errs,
+		Wait:           &latencyHistogram{},
+	}
+	s.Wait.merge(&e.wait)
+	if e.pairs > 0 {
+		s.Inversions = float64(e.inverted) / float64(e.pairs)
+	}
+	slog.Info("exhaustion", "conc", s.Conc, "max_conns", s.MaxConns, "hold", s.Hold, "calls", s.Calls,
+		"acquire_timeouts", s.Timeouts, "errors", s.Errors, "acquire_wait", s.Wait, "inversions", s.Inversions)
+	return s
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Exit codes, one per failure category, so automation can tell a bad flag
+// from a cluster that was down.
+const (
+	exitInternal     = 1   // anything not in a category below
+	exitConfig       = 2   // bad flags, config file, preset or bundle (what the flag package exits with)
+	exitConnectivity = 3   // couldn't connect to the cluster
+	exitTimeout      = 4   // the workload ran out of --timeout, or the stall watchdog aborted it
+	exitSLO          = 5   // an SLO threshold was breached
+	exitConsistency  = 6   // a consistency check found a violation
+	exitAssertion    = 7   // another end-of-run assertion failed (leaks, retries, balance)
+	exitInterrupted  = 130 // stopped by SIGINT or SIGTERM
+)
+
+// exitSeverity ranks the codes, most severe first, for a run whose parts
+// failed differently: what the workload found before what kept it from
+// finding anything.
+var exitSeverity = []int{exitConsistency, exitSLO, exitAssertion, exitTimeout, exitConnectivity, exitConfig, exitInterrupted, exitInternal}
+
+// mostSevere is the one of errs whose exit code is the most severe, nil
+// when none failed.
+func mostSevere(errs []error) error {
+	rank := func(err error) int {
+		if i := slices.Index(exitSeverity, exitCode(err)); i >= 0 {
+			return i
+		}
+		return len(exitSeverity)
+	}
+	var worst error
+	for _, err := range errs {
+		if err != nil && (worst == nil || rank(err) < rank(worst)) {
+			worst = err
+		}
+	}
+	return worst
+}
+
+// consistencyAssertions are the end-of-run checks whose failure is a
+// consistency violation; the others exit with exitAssertion.
+var consistencyAssertions = []string{"read-your-writes", "ambiguous-writes", "duplicates", "bank", "lost-update", "audit"}
+
+// violationError marks the failure of a consistency check that found a
+// violation, as opposed to one that couldn't read what it checks.
+type violationError struct{ err error }
+
+func (e *violationError) Error() string { return e.err.Error() }
+func (e *violationError) Unwrap() error { return e.err }
+
+func violation(err error) error { return &violationError{err: err} }
+
+// exitError carries the exit code of the failure it wraps.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+// withExit tags err with an exit code; nil stays nil. An error already
+// tagged keeps its code.
+func withExit(code int, err error) error {
+	var ee *exitError
+	if err == nil || errors.As(err, &ee) {
+		return err
+	}
+	return &exitError{code: code, err: err}
+}
+
+// exitCode is the exit code for a command that failed with err: its tag,
+// else exitConnectivity for a failure to connect, else exitInternal.
+func exitCode(err error) int {
+	var ee *exitError
+	if errors.As(err, &ee) {
+		return ee.code
+	}
+	var ce *pgconn.ConnectError
+	if errors.As(err, &ce) {
+		return exitConnectivity
+	}
+	return exitInternal
+}
+
+// assertionExitCode is the exit code of the failed end-of-run check name,
+// 0 for a consistency check that failed without finding a violation (a lost
+// connection, say), which exitCode then classifies like any other error.
+func assertionExitCode(name string, err error) int {
+	if !slices.Contains(consistencyAssertions, name) {
+		return exitAssertion
+	}
+	var ve *violationError
+	if errors.As(err, &ve) {
+		return exitConsistency
+	}
+	return 0
+}
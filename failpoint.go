@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Failpoints that can be armed on a testerPool.
+const (
+	fpDropAcquire  = "drop-acquire"  // BeforeAcquire rejects the connection; the pool destroys it and hands out another
+	fpDelayAcquire = "delay-acquire" // BeforeAcquire sleeps for the failpoint delay
+	fpForceRetry   = "force-retry"   // the attempt fails with SQLSTATE 40001 (retry on the same connection)
+	fpForceReset   = "force-reset"   // the attempt fails with SQLSTATE 57P01 (reset onto a different node)
+	fpDelayRetry   = "delay-retry"   // a retry attempt (not a first attempt) sleeps for the failpoint delay
+)
+
+var failpointNames = []string{fpDropAcquire, fpDelayAcquire, fpForceRetry, fpForceReset, fpDelayRetry}
+
+// failpointState is the externally visible state of one armed failpoint.
+type failpointState struct {
+	Name      string        `json:"name"`
+	Remaining int           `json:"remaining"` // 0 => fires until disabled
+	Delay     time.Duration `json:"delay,omitempty"`
+	Hits      int           `json:"hits"`
+}
+
+// failpoints is a named set of armed fault injections. Each armed failpoint
+// fires for the next Remaining hits (or forever when Remaining is 0).
+type failpoints struct {
+	mu    sync.Mutex
+	armed map[string]*failpointState
+}
+
+func newFailpoints() *failpoints {
+	return &failpoints{armed: map[string]*failpointState{}}
+}
+
+func validFailpoint(name string) bool {
+	for _, n := range failpointNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *failpoints) enable(name string, count int, delay time.Duration) error {
+	if !validFailpoint(name) {
+		return fmt.Errorf("unknown failpoint %q (want one of %v)", name, failpointNames)
+	}
+	if count < 0 {
+		return fmt.Errorf("failpoint count must be >= 0 (got %d)", count)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.armed[name] = &failpointState{Name: name, Remaining: count, Delay: delay}
+	return nil
+}
+
+// disable disarms a failpoint and reports whether it was armed.
+func (f *failpoints) disable(name string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.armed[name]
+	delete(f.armed, name)
+	return ok
+}
+
+// fire consumes one hit of an armed failpoint, returning its delay.
+func (f *failpoints) fire(name string) (time.Duration, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fp, ok := f.armed[name]
+	if !ok {
+		return 0, false
+	}
+	fp.Hits++
+	if fp.Remaining > 0 {
+		fp.Remaining--
+		if fp.Remaining == 0 {
+			delete(f.armed, name)
+		}
+	}
+	return fp.Delay, true
+}
+
+func (f *failpoints) list() []failpointState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]failpointState, 0, len(f.armed))
+	for _, fp := range f.armed {
+		out = append(out, *fp)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	crdbpool "github.com/authzed/crdbpool/pkg"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// healthFaultTick is how often active faults are re-asserted and the
+	// per-node connection distribution is sampled. The health tracker's own
+	// poll marks any node it reaches healthy again, so an injected fault has
+	// to be re-applied continuously to stick.
+	healthFaultTick = time.Second
+	// healthFaultMarks is how many unhealthy reports it takes to get past the
+	// tracker's per-node error burst and actually mark the node unhealthy.
+	healthFaultMarks = 3
+	// balancerInterval is the pruning interval of the connection balancers
+	// started in health-fault mode.
+	balancerInterval = 5 * time.Second
+)
+
+// healthFault marks a CockroachDB node unhealthy in the health tracker for a
+// window of the run, without touching the node itself.
+//
+// Flag syntax: node[@start][+duration], where node is a node ID or "busiest"
+// (the node holding the most connections when the fault starts), e.g.
+//
+//	2@1m+30s
+//	busiest@30s+2m
+type healthFault struct {
+	Node     uint32 // 0 => busiest node at Start
+	Start    time.Duration
+	Duration time.Duration // 0 => keep until the end of the run
+}
+
+func parseHealthFault(s string) (healthFault, error) {
+	var hf healthFault
+	spec := strings.TrimSpace(s)
+	if rest, dur, ok := strings.Cut(spec, "+"); ok {
+		d, err := time.ParseDuration(dur)
+		if err != nil || d <= 0 {
+			return hf, fmt.Errorf("health fault %q: invalid duration %q", s, dur)
+		}
+		hf.Duration = d
+		spec = rest
+	}
+	if node, start, ok := strings.Cut(spec, "@"); ok {
+		d, err := time.ParseDuration(start)
+		if err != nil || d < 0 {
+			return hf, fmt.Errorf("health fault %q: invalid start %q", s, start)
+		}
+		hf.Start = d
+		spec = node
+	}
+	if spec != "busiest" {
+		n, err := strconv.ParseUint(spec, 10, 32)
+		if err != nil || n == 0 {
+			return hf, fmt.Errorf("health fault %q: node must be a node ID or \"busiest\"", s)
+		}
+		hf.Node = uint32(n)
+	}
+	return hf, nil
+}
+
+func (hf healthFault) String() string {
+	node := "busiest"
+	if hf.Node != 0 {
+		node = strconv.FormatUint(uint64(hf.Node), 10)
+	}
+	s := fmt.Sprintf("node %s@%s", node, hf.Start)
+	if hf.Duration > 0 {
+		s += "+" + hf.Duration.String()
+	}
+	return s
+}
+
+type healthFaultPhase int
+
+const (
+	faultPending healthFaultPhase = iota
+	faultActive
+	faultRecovering
+	faultDone
+)
+
+// healthFaultState tracks one scheduled fault and how the pools responded:
+// when the node's connections were all pruned, and when the pools opened
+// connections to it again after it was restored.
+type healthFaultState struct {
+	healthFault
+	phase    healthFaultPhase
+	node     uint32
+	began    time.Time
+	restored time.Time
+	drained  time.Time // zero => not drained (yet)
+	regained time.Time // zero => not regained (yet)
+}
+
+// healthFaultInjector drives the shared NodeHealthTracker through a schedule
+// of node faults and runs a crdbpool connection balancer per pool so the
+// injected health changes translate into pruned and reopened connections.
+type healthFaultInjector struct {
+	ht     *crdbpool.NodeHealthTracker
+	pools  map[string]*testerPool
+	faults []*healthFaultState
+	tl     *timeline
+}
+
+func newHealthFaultInjector(ht *crdbpool.NodeHealthTracker, pools map[string]*testerPool, faults []healthFault, tl *timeline) *healthFaultInjector {
+	h := &healthFaultInjector{ht: ht, pools: pools, tl: tl}
+	for _, f := range faults {
+		h.faults = append(h.faults, &healthFaultState{healthFault: f})
+	}
+	return h
+}
+
+// run applies the schedule until ctx is done, then restores every node it
+// still holds unhealthy.
+func (h *healthFaultInjector) run(ctx context.Context) {
+	start := time.Now()
+	names := slices.Sorted(maps.Keys(h.pools))
+	balancers := newPoolBalancers(h.ht, h.pools)
+	defer balancers.close()
+	prev := map[string]string{}
+
+	t := time.NewTicker(healthFaultTick)
+	defer t.Stop()
+	for {
+		balancers.sync(ctx)
+
+		conns := map[string]map[uint32]int{}
+		for _, name := range names {
+			conns[name] = nodeConns(h.pools[name].pool())
+		}
+		h.step(time.Since(start), conns)
+		for _, name := range names {
+			if s := formatNodeConns(conns[name], h.faultedNodes()); s != prev[name] {
+				h.tl.record("rebalance", "%s: %s", name, s)
+				prev[name] = s
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			for _, f := range h.faults {
+				if f.phase == faultActive {
+					h.ht.SetNodeHealth(f.node, true)
+					h.tl.record("health-restore", "node %d (end of run)", f.node)
+				}
+			}
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// step advances every fault for the current offset and connection sample.
+func (h *healthFaultInjector) step(elapsed time.Duration, conns map[string]map[uint32]int) {
+	now := time.Now()
+	for _, f := range h.faults {
+		switch f.phase {
+		case faultPending:
+			if elapsed < f.Start {
+				continue
+			}
+			f.node = f.Node
+			if f.node == 0 {
+				f.node = busiestNode(conns)
+			}
+			if f.node == 0 {
+				h.tl.record("health-fault", "%s skipped: no connections to pick a node from", f.healthFault)
+				f.phase = faultDone
+				continue
+			}
+			f.phase, f.began = faultActive, now
+			h.tl.record("health-fault", "node %d marked unhealthy (%s); healthy nodes %d", f.node, f.healthFault, h.ht.HealthyNodeCount())
+			fallthrough
+		case faultActive:
+			if f.Duration > 0 && elapsed >= f.Start+f.Duration {
+				h.ht.SetNodeHealth(f.node, true)
+				f.phase, f.restored = faultRecovering, now
+				h.tl.record("health-restore", "node %d marked healthy; healthy nodes %d", f.node, h.ht.HealthyNodeCount())
+				continue
+			}
+			for range healthFaultMarks {
+				h.ht.SetNodeHealth(f.node, false)
+			}
+			if f.drained.IsZero() && totalNodeConns(conns, f.node) == 0 {
+				f.drained = now
+				h.tl.record("rebalance", "node %d drained from all pools after %s", f.node, f.drained.Sub(f.began).Round(time.Millisecond))
+			}
+		case faultRecovering:
+			if totalNodeConns(conns, f.node) > 0 {
+				f.regained, f.phase = now, faultDone
+				h.tl.record("rebalance", "node %d regained connections after %s", f.node, f.regained.Sub(f.restored).Round(time.Millisecond))
+			}
+		}
+	}
+}
+
+// faultedNodes returns the nodes that have been faulted so far, so they keep
+// showing up (with 0 connections) in the distribution once drained.
+func (h *healthFaultInjector) faultedNodes() []uint32 {
+	var nodes []uint32
+	for _, f := range h.faults {
+		if f.node != 0 {
+			nodes = append(nodes, f.node)
+		}
+	}
+	return nodes
+}
+
+func (h *healthFaultInjector) logSummary() {
+	for _, f := range h.faults {
+		if f.node == 0 {
+			slog.Info("health fault not applied", "fault", f.healthFault.String())
+			continue
+		}
+		drained, regained := "never", "n/a"
+		if !f.drained.IsZero() {
+			drained = f.drained.Sub(f.began).Round(time.Millisecond).String()
+		}
+		if !f.restored.IsZero() {
+			regained = "never"
+			if !f.regained.IsZero() {
+				regained = f.regained.Sub(f.restored).Round(time.Millisecond).String()
+			}
+		}
+		slog.Info("health fault summary", "node", f.node, "fault", f.healthFault.String(), "drained", drained, "regained", regained)
+	}
+}
+
+// nodeConns counts a pool's open connections per CockroachDB node.
+func nodeConns(rp basePool) map[uint32]int {
+	m := map[uint32]int{}
+	rp.Range(func(_ *pgx.Conn, node uint32) { m[node]++ })
+	return m
+}
+
+func totalNodeConns(conns map[string]map[uint32]int, node uint32) int {
+	n := 0
+	for _, m := range conns {
+		n += m[node]
+	}
+	return n
+}
+
+// busiestNode returns the node with the most connections across all pools,
+// or 0 if there are none. Ties go to the lowest node ID.
+func busiestNode(conns map[string]map[uint32]int) uint32 {
+	totals := map[uint32]int{}
+	for _, m := range conns {
+		for node, n := range m {
+			totals[node] += n
+		}
+	}
+	var best uint32
+	for _, node := range slices.Sorted(maps.Keys(totals)) {
+		if best == 0 || totals[node] > totals[best] {
+			best = node
+		}
+	}
+	return best
+}
+
+// formatNodeConns renders a per-node distribution as "n1=3 n2=0 n3=4",
+// always including the extra nodes.
+func formatNodeConns(m map[uint32]int, extra []uint32) string {
+	nodes := slices.Collect(maps.Keys(m))
+	for _, node := range extra {
+		if _, ok := m[node]; !ok {
+			nodes = append(nodes, node)
+		}
+	}
+	slices.Sort(nodes)
+	nodes = slices.Compact(nodes)
+	parts := make([]string, len(nodes))
+	for i, node := range nodes {
+		parts[i] = fmt.Sprintf("n%d=%d", node, m[node])
+	}
+	return strings.Join(parts, " ")
+}
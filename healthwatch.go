@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	crdbpool "github.com/authzed/crdbpool/pkg"
+)
+
+const (
+	defaultHealthLogInterval = 30 * time.Second
+	healthWatchTick          = time.Second
+	healthGossipEvery        = 30 * time.Second
+)
+
+// healthWatch makes the shared NodeHealthTracker's view visible. The
+// tracker can't list its nodes, so the known nodes are the ones the pools
+// hold connections to plus the cluster's gossip nodes (refreshed every
+// 30s); each is checked every second, transitions go on the timeline,
+// and the whole view is logged every logEvery and served by the admin API.
+type healthWatch struct {
+	ht       *crdbpool.NodeHealthTracker
+	pools    map[string]*testerPool
+	tl       *timeline
+	logEvery time.Duration // 0 => no periodic log
+
+	mu      sync.Mutex
+	nodes   map[uint32]*nodeHealth
+	healthy int // the tracker's count, which may include nodes not known here
+}
+
+// healthView is the tracker's view, as served by GET /health and written to
+// --results-out.
+type healthView struct {
+	HealthyNodes int          `json:"healthy_nodes"`
+	Nodes        []nodeHealth `json:"nodes"`
+}
+
+// nodeHealth is one node as the tracker sees it.
+type nodeHealth struct {
+	Node        uint32    `json:"node"`
+	Healthy     bool      `json:"healthy"`
+	Since       time.Time `json:"since"` // first seen or last transition
+	Transitions int       `json:"transitions"`
+}
+
+func newHealthWatch(ht *crdbpool.NodeHealthTracker, pools map[string]*testerPool, logEvery time.Duration, tl *timeline) *healthWatch {
+	return &healthWatch{ht: ht, pools: pools, tl: tl, logEvery: logEvery, nodes: map[uint32]*nodeHealth{}}
+}
+
+func (h *healthWatch) run(ctx context.Context) {
+	t := time.NewTicker(healthWatchTick)
+	defer t.Stop()
+	var lastLog, lastGossip time.Time
+	for {
+		var candidates []uint32
+		if now := time.Now(); now.Sub(lastGossip) >= healthGossipEvery {
+			candidates = h.gossip(ctx)
+			lastGossip = now
+		}
+		for _, p := range h.pools {
+			p.pool().Range(func(_ *pgx.Conn, node uint32) {
+				candidates = append(candidates, node)
+			})
+		}
+		h.check(candidates)
+		if h.logEvery > 0 && time.Since(lastLog) >= h.logEvery {
+			h.log()
+			lastLog = time.Now()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// gossip lists the cluster's nodes through the reader's pool, outside
+// the workload's stats.
+func (h *healthWatch) gossip(ctx context.Context) []uint32 {
+	p, ok := h.pools["reader"]
+	if !ok {
+		return nil
+	}
+	var ids []uint32
+	err := p.pool().QueryFunc(ctx, func(ctx context.Context, rows pgx.Rows) error {
+		ids = ids[:0]
+		for rows.Next() {
+			var n gossipNode
+			if err := rows.Scan(&n.id, &n.address, &n.live); err != nil {
+				return err
+			}
+			ids = append(ids, uint32(n.id))
+		}
+		return rows.Err()
+	}, sqlGossipNodes)
+	if err != nil && ctx.Err() == nil {
+		slog.Debug("list nodes for health watch", "err", err)
+	}
+	return ids
+}
+
+func (h *healthWatch) check(candidates []uint32) {
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, id := range candidates {
+		if id != 0 && h.nodes[id] == nil {
+			h.nodes[id] = &nodeHealth{Node: id, Healthy: h.ht.IsHealthy(id), Since: now}
+			slog.Debug("health watch: node seen", "node", id, "healthy", h.nodes[id].Healthy)
+		}
+	}
+	for _, n := range h.nodes {
+		if healthy := h.ht.IsHealthy(n.Node); healthy != n.Healthy {
+			h.tl.record("health", "n%d %s -> %s (after %s)", n.Node, healthWord(n.Healthy), healthWord(healthy), now.Sub(n.Since).Truncate(time.Millisecond))
+			n.Healthy, n.Since = healthy, now
+			n.Transitions++
+		}
+	}
+	if count := h.ht.HealthyNodeCount(); count != h.healthy {
+		slog.Debug("health watch: healthy node count", "from", h.healthy, "to", count)
+		h.healthy = count
+	}
+}
+
+func healthWord(healthy bool) string {
+	if healthy {
+		return "healthy"
+	}
+	return "unhealthy"
+}
+
+func (h *healthWatch) snapshot() healthView {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	v := healthView{HealthyNodes: h.healthy, Nodes: make([]nodeHealth, 0, len(h.nodes))}
+	for _, id := range slices.Sorted(maps.Keys(h.nodes)) {
+		v.Nodes = append(v.Nodes, *h.nodes[id])
+	}
+	return v
+}
+
+func (h *healthWatch) log() {
+	v := h.snapshot()
+	var healthy, unhealthy []string
+	for _, n := range v.Nodes {
+		s := fmt.Sprintf("n%d", n.Node)
+		if n.Healthy {
+			healthy = append(healthy, s)
+		} else {
+			unhealthy = append(unhealthy, fmt.Sprintf("%s (since %s)", s, n.Since.UTC().Format(time.RFC3339)))
+		}
+	}
+	slog.Info("health tracker", "healthy_nodes", v.HealthyNodes, "known", len(v.Nodes), "healthy", healthy, "unhealthy", unhealthy)
+}
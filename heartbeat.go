@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"time"
+
+	crdbpool "github.com/authzed/crdbpool/pkg"
+)
+
+const (
+	defaultHeartbeatInterval = time.Minute
+	defaultHeartbeatTimeout  = 7 * 24 * time.Hour
+)
+
+// watchHeartbeat logs, once per interval, what happened to each pool's
+// connections since the previous beat (new connections, lifetime and idle
+// reaping) and records connection churn and healthy-node changes on the
+// timeline. It is meant for near-idle, multi-day runs where those slow events
+// are the point of the test.
+func watchHeartbeat(ctx context.Context, pools map[string]*testerPool, ht *crdbpool.NodeHealthTracker, interval time.Duration, tl *timeline) {
+	names := make([]string, 0, len(pools))
+	prev := map[string]poolStat{}
+	for name, p := range pools {
+		names = append(names, name)
+		prev[name] = newPoolStat(p.Stat())
+	}
+	sort.Strings(names)
+	healthy := ht.HealthyNodeCount()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		for _, name := range names {
+			cur := newPoolStat(pools[name].Stat())
+			p := prev[name]
+			newConns := cur.NewConnsCount - p.NewConnsCount
+			lifetime := cur.MaxLifetimeDestroyed - p.MaxLifetimeDestroyed
+			idle := cur.MaxIdleDestroyed - p.MaxIdleDestroyed
+			slog.Info("heartbeat", "pool", name, "total_conns", cur.TotalConns, "idle_conns", cur.IdleConns, "acquired_conns", cur.AcquiredConns,
+				"new_conns", newConns, "lifetime_reaped", lifetime, "idle_reaped", idle)
+			if newConns > 0 || lifetime > 0 || idle > 0 {
+				tl.record("conn-churn", "%s: new=%d lifetime-reaped=%d idle-reaped=%d", name, newConns, lifetime, idle)
+			}
+			prev[name] = cur
+		}
+		if n := ht.HealthyNodeCount(); n != healthy {
+			tl.record("health", "healthy nodes %d -> %d", healthy, n)
+			healthy = n
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// isolationLevels are the --isolation levels the transaction workloads (bank,
+// and --pool mode=tx) can run at. CockroachDB runs READ COMMITTED from 23.2
+// on, once sql.txn.read_committed_isolation.enabled is set; without it the
+// transactions silently run SERIALIZABLE, which the setup check warns about.
+var isolationLevels = map[string]pgx.TxIsoLevel{
+	"serializable":   pgx.Serializable,
+	"read_committed": pgx.ReadCommitted,
+}
+
+func validateIsolation(s string) error {
+	if _, ok := isolationLevels[s]; !ok {
+		return fmt.Errorf("unknown isolation %q (want one of %s)", s, strings.Join(slices.Sorted(maps.Keys(isolationLevels)), ", "))
+	}
+	return nil
+}
+
+// txOptions are the options of the workloads' transactions at level, the
+// session's default with "".
+func txOptions(level string) pgx.TxOptions {
+	return pgx.TxOptions{IsoLevel: isolationLevels[level]}
+}
+
+// isolationCheck reads, in each transaction workload's setup, the level its
+// transactions actually run at, and reports the retries and anomalies seen
+// under it.
+type isolationCheck struct {
+	requested string
+	opts      pgx.TxOptions
+	tl        *timeline
+
+	mu        sync.Mutex
+	effective map[string]string // per workload, as it read it
+}
+
+// isolationSummary is the run's record under --isolation, as written to
+// --results-out, to set against a run at the other level.
+type isolationSummary struct {
+	Requested string                       `json:"requested"`
+	Effective map[string]string            `json:"effective"` // per workload, as its setup read it
+	Workloads map[string]isolationWorkload `json:"workloads"`
+}
+
+type isolationWorkload struct {
+	Calls        uint64  `json:"calls"` // the pool's, setup included
+	RetriedCalls uint64  `json:"retried_calls"`
+	RetryRate    float64 `json:"retry_rate"`
+	// SerializationFailures are the 40001 errors the retries didn't absorb.
+	SerializationFailures uint64 `json:"serialization_failures"`
+	Anomalies             int    `json:"anomalies"` // bank: checks whose totals were off
+}
+
+func newIsolationCheck(level string, tl *timeline) *isolationCheck {
+	return &isolationCheck{requested: level, opts: txOptions(level), tl: tl, effective: map[string]string{}}
+}
+
+// setup returns name's setup: next, then a transaction through db reading
+// its level.
+func (c *isolationCheck) setup(name string, db querier, next func(ctx context.Context) error) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		if next != nil {
+			if err := next(ctx); err != nil {
+				return err
+			}
+		}
+		var level string
+		err := db.BeginTxFunc(ctx, c.opts, func(tx pgx.Tx) error {
+			return tx.QueryRow(ctx, "show transaction_isolation").Scan(&level)
+		})
+		if err != nil {
+			return fmt.Errorf("%s: read transaction isolation: %w", name, err)
+		}
+		level = strings.ReplaceAll(strings.ToLower(level), " ", "_")
+		c.mu.Lock()
+		c.effective[name] = level
+		c.mu.Unlock()
+		if level != c.requested {
+			slog.Warn("transactions run at another isolation than requested; READ COMMITTED needs CockroachDB 23.2+ and sql.txn.read_committed_isolation.enabled",
+				"workload", name, "requested", c.requested, "effective", level)
+			c.tl.record("isolation", "%s: requested %s, runs %s", name, c.requested, level)
+			return nil
+		}
+		slog.Info("transaction isolation", "workload", name, "level", level)
+		return nil
+	}
+}
+
+// summary reports the workloads whose level was read, from the run's
+// retries and workload summaries and the bank's checks.
+func (c *isolationCheck) summary(retries map[string]retrySummary, workloads map[string]opSummary, bank *bankSummary) *isolationSummary {
+	c.mu.Lock()
+	out := &isolationSummary{Requested: c.requested, Effective: maps.Clone(c.effective), Workloads: map[string]isolationWorkload{}}
+	c.mu.Unlock()
+	for _, name := range slices.Sorted(maps.Keys(out.Effective)) {
+		rs := retries[name]
+		iw := isolationWorkload{Calls: rs.Calls, RetriedCalls: rs.RetriedCalls, SerializationFailures: workloads[name].ErrorClasses["sqlstate-40001"]}
+		if rs.Calls > 0 {
+			iw.RetryRate = float64(rs.RetriedCalls) / float64(rs.Calls)
+		}
+		if name == "writer" && bank != nil {
+			iw.Anomalies = len(bank.Violations)
+		}
+		out.Workloads[name] = iw
+		slog.Info("isolation summary", "workload", name, "requested", c.requested, "effective", out.Effective[name],
+			"calls", iw.Calls, "retried_calls", iw.RetriedCalls, "retry_rate", iw.RetryRate, "serialization_failures", iw.SerializationFailures, "anomalies", iw.Anomalies)
+	}
+	return out
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// assertionResult is one end-of-run check (leak check, bank, audit, ...) as
+// written to --results-out and --junit-out.
+type assertionResult struct {
+	Name string `json:"name"`
+	Pass bool   `json:"pass"`
+	Err  string `json:"err,omitempty"`
+}
+
+// assert records the outcome of the check name and returns err, tagged
+// with the check's exit code.
+func (r *runResult) assert(name string, err error) error {
+	a := assertionResult{Name: name, Pass: err == nil}
+	if err != nil {
+		a.Err = err.Error()
+	}
+	r.Assertions = append(r.Assertions, a)
+	if code := assertionExitCode(name, err); code != 0 {
+		return withExit(code, err)
+	}
+	return err
+}
+
+type junitSuites struct {
+	XMLName xml.Name     `xml:"testsuites"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name      string      `xml:"name,attr"`
+	Tests     int         `xml:"tests,attr"`
+	Failures  int         `xml:"failures,attr"`
+	Time      string      `xml:"time,attr"`
+	Timestamp string      `xml:"timestamp,attr"`
+	Cases     []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func junitSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// junitReport renders a run as one test suite: a case for the run itself,
+// one per workload and event window with its stats, one per SLO threshold
+// and workload, and one per end-of-run assertion.
+func junitReport(res runResult) junitSuites {
+	suite := junitSuite{
+		Name:      "crdbpool-tester." + res.RunID,
+		Time:      junitSeconds(res.EndedAt.Sub(res.StartedAt)),
+		Timestamp: res.StartedAt.UTC().Format(time.RFC3339),
+	}
+	add := func(class, name string, d time.Duration, failure, out string) {
+		c := junitCase{Name: name, Classname: class, Time: junitSeconds(d), SystemOut: out}
+		if failure != "" {
+			c.Failure = &junitFailure{Message: failure, Text: failure}
+			suite.Failures++
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+
+	outcome := ""
+	if res.Outcome != "ok" {
+		outcome = res.Outcome
+	}
+	add("run", "run", res.EndedAt.Sub(res.StartedAt), outcome, "run_id "+res.RunID)
+	for _, name := range slices.Sorted(maps.Keys(res.Workloads)) {
+		s := res.Workloads[name]
+		add("workload", name, s.Duration, "", workloadStatsLine(s))
+	}
+	for _, w := range res.Windows {
+		for _, name := range slices.Sorted(maps.Keys(w.Workloads)) {
+			s := w.Workloads[name]
+			add("window."+w.Name, name, w.End.Sub(w.Start), "", workloadStatsLine(s))
+		}
+	}
+	if res.SLO != nil {
+		for _, c := range sloCases(res) {
+			add("slo", c.name, 0, c.failure, "")
+		}
+	}
+	for _, a := range res.Assertions {
+		add("assertion", a.Name, 0, a.Err, "")
+	}
+	suite.Tests = len(suite.Cases)
+	return junitSuites{Suites: []junitSuite{suite}}
+}
+
+type sloCase struct{ name, failure string }
+
+// sloCases has a case per set threshold and checked workload, failed with
+// its violation if it has one.
+func sloCases(res runResult) []sloCase {
+	t := res.SLO.Thresholds
+	var metrics []string
+	if t.MaxErrorRate >= 0 {
+		metrics = append(metrics, "error_rate")
+	}
+	for _, m := range []struct {
+		name string
+		on   bool
+	}{{"p50", t.MaxP50 > 0}, {"p95", t.MaxP95 > 0}, {"p99", t.MaxP99 > 0}, {"throughput", t.MinThroughput > 0}} {
+		if m.on {
+			metrics = append(metrics, m.name)
+		}
+	}
+	workloads := t.Workloads
+	if len(workloads) == 0 {
+		workloads = slices.Sorted(maps.Keys(res.Workloads))
+	}
+	var cases []sloCase
+	for _, w := range workloads {
+		for _, m := range metrics {
+			c := sloCase{name: w + "." + m}
+			for _, v := range res.SLO.Violations {
+				if v.Workload == w && v.Metric == m {
+					c.failure = fmt.Sprintf("%s %s: %s, limit %s", w, m, v.Actual, v.Limit)
+				}
+			}
+			cases = append(cases, c)
+		}
+	}
+	return cases
+}
+
+func workloadStatsLine(s opSummary) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "queries %d errors %d qps %.1f p50 %s p95 %s p99 %s max %s", s.Queries, s.Errors, s.Throughput,
+		s.P50.Round(time.Microsecond), s.P95.Round(time.Microsecond), s.P99.Round(time.Microsecond), s.Max.Round(time.Microsecond))
+	for _, class := range slices.Sorted(maps.Keys(s.ErrorClasses)) {
+		fmt.Fprintf(&b, "\nerrors %s %d", class, s.ErrorClasses[class])
+	}
+	return b.String()
+}
+
+// writeJUnit writes the run's JUnit XML report to path.
+func writeJUnit(path string, res runResult) error {
+	b, err := xml.MarshalIndent(junitReport(res), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append([]byte(xml.Header), append(b, '\n')...), 0o644)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	leakGrace    = 2 * time.Second // for calls still returning their connections at the end
+	leakStackMax = 16 << 10
+)
+
+// leakTracker records every connection acquired from the pools with the
+// goroutine and stack that acquired it, and forgets it on release. Whatever
+// is left once the workloads have finished was never returned.
+type leakTracker struct {
+	mu   sync.Mutex
+	held map[*pgx.Conn]heldConn
+}
+
+type heldConn struct {
+	pool      string
+	goroutine int64
+	at        time.Time
+	stack     []byte
+}
+
+// connLeak is a connection not returned to its pool, as logged and written
+// to --results-out.
+type connLeak struct {
+	Pool      string        `json:"pool"`
+	Goroutine int64         `json:"goroutine"`
+	Conn      string        `json:"conn"`
+	Node      uint32        `json:"node,omitempty"`
+	Held      time.Duration `json:"held_ns"`
+	Stack     string        `json:"stack"`
+}
+
+func newLeakTracker() *leakTracker {
+	return &leakTracker{held: map[*pgx.Conn]heldConn{}}
+}
+
+func (l *leakTracker) acquired(pool string, conn *pgx.Conn) {
+	buf := make([]byte, leakStackMax)
+	buf = buf[:runtime.Stack(buf, false)]
+	h := heldConn{pool: pool, goroutine: goroutineID(buf), at: time.Now(), stack: buf}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.held[conn] = h
+}
+
+func (l *leakTracker) released(conn *pgx.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.held, conn)
+}
+
+// goroutineID parses the ID out of the "goroutine N [running]:" header of a
+// stack trace.
+func goroutineID(stack []byte) int64 {
+	b, ok := bytes.CutPrefix(stack, []byte("goroutine "))
+	if !ok {
+		return 0
+	}
+	if i := bytes.IndexByte(b, ' '); i > 0 {
+		b = b[:i]
+	}
+	id, _ := strconv.ParseInt(string(b), 10, 64)
+	return id
+}
+
+func (l *leakTracker) outstanding() []connLeak {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]connLeak, 0, len(l.held))
+	for conn, h := range l.held {
+		out = append(out, connLeak{
+			Pool:      h.pool,
+			Goroutine: h.goroutine,
+			Conn:      safeRemoteAddr(conn),
+			Node:      connNode(conn),
+			Held:      time.Since(h.at),
+			Stack:     string(h.stack),
+		})
+	}
+	slices.SortFunc(out, func(a, b connLeak) int { return cmp.Compare(b.Held, a.Held) })
+	return out
+}
+
+// check waits up to leakGrace for held connections to come back, then
+// reports each one still out with the stack that acquired it, and the
+// goroutines holding them.
+func (l *leakTracker) check(ctx context.Context) ([]connLeak, error) {
+	deadline := time.Now().Add(leakGrace)
+	leaks := l.outstanding()
+	for len(leaks) > 0 && time.Now().Before(deadline) && sleepCtx(ctx, 50*time.Millisecond) {
+		leaks = l.outstanding()
+	}
+	if len(leaks) == 0 {
+		slog.Info("leak check", "leaked_conns", 0)
+		return nil, nil
+	}
+	perGoroutine := map[int64]int{}
+	for _, lk := range leaks {
+		perGoroutine[lk.Goroutine]++
+		slog.Error("connection leak", "pool", lk.Pool, "goroutine", lk.Goroutine, "conn", lk.Conn, "node", lk.Node, "held", lk.Held, "stack", lk.Stack)
+	}
+	for _, g := range slices.Sorted(maps.Keys(perGoroutine)) {
+		slog.Error("goroutine holding connections", "goroutine", g, "conns", perGoroutine[g])
+	}
+	return leaks, fmt.Errorf("%d connections acquired and never released", len(leaks))
+}
+
+// leakTracer feeds a leakTracker from pgxpool's acquire and release hooks.
+type leakTracer struct {
+	pool string
+	l    *leakTracker
+}
+
+func (lt leakTracer) TraceAcquireStart(ctx context.Context, _ *pgxpool.Pool, _ pgxpool.TraceAcquireStartData) context.Context {
+	return ctx
+}
+
+func (lt leakTracer) TraceAcquireEnd(_ context.Context, _ *pgxpool.Pool, data pgxpool.TraceAcquireEndData) {
+	if data.Err == nil && data.Conn != nil {
+		lt.l.acquired(lt.pool, data.Conn)
+	}
+}
+
+func (lt leakTracer) TraceRelease(_ *pgxpool.Pool, data pgxpool.TraceReleaseData) {
+	lt.l.released(data.Conn)
+}
+
+func (lt leakTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, _ pgx.TraceQueryStartData) context.Context {
+	return ctx
+}
+
+func (lt leakTracer) TraceQueryEnd(context.Context, *pgx.Conn, pgx.TraceQueryEndData) {}
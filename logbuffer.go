@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+const defaultLogBuffer = 4096
+
+// logSink is the process's asynchronous log writer, nil with --log-buffer 0.
+// Set by setupLogging before any workload starts.
+var logSink *asyncWriter
+
+// asyncWriter takes log lines off the logging goroutines: a write queues a
+// copy and returns, and one goroutine writes the queue out through a buffer,
+// flushed whenever the queue runs empty. At high concurrency the tracer's
+// lines written synchronously to stderr serialize the workers on the
+// handler's lock and the write syscall, inflating the latencies measured and
+// throttling the load generated.
+//
+// Writes block while the queue is full, so no line is lost and lines keep
+// their order; logQuery drops the per-query lines instead, counted in
+// dropped, rather than stall the workload on its own logging.
+type asyncWriter struct {
+	w       io.Writer
+	lines   chan []byte
+	done    chan struct{}
+	dropped atomic.Uint64
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newAsyncWriter(w io.Writer, size int) *asyncWriter {
+	a := &asyncWriter{w: w, lines: make(chan []byte, size), done: make(chan struct{})}
+	go a.drain()
+	return a
+}
+
+func (a *asyncWriter) drain() {
+	defer close(a.done)
+	bw := bufio.NewWriterSize(a.w, 64<<10)
+	for line := range a.lines {
+		_, _ = bw.Write(line)
+		if len(a.lines) == 0 {
+			_ = bw.Flush()
+		}
+	}
+	_ = bw.Flush()
+}
+
+// Write queues a copy of p: slog handlers reuse their buffers. Once closed
+// it writes through.
+func (a *asyncWriter) Write(p []byte) (int, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		return a.w.Write(p)
+	}
+	a.lines <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+// saturated reports whether the queue is full, so a write would block.
+func (a *asyncWriter) saturated() bool {
+	return len(a.lines) == cap(a.lines)
+}
+
+// close writes out the queue and switches to synchronous writes.
+func (a *asyncWriter) close() {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.lines)
+	}
+	a.mu.Unlock()
+	<-a.done
+}
+
+// logOutput is where the process logger writes: the async writer, or
+// stderr directly.
+func logOutput() io.Writer {
+	if logSink == nil {
+		return os.Stderr
+	}
+	return logSink
+}
+
+// logLinesDropped is the number of per-query lines dropped so far.
+func logLinesDropped() uint64 {
+	if logSink == nil {
+		return 0
+	}
+	return logSink.dropped.Load()
+}
+
+// flushLogs writes out the queued log lines before the process exits, and
+// reports the lines dropped.
+func flushLogs() {
+	if logSink == nil {
+		return
+	}
+	logSink.close()
+	if n := logSink.dropped.Load(); n > 0 {
+		slog.Warn("per-query log lines dropped: the log output couldn't keep up; raise --log-buffer, use --quiet or --log-level warn", "dropped", n)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	defaultLogFormat = "text"
+	defaultLogLevel  = "info"
+)
+
+// logQueries is cleared by --quiet: the per-query lines (the query tracer,
+// ping/upsert results) are dropped, leaving summaries, events and errors.
+// Set once before any workload starts.
+var logQueries = true
+
+// logQuery logs one per-query line at info level unless --quiet is set.
+// The line is dropped, and counted, when the log buffer is full.
+func logQuery(ctx context.Context, msg string, args ...any) {
+	if !logQueries {
+		return
+	}
+	if logSink != nil && logSink.saturated() && slog.Default().Enabled(ctx, slog.LevelInfo) {
+		logSink.dropped.Add(1)
+		return
+	}
+	slog.InfoContext(ctx, msg, args...)
+}
+
+type queryIDKey struct{}
+
+var queryIDSeq atomic.Uint64
+
+// withQueryID tags ctx with a new query ID for one logical operation, unless
+// it already carries one. Records logged with the context get a qid
+// attribute, so the tracer lines, retry attempts and errors of the same
+// operation can be correlated.
+func withQueryID(ctx context.Context) (context.Context, string) {
+	if id := queryID(ctx); id != "" {
+		return ctx, id
+	}
+	id := "q" + strconv.FormatUint(queryIDSeq.Add(1), 10)
+	return context.WithValue(ctx, queryIDKey{}, id), id
+}
+
+// queryID returns the query ID ctx carries, or "".
+func queryID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(queryIDKey{}).(string)
+	return id
+}
+
+// parseLogLevel accepts debug, info, warn and error.
+func parseLogLevel(s string) (slog.Level, error) {
+	switch s {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("log-level must be debug, info, warn or error (got %q)", s)
+}
+
+// newLogger builds the process logger writing format ("text" or "json") at
+// level ("debug", "info", "warn" or "error") and above to w.
+func newLogger(format, level string, w io.Writer) (*slog.Logger, error) {
+	lvl, err := parseLogLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	var h slog.Handler
+	switch format {
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("log-format must be text or json (got %q)", format)
+	}
+	return slog.New(queryIDHandler{sqlstateHandler{h}}), nil
+}
+
+// queryIDHandler adds the qid attribute of the record's context.
+type queryIDHandler struct{ slog.Handler }
+
+func (h queryIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := queryID(ctx); id != "" {
+		r = r.Clone()
+		r.AddAttrs(slog.String("qid", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h queryIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return queryIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h queryIDHandler) WithGroup(name string) slog.Handler {
+	return queryIDHandler{h.Handler.WithGroup(name)}
+}
+
+// sqlstateHandler adds a sqlstate attribute to records whose err attribute
+// carries a server error, so log pipelines can filter on it without parsing
+// error strings.
+type sqlstateHandler struct{ slog.Handler }
+
+func (h sqlstateHandler) Handle(ctx context.Context, r slog.Record) error {
+	var code string
+	r.Attrs(func(a slog.Attr) bool {
+		if err, ok := a.Value.Any().(error); ok && a.Key == "err" {
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) {
+				code = pgErr.Code
+				return false
+			}
+		}
+		return true
+	})
+	if code != "" {
+		r = r.Clone()
+		r.AddAttrs(slog.String("sqlstate", code))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h sqlstateHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return sqlstateHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h sqlstateHandler) WithGroup(name string) slog.Handler {
+	return sqlstateHandler{h.Handler.WithGroup(name)}
+}
+
+// fatal logs at error level and exits with code.
+func fatal(code int, msg string, args ...any) {
+	slog.Error(msg, args...)
+	flushLogs()
+	os.Exit(code)
+}
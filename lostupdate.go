@@ -0,0 +1,192 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	lostUpdateVerifyTimeout = time.Minute
+	maxCounterMismatches    = 20 // keys kept for the results
+)
+
+// lostUpdate has the writers increment per-key counters and, once the
+// workloads are done, checks every counter against the increments the
+// clients saw. An increment that failed before it reached the server, or
+// with an error the server returned, didn't happen; one that failed any
+// other way (a dropped connection, a deadline, 40003) may have. A counter
+// below the acknowledged increments lost an update; one above the
+// acknowledged plus the ambiguous ones was incremented twice, typically by
+// a retry of a commit that had in fact succeeded.
+type lostUpdate struct {
+	incr, read string
+	keys       *lockedRand
+	base       int // first key, set by applyShard
+	nkeys      int
+
+	mu        sync.Mutex
+	acked     map[int]int64
+	ambiguous map[int]int64
+	failed    int64 // increments that certainly didn't happen
+}
+
+// counterMismatch is one counter that doesn't add up.
+type counterMismatch struct {
+	Key       int    `json:"key"`
+	Value     int64  `json:"value"`
+	Acked     int64  `json:"acked"`
+	Ambiguous int64  `json:"ambiguous"`
+	Kind      string `json:"kind"` // "lost" or "extra"
+}
+
+// lostUpdateSummary is logged and written to --results-out.
+type lostUpdateSummary struct {
+	Keys       int               `json:"keys"` // counters written
+	Acked      int64             `json:"acked"`
+	Ambiguous  int64             `json:"ambiguous"`
+	Failed     int64             `json:"failed"`
+	Total      int64             `json:"total"` // sum of the counters in the table
+	Lost       int64             `json:"lost"`  // acknowledged increments missing from the counters
+	Extra      int64             `json:"extra"` // increments counted beyond every one that may have happened
+	Mismatches []counterMismatch `json:"mismatches,omitempty"`
+}
+
+func newLostUpdate(table runTable, keys *lockedRand, base, nkeys int) *lostUpdate {
+	return &lostUpdate{
+		incr:      table.incrementSQL(),
+		read:      table.selectCountersSQL(),
+		keys:      keys,
+		base:      base,
+		nkeys:     nkeys,
+		acked:     map[int]int64{},
+		ambiguous: map[int]int64{},
+	}
+}
+
+// query returns the writer query: increment a random key's counter.
+func (l *lostUpdate) query(writer querier) func(ctx context.Context, i int) error {
+	return func(ctx context.Context, i int) error {
+		key := l.base + l.keys.IntN(l.nkeys)
+		var n int64
+		err := writer.QueryRowFunc(ctx, func(ctx context.Context, row pgx.Row) error { return row.Scan(&n) }, l.incr, key)
+		l.record(key, err)
+		if err == nil {
+			logQuery(ctx, "increment ok", "workload", "writer", "iteration", i+1, "key", key, "counter", n)
+		}
+		return err
+	}
+}
+
+func (l *lostUpdate) record(key int, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case err == nil:
+		l.acked[key]++
+	case ambiguousOutcome(err):
+		l.ambiguous[key]++
+	default:
+		l.failed++
+	}
+}
+
+// ambiguousOutcome reports whether a write that failed with err may still
+// have committed: it did unless pgx never sent it or the server answered
+// with an error other than 40003 (result is ambiguous).
+func ambiguousOutcome(err error) bool {
+	if pgconn.SafeToRetry(err) {
+		return false
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return isAmbiguous(pgErr)
+	}
+	return true
+}
+
+// verify reads every counter through db and compares it with what the
+// clients saw; any lost or extra increment fails the run. Keys outside the
+// run's range are other shards' and left out.
+func (l *lostUpdate) verify(ctx context.Context, db querier) (*lostUpdateSummary, error) {
+	ctx, cancel := context.WithTimeout(ctx, lostUpdateVerifyTimeout)
+	defer cancel()
+	values := map[int]int64{}
+	err := db.QueryFunc(ctx, func(ctx context.Context, rows pgx.Rows) error {
+		clear(values)
+		for rows.Next() {
+			var key int
+			var n int64
+			if err := rows.Scan(&key, &n); err != nil {
+				return err
+			}
+			if key < l.base || key >= l.base+l.nkeys {
+				continue
+			}
+			values[key] = n
+		}
+		return rows.Err()
+	}, l.read)
+	if err != nil {
+		return nil, fmt.Errorf("lost-update: read counters: %w", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := &lostUpdateSummary{Failed: l.failed}
+	keys := map[int]bool{}
+	for _, m := range []map[int]int64{values, l.acked, l.ambiguous} {
+		for k := range m {
+			keys[k] = true
+		}
+	}
+	for _, k := range slices.Sorted(maps.Keys(keys)) {
+		v, acked, amb := values[k], l.acked[k], l.ambiguous[k]
+		s.Acked += acked
+		s.Ambiguous += amb
+		s.Total += v
+		m := counterMismatch{Key: k, Value: v, Acked: acked, Ambiguous: amb}
+		switch {
+		case v < acked:
+			m.Kind = "lost"
+			s.Lost += acked - v
+		case v > acked+amb:
+			m.Kind = "extra"
+			s.Extra += v - acked - amb
+		default:
+			continue
+		}
+		slog.Error("counter mismatch", "key", k, "kind", m.Kind, "value", v, "acked", acked, "ambiguous", amb)
+		s.Mismatches = append(s.Mismatches, m)
+	}
+	s.Keys = len(values)
+	// the worst first
+	slices.SortStableFunc(s.Mismatches, func(a, b counterMismatch) int {
+		return cmp.Compare(counterDelta(b), counterDelta(a))
+	})
+	if len(s.Mismatches) > maxCounterMismatches {
+		s.Mismatches = s.Mismatches[:maxCounterMismatches]
+	}
+	slog.Info("lost-update", "keys", s.Keys, "acked", s.Acked, "ambiguous", s.Ambiguous, "failed", s.Failed, "total", s.Total, "lost", s.Lost, "extra", s.Extra)
+	if s.Lost > 0 || s.Extra > 0 {
+		return s, violation(fmt.Errorf("lost-update: counters off by %d lost and %d extra increments", s.Lost, s.Extra))
+	}
+	return s, nil
+}
+
+// counterDelta is how far a mismatched counter is outside its bounds.
+func counterDelta(m counterMismatch) int64 {
+	if m.Kind == "lost" {
+		return m.Acked - m.Value
+	}
+	return m.Value - m.Acked - m.Ambiguous
+}
@@ -1,13 +1,21 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"maps"
+	"math"
+	"math/rand/v2"
 	"net/url"
 	"os"
+	"slices"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/jackc/pgx/v5"
@@ -25,26 +33,194 @@ const (
 	defaultReaderSleep    = 50 * time.Millisecond
 	defaultConcurrency    = 1
 	healthPollInterval    = 5 * time.Second
-	retryAttempts         = 3
-	retryBackoff          = 200 * time.Millisecond
+	defaultRetryAttempts  = 3
+	defaultRetryBackoff   = 200 * time.Millisecond
+	maxRetryAttempts      = math.MaxUint8 - 1 // at MaxUint8 crdbpool's uint8 retry loop wraps and retries forever
 	sqlNow                = "select now()"
-	sqlEnsureTable        = "create table if not exists tmp_crush(id int primary key, ts timestamptz)"
-	sqlUpsertReturningTS  = "insert into tmp_crush (id, ts) values (1, now()) on conflict (id) do update set ts = now() returning ts"
+	sqlNodeID             = "select crdb_internal.node_id()"
 )
 
 type Config struct {
-	Iterations  int
-	Timeout     time.Duration
-	ReaderMax   int
-	WriterMax   int // 0 => derive from ReaderMax (1/3, min 1)
-	ReaderSleep time.Duration
-	WriterSleep time.Duration
-	ReaderConc  int
-	WriterConc  int
-	DSN         string
+	Iterations   int
+	Timeout      time.Duration
+	Warmup       time.Duration // each workload's samples this long into its run are kept apart from its stats
+	QueryTimeout time.Duration // deadline of each workload query call; 0 => the run's only
+	ReaderMax    int
+	WriterMax    int // 0 => derive from ReaderMax (1/3, min 1)
+	ReaderSleep  time.Duration
+	WriterSleep  time.Duration
+	ReaderConc   int
+	WriterConc   int
+	SleepJitter  float64   // spread of each worker's sleep, as a fraction of it
+	ThinkDist    thinkDist // how the interval between batches is drawn; "" => fixed
+	DSN          string
+	ReaderDSN    string     // reader pool endpoint; empty => DSN
+	WriterDSN    string     // writer pool endpoint; empty => DSN
+	ReadOnly     bool       // no writer pool, and every session read-only
+	ViaProxy     bool       // connecting through a transaction-mode pooler
+	TLS          tlsOptions // --ssl* flags, merged into the DSNs
+	Dial         dialOptions
+	Statements   statementOptions // statement caches and --prepare
+	Session      sessionTimeouts  // server-side statement and idle-in-transaction timeouts
+
+	CCloudCluster  string // CockroachDB Cloud cluster ID the DSN is built for
+	CCloudRegion   string
+	CCloudDatabase string
+	Pools          []poolSpec // --pool: named pools beyond the reader and writer
+
+	ToxiproxyAddr   string // Toxiproxy API address; empty disables fault injection
+	ToxiproxyProxy  string
+	ToxiproxyListen string
+	Toxics          []toxicSchedule
+	HealthFaults    []healthFault
+	UpgradeDrill    bool // track node versions through a rolling upgrade
+	ShutdownGrace   time.Duration
+	Drain           time.Duration // after the timeout, how long queries in flight may finish
+	RetryAttempts   int           // crdbpool's retries of a call
+	RetryBackoff    time.Duration // passed to crdbpool as the connect rate interval
+	StallTimeout    time.Duration // a workload without completed queries this long is stalled; 0 disables
+	StallAbort      bool          // cancel the run on a stall
+	Soak            soakOptions   // until interrupted, watching the tester's own resources
+	Steps           []loadStep    // --steps: the workloads' target rate in stages
+	Sine            sineOptions   // the workloads' target rate on a sine wave
+	Spikes          []spikeSpec   // --spike: the workloads' concurrency and rate multiplied for a while
+
+	Middleware        bool // route workload calls through the application-style middleware
+	MiddlewareTimeout time.Duration
+	MiddlewareRetries int
+	RetryStrategy     string // backoff between the middleware's retries
+
+	Breaker breakerOptions // a circuit breaker in front of each pool
+
+	Clusters []clusterTarget // --dsn targets; with more than one, the workload runs against each
+
+	CoordinateAddr string // serve the run's plan to Workers workers here instead of running it
+	Workers        int
+	WorkersWait    time.Duration // how long the coordinator waits for every worker to register
+	ShardIndex     int           // with ShardCount, this run's share of the load (e.g. a Kubernetes indexed Job's pod)
+	ShardCount     int           // 0 => not sharded
+
+	// set by the worker command for its share of a coordinated run
+	runID      string                     // the run's ID; empty => a new one
+	onProgress func(map[string]opSummary) // called with the workloads' stats every workerProgressInterval
+	onResult   func(runResult)            // called with the result at the end of the run
+	keyBase    int                        // first of the Keys the writer upserts; set by applyShard
+
+	MirrorDSN       string // secondary cluster for reader mirroring; empty disables
+	MirrorTolerance time.Duration
+
+	ScenarioPath   string          // file of timed events to execute during the run
+	ScenarioEvents []scenarioEvent // events given with --scenario-event, merged with the file's
+
+	AdminAddr string // listen address of the HTTP control API; empty disables
+	Pprof     bool   // serve net/http/pprof on the control API
+
+	CredentialsFile string // watched file holding a password or full DSN; empty disables rotation
+	CredentialsPoll time.Duration
+	DSNFile         string // DATABASE_URL, or its password, read from this file
+	VaultPath       string // ... or from this Vault secret
+	VaultField      string
+	VaultTokenFile  string
+
+	ResultsOut string            // write a JSON result file here at the end of the run
+	SLO        sloThresholds     // pass/fail gates on the workloads' stats
+	JUnitOut   string            // write a JUnit XML report here at the end of the run
+	SummaryMD  string            // write a Markdown summary here at the end of the run
+	Components map[string]string // component version labels recorded with results
+
+	PushgatewayURL      string // push the stats to this Prometheus Pushgateway at exit; empty disables
+	PushgatewayJob      string
+	PushgatewayInterval time.Duration // also push this often during the run; 0 => only at exit
+
+	NotifyURL    string // webhook posted the run's summary when it ends; empty disables
+	NotifyFormat string // notifyFormatJSON or notifyFormatSlack; empty => by the URL
+	NotifyOn     string // notifyAlways or notifyFailure
+	NotifyLink   string // link to the results artifact included in the summary
+
+	StatsdAddr     string // DogStatsD agent (host:port or unix:///path); empty disables
+	StatsdPrefix   string
+	StatsdTags     []string      // key:value tags added to every metric
+	StatsdInterval time.Duration // gauge and flush interval
+
+	ReloadFile string // key=value pool settings applied on SIGHUP
+
+	HeartbeatOnly     bool // one query per pool per HeartbeatInterval, for multi-day idle studies
+	HeartbeatInterval time.Duration
+
+	CheckpointPath     string // periodically save progress here
+	CheckpointInterval time.Duration
+	ResumePath         string // resume the run saved in this checkpoint
+
+	KeepTable             bool // keep the per-run table instead of dropping it at exit
+	Cleanup               bool // at exit, also drop the tables previous runs left behind
+	EphemeralDB           bool // run in a database of its own, dropped at exit
+	CleanupOlderThan      time.Duration
+	Table                 tableOptions // physical layout of the workload table
+	Keys                  int          // distinct rows the writer upserts, picked at random
+	Workload              string       // workloadNames
+	PoolImpl              string       // poolImpls
+	ChurnEvery            int          // with conn-churn: calls a connection serves before it is recycled
+	ExhaustFactor         float64      // with exhaustion: reader calls per reader connection
+	ExhaustHold           time.Duration
+	ExhaustAcquireTimeout time.Duration
+	BankAccounts          int   // with bank: accounts transfers move money between
+	BankBalance           int64 // ... and each one's initial balance
+	BankCheckEvery        time.Duration
+	Isolation             string   // with bank and mode=tx pools: isolationLevels; "" => the session's
+	VerifyAmbiguous       bool     // writer inserts tokens, counted after the run
+	VisibilityPools       []string // with visibility: --pool pools polled besides the reader
+	VisibilityFollower    bool     // ... reading as of follower_read_timestamp()
+	VisibilityTimeout     time.Duration
+	VisibilityPoll        time.Duration
+	DetectDuplicates      bool   // writer inserts tokens as idempotency keys, duplicates counted after the run
+	Ledger                string // writer inserts tokens, acknowledged ones appended here and audited after the run
+
+	// pgxpool settings for both pools; 0 => the DSN's or pgxpool's default
+	HealthLogInterval time.Duration // periodic log of the health tracker's view; 0 => only at the end
+	LeakCheck         bool          // fail the run if connections are never returned to their pools
+	AcquireThreshold  time.Duration // acquire waits this long are slow; 0 => none are
+	MinConns          int           // capped at each pool's max
+	MinConnsTimeout   time.Duration // how long the pools get to open MinConns before the workload starts
+	MaxConnLifetime   time.Duration
+	MaxConnIdleTime   time.Duration
+	HealthCheckPeriod time.Duration
+	Preset            string // standard workload the flags started from
+
+	ShowVersion bool // print the build info and exit
+
+	AssertRetries      int           // forced retries per probe call; 0 => off
+	AssertRetriesEvery time.Duration // interval between probes
+
+	VerifyBalance    bool // fail the run if connections aren't spread over the healthy nodes after BalanceWarmup
+	BalanceWarmup    time.Duration
+	BalanceTolerance float64 // allowed deviation from an even share per node, relative to it
+
+	SlowQuery durationDist // when set, the reader runs pg_sleep with durations from this distribution
+	Seed      uint64       // seeds the workload's random choices; 0 => pick one (recorded in repro bundles)
+
+	ReproBundle string        // on failure, write a repro bundle under this directory
+	ReproWindow time.Duration // how much recent log output a bundle keeps
+	FromBundle  string        // rerun the bundle in this directory
+	Args        []string      // the arguments flags were parsed from, bundle arguments included
+
+	LogFormat string // text or json
+	LogLevel  string // debug, info, warn or error
+	Quiet     bool   // drop per-query log lines
+	Measure   bool   // minimal tester overhead on the query path, for benchmarking
+	LogBuffer int    // log lines queued for the async writer; 0 writes synchronously
+
+	TraceSlowThreshold time.Duration // only trace queries at least this slow; 0 => trace all
+	RedactArgs         string        // "hash" or "elide" query arguments in traces; empty logs them
+
+	OutlierThreshold time.Duration // calls at least this slow are captured; 0 disables
+	OutliersOut      string        // JSON-lines file the outliers are written to
+
+	ReportPaths     []string // report mode: result files or directories to group by version
+	ReportComponent string
+	ReportThreshold float64
 }
 
-func parseFlags() Config {
+func parseFlags(args []string) Config {
 	var (
 		itersShort       int
 		itersLong        int
@@ -62,10 +238,54 @@ func parseFlags() Config {
 		writerConc       int
 	)
 
+	cfg := Config{
+		Iterations:         defaultIterations,
+		Timeout:            defaultTimeout,
+		RetryAttempts:      defaultRetryAttempts,
+		RetryBackoff:       defaultRetryBackoff,
+		ReaderMax:          defaultReaderMaxConns,
+		WriterMax:          0,
+		ReaderSleep:        defaultReaderSleep,
+		WriterSleep:        defaultWriterSleep,
+		ReaderConc:         defaultConcurrency,
+		WriterConc:         defaultConcurrency,
+		DSN:                os.Getenv("DATABASE_URL"),
+		ToxiproxyProxy:     defaultToxiproxyProxy,
+		ToxiproxyListen:    defaultToxiproxyListen,
+		MirrorDSN:          os.Getenv("MIRROR_DATABASE_URL"),
+		MirrorTolerance:    defaultMirrorTimeTolerance,
+		CredentialsPoll:    defaultCredentialsPoll,
+		Components:         map[string]string{},
+		HeartbeatInterval:  defaultHeartbeatInterval,
+		PushgatewayJob:     defaultPushgatewayJob,
+		StatsdPrefix:       defaultStatsdPrefix,
+		NotifyOn:           notifyAlways,
+		StatsdInterval:     defaultStatsdInterval,
+		WorkersWait:        defaultWorkersWait,
+		Table:              tableOptions{Name: tablePrefix, RunSuffix: true},
+		ShardIndex:         shardIndexFromEnv(),
+		CheckpointInterval: defaultCheckpointInterval,
+		ReportComponent:    "crdbpool",
+		ReportThreshold:    defaultReportThreshold,
+		ShutdownGrace:      defaultShutdownGrace,
+		ReproWindow:        defaultReproWindow,
+		SLO:                sloThresholds{MaxErrorRate: -1},
+		LogFormat:          defaultLogFormat,
+		LogLevel:           defaultLogLevel,
+		LogBuffer:          defaultLogBuffer,
+		MiddlewareTimeout:  defaultMiddlewareTimeout,
+		MiddlewareRetries:  defaultMiddlewareRetries,
+		RetryStrategy:      defaultRetryStrategy,
+	}
+
 	flag.IntVar(&itersShort, "i", 0, "short for --iterations: number of iterations for reader and writer workloads")
 	flag.IntVar(&itersLong, "iterations", 0, "number of iterations for reader and writer workloads")
 	flag.DurationVar(&timeoutShort, "t", 0, "short for --timeout: overall workload timeout (e.g., 30s, 2m, 1h)")
 	flag.DurationVar(&timeoutLong, "timeout", 0, "overall workload timeout (e.g., 30s, 2m, 1h)")
+	flag.IntVar(&cfg.RetryAttempts, "retry-attempts", cfg.RetryAttempts, "retries crdbpool makes of a call after a retryable error, 0-254 (each pool's, like the admin API's reload)")
+	flag.DurationVar(&cfg.RetryBackoff, "retry-backoff", cfg.RetryBackoff, "each pool's retry-backoff, which crdbpool takes as the interval between new connections")
+	flag.DurationVar(&cfg.QueryTimeout, "query-timeout", 0, "deadline of each workload query call (e.g., 2s), apart from the run's --timeout; calls cut off by it are counted as the query-timeout error class (0 = none)")
+	flag.DurationVar(&cfg.Warmup, "warmup", 0, "run each workload this long (e.g., 30s) before its samples count: latencies and errors of the warmup, while connections are established and caches warm up, are reported apart from the final stats (part of --timeout and --iterations)")
 	flag.IntVar(&readerShort, "r", 0, "short for --reader-max-conns: max connections for reader pool")
 	flag.IntVar(&readerLong, "reader-max-conns", 0, "max connections for reader pool")
 	flag.IntVar(&writerShort, "w", 0, "short for --writer-max-conns: max connections for writer pool (if 0, derived as 1/3 of reader)")
@@ -75,20 +295,263 @@ func parseFlags() Config {
 	flag.DurationVar(&writerSleepShort, "ws", 0, "short for --writer-sleep: sleep between writer iterations (e.g., 50ms)")
 	flag.DurationVar(&writerSleepLong, "writer-sleep", 0, "sleep between writer iterations (e.g., 50ms)")
 	flag.IntVar(&readerConc, "reader-conc", 0, "number of concurrent reader queries per iteration")
+	flag.Func("sleep-jitter", "spread each worker's sleep over this share of the sleep either way, as a percentage (20%) or fraction (0.2), so the workers of an iteration don't all wake at once", func(s string) (err error) {
+		cfg.SleepJitter, err = parseRate(s)
+		return err
+	})
+	flag.Func("think-dist", "draw the interval between a workload's iterations around the sleep (or the target rate's interval): fixed (default), uniform (0 to twice the mean) or exp (poisson), the exponential think times of open-loop arrivals", func(s string) (err error) {
+		cfg.ThinkDist, err = parseThinkDist(s)
+		return err
+	})
 	flag.IntVar(&writerConc, "writer-conc", 0, "number of concurrent writer queries per iteration")
-	flag.Parse()
+	flag.BoolVar(&cfg.UpgradeDrill, "upgrade-drill", false, "follow a rolling CockroachDB upgrade: track per-node versions seen through the connections and count calls and errors before, during and after version skew")
+	flag.BoolVar(&cfg.Middleware, "middleware", false, "call the pools through an application-style middleware (per-call deadline, retries, per-operation metrics)")
+	flag.DurationVar(&cfg.MiddlewareTimeout, "middleware-timeout", cfg.MiddlewareTimeout, "with --middleware: deadline of each call, retries included (0 = none)")
+	flag.IntVar(&cfg.MiddlewareRetries, "middleware-retries", cfg.MiddlewareRetries, "with --middleware: retries of a call on retryable errors after crdbpool's own")
+	flag.StringVar(&cfg.RetryStrategy, "retry-strategy", cfg.RetryStrategy, "with --middleware: backoff between its retries, "+strings.Join(retryStrategies, ", ")+", from 50ms and capped at 2s; the retries' latency overhead is reported per pool")
+	flag.DurationVar(&cfg.StallTimeout, "stall-timeout", 0, "record a stall (timeline event and goroutine dump) when a running, unpaused workload completes no query for this long (0 = disabled)")
+	flag.BoolVar(&cfg.StallAbort, "stall-abort", false, "with --stall-timeout: cancel the run when a workload stalls")
+	cfg.Soak.register(flag.CommandLine)
+	cfg.Breaker.register(flag.CommandLine)
+	cfg.Sine.register(flag.CommandLine)
+	flag.Func("spike", "multiply every workload's concurrency (and target rate, with --steps or --sine) for a while, repeatable: <factor>x:<duration>@<start>, e.g. 10x:30s@5m, reporting how quickly latency recovers and the pools grow and shrink", func(s string) error {
+		sp, err := parseSpike(s)
+		if err != nil {
+			return err
+		}
+		cfg.Spikes = append(cfg.Spikes, sp)
+		return nil
+	})
+	flag.Func("steps", "staircase load profile: comma-separated <rate>qps:<duration> steps every workload targets in turn, e.g. 100qps:5m,200qps:5m,400qps:5m, with stats per step; the run ends after the last step", func(s string) (err error) {
+		cfg.Steps, err = parseSteps(s)
+		return err
+	})
+	flag.DurationVar(&cfg.ShutdownGrace, "shutdown-grace", cfg.ShutdownGrace, "on SIGINT/SIGTERM, how long in-flight queries may finish before they are cancelled (a second signal cancels them at once)")
+	flag.DurationVar(&cfg.Drain, "drain", 0, "once the workloads stop at the timeout (or the end of --steps or --spike), how long their queries in flight may finish before they are cancelled; the pools are sampled once more after, and the queries cut off reported (0 = cancel them at the timeout)")
+	flag.StringVar(&cfg.ToxiproxyAddr, "toxiproxy-addr", "", "Toxiproxy API address (e.g., localhost:8474); when set, all connections go through a Toxiproxy proxy")
+	flag.StringVar(&cfg.ToxiproxyProxy, "toxiproxy-proxy", cfg.ToxiproxyProxy, "name of the Toxiproxy proxy to create")
+	flag.StringVar(&cfg.ToxiproxyListen, "toxiproxy-listen", cfg.ToxiproxyListen, "listen address of the Toxiproxy proxy (as reachable from this host)")
+	flag.Func("toxic", "scheduled toxic, repeatable: type[@start][+duration][:key=value,...] (e.g., latency@1m+30s:latency=500)", func(s string) error {
+		ts, err := parseToxicSchedule(s)
+		if err != nil {
+			return err
+		}
+		cfg.Toxics = append(cfg.Toxics, ts)
+		return nil
+	})
+	flag.Func("health-fault", "mark a node unhealthy in the health tracker, repeatable: node[@start][+duration] where node is an ID or 'busiest' (e.g., busiest@1m+30s)", func(s string) error {
+		hf, err := parseHealthFault(s)
+		if err != nil {
+			return err
+		}
+		cfg.HealthFaults = append(cfg.HealthFaults, hf)
+		return nil
+	})
+	flag.Func("dsn", "cluster to run against instead of $DATABASE_URL, as a DSN or label=DSN; repeat to run the same workload against several clusters at once and compare them", func(s string) error {
+		cfg.Clusters = append(cfg.Clusters, parseClusterTarget(s, len(cfg.Clusters)+1))
+		return nil
+	})
+	flag.StringVar(&cfg.CoordinateAddr, "coordinate", "", "coordinate a distributed run: listen on this address for --workers `crdbpool-tester worker` processes, give each its shard of the load and merge their results instead of running the workload")
+	flag.IntVar(&cfg.Workers, "workers", 0, "with --coordinate, the number of workers the run is split between; it starts once all have registered")
+	flag.DurationVar(&cfg.WorkersWait, "workers-wait", cfg.WorkersWait, "with --coordinate, how long to wait for every worker to register")
+	flag.IntVar(&cfg.ShardIndex, "shard-index", cfg.ShardIndex, "with --shard-count, this run's shard, 0-based (default: $"+shardIndexEnv+", set in each pod of a Kubernetes indexed Job)")
+	flag.IntVar(&cfg.ShardCount, "shard-count", 0, "split the load between this many independent runs: each takes its share of the concurrency, connections and writer keys by --shard-index; merge their results with `report merge`")
+	flag.StringVar(&cfg.ReaderDSN, "reader-dsn", "", "connect the reader pool here instead of $DATABASE_URL (e.g., a follower-read or locality-specific endpoint)")
+	flag.StringVar(&cfg.WriterDSN, "writer-dsn", "", "connect the writer pool here instead of $DATABASE_URL")
+	cfg.TLS.register(flag.CommandLine)
+	cfg.Dial.register(flag.CommandLine)
+	cfg.Statements.register(flag.CommandLine)
+	cfg.Session.register(flag.CommandLine)
+	flag.BoolVar(&cfg.ViaProxy, "via-proxy", false, "the DSN is a transaction-mode connection pooler such as PgBouncer: run without prepared statements and session settings, and report how connections behave differently behind it")
+	flag.StringVar(&cfg.CCloudCluster, "ccloud-cluster", "", "run against this CockroachDB Cloud cluster ID: look it up with $"+ccloudAPIKeyEnv+", fetch its CA certificate and connect as $"+ccloudSQLUserEnv+" with $"+ccloudSQLPassEnv+", replacing $DATABASE_URL")
+	flag.StringVar(&cfg.CCloudRegion, "ccloud-region", "", "with --ccloud-cluster, connect to this region's SQL endpoint (default: the cluster's first region)")
+	flag.StringVar(&cfg.CCloudDatabase, "ccloud-database", "defaultdb", "with --ccloud-cluster, the database to connect to")
+	flag.BoolVar(&cfg.ReadOnly, "read-only", false, "never write: run without the writer pool and its table, with default_transaction_read_only=on on every session, e.g. for latency canaries against a production cluster")
+	flag.Func("pool", "named pool with a workload of its own next to the reader and writer, repeatable: name:key=value,... with keys max-conns, conc, iterations, sleep, mode (query, exec or tx), dsn and sql (e.g., migration:max-conns=2,mode=exec,sleep=5s,sql=UPDATE t SET v = v + 1)", func(s string) error {
+		ps, err := parsePoolSpec(s)
+		if err != nil {
+			return err
+		}
+		cfg.Pools = append(cfg.Pools, ps)
+		return nil
+	})
+	flag.StringVar(&cfg.MirrorDSN, "mirror-dsn", cfg.MirrorDSN, "mirror every reader query to this secondary cluster and diff results/latencies (default: $MIRROR_DATABASE_URL)")
+	flag.DurationVar(&cfg.MirrorTolerance, "mirror-time-tolerance", cfg.MirrorTolerance, "max difference between timestamp values before a mirrored result counts as divergent")
+	flag.StringVar(&cfg.ScenarioPath, "scenario", "", "scenario file of timed events (e.g., 'at 2m: kill-conns', 'at 5m: pause writer')")
+	flag.Func("scenario-event", "timed scenario event, repeatable, in scenario file syntax (e.g., 'at 2m: pause writer'); merged with --scenario", func(s string) error {
+		evs, err := parseScenario(strings.NewReader(s))
+		if err != nil {
+			return err
+		}
+		cfg.ScenarioEvents = append(cfg.ScenarioEvents, evs...)
+		return nil
+	})
+	flag.StringVar(&cfg.AdminAddr, "admin-addr", "", "listen address for the HTTP control API (e.g., 127.0.0.1:8080); disabled when empty")
+	flag.BoolVar(&cfg.Pprof, "pprof", false, "serve the tester's own profiles (net/http/pprof) under /debug/pprof/ on --admin-addr")
+	flag.StringVar(&cfg.CredentialsFile, "credentials-file", "", "watch this file for a password or full DSN and use its current contents for every new connection")
+	flag.DurationVar(&cfg.CredentialsPoll, "credentials-poll", cfg.CredentialsPoll, "how often to re-read --credentials-file; with --dsn-file or --vault-path, how stale the credentials may be when a connection is opened")
+	flag.StringVar(&cfg.DSNFile, "dsn-file", "", "read the DSN, or the password for $DATABASE_URL's user, from this file instead of the environment, re-reading it when new connections are opened")
+	flag.StringVar(&cfg.VaultPath, "vault-path", "", "read the DSN, or the password for $DATABASE_URL's user, from this Vault secret (API path, e.g. secret/data/crdb/app) at $VAULT_ADDR, re-reading it when new connections are opened")
+	flag.StringVar(&cfg.VaultField, "vault-field", defaultVaultField, "the --vault-path secret's field holding the DSN or password")
+	flag.StringVar(&cfg.VaultTokenFile, "vault-token-file", "", "with --vault-path and no $VAULT_TOKEN, read the token from this file, e.g. a Vault Agent sink (default: ~/.vault-token)")
+	flag.StringVar(&cfg.ReloadFile, "reload-file", "", "pool settings file (max-conns, retry-attempts, retry-backoff; optionally prefixed 'reader.'/'writer.') applied when SIGHUP rebuilds the pools")
+	flag.BoolVar(&cfg.HeartbeatOnly, "heartbeat-only", false, "issue a single query per pool every --heartbeat-interval and log connection churn; runs until --timeout (default 7 days)")
+	flag.DurationVar(&cfg.HeartbeatInterval, "heartbeat-interval", cfg.HeartbeatInterval, "interval between heartbeat queries in --heartbeat-only mode")
+	flag.StringVar(&cfg.CheckpointPath, "checkpoint", "", "periodically save progress (iterations done, stats, timeline) to this file")
+	flag.DurationVar(&cfg.CheckpointInterval, "checkpoint-interval", cfg.CheckpointInterval, "how often to write --checkpoint")
+	flag.StringVar(&cfg.ResumePath, "resume", "", "resume the run saved in this checkpoint (keeps checkpointing to it unless --checkpoint is set)")
+	flag.Func("slow-query", "run the reader as a slow-query workload: pg_sleep with durations from fixed:D, uniform:MIN-MAX, exp:MEAN[,max=D] or mix:D@W,...", func(s string) error {
+		d, err := parseDurationDist(s)
+		if err != nil {
+			return err
+		}
+		cfg.SlowQuery = d
+		return nil
+	})
+	flag.BoolVar(&cfg.KeepTable, "keep-table", false, "keep the per-run workload table at exit instead of dropping it")
+	flag.BoolVar(&cfg.Cleanup, "cleanup", false, "at exit, also drop the workload tables crashed or --keep-table runs left behind, registered or named like --table's (as the cleanup command with --unregistered)")
+	flag.DurationVar(&cfg.CleanupOlderThan, "cleanup-older-than", defaultCleanupAge, "with --cleanup, only drop tables created at least this long ago")
+	flag.BoolVar(&cfg.EphemeralDB, "ephemeral-db", false, "create a database of the run's own, "+ephemeralDBPrefix+"<run ID>, connect every pool to it and drop it at exit, keeping the run's tables out of existing schemas")
+	flag.Uint64Var(&cfg.Seed, "seed", 0, "seed for every random choice of the workload (keys, slow-query durations); 0 picks one, logged at startup and recorded with results")
+	flag.StringVar(&cfg.Workload, "workload", workloadDefault, "workload to run: "+strings.Join(workloadNames, ", "))
+	flag.StringVar(&cfg.PoolImpl, "pool-impl", poolImplCrdbpool, "pool the workload runs through: crdbpool (its RetryPool, with retries, resets and balancing) or pgxpool (a plain pgxpool, one attempt per call, as a baseline)")
+	flag.Float64Var(&cfg.ExhaustFactor, "exhaust-factor", defaultExhaustFactor, "with --workload exhaustion: concurrent reader calls per reader connection")
+	flag.DurationVar(&cfg.ExhaustHold, "exhaust-hold", defaultExhaustHold, "with --workload exhaustion: how long each reader call holds its connection (pg_sleep)")
+	flag.BoolVar(&cfg.VerifyAmbiguous, "verify-ambiguous", false, "have the writer insert a row with a unique token per call, then check whether each call that returned 40003 (result is ambiguous) or succeeded after one committed, and fail the run on any write applied twice")
+	flag.BoolVar(&cfg.DetectDuplicates, "detect-duplicates", false, "have the writer insert a row with a unique idempotency key per call, then fail the run on any key in the table more than once (a retry re-executed a committed statement), reporting each with the timeline events around it")
+	flag.StringVar(&cfg.Ledger, "ledger", "", "have the writer insert a row with a unique token per call, append every acknowledged insert to this JSON-lines file, and audit the table against it after the run: missing, duplicate and torn rows fail the run (the audit command repeats it on a --keep-table run)")
+	flag.Func("visibility-pools", "with --workload visibility: comma-separated --pool names whose pools poll for every write too, e.g. pools on nodes in other localities (the reader pool always does)", func(s string) error {
+		cfg.VisibilityPools = append(cfg.VisibilityPools, strings.Split(s, ",")...)
+		return nil
+	})
+	flag.BoolVar(&cfg.VisibilityFollower, "visibility-follower-reads", false, "with --workload visibility: poll with follower reads (as of system time follower_read_timestamp()), measuring their staleness")
+	flag.DurationVar(&cfg.VisibilityTimeout, "visibility-timeout", defaultVisibilityTimeout, "with --workload visibility: stop polling for a write after this long and count it as not visible")
+	flag.DurationVar(&cfg.VisibilityPoll, "visibility-poll", defaultVisibilityPoll, "with --workload visibility: interval between a pool's reads of a write not yet visible")
+	flag.IntVar(&cfg.BankAccounts, "bank-accounts", defaultBankAccounts, "with --workload bank: number of accounts")
+	flag.Int64Var(&cfg.BankBalance, "bank-balance", defaultBankBalance, "with --workload bank: initial balance of each account")
+	flag.DurationVar(&cfg.BankCheckEvery, "bank-check-every", defaultBankCheckEvery, "with --workload bank: interval between checks of the total balance")
+	flag.StringVar(&cfg.Isolation, "isolation", "", "run the transaction workloads (--workload bank, --pool mode=tx) at this isolation level, serializable or read_committed (CockroachDB 23.2+), and report their retry rates and anomalies under it (default: the session's)")
+	flag.DurationVar(&cfg.ExhaustAcquireTimeout, "exhaust-acquire-timeout", defaultExhaustAcquireTimeout, "with --workload exhaustion: how long a reader call waits for a connection before giving up")
+	flag.IntVar(&cfg.ChurnEvery, "churn-every", defaultChurnEvery, "with --workload conn-churn: calls a connection serves before the pool destroys it on release")
+	flag.DurationVar(&cfg.HealthLogInterval, "health-log-interval", defaultHealthLogInterval, "log the node health tracker's view this often (0 = only at the end); health transitions are always recorded on the timeline")
+	flag.BoolVar(&cfg.LeakCheck, "leak-check", false, "record the goroutine and stack of every connection acquire and fail the run if any connection is still out once the workloads have finished, reporting each with its acquisition stack")
+	flag.DurationVar(&cfg.AcquireThreshold, "acquire-threshold", defaultAcquireThreshold, "warn when a call waits this long to acquire a connection, and report a pool as saturated when 1% of its acquires do (0 = never)")
+	flag.IntVar(&cfg.MinConns, "min-conns", 0, "connections each pool keeps open (pgxpool MinConns, capped at the pool's max; 0 = the DSN's pool_min_conns or none); the workload starts once both pools have opened them")
+	flag.DurationVar(&cfg.MinConnsTimeout, "min-conns-timeout", defaultMinConnsTimeout, "fail the run if the pools haven't opened their minimum connections within this long")
+	flag.DurationVar(&cfg.MaxConnLifetime, "max-conn-lifetime", 0, "close pooled connections this long after they connected (pgxpool MaxConnLifetime; 0 = the DSN's pool_max_conn_lifetime or 1h)")
+	flag.DurationVar(&cfg.MaxConnIdleTime, "max-conn-idle-time", 0, "close pooled connections idle this long (pgxpool MaxConnIdleTime; 0 = the DSN's pool_max_conn_idle_time or 30m)")
+	flag.DurationVar(&cfg.HealthCheckPeriod, "health-check-period", 0, "how often pgxpool checks idle connections for lifetime and idle time (0 = the DSN's pool_health_check_period or 1m)")
+	flag.IntVar(&cfg.Keys, "keys", 1, "number of rows the writer upserts, one picked at random per call; 1 => every write contends on the same row")
+	flag.StringVar(&cfg.Table.Name, "table", cfg.Table.Name, "name of the workload table, or with --table-run-suffix its prefix")
+	flag.StringVar(&cfg.Table.Schema, "schema", "", "create the workload table in this schema, creating it if missing (default: the database's current schema)")
+	flag.BoolVar(&cfg.Table.RunSuffix, "table-run-suffix", cfg.Table.RunSuffix, "append the run ID to --table so runs sharing a cluster never share a table; false uses --table as is, created if missing")
+	flag.BoolVar(&cfg.Table.Families, "table-families", false, "create the workload table with id and ts in separate column families")
+	flag.IntVar(&cfg.Table.HashBuckets, "table-hash-buckets", 0, "hash-shard the workload table's primary key into this many buckets (0 = not sharded)")
+	flag.StringVar(&cfg.Table.Locality, "table-locality", "", "locality clause for the workload table on a multi-region database (e.g. \"regional by row\", global)")
+	flag.Func("table-storage", "storage parameter for the workload table as key=value, value a SQL literal (repeatable; e.g. fillfactor=90, ttl_expire_after='1h')", func(s string) error {
+		p, err := parseStorageParam(s)
+		if err != nil {
+			return err
+		}
+		cfg.Table.Storage = append(cfg.Table.Storage, p)
+		return nil
+	})
+	flag.DurationVar(&cfg.Table.RowTTL, "row-ttl", 0, "create the workload table with CockroachDB row-level TTL, deleting rows this long after their last write, so long-running canaries don't grow it unboundedly (e.g. 1h; 0 = no TTL)")
+	flag.StringVar(&cfg.Table.RowTTLCron, "row-ttl-cron", "", "with --row-ttl, the cron schedule of the TTL deletion job (default: CockroachDB's, hourly)")
+	flag.StringVar(&cfg.ResultsOut, "results-out", "", "write a JSON result file (stats, timeline, component versions) to this path")
+	flag.StringVar(&cfg.JUnitOut, "junit-out", "", "write a JUnit XML report to this path: a test case for the run, each workload and event window, each SLO threshold and each end-of-run assertion")
+	flag.StringVar(&cfg.SummaryMD, "summary-md", "", "append a GitHub-flavored Markdown summary (workloads, error classes, retries, SLO and assertion results) to this path, e.g. $GITHUB_STEP_SUMMARY")
+	flag.StringVar(&cfg.PushgatewayURL, "pushgateway-url", "", "push the final stats (per workload: queries, errors, throughput, latency quantiles; per pool: retries) to this Prometheus Pushgateway, grouped by job and run_id")
+	flag.StringVar(&cfg.PushgatewayJob, "pushgateway-job", cfg.PushgatewayJob, "job label of the pushed group")
+	flag.DurationVar(&cfg.PushgatewayInterval, "pushgateway-interval", 0, "with --pushgateway-url, also push the stats this often during the run; 0 pushes only at exit")
+	flag.StringVar(&cfg.NotifyURL, "notify-url", "", "when the run ends or aborts, post a summary (outcome, exit code, per-workload stats, SLO and failed assertions, results link) to this webhook")
+	flag.StringVar(&cfg.NotifyFormat, "notify-format", "", "json (the summary object) or slack (a message); default slack for hooks.slack.com URLs, json otherwise")
+	flag.StringVar(&cfg.NotifyOn, "notify-on", cfg.NotifyOn, "always or failure: when to post to --notify-url")
+	flag.StringVar(&cfg.NotifyLink, "notify-link", "", "link to the results artifact (e.g. the CI job's artifacts page) in the notification; default the --results-out path")
+	flag.StringVar(&cfg.StatsdAddr, "statsd-addr", "", "send DogStatsD metrics to this agent, host:port over UDP or unix:///path: a timer and counters per call tagged pool, node and sqlstate, and the pools' connection gauges")
+	flag.StringVar(&cfg.StatsdPrefix, "statsd-prefix", cfg.StatsdPrefix, "prefix of the DogStatsD metric names")
+	flag.Func("statsd-tags", "comma-separated key:value tags added to every DogStatsD metric, e.g. env:ci,team:storage", func(s string) (err error) {
+		cfg.StatsdTags, err = parseStatsdTags(s)
+		return err
+	})
+	flag.DurationVar(&cfg.StatsdInterval, "statsd-interval", cfg.StatsdInterval, "how often the pools' gauges are sent and buffered metrics flushed")
+	flag.Func("max-error-rate", "fail the run if a workload's errors exceed this share of its queries, as a percentage (0.1%) or fraction (0.001)", func(s string) (err error) {
+		cfg.SLO.MaxErrorRate, err = parseRate(s)
+		return err
+	})
+	flag.DurationVar(&cfg.SLO.MaxP50, "max-p50", 0, "fail the run if a workload's p50 latency exceeds this (0 = no limit)")
+	flag.DurationVar(&cfg.SLO.MaxP95, "max-p95", 0, "fail the run if a workload's p95 latency exceeds this (0 = no limit)")
+	flag.DurationVar(&cfg.SLO.MaxP99, "max-p99", 0, "fail the run if a workload's p99 latency exceeds this (0 = no limit)")
+	flag.Func("min-throughput", "fail the run if a workload's throughput falls below this, e.g. 500qps", func(s string) (err error) {
+		cfg.SLO.MinThroughput, err = parseThroughput(s)
+		return err
+	})
+	flag.Func("slo-workloads", "comma-separated workloads the SLO flags apply to (reader, writer, --pool names; default: all)", func(s string) error {
+		cfg.SLO.Workloads = append(cfg.SLO.Workloads, strings.Split(s, ",")...)
+		return nil
+	})
+	flag.Func("component-versions", "component version labels recorded with results, e.g. crdbpool=v1.3.0,lb=haproxy-2.8 (crdbpool and pgx default to the compiled-in versions)", func(s string) error {
+		return parseComponentVersions(s, cfg.Components)
+	})
+	flag.Func("report", "report mode: comma-separated result files or directories to group by component version (no workload is run)", func(s string) error {
+		cfg.ReportPaths = append(cfg.ReportPaths, strings.Split(s, ",")...)
+		return nil
+	})
+	flag.StringVar(&cfg.ReportComponent, "report-component", cfg.ReportComponent, "component whose version groups runs in --report")
+	flag.Float64Var(&cfg.ReportThreshold, "report-threshold", cfg.ReportThreshold, "relative change between versions that --report highlights (0.10 = 10%)")
+	flag.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "log output format: text or json (key=value / one JSON object per line)")
+	flag.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "minimum log level: debug, info, warn or error")
+	flag.DurationVar(&cfg.TraceSlowThreshold, "trace-slow-threshold", 0, "only log traced queries that take at least this long, counting the rest (0 = log every query)")
+	flag.StringVar(&cfg.RedactArgs, "redact-args", "", "keep query arguments out of the logs: hash (keyed per run, equal values match) or elide")
+	flag.IntVar(&cfg.LogBuffer, "log-buffer", cfg.LogBuffer, "log lines queued for the background log writer; per-query lines are dropped, and counted, while it is full (0: write synchronously)")
+	flag.BoolVar(&cfg.Measure, "measure", false, "benchmark with minimal overhead from the tester: no query tracer, no per-query log lines (errors included, still counted) and no per-query allocations of its own")
+	flag.BoolVar(&cfg.Quiet, "quiet", false, "suppress per-query log lines (tracer, ping/upsert results), keeping summaries, events and errors")
+	flag.StringVar(&cfg.ReproBundle, "repro-bundle", "", "when the run fails, write a repro bundle (effective flags, seed, scenario, timeline, recent log) to a per-run directory under this one")
+	flag.DurationVar(&cfg.ReproWindow, "repro-window", cfg.ReproWindow, "how much of the most recent log output a repro bundle keeps")
+	flag.DurationVar(&cfg.OutlierThreshold, "outlier-threshold", 0, "capture calls at least this slow (pool stats, node, connection age, attempts, in-flight count) to --outliers-out; 0 disables")
+	flag.StringVar(&cfg.OutliersOut, "outliers-out", "", "JSON-lines file --outlier-threshold writes captured outliers to")
+	flag.StringVar(&cfg.FromBundle, "from-bundle", "", "rerun the repro bundle in this directory; flags on the command line replace the bundle's")
 
-	cfg := Config{
-		Iterations:  defaultIterations,
-		Timeout:     defaultTimeout,
-		ReaderMax:   defaultReaderMaxConns,
-		WriterMax:   0,
-		ReaderSleep: defaultReaderSleep,
-		WriterSleep: defaultWriterSleep,
-		ReaderConc:  defaultConcurrency,
-		WriterConc:  defaultConcurrency,
-		DSN:         os.Getenv("DATABASE_URL"),
+	flag.IntVar(&cfg.AssertRetries, "assert-retries", 0, "every --assert-retries-every, run a probe call per pool that fails with SQLSTATE 40001 this many times, and fail the run unless the RetryPool retried it as often, on the same connection, with its backoff in between, and succeeded (or gave up with a MaxRetryError past its retry budget); 0 disables")
+	flag.DurationVar(&cfg.AssertRetriesEvery, "assert-retries-every", defaultRetryAssertEvery, "interval between --assert-retries probes")
+	flag.BoolVar(&cfg.VerifyBalance, "verify-balance", false, "fill both pools, run crdbpool's connection balancer and, after --balance-warmup, fail the run unless each pool's connections are spread evenly over the healthy nodes")
+	flag.DurationVar(&cfg.BalanceWarmup, "balance-warmup", defaultBalanceWarmup, "how long the balancer gets before --verify-balance checks")
+	flag.Float64Var(&cfg.BalanceTolerance, "balance-tolerance", defaultBalanceTolerance, "allowed deviation of a node's connection count from an even share, relative to it (at least one connection)")
+	flag.BoolVar(&cfg.ShowVersion, "version", false, "print the version, commit, build date and crdbpool/pgx versions, then exit")
+	flag.StringVar(&cfg.Preset, "preset", "", "start from a standard workload: smoke, soak, stress or contention; other flags change its values")
+	flag.String("config", "", "YAML or TOML file of flag values keyed by long flag name; flags on the command line replace the file's")
+
+	if path := scanFlag(args, "config"); path != "" {
+		fileArgs, err := loadConfigFile(flag.CommandLine, path)
+		if err != nil {
+			fatal(exitConfig, "config", "path", path, "err", err)
+		}
+		args = append(withoutOverridden(fileArgs, args), args...)
+		slog.Info("config loaded", "path", path, "flags", len(fileArgs))
+	}
+	if name := scanFlag(args, "preset"); name != "" {
+		p, err := lookupPreset(name)
+		if err != nil {
+			fatal(exitConfig, "preset", "err", err)
+		}
+		args = append(withoutOverridden(p.args, args), args...)
+		slog.Info("preset", "name", name, "summary", p.summary)
 	}
+	if dir := scanFlag(args, "from-bundle"); dir != "" {
+		b, err := readReproBundle(dir)
+		if err != nil {
+			fatal(exitConfig, "from-bundle", "dir", dir, "err", err)
+		}
+		args = append(b.rerunArgs(dir, args), args...)
+		cfg.Seed = b.Seed
+		slog.Info("rerunning bundle", "dir", dir, "run_id", b.RunID, "reason", b.Reason)
+	}
+	_ = flag.CommandLine.Parse(args) // exits on error
+	cfg.Args = args
+	if len(cfg.Clusters) > 0 {
+		cfg.DSN = cfg.Clusters[0].dsn
+	}
+
 	if itersLong > 0 {
 		cfg.Iterations = itersLong
 	} else if itersShort > 0 {
@@ -125,12 +588,113 @@ func parseFlags() Config {
 	if writerConc > 0 {
 		cfg.WriterConc = writerConc
 	}
+	if cfg.HeartbeatOnly {
+		// a single query per pool per interval, until the timeout
+		cfg.ReaderConc, cfg.WriterConc = 1, 1
+		cfg.ReaderSleep, cfg.WriterSleep = cfg.HeartbeatInterval, cfg.HeartbeatInterval
+		if itersLong <= 0 && itersShort <= 0 {
+			cfg.Iterations = math.MaxInt
+		}
+		if timeoutLong <= 0 && timeoutShort <= 0 {
+			cfg.Timeout = defaultHeartbeatTimeout
+		}
+	}
+	if cfg.Soak.Enabled {
+		if itersLong <= 0 && itersShort <= 0 {
+			cfg.Iterations = math.MaxInt
+		}
+		if timeoutLong <= 0 && timeoutShort <= 0 {
+			cfg.Timeout = soakTimeout
+		}
+	}
+	if len(cfg.Steps) > 0 {
+		if itersLong <= 0 && itersShort <= 0 {
+			cfg.Iterations = math.MaxInt
+		}
+		if timeoutLong <= 0 && timeoutShort <= 0 {
+			cfg.Timeout = stepsDuration(cfg.Steps) + stepsSetupSlack
+		}
+	}
+	if cfg.Sine.Rate > 0 {
+		if itersLong <= 0 && itersShort <= 0 {
+			cfg.Iterations = math.MaxInt
+		}
+		if timeoutLong <= 0 && timeoutShort <= 0 {
+			cfg.Timeout = cfg.Sine.Period + stepsSetupSlack
+		}
+	}
+	if len(cfg.Spikes) > 0 && len(cfg.Steps) == 0 && cfg.Sine.Rate == 0 {
+		if itersLong <= 0 && itersShort <= 0 {
+			cfg.Iterations = math.MaxInt
+		}
+		if timeoutLong <= 0 && timeoutShort <= 0 {
+			cfg.Timeout = spikesDuration(cfg.Spikes) + stepsSetupSlack
+		}
+	}
 	return cfg
 }
 
+func validateRetries(attempts int, backoff time.Duration) error {
+	if attempts < 0 || attempts > maxRetryAttempts || backoff <= 0 {
+		return fmt.Errorf("retry-attempts must be 0-254 and retry-backoff > 0 (got %d, %s)", attempts, backoff)
+	}
+	return nil
+}
+
 func validateConfig(cfg *Config) error {
-	if cfg.DSN == "" {
-		return errors.New("DATABASE_URL is required")
+	if cfg.CoordinateAddr != "" {
+		// the workers connect with their own DATABASE_URL
+		if cfg.Workers < 1 {
+			return fmt.Errorf("--coordinate needs --workers >= 1 (got %d)", cfg.Workers)
+		}
+		if len(cfg.Clusters) > 1 || cfg.ResumePath != "" {
+			return errors.New("--coordinate can't be combined with several --dsn or with --resume")
+		}
+		if cfg.ShardCount > 0 {
+			return errors.New("--coordinate shards the run itself and can't be combined with --shard-count")
+		}
+	} else if cfg.DSN == "" && cfg.ReadOnly && cfg.ReaderDSN == "" {
+		return errors.New("DATABASE_URL is required unless --reader-dsn is set")
+	} else if cfg.DSN == "" && !cfg.ReadOnly && (cfg.ReaderDSN == "" || cfg.WriterDSN == "") {
+		return errors.New("DATABASE_URL is required unless both --reader-dsn and --writer-dsn are set")
+	}
+	if err := cfg.applyTLS(); err != nil {
+		return err
+	}
+	if err := cfg.Dial.validate(); err != nil {
+		return err
+	}
+	if err := cfg.Statements.validate(); err != nil {
+		return err
+	}
+	if cfg.ViaProxy && !cfg.Statements.sessionFree() {
+		return errors.New("--via-proxy runs without prepared statements and their caches; --prepare, the --*-cache-capacity flags and the --query-exec-mode that prepare can't be combined with it")
+	}
+	if cfg.ViaProxy && cfg.ReadOnly {
+		return errors.New("--read-only sets a session setting, which --via-proxy's pooler doesn't keep")
+	}
+	if err := cfg.Session.validate(); err != nil {
+		return err
+	}
+	if cfg.ViaProxy && cfg.Session.set() {
+		return errors.New("--statement-timeout and --idle-in-tx-timeout set session settings, which --via-proxy's pooler doesn't keep")
+	}
+	if err := validateReadOnly(*cfg); err != nil {
+		return err
+	}
+	if err := validateMeasure(*cfg); err != nil {
+		return err
+	}
+	if err := validateEphemeralDB(*cfg); err != nil {
+		return err
+	}
+	if cfg.ToxiproxyAddr != "" && (cfg.ReaderDSN != "" || cfg.WriterDSN != "") {
+		return errors.New("--toxiproxy-addr proxies DATABASE_URL only and can't be combined with --reader-dsn or --writer-dsn")
+	}
+	for _, ps := range cfg.Pools {
+		if cfg.ToxiproxyAddr != "" && ps.DSN != "" {
+			return fmt.Errorf("--toxiproxy-addr proxies DATABASE_URL only and can't be combined with pool %s's dsn", ps.Name)
+		}
 	}
 	if cfg.Iterations <= 0 {
 		return fmt.Errorf("iterations must be > 0 (got %d)", cfg.Iterations)
@@ -138,24 +702,263 @@ func validateConfig(cfg *Config) error {
 	if cfg.Timeout <= 0 {
 		return fmt.Errorf("timeout must be > 0 (got %s)", cfg.Timeout)
 	}
+	if err := validateRetries(cfg.RetryAttempts, cfg.RetryBackoff); err != nil {
+		return err
+	}
+	if cfg.QueryTimeout < 0 {
+		return fmt.Errorf("query-timeout must be >= 0 (got %s)", cfg.QueryTimeout)
+	}
+	if cfg.Warmup < 0 || cfg.Warmup >= cfg.Timeout {
+		return fmt.Errorf("warmup must be >= 0 and shorter than the timeout (got %s, timeout %s)", cfg.Warmup, cfg.Timeout)
+	}
 	if cfg.ReaderMax <= 0 {
 		return fmt.Errorf("reader-max-conns must be > 0 (got %d)", cfg.ReaderMax)
 	}
 	if cfg.ReaderConc <= 0 || cfg.WriterConc <= 0 {
 		return fmt.Errorf("concurrency must be > 0 (reader=%d writer=%d)", cfg.ReaderConc, cfg.WriterConc)
 	}
+	if cfg.HeartbeatOnly && cfg.HeartbeatInterval <= 0 {
+		return fmt.Errorf("heartbeat-interval must be > 0 (got %s)", cfg.HeartbeatInterval)
+	}
+	if err := cfg.Breaker.validate(); err != nil {
+		return err
+	}
+	if err := validateRetryStrategy(cfg.RetryStrategy); err != nil {
+		return err
+	}
+	if cfg.RetryStrategy != defaultRetryStrategy && !cfg.Middleware {
+		return errors.New("--retry-strategy sets the middleware's backoff and requires --middleware")
+	}
+	if cfg.MiddlewareTimeout < 0 || cfg.MiddlewareRetries < 0 {
+		return fmt.Errorf("middleware-timeout and middleware-retries must be >= 0 (got %s, %d)", cfg.MiddlewareTimeout, cfg.MiddlewareRetries)
+	}
+	if cfg.StallTimeout < 0 {
+		return fmt.Errorf("stall-timeout must be >= 0 (got %s)", cfg.StallTimeout)
+	}
+	if cfg.StallAbort && cfg.StallTimeout == 0 {
+		return errors.New("stall-abort requires stall-timeout")
+	}
+	if err := cfg.Soak.validate(); err != nil {
+		return err
+	}
+	if err := cfg.Sine.validate(); err != nil {
+		return err
+	}
+	if err := validateSpikes(cfg.Spikes); err != nil {
+		return err
+	}
+	switch {
+	case len(cfg.Steps) > 0 && cfg.Sine.Rate > 0:
+		return errors.New("--steps and --sine both set the workloads' rate; use one")
+	case (len(cfg.Steps) > 0 || cfg.Sine.Rate > 0) && cfg.HeartbeatOnly:
+		return errors.New("--steps and --sine set the workloads' rate; they can't be combined with --heartbeat-only")
+	}
+	if cfg.Drain < 0 {
+		return fmt.Errorf("drain must be >= 0 (got %s)", cfg.Drain)
+	}
+	if cfg.ShutdownGrace < 0 {
+		return fmt.Errorf("shutdown-grace must be >= 0 (got %s)", cfg.ShutdownGrace)
+	}
+	if cfg.ReproBundle != "" && cfg.ReproWindow <= 0 {
+		return fmt.Errorf("repro-window must be > 0 (got %s)", cfg.ReproWindow)
+	}
+	if cfg.OutlierThreshold < 0 {
+		return fmt.Errorf("outlier-threshold must be >= 0 (got %s)", cfg.OutlierThreshold)
+	}
+	if (cfg.OutlierThreshold > 0) != (cfg.OutliersOut != "") {
+		return errors.New("outlier-threshold and outliers-out must be set together")
+	}
+	if cfg.RedactArgs != "" && cfg.RedactArgs != "hash" && cfg.RedactArgs != "elide" {
+		return fmt.Errorf("redact-args must be hash or elide (got %q)", cfg.RedactArgs)
+	}
+	if cfg.TraceSlowThreshold < 0 {
+		return fmt.Errorf("trace-slow-threshold must be >= 0 (got %s)", cfg.TraceSlowThreshold)
+	}
+	if cfg.AssertRetries < 0 || cfg.AssertRetries > 0 && cfg.AssertRetriesEvery <= 0 {
+		return fmt.Errorf("assert-retries must be >= 0 and assert-retries-every > 0 (got %d, %s)", cfg.AssertRetries, cfg.AssertRetriesEvery)
+	}
+	seen := map[string]bool{}
+	for _, ps := range cfg.Pools {
+		if seen[ps.Name] {
+			return fmt.Errorf("pool %s declared twice", ps.Name)
+		}
+		seen[ps.Name] = true
+	}
+	if !slices.Contains(poolImpls, cfg.PoolImpl) {
+		return fmt.Errorf("unknown pool-impl %q (want one of %s)", cfg.PoolImpl, strings.Join(poolImpls, ", "))
+	}
+	if cfg.PoolImpl != poolImplCrdbpool && cfg.AssertRetries > 0 {
+		return fmt.Errorf("--assert-retries checks the RetryPool's retries, which --pool-impl %s doesn't have", cfg.PoolImpl)
+	}
+	if cfg.VerifyBalance && (cfg.BalanceWarmup <= 0 || cfg.BalanceTolerance < 0) {
+		return fmt.Errorf("balance-warmup must be > 0 and balance-tolerance >= 0 (got %s, %g)", cfg.BalanceWarmup, cfg.BalanceTolerance)
+	}
+	if cfg.Keys <= 0 {
+		return fmt.Errorf("keys must be > 0 (got %d)", cfg.Keys)
+	}
+	if cfg.ShardCount < 0 || (cfg.ShardCount > 0 && (cfg.ShardIndex < 0 || cfg.ShardIndex >= cfg.ShardCount)) {
+		return fmt.Errorf("shard-index must be in [0, shard-count) (got %d of %d)", cfg.ShardIndex, cfg.ShardCount)
+	}
+	if !slices.Contains(workloadNames, cfg.Workload) {
+		return fmt.Errorf("unknown workload %q (want one of %s)", cfg.Workload, strings.Join(workloadNames, ", "))
+	}
+	if cfg.VerifyAmbiguous && slices.Contains(writerWorkloads, cfg.Workload) {
+		return fmt.Errorf("--verify-ambiguous replaces the writer query, as --workload %s does", cfg.Workload)
+	}
+	if cfg.DetectDuplicates && slices.Contains(writerWorkloads, cfg.Workload) {
+		return fmt.Errorf("--detect-duplicates replaces the writer query, as --workload %s does", cfg.Workload)
+	}
+	if cfg.Ledger != "" && cfg.VerifyAmbiguous {
+		return errors.New("--ledger and --verify-ambiguous both replace the writer query")
+	}
+	if cfg.Ledger != "" && slices.Contains(writerWorkloads, cfg.Workload) {
+		return fmt.Errorf("--ledger replaces the writer query, as --workload %s does", cfg.Workload)
+	}
+	if cfg.Workload == workloadVisibility && (cfg.VisibilityTimeout <= 0 || cfg.VisibilityPoll <= 0) {
+		return fmt.Errorf("visibility-timeout and visibility-poll must be > 0 (got %s, %s)", cfg.VisibilityTimeout, cfg.VisibilityPoll)
+	}
+	sloWorkloads := []string{"reader", "writer"}
+	if cfg.ReadOnly {
+		sloWorkloads = sloWorkloads[:1]
+	}
+	for _, ps := range cfg.Pools {
+		sloWorkloads = append(sloWorkloads, ps.Name)
+	}
+	if err := validateSLO(cfg.SLO, sloWorkloads); err != nil {
+		return err
+	}
+	if cfg.PushgatewayURL != "" {
+		if err := validatePushgatewayURL(cfg.PushgatewayURL); err != nil {
+			return err
+		}
+	}
+	if err := validateNotify(*cfg); err != nil {
+		return err
+	}
+	if cfg.Pprof && cfg.AdminAddr == "" {
+		return errors.New("--pprof is served on the control API and needs --admin-addr")
+	}
+	if cfg.StatsdAddr != "" && cfg.StatsdInterval <= 0 {
+		return fmt.Errorf("statsd-interval must be > 0 (got %s)", cfg.StatsdInterval)
+	}
+	if cfg.PushgatewayInterval < 0 {
+		return fmt.Errorf("pushgateway-interval must be >= 0 (got %s)", cfg.PushgatewayInterval)
+	}
+	for _, name := range cfg.VisibilityPools {
+		if !seen[name] {
+			return fmt.Errorf("visibility-pools: no --pool named %q", name)
+		}
+	}
+	if cfg.Workload == workloadBank && !cfg.Table.RunSuffix && (cfg.ShardCount > 0 || cfg.CoordinateAddr != "") {
+		// every shard would open the same accounts and check the table's total
+		return errors.New("--workload bank can't share its table between shards: drop --table-run-suffix=false")
+	}
+	shards := cfg.ShardCount
+	if cfg.CoordinateAddr != "" {
+		shards = cfg.Workers
+	}
+	if keyed := cfg.Workload == workloadRYW || cfg.Workload == workloadVisibility || cfg.Workload == workloadLostUpdate; keyed && !cfg.Table.RunSuffix && shards > cfg.Keys {
+		// the shards past the keys share the last one, and each would see the
+		// others' writes to it as its own anomalies
+		return fmt.Errorf("--workload %s can't share its table between more shards than keys: raise --keys to %d or drop --table-run-suffix=false", cfg.Workload, shards)
+	}
+	if cfg.Workload == workloadBank && (cfg.BankAccounts < 2 || cfg.BankBalance <= 0 || cfg.BankCheckEvery <= 0) {
+		return fmt.Errorf("bank-accounts must be >= 2, bank-balance and bank-check-every > 0 (got %d, %d, %s)", cfg.BankAccounts, cfg.BankBalance, cfg.BankCheckEvery)
+	}
+	if cfg.Isolation != "" {
+		if err := validateIsolation(cfg.Isolation); err != nil {
+			return err
+		}
+		tx := cfg.Workload == workloadBank
+		for _, ps := range cfg.Pools {
+			tx = tx || ps.Mode == poolModeTx
+		}
+		if !tx {
+			return errors.New("isolation needs a transaction workload: --workload bank or a --pool with mode=tx")
+		}
+	}
+	if cfg.Workload == workloadExhaustion {
+		if cfg.ExhaustFactor <= 1 || cfg.ExhaustHold <= 0 || cfg.ExhaustAcquireTimeout <= 0 {
+			return fmt.Errorf("exhaust-factor must be > 1, exhaust-hold and exhaust-acquire-timeout > 0 (got %g, %s, %s)", cfg.ExhaustFactor, cfg.ExhaustHold, cfg.ExhaustAcquireTimeout)
+		}
+		if cfg.SlowQuery != nil {
+			return errors.New("--workload exhaustion and --slow-query both replace the reader query")
+		}
+	}
+	if cfg.ChurnEvery <= 0 {
+		return fmt.Errorf("churn-every must be > 0 (got %d)", cfg.ChurnEvery)
+	}
+	if cfg.HealthLogInterval < 0 {
+		return fmt.Errorf("health-log-interval must be >= 0 (got %s)", cfg.HealthLogInterval)
+	}
+	if cfg.AcquireThreshold < 0 {
+		return fmt.Errorf("acquire-threshold must be >= 0 (got %s)", cfg.AcquireThreshold)
+	}
+	if cfg.MinConns < 0 || cfg.MinConnsTimeout <= 0 {
+		return fmt.Errorf("min-conns must be >= 0 and min-conns-timeout > 0 (got %d, %s)", cfg.MinConns, cfg.MinConnsTimeout)
+	}
+	if cfg.MaxConnLifetime < 0 || cfg.MaxConnIdleTime < 0 || cfg.HealthCheckPeriod < 0 {
+		return errors.New("max-conn-lifetime, max-conn-idle-time and health-check-period must be >= 0")
+	}
+	if err := validateTableName(cfg.Table); err != nil {
+		return err
+	}
+	if err := validateRowTTL(cfg.Table); err != nil {
+		return err
+	}
+	if checked := cfg.Workload == workloadLostUpdate || cfg.Workload == workloadBank || cfg.VerifyAmbiguous || cfg.DetectDuplicates || cfg.Ledger != ""; checked && cfg.Table.RowTTL > 0 && cfg.Table.RowTTL <= cfg.Timeout {
+		return fmt.Errorf("--row-ttl %s would expire rows before the end-of-run checks read them; set it above the %s timeout", cfg.Table.RowTTL, cfg.Timeout)
+	}
+	if cfg.CleanupOlderThan < 0 {
+		return fmt.Errorf("cleanup-older-than must be >= 0 (got %s)", cfg.CleanupOlderThan)
+	}
+	if cfg.Table.HashBuckets < 0 {
+		return fmt.Errorf("table-hash-buckets must be >= 0 (got %d)", cfg.Table.HashBuckets)
+	}
+	if err := validateLocality(cfg.Table.Locality); err != nil {
+		return err
+	}
+	if cfg.CheckpointInterval <= 0 {
+		return fmt.Errorf("checkpoint-interval must be > 0 (got %s)", cfg.CheckpointInterval)
+	}
+	if n := btoi(cfg.CredentialsFile != "") + btoi(cfg.DSNFile != "") + btoi(cfg.VaultPath != ""); n > 1 {
+		return errors.New("--credentials-file, --dsn-file and --vault-path are alternatives; set one")
+	}
+	if cfg.credentialSource() != nil && cfg.CredentialsPoll <= 0 {
+		return fmt.Errorf("credentials-poll must be > 0 (got %s)", cfg.CredentialsPoll)
+	}
+	if len(cfg.Toxics) > 0 && cfg.ToxiproxyAddr == "" {
+		return errors.New("--toxic requires --toxiproxy-addr")
+	}
 	return nil
 }
 
-func mustParsePoolConfig(dsn string) *pgxpool.Config {
+func mustParsePoolConfig(dsn string, tracer pgx.QueryTracer) *pgxpool.Config {
 	cfg, err := pgxpool.ParseConfig(dsn)
 	if err != nil {
-		log.Fatalf("parse config: %v", err)
+		fatal(exitConfig, "parse config", "err", err)
 	}
-	cfg.ConnConfig.Tracer = simpleTracer{}
+	cfg.ConnConfig.Tracer = tracer
 	return cfg
 }
 
+// applyConnLifetimes overrides the pool's size and lifetime settings that
+// were set by flag.
+func (cfg Config) applyConnLifetimes(c *pgxpool.Config) {
+	if cfg.MinConns > 0 {
+		c.MinConns = min(int32(cfg.MinConns), c.MaxConns)
+	}
+	if cfg.MaxConnLifetime > 0 {
+		c.MaxConnLifetime = cfg.MaxConnLifetime
+	}
+	if cfg.MaxConnIdleTime > 0 {
+		c.MaxConnIdleTime = cfg.MaxConnIdleTime
+	}
+	if cfg.HealthCheckPeriod > 0 {
+		c.HealthCheckPeriod = cfg.HealthCheckPeriod
+	}
+}
+
 func deriveWriterMax(readerMax int, writerMax int) int32 {
 	if writerMax > 0 {
 		return int32(writerMax)
@@ -181,18 +984,163 @@ func redactedDSNInfo(dsn string) string {
 	return fmt.Sprintf("host=%s db=%s user=%s", host, db, user)
 }
 
-func run(ctx context.Context, cfg Config) error {
-	log.Printf("config: iterations=%d timeout=%s reader-max-conns=%d writer-max-conns=%d reader-sleep=%s writer-sleep=%s reader-conc=%d writer-conc=%d dsn(%s)",
-		cfg.Iterations, cfg.Timeout, cfg.ReaderMax, func() int {
-			if cfg.WriterMax > 0 {
-				return cfg.WriterMax
-			}
-			return (cfg.ReaderMax + 2) / 3
-		}(), cfg.ReaderSleep, cfg.WriterSleep, cfg.ReaderConc, cfg.WriterConc, redactedDSNInfo(cfg.DSN))
+func run(ctx context.Context, cfg Config) (err error) {
+	var ring *logRing
+	if cfg.ReproBundle != "" {
+		ring = newLogRing(cfg.ReproWindow)
+		logger, err := newLogger(cfg.LogFormat, cfg.LogLevel, io.MultiWriter(logOutput(), ring))
+		if err != nil {
+			return err
+		}
+		prev := slog.Default()
+		slog.SetDefault(logger)
+		defer slog.SetDefault(prev)
+	}
+	if cfg.ShardCount > 0 {
+		applyShard(&cfg, cfg.ShardIndex, cfg.ShardCount)
+		slog.Info("shard", "index", cfg.ShardIndex, "count", cfg.ShardCount, "keys", fmt.Sprintf("%d-%d", cfg.keyBase, cfg.keyBase+cfg.Keys-1))
+	}
+	if cfg.Seed == 0 {
+		cfg.Seed = rand.Uint64()
+	}
+	slog.Info("config", "iterations", cfg.Iterations, "timeout", cfg.Timeout, "reader_max_conns", cfg.ReaderMax,
+		"writer_max_conns", deriveWriterMax(cfg.ReaderMax, cfg.WriterMax), "reader_sleep", cfg.ReaderSleep, "writer_sleep", cfg.WriterSleep,
+		"reader_conc", cfg.ReaderConc, "writer_conc", cfg.WriterConc, "dsn", redactedDSNInfo(cfg.DSN))
+	if cfg.ReaderDSN != "" || cfg.WriterDSN != "" {
+		slog.Info("pool endpoints", "reader", redactedDSNInfo(cmp.Or(cfg.ReaderDSN, cfg.DSN)), "writer", redactedDSNInfo(cmp.Or(cfg.WriterDSN, cfg.DSN)))
+	}
 
-	baseCfg := mustParsePoolConfig(cfg.DSN)
+	res := runResult{
+		RunID:      cmp.Or(cfg.runID, newRunID()),
+		StartedAt:  time.Now(),
+		Build:      currentBuild(),
+		Components: defaultComponentVersions(cfg.Components),
+		Settings:   newResultSettings(cfg),
+		Workloads:  map[string]opSummary{},
+		Warmup:     map[string]opSummary{},
+		Retries:    map[string]retrySummary{},
+		Middleware: map[string]opSummary{},
+		Connect:    map[string]connectSummary{},
+		Statements: map[string]statementSummary{},
+		Acquire:    map[string]acquireSummary{},
+		Ambiguous:  map[string]ambiguousSummary{},
+		ByNode:     map[string]map[string]opSummary{},
+	}
+	if _, ok := res.Components["pool-impl"]; !ok {
+		// so report --component pool-impl compares runs of the two
+		res.Components["pool-impl"] = cfg.PoolImpl
+	}
+	if cfg.NotifyURL != "" {
+		// registered first so it runs last, after the end-of-run summary,
+		// and also for runs that abort before their workloads start
+		defer func() { notifyRunEnd(cfg, res, err) }()
+	}
+	var resumed *checkpoint
+	if cfg.ResumePath != "" {
+		if resumed, err = readCheckpoint(cfg.ResumePath); err != nil {
+			return fmt.Errorf("read checkpoint: %w", err)
+		}
+		if resumed.Elapsed >= cfg.Timeout {
+			return fmt.Errorf("checkpoint %s already used %s of the %s timeout", cfg.ResumePath, resumed.Elapsed, cfg.Timeout)
+		}
+		res.RunID, res.StartedAt = resumed.RunID, resumed.StartedAt
+		if cfg.CheckpointPath == "" {
+			cfg.CheckpointPath = cfg.ResumePath
+		}
+	}
+	slog.Info("run", "run_id", res.RunID, "seed", cfg.Seed, "version", res.Build.Version, "commit", res.Build.Commit, "components", res.Components)
+	tl := newTimeline(res.StartedAt)
+	defer tl.logSummary()
+	if resumed != nil {
+		tl.restore(resumed.Timeline)
+		tl.record("resume", "from %s saved at %s after %s", cfg.ResumePath, resumed.SavedAt.Format(time.RFC3339), resumed.Elapsed.Truncate(time.Second))
+	}
+
+	// the health checker polls DATABASE_URL, or the writer's endpoint when
+	// both pools have their own (the reader's when there is no writer)
+	dsn := cmp.Or(cfg.DSN, cfg.WriterDSN, cfg.ReaderDSN)
+	var edb *ephemeralDB
+	if cfg.EphemeralDB {
+		// created before, and so dropped after, the pools
+		edb, err = createEphemeralDB(ctx, dsn, res.RunID)
+		if err != nil {
+			return err
+		}
+		defer edb.drop()
+		res.Settings.Database = edb.name
+		tl.record("ephemeral-db", "created database %s", edb.name)
+	}
+	var toxi *toxiproxyClient
+	if cfg.ToxiproxyAddr != "" {
+		toxi = newToxiproxyClient(cfg.ToxiproxyAddr, cfg.ToxiproxyProxy)
+		proxied, err := toxi.setup(ctx, dsn, cfg.ToxiproxyListen)
+		if err != nil {
+			return fmt.Errorf("toxiproxy setup: %w", err)
+		}
+		defer toxi.teardown(tl)
+		dsn = proxied
+		tl.record("toxiproxy", "proxy %s listening on %s (%d toxics scheduled)", cfg.ToxiproxyProxy, cfg.ToxiproxyListen, len(cfg.Toxics))
+	}
 
-	ht, err := crdbpool.NewNodeHealthChecker(cfg.DSN)
+	var scenario []scenarioEvent
+	if cfg.ScenarioPath != "" {
+		scenario, err = loadScenario(cfg.ScenarioPath)
+		if err != nil {
+			return fmt.Errorf("load scenario: %w", err)
+		}
+		slog.Info("scenario loaded", "path", cfg.ScenarioPath, "events", len(scenario))
+	}
+	if len(cfg.ScenarioEvents) > 0 {
+		scenario = append(scenario, cfg.ScenarioEvents...)
+		sort.SliceStable(scenario, func(i, j int) bool { return scenario[i].At < scenario[j].At })
+	}
+
+	redact, err := newArgRedactor(cfg.RedactArgs)
+	if err != nil {
+		return err
+	}
+	tracer := newSimpleTracer(cfg.TraceSlowThreshold, redact)
+	var qt pgx.QueryTracer = tracer
+	if cfg.Measure {
+		qt = nil
+	} else {
+		defer tracer.logSummary()
+	}
+	baseCfg := mustParsePoolConfig(dsn, qt)
+	if edb != nil {
+		edb.use(baseCfg)
+	}
+	cfg.Dial.apply(baseCfg)
+	var proxyDropped []string
+	if cfg.ViaProxy {
+		proxyDropped = applyViaProxy(baseCfg)
+		slog.Info("via proxy: no prepared statements or session settings", "exec_mode", baseCfg.ConnConfig.DefaultQueryExecMode, "dropped_session_params", proxyDropped)
+	}
+	cfg.Statements.apply(baseCfg)
+	var prep *statementPreparer
+	if cfg.Statements.Prepare {
+		prep = newStatementPreparer()
+		prep.attach(baseCfg)
+	}
+	execMode := queryExecModeName(baseCfg.ConnConfig.DefaultQueryExecMode)
+	if _, ok := res.Components["query-exec-mode"]; !ok {
+		// so report --component query-exec-mode compares runs of each
+		res.Components["query-exec-mode"] = execMode
+	}
+	if cfg.Statements.set() {
+		slog.Info("statements", "settings", cfg.Statements.String(), "exec_mode", execMode,
+			"statement_cache", baseCfg.ConnConfig.StatementCacheCapacity, "description_cache", baseCfg.ConnConfig.DescriptionCacheCapacity)
+	}
+	if cfg.ReadOnly {
+		applyReadOnly(baseCfg)
+		slog.Info("read-only: no writer pool", "session", readOnlySessionParam+"=on")
+	}
+	if cfg.Session.set() {
+		cfg.Session.apply(baseCfg)
+		slog.Info("session timeouts", "settings", cfg.Session.String())
+	}
+
+	ht, err := crdbpool.NewNodeHealthChecker(dsn)
 	if err != nil {
 		return fmt.Errorf("create health tracker: %w", err)
 	}
@@ -200,124 +1148,973 @@ func run(ctx context.Context, cfg Config) error {
 	defer cancelPoll()
 	go ht.Poll(ctxPoll, healthPollInterval)
 
-	readerCfg := *baseCfg
+	var rot *credentialRotator
+	if src := cfg.credentialSource(); src != nil {
+		rot, err = newCredentialRotator(ctx, src, baseCfg.ConnConfig.User, cfg.TLS, tl)
+		if err != nil {
+			return fmt.Errorf("credentials: %w", err)
+		}
+		if edb != nil {
+			rot.database = edb.name
+		}
+		rot.attach(baseCfg)
+		defer rot.logSummary()
+		if cfg.CredentialsFile != "" {
+			go rot.watch(ctxPoll, cfg.CredentialsPoll)
+			slog.Info("watching for credential rotation", "path", cfg.CredentialsFile, "poll", cfg.CredentialsPoll)
+		} else {
+			rot.refreshOnConnect = cfg.CredentialsPoll
+			slog.Info("re-reading credentials on connect", "source", src.String(), "max_age", cfg.CredentialsPoll)
+		}
+	}
+	// poolConfig returns the settings of a pool's own endpoint, or the base
+	// ones when it has none
+	poolConfig := func(poolDSN string) *pgxpool.Config {
+		if poolDSN == "" {
+			return baseCfg
+		}
+		c := mustParsePoolConfig(poolDSN, qt)
+		if rot != nil {
+			rot.attach(c)
+		}
+		if cfg.ReadOnly {
+			applyReadOnly(c)
+		}
+		cfg.Session.apply(c)
+		if edb != nil {
+			edb.use(c)
+		}
+		cfg.Dial.apply(c)
+		if cfg.ViaProxy {
+			proxyDropped = append(proxyDropped, applyViaProxy(c)...)
+		}
+		cfg.Statements.apply(c)
+		if prep != nil {
+			prep.attach(c)
+		}
+		return c
+	}
+
+	obs := poolObservers{peaks: newPeakTracker(), acquireThreshold: cfg.AcquireThreshold}
+	defer obs.peaks.logSummary()
+	if cfg.OutliersOut != "" {
+		obs.outliers, err = openOutlierLog(cfg.OutliersOut, cfg.OutlierThreshold)
+		if err != nil {
+			return err
+		}
+		defer obs.outliers.Close()
+	}
+	if cfg.UpgradeDrill {
+		obs.upgrade = newUpgradeDrill(tl)
+	}
+	if cfg.LeakCheck {
+		obs.leaks = newLeakTracker()
+	}
+	if cfg.StatsdAddr != "" {
+		obs.statsd, err = newStatsdEmitter(cfg.StatsdAddr, cfg.StatsdPrefix, cfg.StatsdTags, res)
+		if err != nil {
+			return withExit(exitConfig, err)
+		}
+	}
+	if cfg.Workload == workloadConnChurn {
+		obs.churn = newConnChurn(cfg.ChurnEvery)
+		slog.Info("conn-churn workload", "churn_every", cfg.ChurnEvery)
+	}
+	poolsCreated := time.Now()
+	readerBase := poolConfig(cfg.ReaderDSN)
+	readerCfg := *readerBase
 	readerCfg.MaxConns = int32(cfg.ReaderMax)
-	readerCfg.ConnConfig.Tracer = baseCfg.ConnConfig.Tracer
-	readerPool, err := crdbpool.NewRetryPool(ctx, "reader", &readerCfg, ht, retryAttempts, retryBackoff)
+	readerCfg.ConnConfig.Tracer = readerBase.ConnConfig.Tracer
+	cfg.applyConnLifetimes(&readerCfg)
+	if cfg.VerifyBalance {
+		// a full pool, so there is something to balance at any load
+		readerCfg.MinConns = readerCfg.MaxConns
+	}
+	readerPool, err := newTesterPool(ctx, "reader", cfg.PoolImpl, &readerCfg, ht, obs, uint8(cfg.RetryAttempts), cfg.RetryBackoff)
 	if err != nil {
 		return fmt.Errorf("create reader pool: %w", err)
 	}
 	defer readerPool.Close()
 
-	writerCfg := *baseCfg
-	writerCfg.MaxConns = deriveWriterMax(cfg.ReaderMax, cfg.WriterMax)
-	writerCfg.ConnConfig.Tracer = baseCfg.ConnConfig.Tracer
-	writerPool, err := crdbpool.NewRetryPool(ctx, "writer", &writerCfg, ht, retryAttempts, retryBackoff)
+	pools := map[string]*testerPool{"reader": readerPool}
+	var writerPool *testerPool
+	if !cfg.ReadOnly {
+		writerBase := poolConfig(cfg.WriterDSN)
+		writerCfg := *writerBase
+		writerCfg.MaxConns = deriveWriterMax(cfg.ReaderMax, cfg.WriterMax)
+		writerCfg.ConnConfig.Tracer = writerBase.ConnConfig.Tracer
+		cfg.applyConnLifetimes(&writerCfg)
+		if cfg.VerifyBalance {
+			writerCfg.MinConns = writerCfg.MaxConns
+		}
+		writerPool, err = newTesterPool(ctx, "writer", cfg.PoolImpl, &writerCfg, ht, obs, uint8(cfg.RetryAttempts), cfg.RetryBackoff)
+		if err != nil {
+			return fmt.Errorf("create writer pool: %w", err)
+		}
+		defer writerPool.Close()
+		pools["writer"] = writerPool
+	}
+	for _, ps := range cfg.Pools {
+		base := poolConfig(ps.DSN)
+		pcfg := *base
+		pcfg.MaxConns = ps.MaxConns
+		pcfg.ConnConfig.Tracer = base.ConnConfig.Tracer
+		cfg.applyConnLifetimes(&pcfg)
+		if cfg.VerifyBalance {
+			pcfg.MinConns = pcfg.MaxConns
+		}
+		p, err := newTesterPool(ctx, ps.Name, cfg.PoolImpl, &pcfg, ht, obs, uint8(cfg.RetryAttempts), cfg.RetryBackoff)
+		if err != nil {
+			return fmt.Errorf("create %s pool: %w", ps.Name, err)
+		}
+		defer p.Close()
+		pools[ps.Name] = p
+		slog.Info("named pool", "pool", ps.Name, "max_conns", ps.MaxConns, "conc", ps.Conc, "mode", ps.Mode, "sql", ps.SQL)
+	}
+	if cfg.PoolImpl != poolImplCrdbpool {
+		slog.Info("pool implementation", "pool_impl", cfg.PoolImpl, "retries", false, "balancing", false)
+	}
+	if obs.statsd != nil {
+		ctxStatsd, stopStatsd := context.WithCancel(ctx)
+		go obs.statsd.watch(ctxStatsd, pools, cfg.StatsdInterval)
+		defer func() { stopStatsd(); obs.statsd.Close(pools) }()
+		slog.Info("emitting DogStatsD metrics", "addr", cfg.StatsdAddr, "prefix", cfg.StatsdPrefix, "interval", cfg.StatsdInterval)
+	}
+
+	var mir *mirror
+	if cfg.MirrorDSN != "" {
+		mirrorHT, err := crdbpool.NewNodeHealthChecker(cfg.MirrorDSN)
+		if err != nil {
+			return fmt.Errorf("create mirror health tracker: %w", err)
+		}
+		go mirrorHT.Poll(ctxPoll, healthPollInterval)
+		mirrorCfg := mustParsePoolConfig(cfg.MirrorDSN, qt)
+		mirrorCfg.MaxConns = int32(cfg.ReaderMax)
+		cfg.Dial.apply(mirrorCfg)
+		if cfg.ReadOnly {
+			applyReadOnly(mirrorCfg)
+		}
+		cfg.Session.apply(mirrorCfg)
+		mirrorPool, err := crdbpool.NewRetryPool(ctx, "mirror", mirrorCfg, mirrorHT, uint8(cfg.RetryAttempts), cfg.RetryBackoff)
+		if err != nil {
+			return fmt.Errorf("create mirror pool: %w", err)
+		}
+		defer mirrorPool.Close()
+		mir = newMirror(mirrorPool, cfg.MirrorTolerance)
+		defer mir.logSummary()
+		slog.Info("mirroring reader queries", "dsn", redactedDSNInfo(cfg.MirrorDSN))
+	}
+
+	var readerDB, writerDB querier = readerPool, nil
+	if writerPool != nil {
+		writerDB = writerPool
+	}
+	poolDBs := map[string]querier{}
+	for _, ps := range cfg.Pools {
+		poolDBs[ps.Name] = pools[ps.Name]
+	}
+	var breakers []*breaker
+	if cfg.Breaker.Enabled {
+		rb := newBreaker(readerDB, "reader", cfg.Breaker, tl)
+		readerDB, breakers = rb, []*breaker{rb}
+		if writerPool != nil {
+			wb := newBreaker(writerDB, "writer", cfg.Breaker, tl)
+			writerDB, breakers = wb, append(breakers, wb)
+		}
+		for _, ps := range cfg.Pools {
+			b := newBreaker(poolDBs[ps.Name], ps.Name, cfg.Breaker, tl)
+			poolDBs[ps.Name] = b
+			breakers = append(breakers, b)
+		}
+		slog.Info("circuit breakers enabled", "settings", cfg.Breaker.String())
+	}
+	var middlewares []*middleware
+	if cfg.Middleware {
+		res.RetryStrategy = map[string]backoffSummary{}
+		rm := newMiddleware(readerDB, "reader", cfg.MiddlewareTimeout, cfg.MiddlewareRetries, newBackoff(cfg.RetryStrategy, cfg.Seed, "reader"))
+		readerDB, middlewares = rm, []*middleware{rm}
+		if writerPool != nil {
+			wm := newMiddleware(writerDB, "writer", cfg.MiddlewareTimeout, cfg.MiddlewareRetries, newBackoff(cfg.RetryStrategy, cfg.Seed, "writer"))
+			writerDB, middlewares = wm, append(middlewares, wm)
+		}
+		for _, ps := range cfg.Pools {
+			m := newMiddleware(poolDBs[ps.Name], ps.Name, cfg.MiddlewareTimeout, cfg.MiddlewareRetries, newBackoff(cfg.RetryStrategy, cfg.Seed, ps.Name))
+			poolDBs[ps.Name] = m
+			middlewares = append(middlewares, m)
+		}
+		slog.Info("middleware enabled", "timeout", cfg.MiddlewareTimeout, "retries", cfg.MiddlewareRetries, "retry_strategy", cfg.RetryStrategy)
+	}
+	gates := map[string]*pauseGate{"reader": {}}
+	if writerPool != nil {
+		gates["writer"] = &pauseGate{}
+	}
+	for _, ps := range cfg.Pools {
+		gates[ps.Name] = &pauseGate{}
+	}
+	windows := newWindowTracker()
+	health := newHealthWatch(ht, pools, cfg.HealthLogInterval, tl)
+	go health.run(ctxPoll)
+	var admin *adminServer
+	if cfg.AdminAddr != "" {
+		admin = newAdminServer(cfg.AdminAddr)
+		admin.registerFailpoints(pools)
+		admin.registerWorkloads(gates, pools, tl)
+		admin.registerReload(ctx, pools, tl)
+		admin.registerWindows(windows, tl)
+		admin.registerHealth(health)
+		if cfg.Pprof {
+			admin.registerPprof()
+		}
+		if err := admin.start(); err != nil {
+			return fmt.Errorf("start admin API: %w", err)
+		}
+		defer admin.stop()
+	}
+
+	res.PoolWarmup, err = warmPools(ctx, pools, poolsCreated, cfg.MinConnsTimeout)
 	if err != nil {
-		return fmt.Errorf("create writer pool: %w", err)
+		return err
+	}
+	var pg *pushgateway
+	if cfg.PushgatewayURL != "" {
+		pg = newPushgateway(cfg, res)
+	}
+	var manifest *runManifest
+	if cfg.ResultsOut != "" {
+		manifest = newRunManifest(cfg, res)
+		probed := readerPool
+		if writerPool != nil {
+			probed = writerPool
+		}
+		manifest.probe(ctx, probed)
 	}
-	defer writerPool.Close()
 
-	ctxRun, cancelRun := context.WithTimeout(ctx, cfg.Timeout)
+	timeout := cfg.Timeout
+	if resumed != nil {
+		timeout -= resumed.Elapsed
+	}
+	ctxRun, cancelRun := context.WithTimeout(ctx, timeout+cfg.Drain)
 	defer cancelRun()
-	log.Printf("starting concurrent workload with %d iterations and %s timeout", cfg.Iterations, cfg.Timeout)
-
-	g, gctx := errgroup.WithContext(ctxRun)
-
-	g.Go(func() error { // reader
-		log.Printf("[reader] goroutine started")
-		for i := 0; i < cfg.Iterations; i++ {
-			select {
-			case <-gctx.Done():
-				log.Printf("[reader] context done: %v", gctx.Err())
-				return gctx.Err()
-			default:
-			}
-			// run cfg.ReaderConc concurrent SELECT now()
-			grp, qctx := errgroup.WithContext(gctx)
-			for j := 0; j < cfg.ReaderConc; j++ {
-				grp.Go(func() error {
-					err := readerPool.QueryRowFunc(qctx, func(ctx context.Context, row pgx.Row) error {
-						var now time.Time
-						if err := row.Scan(&now); err != nil {
-							return err
-						}
-						log.Printf("[reader] ping %d DB time: %s", i+1, now.UTC().Format(time.RFC3339Nano))
-						return nil
-					}, sqlNow)
-					if err != nil {
-						log.Printf("[reader] query error: %v", err)
+	slog.Info("starting concurrent workload", "iterations", cfg.Iterations, "timeout", timeout, "drain", cfg.Drain)
+
+	// ctxWork stops the workloads from starting new iterations; queries in
+	// flight run under ctxRun so a shutdown signal or --drain can let them
+	// finish.
+	ctxWork, stopWork := context.WithTimeout(ctxRun, timeout)
+	defer stopWork()
+	sd := watchShutdownSignals(ctxRun, stopWork, cancelRun, cfg.ShutdownGrace, tl)
+
+	g, gctx := errgroup.WithContext(ctxWork)
+
+	if toxi != nil && len(cfg.Toxics) > 0 {
+		toxicsDone := make(chan struct{})
+		go func() {
+			defer close(toxicsDone)
+			toxi.runSchedule(gctx, cfg.Toxics, tl)
+		}()
+		// wait for the scheduler before teardown runs so no toxic is added
+		// after the proxy has been cleaned up
+		defer func() { cancelRun(); <-toxicsDone }()
+	}
+
+	if len(cfg.HealthFaults) > 0 {
+		hfi := newHealthFaultInjector(ht, pools, cfg.HealthFaults, tl)
+		faultsDone := make(chan struct{})
+		go func() {
+			defer close(faultsDone)
+			hfi.run(gctx)
+		}()
+		defer hfi.logSummary()
+		defer func() { cancelRun(); <-faultsDone }()
+		slog.Info("health-fault mode", "faults", len(cfg.HealthFaults), "balancer_interval", balancerInterval)
+	}
+
+	var balance *balanceCheck
+	if cfg.VerifyBalance {
+		balance = newBalanceCheck(ht, pools, cfg.BalanceWarmup, cfg.BalanceTolerance, tl)
+		// the health-fault injector runs balancers of its own
+		var balancers *poolBalancers
+		if len(cfg.HealthFaults) == 0 {
+			balancers = newPoolBalancers(ht, pools)
+			defer balancers.close()
+		}
+		go balance.run(gctx, balancers)
+		slog.Info("verifying connection balance", "warmup", cfg.BalanceWarmup, "tolerance", cfg.BalanceTolerance, "balancer_interval", balancerInterval)
+	}
+
+	var retries *retryAssert
+	if cfg.AssertRetries > 0 {
+		retries = newRetryAssert(pools, cfg.AssertRetries, cfg.AssertRetriesEvery, tl)
+		go retries.run(gctx)
+		slog.Info("asserting retries", "forced", cfg.AssertRetries, "every", cfg.AssertRetriesEvery)
+	}
+
+	var proxy *proxyProbe
+	if cfg.ViaProxy {
+		proxy = newProxyProbe(pools)
+		go proxy.run(gctx)
+	}
+
+	if obs.upgrade != nil {
+		go obs.upgrade.run(gctx, pools)
+		defer obs.upgrade.logSummary()
+		slog.Info("upgrade drill", "sample_interval", upgradeDrillTick)
+	}
+
+	reader := &workload{
+		name:       "reader",
+		iterations: cfg.Iterations,
+		conc:       cfg.ReaderConc,
+		sleep:      cfg.ReaderSleep,
+		gate:       gates["reader"],
+		windows:    windows,
+		drain:      ctxRun,
+		query: func(ctx context.Context, i int) error { // SELECT now()
+			var mirrored <-chan mirrorResult
+			if mir != nil {
+				mirrored = mir.start(ctx, sqlNow)
+			}
+			var now time.Time
+			start := time.Now()
+			err := readerDB.QueryRowFunc(ctx, func(ctx context.Context, row pgx.Row) error {
+				if err := row.Scan(&now); err != nil {
+					return err
+				}
+				logQuery(ctx, "ping", "workload", "reader", "iteration", i+1, "db_time", now.UTC())
+				return nil
+			}, sqlNow)
+			if mir != nil {
+				primary := mirrorResult{Err: err, Dur: time.Since(start)}
+				if err == nil {
+					primary.Rows = [][]any{{now}}
+				}
+				mir.compare(fmt.Sprintf("ping %d", i+1), primary, <-mirrored)
+			}
+			return err
+		},
+	}
+
+	var ex *exhaustion
+	if cfg.Workload == workloadExhaustion {
+		ex = newExhaustion(int(math.Ceil(cfg.ExhaustFactor*float64(cfg.ReaderMax))), int32(cfg.ReaderMax), cfg.ExhaustHold, cfg.ExhaustAcquireTimeout)
+		reader.query, reader.conc = ex.query(readerDB), ex.conc
+		slog.Info("exhaustion workload", "workload", "reader", "conc", ex.conc, "max_conns", cfg.ReaderMax, "hold", cfg.ExhaustHold, "acquire_timeout", cfg.ExhaustAcquireTimeout)
+	}
+	if cfg.SlowQuery != nil {
+		reader.query = slowReaderQuery(readerDB, mir, cfg.SlowQuery, newLockedRand(cfg.Seed, "slow-query"))
+		slog.Info("slow-query workload", "workload", "reader", "pg_sleep", cfg.SlowQuery.String())
+	}
+
+	cfg.Table.Token = cfg.Workload == workloadRYW || cfg.Workload == workloadVisibility || cfg.VerifyAmbiguous || cfg.DetectDuplicates || cfg.Ledger != ""
+	cfg.Table.Counter = cfg.Workload == workloadLostUpdate || cfg.Workload == workloadBank
+	table := newRunTable(res.RunID, cfg.Table)
+	upsertSQL := table.upsertReturningTSSQL()
+	keys := newLockedRand(cfg.Seed, "keys")
+	dropTable := false
+	defer func() {
+		if dropTable && cfg.CheckpointPath != "" && sd.signal() != nil {
+			// the --resume carries on in it, its end-of-run checks over
+			// both processes' writes
+			slog.Info("keeping the table of the interrupted run for --resume", "table", table.name)
+			dropTable = false
+		}
+		if dropTable {
+			table.drop(writerPool)
+		}
+		if cfg.Cleanup {
+			// the run's context may be gone by now
+			ctx, cancel := context.WithTimeout(context.Background(), defaultCommandTimeout)
+			defer cancel()
+			n, err := cleanupTables(ctx, writerPool, cleanupOptions{olderThan: cfg.CleanupOlderThan, unregistered: true, prefix: cfg.Table.Name})
+			if err != nil {
+				slog.Warn("cleanup", "tables", n, "err", err)
+				return
+			}
+			slog.Info("cleanup", "tables", n)
+		}
+	}()
+	writer := &workload{
+		name:       "writer",
+		iterations: cfg.Iterations,
+		conc:       cfg.WriterConc,
+		sleep:      cfg.WriterSleep,
+		gate:       gates["writer"],
+		windows:    windows,
+		drain:      ctxRun,
+		setup: func(ctx context.Context) error {
+			slog.Info("ensuring table exists", "workload", "writer", "table", table.name, "ddl", table.ensureSQL())
+			if err := table.create(ctx, writerPool, res.RunID); err != nil {
+				return fmt.Errorf("writer DDL: %w", err)
+			}
+			if prep != nil {
+				prep.add(upsertSQL)
+				for _, ps := range cfg.Pools {
+					if strings.Contains(ps.SQL, "{table}") {
+						prep.add(ps.statement(table.ident))
 					}
-					return nil
-				})
+				}
 			}
-			if err := grp.Wait(); err != nil {
-				log.Printf("[reader] batch error: %v (continuing)", err)
+			if !cfg.KeepTable {
+				dropTable = true
 			}
-			select {
-			case <-gctx.Done():
-				return gctx.Err()
-			case <-time.After(cfg.ReaderSleep):
+			return nil
+		},
+		query: func(ctx context.Context, i int) error { // UPSERT returning ts
+			var ts time.Time
+			if err := writerDB.QueryRowFunc(ctx, func(ctx context.Context, row pgx.Row) error { return row.Scan(&ts) }, upsertSQL, cfg.keyBase+keys.IntN(cfg.Keys)); err != nil {
+				return err
 			}
+			logQuery(ctx, "upsert ok", "workload", "writer", "iteration", i+1, "ts", ts.UTC())
+			return nil
+		},
+	}
+
+	var ryw *readYourWrites
+	if cfg.Workload == workloadRYW {
+		ryw = newReadYourWrites(res.RunID, table, readerDB, keys, cfg.keyBase, cfg.Keys, tl)
+		writer.query = ryw.query(writerDB)
+		slog.Info("read-your-writes workload", "keys", cfg.Keys, "converge_wait", rywConvergeWait)
+	}
+
+	var vis *visibility
+	if cfg.Workload == workloadVisibility {
+		readers := map[string]querier{"reader": readerDB}
+		for _, name := range cfg.VisibilityPools {
+			readers[name] = poolDBs[name]
 		}
-		log.Printf("[reader] done")
-		return nil
-	})
+		vis = newVisibility(res.RunID, table, readers, keys, cfg.keyBase, cfg.Keys, cfg.VisibilityTimeout, cfg.VisibilityPoll, cfg.VisibilityFollower, tl)
+		writer.query = vis.query(writerDB)
+		slog.Info("visibility workload", "keys", cfg.Keys, "pools", slices.Sorted(maps.Keys(readers)), "follower_reads", cfg.VisibilityFollower, "timeout", cfg.VisibilityTimeout)
+	}
 
-	g.Go(func() error { // writer
-		log.Printf("[writer] goroutine started")
-		log.Printf("[writer] ensuring table exists")
-		if err := writerPool.QueryFunc(gctx, func(ctx context.Context, rows pgx.Rows) error { return nil }, sqlEnsureTable); err != nil {
-			return fmt.Errorf("writer DDL: %w", err)
-		}
-		for i := 0; i < cfg.Iterations; i++ {
-			select {
-			case <-gctx.Done():
-				log.Printf("[writer] context done: %v", gctx.Err())
-				return gctx.Err()
-			default:
-			}
-			grp, qctx := errgroup.WithContext(gctx)
-			for j := 0; j < cfg.WriterConc; j++ {
-				grp.Go(func() error {
-					var ts time.Time
-					if err := writerPool.QueryRowFunc(qctx, func(ctx context.Context, row pgx.Row) error { return row.Scan(&ts) }, sqlUpsertReturningTS); err != nil {
-						log.Printf("[writer] query error: %v", err)
-						return nil
-					}
-					log.Printf("[writer] upsert ok, ts: %s", ts.UTC().Format(time.RFC3339Nano))
-					return nil
-				})
+	var lost *lostUpdate
+	if cfg.Workload == workloadLostUpdate {
+		lost = newLostUpdate(table, keys, cfg.keyBase, cfg.Keys)
+		writer.query = lost.query(writerDB)
+		slog.Info("lost-update workload", "keys", cfg.Keys, "writers", cfg.WriterConc)
+	}
+
+	var bk *bank
+	if cfg.Workload == workloadBank {
+		bk = newBank(table, cfg.BankAccounts, cfg.BankBalance, cfg.BankCheckEvery, txOptions(cfg.Isolation), newLockedRand(cfg.Seed, "bank"), tl)
+		setup := writer.setup
+		writer.setup = func(ctx context.Context) error {
+			if err := setup(ctx); err != nil {
+				return err
 			}
-			if err := grp.Wait(); err != nil {
-				log.Printf("[writer] batch error: %v (continuing)", err)
+			return bk.seed(ctx, writerDB)
+		}
+		writer.query = bk.query(writerDB)
+		go bk.run(gctx, readerDB)
+		slog.Info("bank workload", "accounts", cfg.BankAccounts, "balance", cfg.BankBalance, "check_every", cfg.BankCheckEvery)
+	}
+
+	var amb *ambiguousVerifier
+	if cfg.VerifyAmbiguous {
+		amb = newAmbiguousVerifier(res.RunID, table)
+		writer.query = amb.query(writerDB)
+		slog.Info("verifying ambiguous writes", "table", table.name)
+	}
+
+	var led *ledger
+	if cfg.Ledger != "" {
+		if led, err = openLedger(cfg.Ledger, res.RunID, table, res.StartedAt); err != nil {
+			return err
+		}
+		defer led.close()
+		writer.query = led.query(writerDB)
+		slog.Info("writing ledger", "path", cfg.Ledger, "table", table.name)
+	}
+
+	var dup *duplicateDetector
+	if cfg.DetectDuplicates {
+		dup = newDuplicateDetector(res.RunID, table, tl)
+		if amb == nil && led == nil {
+			writer.query = dup.query(writerDB)
+		}
+		slog.Info("detecting duplicate writes", "table", table.name)
+	}
+
+	if resumed != nil && (amb != nil || led != nil || dup != nil) {
+		// the tokens of the process resumed are in the table already, the
+		// unacknowledged ones included
+		setup := writer.setup
+		writer.setup = func(ctx context.Context) error {
+			if err := setup(ctx); err != nil {
+				return err
 			}
-			select {
-			case <-gctx.Done():
-				return gctx.Err()
-			case <-time.After(cfg.WriterSleep):
+			seq, err := lastTokenSeq(ctx, writerDB, table, res.RunID)
+			if err != nil {
+				return err
 			}
+			if amb != nil {
+				amb.resume(seq)
+			}
+			if led != nil {
+				led.resume(seq)
+			}
+			if dup != nil {
+				dup.resume(seq)
+			}
+			slog.Info("resuming tokens", "after", fmt.Sprintf("%s-%d", res.RunID, seq))
+			return nil
 		}
-		log.Printf("[writer] done")
-		return nil
-	})
+	}
+
+	if cfg.Measure {
+		// the default queries only; the others do more per query than
+		// scanning a timestamp
+		if mir == nil && cfg.SlowQuery == nil {
+			reader.queryInto = func(ctx context.Context, i int, st *scanTargets) error {
+				return readerDB.QueryRowFunc(ctx, st.scan, sqlNow)
+			}
+		}
+		if ryw == nil && vis == nil && lost == nil && bk == nil && amb == nil && led == nil && dup == nil {
+			writer.queryInto = func(ctx context.Context, i int, st *scanTargets) error {
+				return writerDB.QueryRowFunc(ctx, st.scan, upsertSQL, cfg.keyBase+keys.IntN(cfg.Keys))
+			}
+		}
+		slog.Info("measure mode: no query tracer, per-query log lines or query IDs")
+	}
+
+	if prep != nil {
+		// the statements on the workload table are added once it exists
+		prep.add(sqlNow)
+		if cfg.SlowQuery != nil {
+			prep.add(sqlSleep)
+		}
+		for _, ps := range cfg.Pools {
+			if !strings.Contains(ps.SQL, "{table}") {
+				prep.add(ps.SQL)
+			}
+		}
+	}
+
+	workloads := []*workload{reader}
+	if writerPool != nil {
+		workloads = append(workloads, writer)
+	}
+	var iso *isolationCheck
+	if cfg.Isolation != "" {
+		iso = newIsolationCheck(cfg.Isolation, tl)
+		if bk != nil {
+			writer.setup = iso.setup(writer.name, writerDB, writer.setup)
+		}
+	}
+	for _, ps := range cfg.Pools {
+		w := &workload{
+			name:       ps.Name,
+			iterations: cmp.Or(ps.Iterations, cfg.Iterations),
+			conc:       ps.Conc,
+			sleep:      ps.Sleep,
+			gate:       gates[ps.Name],
+			windows:    windows,
+			drain:      ctxRun,
+			query:      ps.query(poolDBs[ps.Name], table.ident, txOptions(cfg.Isolation)),
+		}
+		if iso != nil && ps.Mode == poolModeTx {
+			w.setup = iso.setup(w.name, poolDBs[ps.Name], nil)
+		}
+		workloads = append(workloads, w)
+	}
+
+	if cfg.SleepJitter > 0 {
+		for _, w := range workloads {
+			w.jitter, w.rng = cfg.SleepJitter, newLockedRand(cfg.Seed, "jitter-"+w.name)
+		}
+	}
+
+	for _, w := range workloads {
+		w.warmup, w.queryTimeout = cfg.Warmup, cfg.QueryTimeout
+	}
+	if cfg.ThinkDist != "" && cfg.ThinkDist != thinkFixed {
+		for _, w := range workloads {
+			w.think, w.thinkRng = cfg.ThinkDist, newLockedRand(cfg.Seed, "think-"+w.name)
+		}
+	}
+
+	if admin != nil {
+		admin.registerLive(workloads, gates, pools, tl)
+	}
+
+	if len(scenario) > 0 {
+		targets := scenarioTargets{
+			pools: pools,
+			gates: gates,
+		}
+		scenarioDone := make(chan struct{})
+		go func() {
+			defer close(scenarioDone)
+			runScenario(gctx, scenario, targets, tl)
+		}()
+		defer func() { cancelRun(); <-scenarioDone }()
+	}
+
+	if resumed != nil {
+		for _, w := range workloads {
+			resumeWorkload(w, resumed.Workloads[w.name])
+			slog.Info("resuming", "workload", w.name, "iteration", w.startIter)
+		}
+	}
+	if cfg.CheckpointPath != "" {
+		cp := &checkpointer{path: cfg.CheckpointPath, res: &res, start: time.Now(), workloads: workloads, tl: tl}
+		if resumed != nil {
+			cp.prior = resumed.Elapsed
+		}
+		go cp.run(gctx, cfg.CheckpointInterval)
+		defer cp.save()
+	}
+
+	var wd *stallWatchdog
+	if cfg.StallTimeout > 0 {
+		wd = newStallWatchdog(workloads, cfg.StallTimeout, cfg.StallAbort, cancelRun, res.RunID, tl)
+		go wd.run(gctx)
+	}
+
+	var soak *soakMonitor
+	if cfg.Soak.Enabled {
+		soak = newSoakMonitor(cfg.Soak, cancelRun, tl)
+		go soak.run(gctx)
+		slog.Info("soak: watching the tester's resources", "interval", cfg.Soak.Interval, "warmup", cfg.Soak.Warmup, "window", cfg.Soak.Window, "max_growth", cfg.Soak.MaxGrowth, "fail", cfg.Soak.Fail)
+	}
 
-	if err := g.Wait(); err != nil {
+	var steps *stepRunner
+	if len(cfg.Steps) > 0 {
+		steps = newStepRunner(cfg.Steps, workloads, tl)
+	}
+	var spikes *spikeMonitor
+	if len(cfg.Spikes) > 0 {
+		spikes = newSpikeMonitor(cfg.Spikes, workloads, pools, tl)
+	}
+	var drain *drainWatch
+	stopDrain := func() bool { return false }
+	if cfg.Drain > 0 {
+		drain = newDrainWatch(cfg.Drain, workloads, tl)
+		stopDrain = context.AfterFunc(ctxWork, drain.begin)
+	}
+	var sine *sineShaper
+	if cfg.Sine.Rate > 0 {
+		sine = newSineShaper(cfg.Sine, workloads, pools, tl)
+		slog.Info("sine: modulating the workloads' rate", "mean_qps", cfg.Sine.Rate, "amplitude", cfg.Sine.Amplitude, "period", cfg.Sine.Period, "interval", cfg.Sine.Interval)
+	}
+
+	defer func() {
+		for _, w := range workloads {
+			if cfg.Warmup > 0 {
+				ws := w.warmupStats.summary()
+				res.Warmup[w.name] = ws
+				slog.Info("warmup summary", "workload", w.name, "stats", ws)
+			}
+			sum := w.stats.summary()
+			res.Workloads[w.name] = sum
+			slog.Info("summary", "workload", w.name, "stats", sum)
+		}
+		if soak != nil {
+			res.Soak = soak.summary()
+		}
+		if steps != nil {
+			res.Steps = steps.summary()
+		}
+		if sine != nil {
+			res.Sine = sine.summary()
+		}
+		if spikes != nil {
+			res.Spikes = spikes.summary()
+		}
+		if proxy != nil {
+			slices.Sort(proxyDropped)
+			res.Proxy = proxy.summary(slices.Compact(proxyDropped), res.Workloads)
+		}
+		if cfg.SLO.set() {
+			// a breach fails a run that otherwise passed, and so gets a
+			// repro bundle like any other failure
+			var sloErr error
+			res.SLO, sloErr = cfg.SLO.evaluate(res.Workloads)
+			if err == nil {
+				err = withExit(exitSLO, sloErr)
+			}
+		}
+		for _, name := range slices.Sorted(maps.Keys(pools)) {
+			rs := pools[name].retries.summary()
+			res.Retries[name] = rs
+			slog.Info("retries", "pool", name, "stats", rs)
+			if as := pools[name].ambiguous.summary(); as.Attempts > 0 || as.Surfaced > 0 {
+				res.Ambiguous[name] = as
+				slog.Warn("ambiguous results", "pool", name, "attempts", as.Attempts, "by_node", as.ByNode, "surfaced", as.Surfaced, "retried_ok", as.RetriedOK)
+			}
+			ns := pools[name].nodes.summary()
+			res.ByNode[name] = ns
+			for _, node := range slices.Sorted(maps.Keys(ns)) {
+				slog.Info("node summary", "pool", name, "node", node, "stats", ns[node])
+			}
+			if cfg.Statements.set() {
+				ss := pools[name].prepares.summary(res.Workloads[name])
+				res.Statements[name] = ss
+				slog.Info("prepared statements", "pool", name, "stats", ss)
+			}
+			cs := pools[name].timings.summary()
+			res.Connect[name] = cs
+			slog.Info("connections", "pool", name, "stats", cs)
+			as := pools[name].acquire.summary()
+			res.Acquire[name] = as
+			slog.Info("acquire", "pool", name, "stats", as)
+			if as.Saturated {
+				slog.Warn("pool saturated: calls wait for connections, MaxConns is the bottleneck", "pool", name,
+					"slow_acquires", as.Slow, "acquires", as.Acquires, "wait_share", as.WaitShare, "max_conns", pools[name].settings().MaxConns)
+			}
+		}
+		if iso != nil {
+			res.Isolation = iso.summary(res.Retries, res.Workloads, res.Bank)
+		}
+		windows.closeAll()
+		windows.logSummary()
+		res.Windows = windows.results()
+		for _, mw := range middlewares {
+			maps.Copy(res.Middleware, mw.logSummary())
+			res.RetryStrategy[mw.name] = mw.logBackoff()
+		}
+		if len(breakers) > 0 {
+			res.Breakers = map[string]breakerSummary{}
+			for _, b := range breakers {
+				res.Breakers[b.name] = b.summary()
+			}
+		}
+		res.Peaks = obs.peaks.results()
+		if obs.upgrade != nil {
+			res.Upgrade = obs.upgrade.summary()
+		}
+		if obs.churn != nil {
+			res.Churn = obs.churn.summary()
+		}
+		if ex != nil {
+			res.Exhaustion = ex.summary()
+		}
+		hv := health.snapshot()
+		res.Health = &hv
+		health.log()
+		res.LogLinesDropped = logLinesDropped()
+		res.EndedAt = time.Now()
+		res.Outcome = "ok"
+		if err != nil {
+			res.Outcome = err.Error()
+		}
+		res.Timeline = tl.snapshot()
+		if cfg.onResult != nil {
+			cfg.onResult(res)
+		}
+		if cfg.ResultsOut != "" {
+			if werr := writeResults(cfg.ResultsOut, res); werr != nil {
+				slog.Error("write results", "path", cfg.ResultsOut, "err", werr)
+			} else {
+				slog.Info("results written", "path", cfg.ResultsOut)
+			}
+			if manifest != nil {
+				if werr := writeJSONFile(manifestPath(cfg.ResultsOut), manifest); werr != nil {
+					slog.Error("write manifest", "path", manifestPath(cfg.ResultsOut), "err", werr)
+				}
+			}
+		}
+		if cfg.JUnitOut != "" {
+			if werr := writeJUnit(cfg.JUnitOut, res); werr != nil {
+				slog.Error("write junit report", "path", cfg.JUnitOut, "err", werr)
+			} else {
+				slog.Info("junit report written", "path", cfg.JUnitOut)
+			}
+		}
+		if cfg.SummaryMD != "" {
+			if werr := writeMarkdownFile(cfg.SummaryMD, res); werr != nil {
+				slog.Error("write markdown summary", "path", cfg.SummaryMD, "err", werr)
+			} else {
+				slog.Info("markdown summary written", "path", cfg.SummaryMD)
+			}
+		}
+		if pg != nil {
+			// the run's context may be gone by now; the push has its own timeout
+			snap := pushSnapshot{Workloads: res.Workloads, Retries: res.Retries, Pools: snapshotPools(pools), Health: hv}
+			if werr := pg.push(context.Background(), pg.render(snap, true, err == nil)); werr != nil {
+				slog.Error("push metrics", "err", werr)
+			} else {
+				slog.Info("metrics pushed", "pushgateway", cfg.PushgatewayURL, "run_id", res.RunID)
+			}
+		}
+		if ring != nil && err != nil {
+			b := reproBundle{
+				RunID:      res.RunID,
+				CreatedAt:  time.Now(),
+				Reason:     err.Error(),
+				Seed:       cfg.Seed,
+				Args:       reproArgs(flag.CommandLine, cfg, cfg.Args),
+				Target:     res.Settings.Target,
+				Components: res.Components,
+			}
+			dir, werr := writeReproBundle(cfg.ReproBundle, b, cfg, res, ring.recent())
+			if werr != nil {
+				slog.Error("write repro bundle", "err", werr)
+				return
+			}
+			slog.Info("repro bundle written; rerun with --from-bundle", "dir", dir)
+		}
+	}()
+
+	go watchPauseSignals(gctx, gates, tl)
+	go watchReloadSignal(gctx, pools, cfg.ReloadFile, tl)
+	if cfg.HeartbeatOnly {
+		go watchHeartbeat(gctx, pools, ht, cfg.HeartbeatInterval, tl)
+	}
+	if pg != nil && cfg.PushgatewayInterval > 0 {
+		go pg.watch(gctx, cfg.PushgatewayInterval, func() pushSnapshot {
+			snap := pushSnapshot{Workloads: map[string]opSummary{}, Retries: map[string]retrySummary{}, Pools: snapshotPools(pools), Health: health.snapshot()}
+			for _, w := range workloads {
+				snap.Workloads[w.name] = w.stats.summary()
+			}
+			for name, p := range pools {
+				snap.Retries[name] = p.retries.summary()
+			}
+			return snap
+		})
+	}
+	if cfg.onProgress != nil {
+		go func() {
+			t := time.NewTicker(workerProgressInterval)
+			defer t.Stop()
+			for {
+				select {
+				case <-gctx.Done():
+					return
+				case <-t.C:
+				}
+				progress := map[string]opSummary{}
+				for _, w := range workloads {
+					progress[w.name] = w.stats.summary()
+				}
+				cfg.onProgress(progress)
+			}
+		}()
+	}
+	if steps != nil {
+		go steps.run(gctx, stopWork)
+	}
+	if sine != nil {
+		go sine.run(gctx)
+	}
+	if spikes != nil {
+		spikesDone := make(chan struct{})
+		go func() {
+			defer close(spikesDone)
+			var stop context.CancelFunc
+			if len(cfg.Steps) == 0 && cfg.Sine.Rate == 0 {
+				stop = stopWork // nothing else sets the run's length
+			}
+			spikes.run(gctx, stop)
+		}()
+		// the spike in progress is recorded once the monitor stops
+		defer func() { cancelRun(); <-spikesDone }()
+	}
+	for _, w := range workloads {
+		g.Go(func() error { return w.run(gctx) })
+	}
+
+	err = g.Wait()
+	if drain != nil {
+		stopDrain() // the workloads may have run out of iterations first
+		res.Drain = drain.summary(pools)
+	}
+	if err != nil && errors.Is(err, context.Canceled) && sd.signal() == nil &&
+		(steps != nil && steps.done() || spikes != nil && spikes.done() && len(cfg.Steps) == 0 && cfg.Sine.Rate == 0) {
+		err = nil // the last step or spike ended the workloads
+	}
+	if err != nil {
+		if sig := sd.signal(); sig != nil {
+			return withExit(exitInterrupted, fmt.Errorf("interrupted by %s", sig))
+		}
+		if wd != nil && wd.abortReason() != "" {
+			return withExit(exitTimeout, fmt.Errorf("stalled: %s", wd.abortReason()))
+		}
+		if soak != nil && soak.abortReason() != "" {
+			return withExit(exitAssertion, fmt.Errorf("soak: %s", soak.abortReason()))
+		}
+		if errors.Is(err, context.DeadlineExceeded) && ctxWork.Err() != nil {
+			return withExit(exitTimeout, fmt.Errorf("workload aborted by the %s timeout: %w", timeout, err))
+		}
 		return err
 	}
-	log.Printf("workload complete")
+	slog.Info("workload complete")
+	if obs.leaks != nil {
+		res.Leaks, err = obs.leaks.check(ctx)
+		if err := res.assert("leak-check", err); err != nil {
+			return err
+		}
+	}
+	if retries != nil {
+		res.RetryAssert, err = retries.verdict()
+		if err := res.assert("retry-assert", err); err != nil {
+			return err
+		}
+	}
+	if balance != nil {
+		res.Balance, err = balance.verdict()
+		if err := res.assert("balance", err); err != nil {
+			return err
+		}
+	}
+	if ryw != nil {
+		res.ReadYourWrites, err = ryw.verdict()
+		if err := res.assert("read-your-writes", err); err != nil {
+			return err
+		}
+	}
+	if vis != nil {
+		res.Visibility = vis.summary()
+	}
+	if amb != nil {
+		res.AmbiguousWrites, err = amb.verify(ctx, writerPool)
+		if err := res.assert("ambiguous-writes", err); err != nil {
+			return err
+		}
+	}
+	if dup != nil {
+		res.Duplicates, err = dup.scan(ctx, writerPool)
+		if err := res.assert("duplicates", err); err != nil {
+			return err
+		}
+	}
+	if bk != nil {
+		res.Bank, err = bk.verify(ctx, writerPool)
+		if err := res.assert("bank", err); err != nil {
+			return err
+		}
+	}
+	if lost != nil {
+		res.LostUpdate, err = lost.verify(ctx, writerPool)
+		if err := res.assert("lost-update", err); err != nil {
+			return err
+		}
+	}
+	if led != nil {
+		if err := led.close(); err != nil {
+			return fmt.Errorf("ledger: %w", err)
+		}
+		res.Audit, err = audit(ctx, writerPool, cfg.Ledger)
+		if err := res.assert("audit", err); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func main() {
-	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
-	cfg := parseFlags()
-	if err := validateConfig(&cfg); err != nil {
-		log.Fatal(err)
+	name, args := splitCommand(os.Args[1:])
+	if name == "help" {
+		printCommands()
+		return
+	}
+	cmd, ok := lookupCommand(name)
+	if !ok {
+		printCommands()
+		fatal(exitConfig, "unknown command", "command", name)
 	}
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	if err := run(ctx, cfg); err != nil {
-		log.Fatal(err)
+	if err := cmd.run(args); err != nil {
+		fatal(exitCode(err), name+" failed", "err", err)
 	}
+	flushLogs()
 }
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const manifestTimeout = 5 * time.Second
+
+// runManifest is written next to the results so a result file says months
+// later exactly what produced it: the command line, the configuration it
+// resolved to, the binary and the cluster.
+type runManifest struct {
+	RunID     string         `json:"run_id"`
+	CreatedAt time.Time      `json:"created_at"`
+	Command   []string       `json:"command"`  // as given, DSNs redacted
+	Resolved  []string       `json:"resolved"` // every flag's effective value, as a repro bundle pins them
+	Settings  resultSettings `json:"settings"`
+	Build     buildInfo      `json:"build"`
+	Hostname  string         `json:"hostname"`
+	OS        string         `json:"os"`
+	Cluster   clusterInfo    `json:"cluster"`
+}
+
+// clusterInfo is what the manifest records about the cluster.
+type clusterInfo struct {
+	Target  string `json:"target"` // redacted DSN info
+	Version string `json:"version,omitempty"`
+	Nodes   int    `json:"nodes,omitempty"` // in gossip; 0 => couldn't tell (tenants can't read it)
+	Live    int    `json:"live_nodes,omitempty"`
+}
+
+// manifestPath is the manifest's path for the result file resultsPath:
+// results.json => results.manifest.json.
+func manifestPath(resultsPath string) string {
+	return strings.TrimSuffix(resultsPath, ".json") + ".manifest.json"
+}
+
+func newRunManifest(cfg Config, res runResult) *runManifest {
+	host, _ := os.Hostname()
+	return &runManifest{
+		RunID:     res.RunID,
+		CreatedAt: time.Now(),
+		Command:   redactArgs(cfg.Args),
+		Resolved:  reproArgs(flag.CommandLine, cfg, cfg.Args),
+		Settings:  res.Settings,
+		Build:     res.Build,
+		Hostname:  host,
+		OS:        runtime.GOOS + "/" + runtime.GOARCH,
+		Cluster:   clusterInfo{Target: res.Settings.Target},
+	}
+}
+
+// probe fills in the cluster's version and node count through db. Failures
+// are logged and leave the fields empty; they don't fail the run.
+func (m *runManifest) probe(ctx context.Context, db querier) {
+	ctx, cancel := context.WithTimeout(ctx, manifestTimeout)
+	defer cancel()
+	err := db.QueryRowFunc(ctx, func(ctx context.Context, row pgx.Row) error { return row.Scan(&m.Cluster.Version) }, "select version()")
+	if err != nil {
+		slog.Warn("manifest: cluster version", "err", err)
+	}
+	err = db.QueryRowFunc(ctx, func(ctx context.Context, row pgx.Row) error {
+		return row.Scan(&m.Cluster.Nodes, &m.Cluster.Live)
+	}, "select count(*), count(*) filter (where is_live) from crdb_internal.gossip_nodes")
+	if err != nil {
+		slog.Debug("manifest: node count", "err", err)
+	}
+}
+
+// redactArgs returns args with the credentials of DSN flags and the secret
+// path of --notify-url removed.
+func redactArgs(args []string) []string {
+	out := make([]string, 0, len(args))
+	redactNext := ""
+	for _, a := range args {
+		if redactNext != "" {
+			out = append(out, redactFlagValue(redactNext, a))
+			redactNext = ""
+			continue
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(a, "-"), "=")
+		if !strings.HasPrefix(a, "-") || !secretFlag(name) {
+			out = append(out, a)
+			continue
+		}
+		if !hasValue {
+			out = append(out, a)
+			redactNext = name
+			continue
+		}
+		out = append(out, a[:len(a)-len(value)]+redactFlagValue(name, value))
+	}
+	return out
+}
+
+func secretFlag(name string) bool {
+	switch name {
+	case "dsn", "reader-dsn", "writer-dsn", "mirror-dsn", "pool", "notify-url":
+		return true
+	}
+	return false
+}
+
+func redactFlagValue(name, value string) string {
+	switch name {
+	case "pool":
+		ps, err := parsePoolSpec(value)
+		if err != nil {
+			return "<invalid pool>"
+		}
+		if ps.DSN != "" {
+			return fmt.Sprintf("%s,dsn=%s", ps, redactedDSNInfo(ps.DSN))
+		}
+		return ps.String()
+	case "notify-url":
+		return redactedURL(value)
+	case "dsn":
+		t := parseClusterTarget(value, 0)
+		if t.dsn != value {
+			return t.name + "=" + redactedDSNInfo(t.dsn)
+		}
+	}
+	return redactedDSNInfo(value)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// writeMarkdownSummary writes the run as compact GitHub-flavored Markdown,
+// for a PR comment or $GITHUB_STEP_SUMMARY: the outcome, a table of the
+// workloads, the pools' retries, the SLO thresholds and the end-of-run
+// assertions.
+func writeMarkdownSummary(w io.Writer, res runResult) {
+	outcome := "**ok**"
+	if res.Outcome != "ok" {
+		outcome = "**failed**"
+	}
+	fmt.Fprintf(w, "### crdbpool-tester run `%s`\n\n", res.RunID)
+	fmt.Fprintf(w, "%s after %s (crdbpool %s, pool-impl %s)\n\n", outcome, res.EndedAt.Sub(res.StartedAt).Round(time.Second),
+		mdEscape(cmp.Or(res.Components["crdbpool"], "-")), mdEscape(cmp.Or(res.Components["pool-impl"], "-")))
+	if res.Outcome != "ok" {
+		fmt.Fprintf(w, "> %s\n\n", mdEscape(res.Outcome))
+	}
+
+	fmt.Fprintln(w, "| Workload | Queries | Errors | QPS | p50 | p95 | p99 | Error classes |")
+	fmt.Fprintln(w, "|---|---:|---:|---:|---:|---:|---:|---|")
+	for _, name := range slices.Sorted(maps.Keys(res.Workloads)) {
+		s := res.Workloads[name]
+		var classes []string
+		for _, class := range slices.Sorted(maps.Keys(s.ErrorClasses)) {
+			classes = append(classes, fmt.Sprintf("%s: %d", class, s.ErrorClasses[class]))
+		}
+		fmt.Fprintf(w, "| %s | %d | %d (%s) | %.1f | %s | %s | %s | %s |\n", mdEscape(name), s.Queries, s.Errors, formatRate(opErrorRate(s)),
+			s.Throughput, mdDuration(s.P50), mdDuration(s.P95), mdDuration(s.P99), mdEscape(strings.Join(classes, ", ")))
+	}
+
+	if len(res.Retries) > 0 {
+		fmt.Fprintln(w, "\n| Pool | Calls | Retried | Max attempts | Logical p99 |")
+		fmt.Fprintln(w, "|---|---:|---:|---:|---:|")
+		for _, name := range slices.Sorted(maps.Keys(res.Retries)) {
+			r := res.Retries[name]
+			maxAttempts := 0
+			for n := range r.ByAttempts {
+				maxAttempts = max(maxAttempts, n)
+			}
+			fmt.Fprintf(w, "| %s | %d | %d | %d | %s |\n", mdEscape(name), r.Calls, r.RetriedCalls, maxAttempts, mdDuration(r.Logical.quantile(0.99)))
+		}
+	}
+
+	if res.SLO != nil {
+		if res.SLO.Pass {
+			fmt.Fprintln(w, "\nSLO: **met**")
+		} else {
+			fmt.Fprintln(w, "\nSLO: **violated**\n\n| Workload | Metric | Limit | Actual |\n|---|---|---:|---:|")
+			for _, v := range res.SLO.Violations {
+				fmt.Fprintf(w, "| %s | %s | %s | %s |\n", mdEscape(v.Workload), v.Metric, v.Limit, mdEscape(v.Actual))
+			}
+		}
+	}
+
+	if len(res.Assertions) > 0 {
+		fmt.Fprintln(w, "\n| Assertion | Result |\n|---|---|")
+		for _, a := range res.Assertions {
+			result := "pass"
+			if !a.Pass {
+				result = "**fail**: " + mdEscape(a.Err)
+			}
+			fmt.Fprintf(w, "| %s | %s |\n", a.Name, result)
+		}
+	}
+}
+
+// writeMarkdownFile appends the summary to path, as GitHub expects of
+// $GITHUB_STEP_SUMMARY, so what earlier commands of the step wrote stays.
+func writeMarkdownFile(path string, res runResult) error {
+	var b strings.Builder
+	writeMarkdownSummary(&b, res)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(b.String()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// mdEscape keeps s on one table row: pipes escaped, newlines folded.
+func mdEscape(s string) string {
+	return strings.NewReplacer("|", `\|`, "\n", " ", "\t", " ").Replace(s)
+}
+
+func mdDuration(d time.Duration) string {
+	return d.Round(time.Microsecond).String()
+}
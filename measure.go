@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// measuring is set by --measure before any workload starts: the tester is
+// used for throughput benchmarking rather than debugging, and the query path
+// keeps only what the results need. No query tracer is installed (so no
+// per-query lines and no JSON-encoded arguments), queries get no query ID
+// and their errors are counted but not logged.
+var measuring bool
+
+// scanTargets are the destinations a worker scans the default workloads'
+// results into, allocated once per worker instead of once per query, with
+// the scan func bound to them.
+type scanTargets struct {
+	ts   time.Time
+	scan func(ctx context.Context, row pgx.Row) error
+}
+
+func newScanTargets() *scanTargets {
+	st := &scanTargets{}
+	st.scan = func(_ context.Context, row pgx.Row) error { return row.Scan(&st.ts) }
+	return st
+}
+
+func validateMeasure(cfg Config) error {
+	if !cfg.Measure {
+		return nil
+	}
+	if cfg.TraceSlowThreshold > 0 || cfg.RedactArgs != "" {
+		return errors.New("--measure runs without the query tracer; --trace-slow-threshold and --redact-args can't be combined with it")
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Merge modes: how the parts of a merged result relate in time.
+const (
+	mergeAuto       = "auto"       // sequential if no two parts overlap, concurrent otherwise
+	mergeConcurrent = "concurrent" // parts ran at the same time (shards, workers)
+	mergeSequential = "sequential" // parts ran one after another (repeated runs)
+)
+
+// mergeOpSummaries combines the stats of one workload run in parts: counters
+// add up and the histograms merge. Parts that ran at the same time (the
+// shards of a distributed run) last as long as the longest of them;
+// sequential parts as long as all of them together. The throughput is the
+// combined queries over that.
+func mergeOpSummaries(parts []opSummary, sequential bool) opSummary {
+	out := opSummary{ErrorClasses: map[string]uint64{}, Latency: &latencyHistogram{}}
+	for _, s := range parts {
+		out.Queries += s.Queries
+		out.Errors += s.Errors
+		for class, n := range s.ErrorClasses {
+			out.ErrorClasses[class] += n
+		}
+		if sequential {
+			out.Duration += s.Duration
+		} else {
+			out.Duration = max(out.Duration, s.Duration)
+		}
+		if s.Latency != nil {
+			out.Latency.merge(s.Latency)
+		}
+	}
+	if out.Duration > 0 {
+		out.Throughput = float64(out.Queries) / out.Duration.Seconds()
+	}
+	out.P50, out.P95, out.P99 = out.Latency.quantile(0.50), out.Latency.quantile(0.95), out.Latency.quantile(0.99)
+	out.Max, out.Mean = out.Latency.quantile(1), out.Latency.mean()
+	return out
+}
+
+func mergeRetrySummaries(parts []retrySummary) retrySummary {
+	out := retrySummary{ByAttempts: map[int]uint64{}, Logical: &latencyHistogram{}, Attempt: &latencyHistogram{}, RetriedLatency: &latencyHistogram{}}
+	for _, r := range parts {
+		out.Calls += r.Calls
+		out.RetriedCalls += r.RetriedCalls
+		for n, c := range r.ByAttempts {
+			out.ByAttempts[n] += c
+		}
+		for _, h := range []struct{ dst, src *latencyHistogram }{{out.Logical, r.Logical}, {out.Attempt, r.Attempt}, {out.RetriedLatency, r.RetriedLatency}} {
+			if h.src != nil {
+				h.dst.merge(h.src)
+			}
+		}
+	}
+	return out
+}
+
+// mergeOpSummaryMaps merges per-name stats, such as the workloads', over
+// the parts that have them.
+func mergeOpSummaryMaps(parts []map[string]opSummary, sequential bool) map[string]opSummary {
+	byName := map[string][]opSummary{}
+	for _, p := range parts {
+		for name, s := range p {
+			byName[name] = append(byName[name], s)
+		}
+	}
+	out := make(map[string]opSummary, len(byName))
+	for name, ss := range byName {
+		out[name] = mergeOpSummaries(ss, sequential)
+	}
+	return out
+}
+
+// isSequential reports whether parts ran one after another, none starting
+// before the previous one ended.
+func isSequential(parts []runResult) bool {
+	byStart := slices.SortedFunc(slices.Values(parts), func(a, b runResult) int { return a.StartedAt.Compare(b.StartedAt) })
+	for i := 1; i < len(byStart); i++ {
+		if byStart[i].StartedAt.Before(byStart[i-1].EndedAt) {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeRunResults combines the results of runs into one, labeled by names
+// (e.g. "w0", "w1"): per-workload, per-pool, per-node and middleware stats
+// merged, the timelines interleaved with each event's detail prefixed with
+// its part and each part's start marked, and the assertions kept per part.
+// The build and settings are the first part's. The outcome is ok only if
+// every part's was.
+func mergeRunResults(runID string, names []string, parts []runResult, sequential bool) runResult {
+	out := runResult{
+		RunID:      runID,
+		Outcome:    "ok",
+		Components: map[string]string{},
+		Retries:    map[string]retrySummary{},
+		ByNode:     map[string]map[string]opSummary{},
+	}
+	var workloads, middleware []map[string]opSummary
+	retries := map[string][]retrySummary{}
+	byNode := map[string][]map[string]opSummary{}
+	for i, p := range parts {
+		if out.StartedAt.IsZero() || p.StartedAt.Before(out.StartedAt) {
+			out.StartedAt = p.StartedAt
+		}
+		if p.EndedAt.After(out.EndedAt) {
+			out.EndedAt = p.EndedAt
+		}
+		if i == 0 {
+			out.Build, out.Settings = p.Build, p.Settings
+			out.Settings.Shard, out.Settings.KeyBase = "", 0
+			maps.Copy(out.Components, p.Components)
+		}
+		if p.Outcome != "ok" {
+			if out.Outcome == "ok" {
+				out.Outcome = fmt.Sprintf("%s: %s", names[i], p.Outcome)
+			} else {
+				out.Outcome += fmt.Sprintf("; %s: %s", names[i], p.Outcome)
+			}
+		}
+		workloads, middleware = append(workloads, p.Workloads), append(middleware, p.Middleware)
+		for name, r := range p.Retries {
+			retries[name] = append(retries[name], r)
+		}
+		for pool, nodes := range p.ByNode {
+			byNode[pool] = append(byNode[pool], nodes)
+		}
+		start := timelineEvent{At: p.StartedAt, Kind: "merge", Detail: names[i] + ": run started"}
+		if names[i] != p.RunID {
+			start.Detail = fmt.Sprintf("%s: run %s started", names[i], p.RunID)
+		}
+		out.Timeline = append(out.Timeline, start)
+		for _, ev := range p.Timeline {
+			ev.Detail = names[i] + ": " + ev.Detail
+			out.Timeline = append(out.Timeline, ev)
+		}
+		for _, a := range p.Assertions {
+			a.Name = names[i] + "/" + a.Name
+			out.Assertions = append(out.Assertions, a)
+		}
+	}
+	out.Workloads = mergeOpSummaryMaps(workloads, sequential)
+	if m := mergeOpSummaryMaps(middleware, sequential); len(m) > 0 {
+		out.Middleware = m
+	}
+	for name, rs := range retries {
+		out.Retries[name] = mergeRetrySummaries(rs)
+	}
+	for pool, nodes := range byNode {
+		out.ByNode[pool] = mergeOpSummaryMaps(nodes, sequential)
+	}
+	slices.SortStableFunc(out.Timeline, func(a, b timelineEvent) int { return a.At.Compare(b.At) })
+	if out.EndedAt.IsZero() {
+		out.EndedAt = time.Now()
+	}
+	return out
+}
+
+// mergeName labels a result in a merge: its shard, s<index>, or its run ID.
+func mergeName(res runResult) string {
+	if index, _, ok := strings.Cut(res.Settings.Shard, "/"); ok {
+		return "s" + index
+	}
+	return res.RunID
+}
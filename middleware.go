@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	defaultMiddlewareTimeout = 5 * time.Second
+	defaultMiddlewareRetries = 2
+	middlewareBackoff        = 50 * time.Millisecond
+)
+
+// querier is the call surface the workloads use. *testerPool implements it
+// directly; --middleware puts a middleware in front of it.
+type querier interface {
+	QueryRowFunc(ctx context.Context, rowFunc func(ctx context.Context, row pgx.Row) error, sql string, optionsAndArgs ...any) error
+	QueryFunc(ctx context.Context, rowsFunc func(ctx context.Context, rows pgx.Rows) error, sql string, optionsAndArgs ...any) error
+	ExecFunc(ctx context.Context, tagFunc func(ctx context.Context, tag pgconn.CommandTag, err error) error, sql string, arguments ...any) error
+	BeginTxFunc(ctx context.Context, txOptions pgx.TxOptions, txFunc func(pgx.Tx) error) error
+}
+
+// middleware wraps a pool the way a typical service wraps crdbpool: every
+// call gets its own deadline, is retried a few times on errors that are safe
+// to retry once crdbpool's own retries are exhausted, and is metered per
+// operation. Latencies the workloads record then include the middleware,
+// like an application's would.
+type middleware struct {
+	next    querier
+	name    string
+	timeout time.Duration // per-call deadline; 0 => none
+	retries int
+	backoff *backoff
+
+	mu      sync.Mutex
+	ops     map[string]*opStats
+	retried atomic.Int64
+}
+
+func newMiddleware(next querier, name string, timeout time.Duration, retries int, bo *backoff) *middleware {
+	return &middleware{next: next, name: name, timeout: timeout, retries: retries, backoff: bo, ops: map[string]*opStats{}}
+}
+
+func (m *middleware) QueryRowFunc(ctx context.Context, rowFunc func(ctx context.Context, row pgx.Row) error, sql string, optionsAndArgs ...any) error {
+	return m.call(ctx, "query_row", func(ctx context.Context) error {
+		return m.next.QueryRowFunc(ctx, rowFunc, sql, optionsAndArgs...)
+	})
+}
+
+func (m *middleware) QueryFunc(ctx context.Context, rowsFunc func(ctx context.Context, rows pgx.Rows) error, sql string, optionsAndArgs ...any) error {
+	return m.call(ctx, "query", func(ctx context.Context) error {
+		return m.next.QueryFunc(ctx, rowsFunc, sql, optionsAndArgs...)
+	})
+}
+
+func (m *middleware) ExecFunc(ctx context.Context, tagFunc func(ctx context.Context, tag pgconn.CommandTag, err error) error, sql string, arguments ...any) error {
+	return m.call(ctx, "exec", func(ctx context.Context) error {
+		return m.next.ExecFunc(ctx, tagFunc, sql, arguments...)
+	})
+}
+
+func (m *middleware) BeginTxFunc(ctx context.Context, txOptions pgx.TxOptions, txFunc func(pgx.Tx) error) error {
+	return m.call(ctx, "tx", func(ctx context.Context) error {
+		return m.next.BeginTxFunc(ctx, txOptions, txFunc)
+	})
+}
+
+func (m *middleware) call(ctx context.Context, op string, f func(ctx context.Context) error) error {
+	start := time.Now()
+	var err error
+	var attemptStart time.Time
+	var sleep, slept time.Duration
+	for attempt := 0; ; attempt++ {
+		cctx, cancel := ctx, context.CancelFunc(func() {})
+		if m.timeout > 0 {
+			cctx, cancel = context.WithTimeout(ctx, m.timeout)
+		}
+		attemptStart = time.Now()
+		err = f(cctx)
+		cancel()
+		if err == nil || attempt >= m.retries || ctx.Err() != nil || !appRetryable(err) {
+			break
+		}
+		m.retried.Add(1)
+		sleep = m.backoff.next(attempt, sleep)
+		slept += sleep
+		sleepCtx(ctx, sleep)
+	}
+	d := time.Since(start)
+	if slept > 0 {
+		m.backoff.record(d-time.Since(attemptStart), slept, err)
+	}
+	m.stats(op).record(d, err)
+	return err
+}
+
+func (m *middleware) stats(op string) *opStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.ops[op]
+	if s == nil {
+		s = &opStats{}
+		s.begin()
+		m.ops[op] = s
+	}
+	return s
+}
+
+// appRetryable reports whether an application would retry err: the call
+// never reached the server, or it failed with a serialization failure or a
+// connection-level error that outlasted crdbpool's retries. A deadline is
+// never retried; the request is over.
+func appRetryable(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if pgconn.SafeToRetry(err) {
+		return true
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "40001" || pgErr.Code == "57P01" || strings.HasPrefix(pgErr.Code, "08")
+	}
+	return false
+}
+
+// summaries returns the per-operation stats keyed "<pool>.<op>".
+func (m *middleware) summaries() map[string]opSummary {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := map[string]opSummary{}
+	for op, s := range m.ops {
+		s.end()
+		out[m.name+"."+op] = s.summary()
+	}
+	return out
+}
+
+func (m *middleware) logSummary() map[string]opSummary {
+	sums := m.summaries()
+	for _, op := range slices.Sorted(maps.Keys(sums)) {
+		slog.Info("middleware", "op", op, "stats", sums[op])
+	}
+	slog.Info("middleware retries", "pool", m.name, "retried", m.retried.Load())
+	return sums
+}
+
+// logBackoff logs and returns the retries' overhead under the strategy.
+func (m *middleware) logBackoff() backoffSummary {
+	s := m.backoff.summary()
+	slog.Info("retry strategy", "pool", m.name, "strategy", s.Strategy, "retried_calls", s.Calls, "retried_ok", s.OK,
+		"backoff", s.Backoff, "overhead_p50", s.P50, "overhead_p99", s.P99, "overhead_mean", s.Mean)
+	return s
+}
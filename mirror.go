@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	crdbpool "github.com/authzed/crdbpool/pkg"
+)
+
+const defaultMirrorTimeTolerance = time.Second
+
+// mirrorResult is the outcome of one execution of a mirrored query.
+type mirrorResult struct {
+	Rows [][]any
+	Err  error
+	Dur  time.Duration
+}
+
+// mirror duplicates reader queries to a secondary pool and compares results
+// and latencies against the primary.
+type mirror struct {
+	pool      *crdbpool.RetryPool
+	tolerance time.Duration
+
+	primaryLat latencyHistogram
+	mirrorLat  latencyHistogram
+
+	mu          sync.Mutex
+	queries     int
+	matched     int
+	divergences map[string]int // divergence kind -> count
+	slower      int            // mirror slower than primary
+	deltaSum    time.Duration  // sum of (mirror - primary) latency
+}
+
+func newMirror(pool *crdbpool.RetryPool, tolerance time.Duration) *mirror {
+	return &mirror{pool: pool, tolerance: tolerance, divergences: map[string]int{}}
+}
+
+// start runs the query against the mirror pool in the background and returns
+// a channel that receives its result.
+func (m *mirror) start(ctx context.Context, sql string, args ...any) <-chan mirrorResult {
+	ch := make(chan mirrorResult, 1)
+	go func() {
+		var res mirrorResult
+		begin := time.Now()
+		res.Err = m.pool.QueryFunc(ctx, func(ctx context.Context, rows pgx.Rows) error {
+			for rows.Next() {
+				vals, err := rows.Values()
+				if err != nil {
+					return err
+				}
+				res.Rows = append(res.Rows, vals)
+			}
+			return rows.Err()
+		}, sql, args...)
+		res.Dur = time.Since(begin)
+		ch <- res
+	}()
+	return ch
+}
+
+// compare records the primary and mirror outcomes for one query and logs any
+// divergence.
+func (m *mirror) compare(label string, primary, secondary mirrorResult) {
+	m.primaryLat.observe(primary.Dur)
+	m.mirrorLat.observe(secondary.Dur)
+
+	kind, detail := m.diff(primary, secondary)
+
+	m.mu.Lock()
+	m.queries++
+	m.deltaSum += secondary.Dur - primary.Dur
+	if secondary.Dur > primary.Dur {
+		m.slower++
+	}
+	if kind == "" {
+		m.matched++
+	} else {
+		m.divergences[kind]++
+	}
+	m.mu.Unlock()
+
+	if kind != "" {
+		slog.Warn("mirror divergence", "query", label, "kind", kind, "detail", detail, "primary_duration", primary.Dur, "mirror_duration", secondary.Dur)
+	}
+}
+
+func (m *mirror) diff(primary, secondary mirrorResult) (kind, detail string) {
+	switch {
+	case primary.Err != nil && secondary.Err != nil:
+		return "both-error", fmt.Sprintf("primary: %v; mirror: %v", primary.Err, secondary.Err)
+	case primary.Err != nil:
+		return "primary-error", primary.Err.Error()
+	case secondary.Err != nil:
+		return "mirror-error", secondary.Err.Error()
+	}
+	if len(primary.Rows) != len(secondary.Rows) {
+		return "row-count", fmt.Sprintf("primary=%d mirror=%d", len(primary.Rows), len(secondary.Rows))
+	}
+	for i := range primary.Rows {
+		p, s := primary.Rows[i], secondary.Rows[i]
+		if len(p) != len(s) {
+			return "column-count", fmt.Sprintf("row %d: primary=%d mirror=%d", i, len(p), len(s))
+		}
+		for j := range p {
+			if !m.valuesEqual(p[j], s[j]) {
+				return "value", fmt.Sprintf("row %d col %d: primary=%v mirror=%v", i, j, p[j], s[j])
+			}
+		}
+	}
+	return "", ""
+}
+
+// valuesEqual compares two column values; timestamps are compared within the
+// configured tolerance since two clusters never agree on now().
+func (m *mirror) valuesEqual(a, b any) bool {
+	ta, aok := a.(time.Time)
+	tb, bok := b.(time.Time)
+	if aok && bok {
+		d := ta.Sub(tb)
+		if d < 0 {
+			d = -d
+		}
+		return d <= m.tolerance
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func (m *mirror) logSummary() {
+	m.mu.Lock()
+	queries, matched, slower, deltaSum := m.queries, m.matched, m.slower, m.deltaSum
+	divergences := make(map[string]int, len(m.divergences))
+	for k, v := range m.divergences {
+		divergences[k] = v
+	}
+	m.mu.Unlock()
+	if queries == 0 {
+		slog.Info("mirror summary: no queries mirrored")
+		return
+	}
+	slog.Info("mirror summary", "queries", queries, "matched", matched, "diverged", queries-matched, "divergences", divergences,
+		"primary_latency", &m.primaryLat, "mirror_latency", &m.mirrorLat,
+		"mirror_slower", slower, "mean_delta", (deltaSum / time.Duration(queries)).Round(time.Microsecond))
+}
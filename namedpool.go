@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	defaultPoolMaxConns = 4
+	defaultPoolSQL      = sqlNow
+)
+
+// How a named pool's workload issues its statement.
+const (
+	poolModeQuery = "query" // QueryFunc, rows read and discarded
+	poolModeExec  = "exec"  // ExecFunc
+	poolModeTx    = "tx"    // Exec inside BeginTxFunc
+)
+
+var poolModes = []string{poolModeQuery, poolModeExec, poolModeTx}
+
+var poolNameRE = regexp.MustCompile(`^[a-z][a-z0-9_-]*$`)
+
+// poolSpecKeys are the keys of a --pool spec. sql comes last in a config
+// file's rendering but may hold commas itself, so a comma only separates
+// keys when one of these follows it.
+var poolSpecKeys = []string{"name", "max-conns", "conc", "iterations", "sleep", "mode", "dsn", "sql"}
+
+// poolSpec is a --pool: a named pool alongside the reader and writer, with a
+// workload of its own that runs one statement per call, e.g.
+//
+//	migration:max-conns=2,conc=1,sleep=5s,mode=exec,sql=UPDATE t SET v = v + 1 WHERE id = 1
+type poolSpec struct {
+	Name       string
+	MaxConns   int32
+	Conc       int
+	Iterations int           // 0 => --iterations
+	Sleep      time.Duration // between batches
+	Mode       string        // poolModes
+	DSN        string        // "" => $DATABASE_URL
+	SQL        string
+}
+
+// parsePoolSpec parses name:key=value,... or, as a config file renders a
+// map, key=value,... with a name key.
+func parsePoolSpec(s string) (poolSpec, error) {
+	ps := poolSpec{MaxConns: defaultPoolMaxConns, Conc: 1, Sleep: defaultReaderSleep, Mode: poolModeQuery, SQL: defaultPoolSQL}
+	spec := strings.TrimSpace(s)
+	if colon := strings.IndexByte(spec, ':'); colon >= 0 && (strings.IndexByte(spec, '=') < 0 || colon < strings.IndexByte(spec, '=')) {
+		ps.Name, spec = spec[:colon], spec[colon+1:]
+	}
+	for _, kv := range splitPoolSpec(spec) {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return ps, fmt.Errorf("pool %q: invalid option %q (want key=value)", s, kv)
+		}
+		var err error
+		switch k = strings.TrimSpace(strings.ReplaceAll(k, "_", "-")); k {
+		case "name":
+			ps.Name = v
+		case "max-conns":
+			var n int64
+			n, err = strconv.ParseInt(v, 10, 32)
+			ps.MaxConns = int32(n)
+		case "conc":
+			ps.Conc, err = strconv.Atoi(v)
+		case "iterations":
+			ps.Iterations, err = strconv.Atoi(v)
+		case "sleep":
+			ps.Sleep, err = time.ParseDuration(v)
+		case "mode":
+			ps.Mode = v
+		case "dsn":
+			ps.DSN = v
+		case "sql":
+			ps.SQL = strings.TrimSpace(v)
+		default:
+			return ps, fmt.Errorf("pool %q: unknown option %q (want one of %s)", s, k, strings.Join(poolSpecKeys, ", "))
+		}
+		if err != nil {
+			return ps, fmt.Errorf("pool %q: %s: %w", s, k, err)
+		}
+	}
+	switch {
+	case !poolNameRE.MatchString(ps.Name):
+		return ps, fmt.Errorf("pool %q: name must match %s", s, poolNameRE)
+	case ps.Name == "reader" || ps.Name == "writer" || ps.Name == "mirror":
+		return ps, fmt.Errorf("pool %q: %s is a built-in pool", s, ps.Name)
+	case ps.MaxConns <= 0 || ps.Conc <= 0 || ps.Iterations < 0 || ps.Sleep < 0:
+		return ps, fmt.Errorf("pool %q: max-conns and conc must be > 0, iterations and sleep >= 0", s)
+	case !slices.Contains(poolModes, ps.Mode):
+		return ps, fmt.Errorf("pool %q: unknown mode %q (want one of %s)", s, ps.Mode, strings.Join(poolModes, ", "))
+	case ps.SQL == "":
+		return ps, fmt.Errorf("pool %q: empty sql", s)
+	}
+	return ps, nil
+}
+
+// splitPoolSpec splits key=value,... at the commas followed by a key.
+func splitPoolSpec(spec string) []string {
+	if spec == "" {
+		return nil
+	}
+	var out []string
+	start := 0
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != ',' {
+			continue
+		}
+		next := strings.TrimLeft(spec[i+1:], " ")
+		if slices.ContainsFunc(poolSpecKeys, func(k string) bool {
+			return strings.HasPrefix(next, k+"=") || strings.HasPrefix(next, strings.ReplaceAll(k, "-", "_")+"=")
+		}) {
+			out = append(out, spec[start:i])
+			start = i + 1
+		}
+	}
+	return append(out, spec[start:])
+}
+
+func (ps poolSpec) String() string {
+	return fmt.Sprintf("%s:max-conns=%d,conc=%d,iterations=%d,sleep=%s,mode=%s,sql=%s", ps.Name, ps.MaxConns, ps.Conc, ps.Iterations, ps.Sleep, ps.Mode, ps.SQL)
+}
+
+// statement is the spec's SQL, with {table} standing for the run's
+// workload table.
+func (ps poolSpec) statement(table string) string {
+	return strings.ReplaceAll(ps.SQL, "{table}", table)
+}
+
+// query returns the workload's call: the spec's statement through db, in its
+// mode; tx are the options of mode=tx's transactions.
+func (ps poolSpec) query(db querier, table string, tx pgx.TxOptions) func(ctx context.Context, i int) error {
+	sql := ps.statement(table)
+	return func(ctx context.Context, i int) error {
+		var err error
+		switch ps.Mode {
+		case poolModeExec:
+			err = db.ExecFunc(ctx, func(_ context.Context, _ pgconn.CommandTag, err error) error { return err }, sql)
+		case poolModeTx:
+			err = db.BeginTxFunc(ctx, tx, func(tx pgx.Tx) error {
+				_, err := tx.Exec(ctx, sql)
+				return err
+			})
+		default:
+			err = db.QueryFunc(ctx, func(_ context.Context, rows pgx.Rows) error {
+				for rows.Next() {
+				}
+				return rows.Err()
+			}, sql)
+		}
+		if err == nil {
+			logQuery(ctx, "statement ok", "workload", ps.Name, "iteration", i+1, "mode", ps.Mode)
+		}
+		return err
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const notifyTimeout = 10 * time.Second
+
+const (
+	notifyFormatJSON  = "json"
+	notifyFormatSlack = "slack"
+)
+
+// notifyOn values: when the run's end is posted to --notify-url.
+const (
+	notifyAlways  = "always"
+	notifyFailure = "failure"
+)
+
+// notification is the compact end-of-run summary posted to --notify-url.
+type notification struct {
+	RunID      string                    `json:"run_id"`
+	Outcome    string                    `json:"outcome"` // ok or failed
+	Error      string                    `json:"error,omitempty"`
+	ExitCode   int                       `json:"exit_code"`
+	StartedAt  time.Time                 `json:"started_at"`
+	Duration   string                    `json:"duration"`
+	Target     string                    `json:"target"` // redacted DSN info
+	Components map[string]string         `json:"components,omitempty"`
+	Workloads  map[string]notifyWorkload `json:"workloads,omitempty"`
+	SLO        *bool                     `json:"slo_pass,omitempty"`
+	Failed     []string                  `json:"failed_assertions,omitempty"`
+	Results    string                    `json:"results,omitempty"` // --notify-link, or the --results-out path
+}
+
+type notifyWorkload struct {
+	Queries   uint64  `json:"queries"`
+	Errors    uint64  `json:"errors"`
+	ErrorRate string  `json:"error_rate"`
+	QPS       float64 `json:"qps"`
+	P50       string  `json:"p50"`
+	P99       string  `json:"p99"`
+}
+
+// newNotification summarizes res, which ended with err. A run that failed
+// before its workloads started has no stats, only the error.
+func newNotification(cfg Config, res runResult, err error) notification {
+	n := notification{
+		RunID:      res.RunID,
+		Outcome:    "ok",
+		StartedAt:  res.StartedAt,
+		Duration:   time.Since(res.StartedAt).Round(time.Second).String(),
+		Target:     res.Settings.Target,
+		Components: res.Components,
+		Workloads:  map[string]notifyWorkload{},
+		Results:    cfg.NotifyLink,
+	}
+	if err != nil {
+		n.Outcome, n.Error, n.ExitCode = "failed", err.Error(), exitCode(err)
+	}
+	if !res.EndedAt.IsZero() {
+		n.Duration = res.EndedAt.Sub(res.StartedAt).Round(time.Second).String()
+	}
+	for name, s := range res.Workloads {
+		n.Workloads[name] = notifyWorkload{Queries: s.Queries, Errors: s.Errors, ErrorRate: formatRate(opErrorRate(s)),
+			QPS: s.Throughput, P50: mdDuration(s.P50), P99: mdDuration(s.P99)}
+	}
+	if res.SLO != nil {
+		n.SLO = &res.SLO.Pass
+	}
+	for _, a := range res.Assertions {
+		if !a.Pass {
+			n.Failed = append(n.Failed, a.Name)
+		}
+	}
+	if n.Results == "" && cfg.ResultsOut != "" {
+		n.Results, _ = filepath.Abs(cfg.ResultsOut)
+	}
+	return n
+}
+
+// slackText renders n as a Slack message.
+func (n notification) slackText() string {
+	var b strings.Builder
+	icon := ":white_check_mark:"
+	if n.Outcome != "ok" {
+		icon = ":x:"
+	}
+	fmt.Fprintf(&b, "%s crdbpool-tester run `%s` *%s* after %s (exit %d) against %s\n", icon, n.RunID, n.Outcome, n.Duration, n.ExitCode, n.Target)
+	if n.Error != "" {
+		fmt.Fprintf(&b, "> %s\n", strings.ReplaceAll(n.Error, "\n", " "))
+	}
+	for _, name := range slices.Sorted(maps.Keys(n.Workloads)) {
+		w := n.Workloads[name]
+		fmt.Fprintf(&b, "• *%s*: %d queries, %d errors (%s), %.1f qps, p50 %s, p99 %s\n", name, w.Queries, w.Errors, w.ErrorRate, w.QPS, w.P50, w.P99)
+	}
+	if n.SLO != nil {
+		fmt.Fprintf(&b, "SLO: %s\n", map[bool]string{true: "met", false: "*violated*"}[*n.SLO])
+	}
+	if len(n.Failed) > 0 {
+		fmt.Fprintf(&b, "Failed assertions: %s\n", strings.Join(n.Failed, ", "))
+	}
+	if n.Results != "" {
+		fmt.Fprintf(&b, "Results: %s\n", n.Results)
+	}
+	return b.String()
+}
+
+// notifyFormatFor is format, or for "" slack when u is a Slack webhook and
+// json otherwise.
+func notifyFormatFor(format, u string) string {
+	if format != "" {
+		return format
+	}
+	if pu, err := url.Parse(u); err == nil && pu.Host == "hooks.slack.com" {
+		return notifyFormatSlack
+	}
+	return notifyFormatJSON
+}
+
+// postNotification posts n to u as format.
+func postNotification(ctx context.Context, u, format string, n notification) error {
+	var payload any = n
+	if notifyFormatFor(format, u) == notifyFormatSlack {
+		payload = map[string]string{"text": n.slackText()}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("notify: %w", withoutURL(err, u))
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("notify: %w", withoutURL(err, u))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("notify: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// notifyRunEnd posts the run's end unless --notify-on failure and it passed.
+// A failed post is logged; it doesn't change the run's outcome.
+func notifyRunEnd(cfg Config, res runResult, err error) {
+	if cfg.NotifyOn == notifyFailure && err == nil {
+		return
+	}
+	// the run's context may be gone by now; the post has its own timeout
+	if perr := postNotification(context.Background(), cfg.NotifyURL, cfg.NotifyFormat, newNotification(cfg, res, err)); perr != nil {
+		slog.Error("notify", "err", perr)
+		return
+	}
+	slog.Info("run end notified", "url", redactedURL(cfg.NotifyURL))
+}
+
+// withoutURL swaps the webhook URL in a *url.Error, which would otherwise
+// quote it whole, for its redacted form.
+func withoutURL(err error, u string) error {
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		return &url.Error{Op: ue.Op, URL: redactedURL(u), Err: ue.Err}
+	}
+	return err
+}
+
+// redactedURL is u with its path and query elided: webhook URLs carry their
+// secret there.
+func redactedURL(u string) string {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return "<invalid url>"
+	}
+	return pu.Scheme + "://" + pu.Host + "/..."
+}
+
+func validateNotify(cfg Config) error {
+	if cfg.NotifyURL == "" {
+		return nil
+	}
+	u, err := url.Parse(cfg.NotifyURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("notify-url: want an http(s) URL")
+	}
+	switch cfg.NotifyFormat {
+	case "", notifyFormatJSON, notifyFormatSlack:
+	default:
+		return fmt.Errorf("notify-format must be json or slack (got %q)", cfg.NotifyFormat)
+	}
+	switch cfg.NotifyOn {
+	case notifyAlways, notifyFailure:
+	default:
+		return fmt.Errorf("notify-on must be always or failure (got %q)", cfg.NotifyOn)
+	}
+	return nil
+}
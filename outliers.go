@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// attemptRecord is one attempt of a wrapped call: how long it took, which
+// node and connection it ran on and how old the connection was.
+type attemptRecord struct {
+	Offset   time.Duration `json:"offset_ns"` // start, relative to the call's
+	Duration time.Duration `json:"duration_ns"`
+	Node     uint32        `json:"node,omitempty"`
+	Conn     string        `json:"conn,omitempty"`
+	ConnAge  time.Duration `json:"conn_age_ns,omitempty"`
+	Version  string        `json:"version,omitempty"` // node's CockroachDB version
+	Err      string        `json:"err,omitempty"`
+}
+
+// outlierRecord is the context captured for a call slower than the outlier
+// threshold, at the moment it returned.
+type outlierRecord struct {
+	At       time.Time       `json:"at"`
+	Pool     string          `json:"pool"`
+	QueryID  string          `json:"qid"`
+	SQL      string          `json:"sql,omitempty"` // empty for transactions
+	Duration time.Duration   `json:"duration_ns"`
+	Err      string          `json:"err,omitempty"`
+	Attempts []attemptRecord `json:"attempts"`
+	Inflight int64           `json:"inflight_calls"` // calls in flight on the pool, this one included
+	InUse    int             `json:"conns_in_use"`   // conns in use across all pools
+	Stat     poolStat        `json:"pool_stat"`
+}
+
+// outlierLog appends outlier records to a file, one JSON object per line.
+type outlierLog struct {
+	threshold time.Duration
+	path      string
+
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+	n   int
+}
+
+func openOutlierLog(path string, threshold time.Duration) (*outlierLog, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("open outliers file: %w", err)
+	}
+	return &outlierLog{threshold: threshold, path: path, f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (o *outlierLog) write(rec outlierRecord) {
+	slog.Warn("latency outlier", "pool", rec.Pool, "duration", rec.Duration, "attempts", len(rec.Attempts), "sql", rec.SQL)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.enc.Encode(rec); err != nil {
+		slog.Error("write outlier", "path", o.path, "err", err)
+		return
+	}
+	o.n++
+}
+
+func (o *outlierLog) Close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.f.Close(); err != nil {
+		slog.Error("close outliers file", "path", o.path, "err", err)
+	}
+	slog.Info("outliers written", "path", o.path, "count", o.n, "threshold", o.threshold)
+}
+
+// recordOutlier captures the context of the call c, which took d.
+func (p *testerPool) recordOutlier(c *callClock, d time.Duration, err error) {
+	rec := outlierRecord{
+		At:       time.Now(),
+		Pool:     p.name,
+		QueryID:  c.qid,
+		SQL:      oneLine(c.sql),
+		Duration: d,
+		Attempts: c.attempts,
+		Inflight: p.cur.Load().inflight.Load(),
+		Stat:     newPoolStat(c.rp.Stat()),
+	}
+	if err != nil {
+		rec.Err = err.Error()
+	}
+	if p.obs.peaks != nil {
+		rec.InUse = p.obs.peaks.inUse()
+	}
+	p.obs.outliers.write(rec)
+}
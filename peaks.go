@@ -0,0 +1,125 @@
+package main
+
+import (
+	"cmp"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// peakTracker records the highest number of connections in use at the same
+// time, process-wide, per pool and per pool and node, and when each peak was
+// first reached. A connection counts as in use from the first statement of
+// an attempt until the attempt ends, so the peaks are what the workload
+// actually needed at once rather than the configured maxima.
+type peakTracker struct {
+	mu    sync.Mutex
+	total peakCounter
+	pools map[string]*peakCounter
+	nodes map[peakKey]*peakCounter
+}
+
+type peakKey struct {
+	pool string
+	node uint32
+}
+
+type peakCounter struct {
+	cur, peak int
+	at        time.Time
+}
+
+func (c *peakCounter) add(d int, now time.Time) {
+	c.cur += d
+	if c.cur > c.peak {
+		c.peak, c.at = c.cur, now
+	}
+}
+
+func newPeakTracker() *peakTracker {
+	return &peakTracker{pools: map[string]*peakCounter{}, nodes: map[peakKey]*peakCounter{}}
+}
+
+// acquire marks one more connection of pool to node in use; node 0 means
+// the node is unknown.
+func (t *peakTracker) acquire(pool string, node uint32) { t.add(pool, node, 1) }
+
+// release undoes acquire.
+func (t *peakTracker) release(pool string, node uint32) { t.add(pool, node, -1) }
+
+func (t *peakTracker) add(pool string, node uint32, d int) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.total.add(d, now)
+	pc := t.pools[pool]
+	if pc == nil {
+		pc = &peakCounter{}
+		t.pools[pool] = pc
+	}
+	pc.add(d, now)
+	k := peakKey{pool, node}
+	nc := t.nodes[k]
+	if nc == nil {
+		nc = &peakCounter{}
+		t.nodes[k] = nc
+	}
+	nc.add(d, now)
+}
+
+// inUse returns the number of connections in use right now, process-wide.
+func (t *peakTracker) inUse() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.total.cur
+}
+
+// peakResult is one recorded peak; Pool and Node are empty for the
+// process-wide peak, Node is empty for a pool's peak.
+type peakResult struct {
+	Pool string    `json:"pool,omitempty"`
+	Node uint32    `json:"node,omitempty"`
+	Peak int       `json:"peak"`
+	At   time.Time `json:"at"`
+}
+
+// results lists the process-wide peak first, then each pool's peak followed
+// by its per-node peaks.
+func (t *peakTracker) results() []peakResult {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := []peakResult{{Peak: t.total.peak, At: t.total.at}}
+	for _, pool := range slices.Sorted(maps.Keys(t.pools)) {
+		pc := t.pools[pool]
+		out = append(out, peakResult{Pool: pool, Peak: pc.peak, At: pc.at})
+		var nodes []peakResult
+		for k, nc := range t.nodes {
+			if k.pool == pool && k.node != 0 {
+				nodes = append(nodes, peakResult{Pool: pool, Node: k.node, Peak: nc.peak, At: nc.at})
+			}
+		}
+		slices.SortFunc(nodes, func(a, b peakResult) int { return cmp.Compare(a.Node, b.Node) })
+		out = append(out, nodes...)
+	}
+	return out
+}
+
+func (t *peakTracker) logSummary() {
+	for _, r := range t.results() {
+		args := []any{"peak", r.Peak}
+		if !r.At.IsZero() {
+			args = append(args, "at", r.At)
+		}
+		switch {
+		case r.Pool == "":
+			args = append(args, "scope", "process")
+		case r.Node == 0:
+			args = append(args, "scope", "pool", "pool", r.Pool)
+		default:
+			args = append(args, "scope", "node", "pool", r.Pool, "node", r.Node)
+		}
+		slog.Info("peak conns in use", args...)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	crdbpool "github.com/authzed/crdbpool/pkg"
+)
+
+// Pool implementations --pool-impl selects.
+const (
+	poolImplCrdbpool = "crdbpool"
+	poolImplPgxpool  = "pgxpool"
+)
+
+var poolImpls = []string{poolImplCrdbpool, poolImplPgxpool}
+
+// basePool is what testerPool runs its calls on: crdbpool's RetryPool or,
+// as a baseline, a plainPool.
+type basePool interface {
+	QueryRowFunc(ctx context.Context, rowFunc func(ctx context.Context, row pgx.Row) error, sql string, optionsAndArgs ...any) error
+	QueryFunc(ctx context.Context, rowsFunc func(ctx context.Context, rows pgx.Rows) error, sql string, optionsAndArgs ...any) error
+	ExecFunc(ctx context.Context, tagFunc func(ctx context.Context, tag pgconn.CommandTag, err error) error, sql string, arguments ...any) error
+	BeginTxFunc(ctx context.Context, txOptions pgx.TxOptions, txFunc func(pgx.Tx) error) error
+	Range(f func(conn *pgx.Conn, nodeID uint32))
+	Node(conn *pgx.Conn) uint32
+	MinConns() uint32
+	Stat() *pgxpool.Stat
+	Close()
+}
+
+var (
+	_ basePool = (*crdbpool.RetryPool)(nil)
+	_ basePool = (*plainPool)(nil)
+)
+
+// plainPool is a vanilla pgxpool behind RetryPool's callback API: one
+// attempt per call on a connection pgxpool picks, no retries, resets, health
+// tracking or balancing. Running the same workload on it measures what
+// crdbpool's layer costs and what it buys.
+type plainPool struct {
+	pool *pgxpool.Pool
+
+	mu    sync.RWMutex
+	conns map[*pgx.Conn]uint32 // open connections and their node
+}
+
+func newPlainPool(ctx context.Context, cfg *pgxpool.Config) (*plainPool, error) {
+	p := &plainPool{conns: map[*pgx.Conn]uint32{}}
+	cfg = cfg.Copy()
+	afterConnect := cfg.AfterConnect
+	cfg.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+		if afterConnect != nil {
+			if err := afterConnect(ctx, conn); err != nil {
+				return err
+			}
+		}
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.conns[conn] = connNode(conn)
+		return nil
+	}
+	beforeClose := cfg.BeforeClose
+	cfg.BeforeClose = func(conn *pgx.Conn) {
+		if beforeClose != nil {
+			beforeClose(conn)
+		}
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		delete(p.conns, conn)
+	}
+	pool, err := pgxpool.NewWithConfig(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	p.pool = pool
+	return p, nil
+}
+
+func (p *plainPool) withConn(ctx context.Context, fn func(conn *pgxpool.Conn) error) error {
+	conn, err := p.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	return fn(conn)
+}
+
+func (p *plainPool) QueryRowFunc(ctx context.Context, rowFunc func(ctx context.Context, row pgx.Row) error, sql string, optionsAndArgs ...any) error {
+	return p.withConn(ctx, func(conn *pgxpool.Conn) error {
+		return rowFunc(ctx, conn.Conn().QueryRow(ctx, sql, optionsAndArgs...))
+	})
+}
+
+func (p *plainPool) QueryFunc(ctx context.Context, rowsFunc func(ctx context.Context, rows pgx.Rows) error, sql string, optionsAndArgs ...any) error {
+	return p.withConn(ctx, func(conn *pgxpool.Conn) error {
+		rows, err := conn.Conn().Query(ctx, sql, optionsAndArgs...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		return rowsFunc(ctx, rows)
+	})
+}
+
+func (p *plainPool) ExecFunc(ctx context.Context, tagFunc func(ctx context.Context, tag pgconn.CommandTag, err error) error, sql string, arguments ...any) error {
+	return p.withConn(ctx, func(conn *pgxpool.Conn) error {
+		tag, err := conn.Conn().Exec(ctx, sql, arguments...)
+		return tagFunc(ctx, tag, err)
+	})
+}
+
+func (p *plainPool) BeginTxFunc(ctx context.Context, txOptions pgx.TxOptions, txFunc func(pgx.Tx) error) error {
+	return p.withConn(ctx, func(conn *pgxpool.Conn) error {
+		return pgx.BeginTxFunc(ctx, conn, txOptions, txFunc)
+	})
+}
+
+func (p *plainPool) Range(f func(conn *pgx.Conn, nodeID uint32)) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for conn, node := range p.conns {
+		f(conn, node)
+	}
+}
+
+func (p *plainPool) Node(conn *pgx.Conn) uint32 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.conns[conn]
+}
+
+func (p *plainPool) MinConns() uint32 { return uint32(p.pool.Config().MinConns) }
+
+func (p *plainPool) Stat() *pgxpool.Stat { return p.pool.Stat() }
+
+func (p *plainPool) Close() { p.pool.Close() }
@@ -0,0 +1,651 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	crdbpool "github.com/authzed/crdbpool/pkg"
+)
+
+// poolSettings are the pool parameters that can be changed by a hot reload.
+type poolSettings struct {
+	MaxConns      int32         `json:"max_conns"`
+	RetryAttempts uint8         `json:"retry_attempts"`
+	RetryBackoff  time.Duration `json:"retry_backoff_ns"` // passed to crdbpool as the connect rate interval
+}
+
+func (s poolSettings) String() string {
+	return fmt.Sprintf("max-conns=%d retry-attempts=%d retry-backoff=%s", s.MaxConns, s.RetryAttempts, s.RetryBackoff)
+}
+
+// poolGen is one incarnation of the underlying pool. A reload retires the
+// current generation and builds a new one from updated settings.
+type poolGen struct {
+	rp       basePool
+	n        int
+	settings poolSettings
+
+	inflight  atomic.Int64
+	retired   atomic.Bool
+	disrupted atomic.Int64 // calls in flight at retirement that then failed
+}
+
+// testerPool wraps a crdbpool.RetryPool with the tester's own hooks. The
+// callbacks passed to the *Func methods run once per attempt, which lets the
+// wrapper observe and inject faults into individual retries. The underlying
+// pool can be rebuilt with new settings while the workload keeps using the
+// wrapper, and with --pool-impl pgxpool is a plainPool instead.
+type testerPool struct {
+	name string
+	impl string // poolImplCrdbpool or poolImplPgxpool
+	fp   *failpoints
+	cfg  *pgxpool.Config // with the wrapper's hooks installed
+	ht   *crdbpool.NodeHealthTracker
+
+	mu      sync.Mutex // serializes reloads
+	cur     atomic.Pointer[poolGen]
+	retired sync.WaitGroup
+
+	retries   retryStats
+	ambiguous ambiguousStats
+	timings   connTimings
+	prepares  prepareStats
+	acquire   acquireWatch
+	nodes     nodeStats
+	obs       poolObservers
+}
+
+// connInfo is what the wrapper learned about a connection when it connected.
+type connInfo struct {
+	born    time.Time
+	node    uint32        // CockroachDB node ID; 0 => unknown
+	version string        // CockroachDB build version of the node, if known
+	uses    *atomic.Int64 // acquires, counted with --workload conn-churn
+}
+
+// connInfos holds the connInfo of every open connection of every testerPool,
+// keyed by *pgx.Conn, so the shared tracer can label records by node.
+var connInfos sync.Map
+
+func lookupConn(conn *pgx.Conn) (connInfo, bool) {
+	v, ok := connInfos.Load(conn)
+	if !ok {
+		return connInfo{}, false
+	}
+	return v.(connInfo), true
+}
+
+// connNode returns the node ID of conn, 0 if unknown.
+func connNode(conn *pgx.Conn) uint32 {
+	info, _ := lookupConn(conn)
+	return info.node
+}
+
+// poolObservers are shared by all of a run's pools; nil fields are disabled.
+type poolObservers struct {
+	peaks    *peakTracker
+	outliers *outlierLog
+	upgrade  *upgradeDrill
+	churn    *connChurn
+	leaks    *leakTracker
+	statsd   *statsdEmitter
+
+	acquireThreshold time.Duration // see acquireWatch
+}
+
+func newTesterPool(ctx context.Context, name, impl string, cfg *pgxpool.Config, ht *crdbpool.NodeHealthTracker, obs poolObservers, maxRetries uint8, connectRate time.Duration) (*testerPool, error) {
+	p := &testerPool{name: name, impl: impl, fp: newFailpoints(), ht: ht, obs: obs}
+	p.acquire.pool, p.acquire.threshold = name, obs.acquireThreshold
+	cfg = cfg.Copy()
+	afterConnect := cfg.AfterConnect
+	cfg.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+		info := connInfo{born: time.Now(), version: conn.PgConn().ParameterStatus("crdb_version"), uses: new(atomic.Int64)}
+		var node *int64
+		if err := conn.QueryRow(ctx, sqlNodeID).Scan(&node); err != nil {
+			slog.DebugContext(ctx, "read node id", "pool", p.name, "conn", safeRemoteAddr(conn), "err", err)
+		} else if node != nil {
+			info.node = uint32(*node)
+		}
+		if info.version == "" && p.obs.upgrade != nil {
+			// older servers don't report it at startup; the drill needs it
+			if err := conn.QueryRow(ctx, sqlCrdbVersion).Scan(&info.version); err != nil {
+				return fmt.Errorf("read node version: %w", err)
+			}
+		}
+		connInfos.Store(conn, info)
+		if afterConnect != nil {
+			return afterConnect(ctx, conn)
+		}
+		return nil
+	}
+	beforeClose := cfg.BeforeClose
+	cfg.BeforeClose = func(conn *pgx.Conn) {
+		connInfos.Delete(conn)
+		if beforeClose != nil {
+			beforeClose(conn)
+		}
+	}
+	beforeAcquire := cfg.BeforeAcquire
+	cfg.BeforeAcquire = func(ctx context.Context, conn *pgx.Conn) bool {
+		if d, ok := p.fp.fire(fpDelayAcquire); ok {
+			slog.InfoContext(ctx, "failpoint fired", "pool", p.name, "failpoint", fpDelayAcquire, "delay", d)
+			sleepCtx(ctx, d)
+		}
+		if _, ok := p.fp.fire(fpDropAcquire); ok {
+			slog.InfoContext(ctx, "failpoint fired", "pool", p.name, "failpoint", fpDropAcquire, "conn", safeRemoteAddr(conn), "node", connNode(conn))
+			return false
+		}
+		if p.obs.churn != nil {
+			p.obs.churn.acquire(ctx, conn)
+		}
+		if beforeAcquire != nil {
+			return beforeAcquire(ctx, conn)
+		}
+		return true
+	}
+	if obs.churn != nil {
+		obs.churn.stats(name)
+		afterRelease := cfg.AfterRelease
+		cfg.AfterRelease = func(conn *pgx.Conn) bool {
+			if !obs.churn.release(name, conn) {
+				return false
+			}
+			return afterRelease == nil || afterRelease(conn)
+		}
+	}
+	timing := connTimingTracer{pool: name, t: &p.timings, w: &p.acquire}
+	tracers := multiTracer{attemptTracer{}, timing, prepareTracer{&p.prepares}}
+	if cfg.ConnConfig.Tracer != nil {
+		tracers = append(multiTracer{cfg.ConnConfig.Tracer}, tracers...)
+	}
+	if obs.leaks != nil {
+		tracers = append(tracers, leakTracer{pool: name, l: obs.leaks})
+	}
+	cfg.ConnConfig.Tracer = tracers
+	if cfg.ConnConfig.DialFunc != nil {
+		cfg.ConnConfig.DialFunc = timedDialer(cfg.ConnConfig.DialFunc)
+	}
+	p.cfg = cfg
+	g, err := p.build(ctx, 1, poolSettings{MaxConns: cfg.MaxConns, RetryAttempts: maxRetries, RetryBackoff: connectRate})
+	if err != nil {
+		return nil, err
+	}
+	p.cur.Store(g)
+	return p, nil
+}
+
+func (p *testerPool) build(ctx context.Context, n int, s poolSettings) (*poolGen, error) {
+	cfg := p.cfg.Copy()
+	cfg.MaxConns = s.MaxConns
+	if cfg.MinConns > cfg.MaxConns {
+		cfg.MinConns = cfg.MaxConns
+	}
+	var rp basePool
+	var err error
+	if p.impl == poolImplPgxpool {
+		rp, err = newPlainPool(ctx, cfg)
+	} else {
+		rp, err = crdbpool.NewRetryPool(ctx, p.name, cfg, p.ht, s.RetryAttempts, s.RetryBackoff)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &poolGen{rp: rp, n: n, settings: s}, nil
+}
+
+// pool returns the current underlying pool.
+func (p *testerPool) pool() basePool { return p.cur.Load().rp }
+
+func (p *testerPool) settings() poolSettings { return p.cur.Load().settings }
+
+func (p *testerPool) Stat() *pgxpool.Stat { return p.pool().Stat() }
+
+// Close closes the current pool and waits for retired generations to close.
+func (p *testerPool) Close() {
+	p.pool().Close()
+	p.retired.Wait()
+}
+
+// reload swaps in a new underlying pool built from s. Calls in flight keep
+// running on the previous pool, which is closed once they finish; calls that
+// fail after the swap are counted as disrupted and reported on the timeline.
+func (p *testerPool) reload(ctx context.Context, s poolSettings, tl *timeline) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	old := p.cur.Load()
+	g, err := p.build(ctx, old.n+1, s)
+	if err != nil {
+		return fmt.Errorf("rebuild %s pool: %w", p.name, err)
+	}
+	p.cur.Store(g)
+	old.retired.Store(true)
+	inflight := old.inflight.Load()
+	tl.record("reload", "%s: gen %d -> %d (%s), %d calls in flight on gen %d", p.name, old.n, g.n, s, inflight, old.n)
+	p.retired.Add(1)
+	go func() {
+		defer p.retired.Done()
+		for old.inflight.Load() > 0 {
+			time.Sleep(50 * time.Millisecond)
+		}
+		old.rp.Close()
+		tl.record("reload", "%s: gen %d drained and closed, %d of %d in-flight calls disrupted", p.name, old.n, old.disrupted.Load(), inflight)
+	}()
+	return nil
+}
+
+// enter pins the current generation for the duration of one call; the
+// returned func must be called with the call's result. A generation a
+// reload retired between the load and the pin may be closed already, so
+// the call moves on to the new one.
+func (p *testerPool) enter() (basePool, func(error)) {
+	g := p.cur.Load()
+	g.inflight.Add(1)
+	for g.retired.Load() {
+		g.inflight.Add(-1)
+		g = p.cur.Load()
+		g.inflight.Add(1)
+	}
+	return g.rp, func(err error) {
+		if err != nil && g.retired.Load() {
+			g.disrupted.Add(1)
+		}
+		g.inflight.Add(-1)
+	}
+}
+
+// attempt runs before an attempt's results are handed to the caller's
+// callback; a non-nil error replaces the attempt's outcome. Injected errors
+// happen after the statement was sent, like a real failure mid-flight.
+func (p *testerPool) attempt(ctx context.Context, n int) error {
+	if pr := probeFrom(ctx); pr != nil {
+		// a retry probe is deterministic: its own forced retries, no failpoints
+		if n > pr.force {
+			return nil
+		}
+		slog.DebugContext(ctx, "retry probe forced retry", "pool", p.name, "attempt", n)
+		return &pgconn.PgError{Code: crdbpool.CrdbRetryErrCode, Message: "injected by retry probe"}
+	}
+	if n > 1 {
+		if d, ok := p.fp.fire(fpDelayRetry); ok {
+			slog.InfoContext(ctx, "failpoint fired", "pool", p.name, "failpoint", fpDelayRetry, "attempt", n, "delay", d)
+			sleepCtx(ctx, d)
+		}
+	}
+	if _, ok := p.fp.fire(fpForceRetry); ok {
+		slog.InfoContext(ctx, "failpoint fired", "pool", p.name, "failpoint", fpForceRetry, "attempt", n)
+		return &pgconn.PgError{Code: crdbpool.CrdbRetryErrCode, Message: "injected by failpoint " + fpForceRetry}
+	}
+	if _, ok := p.fp.fire(fpForceReset); ok {
+		slog.InfoContext(ctx, "failpoint fired", "pool", p.name, "failpoint", fpForceReset, "attempt", n)
+		return &pgconn.PgError{Code: crdbpool.CrdbServerNotAcceptingClients, Message: "injected by failpoint " + fpForceReset}
+	}
+	return nil
+}
+
+// callClock times one wrapped call and its attempts. attemptTracer stamps
+// the start of each attempt's first statement and the connection it runs
+// on; the attempt callback ends the attempt once the caller's callback has
+// returned.
+type callClock struct {
+	p        *testerPool
+	rp       basePool
+	sql      string
+	qid      string
+	start    time.Time
+	attempt  time.Time // zero until the current attempt sends a statement
+	cur      attemptRecord
+	attempts []attemptRecord
+	n        int
+	probe    *retryProbe
+	fresh    bool // the call ran on a connection's first acquire (--workload conn-churn)
+
+	acquireWait time.Duration // summed over the call's acquires
+	acquired    time.Time     // end of the call's first successful acquire
+	report      *callReport
+	ambiguous   int // attempts that ended with 40003
+}
+
+// callReport, in a call's context, receives how long the call waited for
+// connections, for workloads that measure the pool itself.
+type callReport struct {
+	acquireWait time.Duration
+	acquired    time.Time // zero if the call never got a connection
+	attempts    int
+	ambiguous   int // attempts that ended with 40003
+
+	onAcquire func() // if set, called once the call has its first connection
+}
+
+type callReportKey struct{}
+
+func withCallReport(ctx context.Context, r *callReport) context.Context {
+	return context.WithValue(ctx, callReportKey{}, r)
+}
+
+type callClockKey struct{}
+
+func (p *testerPool) startCall(ctx context.Context, rp basePool, sql string) (context.Context, *callClock) {
+	ctx, qid := withQueryID(ctx)
+	c := &callClock{p: p, rp: rp, sql: sql, qid: qid, start: time.Now(), probe: probeFrom(ctx)}
+	c.report, _ = ctx.Value(callReportKey{}).(*callReport)
+	return context.WithValue(ctx, callClockKey{}, c), c
+}
+
+func (c *callClock) startAttempt(conn *pgx.Conn) {
+	c.attempt = time.Now()
+	c.cur = attemptRecord{Offset: c.attempt.Sub(c.start), Node: c.rp.Node(conn), Conn: safeRemoteAddr(conn)}
+	if info, ok := lookupConn(conn); ok {
+		c.cur.ConnAge = c.attempt.Sub(info.born)
+		c.cur.Version = info.version
+		if info.node != 0 {
+			c.cur.Node = info.node
+		}
+	}
+	if c.p.obs.peaks != nil {
+		c.p.obs.peaks.acquire(c.p.name, c.cur.Node)
+	}
+}
+
+func (c *callClock) endAttempt(err error) {
+	if c.attempt.IsZero() {
+		return
+	}
+	c.cur.Duration = time.Since(c.attempt)
+	if err != nil {
+		c.cur.Err = err.Error()
+	}
+	c.attempts = append(c.attempts, c.cur)
+	c.p.retries.recordAttempt(c.cur.Duration)
+	if isAmbiguous(err) {
+		c.ambiguous++
+		c.p.ambiguous.recordAttempt(c.cur.Node)
+	}
+	if c.p.obs.peaks != nil {
+		c.p.obs.peaks.release(c.p.name, c.cur.Node)
+	}
+	c.attempt = time.Time{}
+}
+
+func (c *callClock) end(err error) {
+	c.endAttempt(nil) // an attempt that failed before reaching its callback
+	d := time.Since(c.start)
+	c.p.retries.recordCall(c.n, d)
+	c.p.ambiguous.recordCall(c.ambiguous, err)
+	c.p.acquire.call(d, c.acquireWait)
+	if c.report != nil {
+		c.report.acquireWait, c.report.acquired = c.acquireWait, c.acquired
+		c.report.attempts, c.report.ambiguous = c.n, c.ambiguous
+	}
+	if c.probe != nil {
+		c.probe.attempts = c.attempts
+	}
+	var node uint32
+	if len(c.attempts) > 0 {
+		node = c.attempts[len(c.attempts)-1].Node
+	}
+	c.p.nodes.record(node, d, err)
+	if s := c.p.obs.statsd; s != nil {
+		s.call(c.p.name, node, d, c.n, err)
+	}
+	if ch := c.p.obs.churn; ch != nil {
+		ch.record(c.p.name, c.fresh, d, err)
+	}
+	if u := c.p.obs.upgrade; u != nil {
+		var version string
+		if len(c.attempts) > 0 {
+			version = c.attempts[len(c.attempts)-1].Version
+		}
+		u.record(version, err)
+	}
+	if o := c.p.obs.outliers; o != nil && d >= o.threshold {
+		c.p.recordOutlier(c, d, err)
+	}
+}
+
+// callAttempt returns the attempt number of the wrapped call ctx belongs to,
+// or 0 outside one.
+func callAttempt(ctx context.Context) int {
+	if c, ok := ctx.Value(callClockKey{}).(*callClock); ok {
+		return c.n
+	}
+	return 0
+}
+
+// attemptTracer marks the start of an attempt for the call's callClock.
+type attemptTracer struct{}
+
+func (attemptTracer) TraceQueryStart(ctx context.Context, conn *pgx.Conn, _ pgx.TraceQueryStartData) context.Context {
+	if c, ok := ctx.Value(callClockKey{}).(*callClock); ok && c.attempt.IsZero() {
+		c.startAttempt(conn)
+	}
+	return ctx
+}
+
+func (attemptTracer) TraceQueryEnd(context.Context, *pgx.Conn, pgx.TraceQueryEndData) {}
+
+func (p *testerPool) QueryRowFunc(ctx context.Context, rowFunc func(ctx context.Context, row pgx.Row) error, sql string, optionsAndArgs ...any) error {
+	rp, done := p.enter()
+	ctx, clock := p.startCall(ctx, rp, sql)
+	err := rp.QueryRowFunc(ctx, func(ctx context.Context, row pgx.Row) (err error) {
+		clock.n++
+		defer func() { clock.endAttempt(err) }()
+		if err := p.attempt(ctx, clock.n); err != nil {
+			_ = row.Scan(discardRow{}) // release the row so the conn can be reused
+			return err
+		}
+		return rowFunc(ctx, row)
+	}, sql, optionsAndArgs...)
+	clock.end(err)
+	done(err)
+	return err
+}
+
+func (p *testerPool) QueryFunc(ctx context.Context, rowsFunc func(ctx context.Context, rows pgx.Rows) error, sql string, optionsAndArgs ...any) error {
+	rp, done := p.enter()
+	ctx, clock := p.startCall(ctx, rp, sql)
+	err := rp.QueryFunc(ctx, func(ctx context.Context, rows pgx.Rows) (err error) {
+		clock.n++
+		defer func() { clock.endAttempt(err) }()
+		if err := p.attempt(ctx, clock.n); err != nil {
+			return err
+		}
+		return rowsFunc(ctx, rows)
+	}, sql, optionsAndArgs...)
+	clock.end(err)
+	done(err)
+	return err
+}
+
+func (p *testerPool) ExecFunc(ctx context.Context, tagFunc func(ctx context.Context, tag pgconn.CommandTag, err error) error, sql string, arguments ...any) error {
+	rp, done := p.enter()
+	ctx, clock := p.startCall(ctx, rp, sql)
+	err := rp.ExecFunc(ctx, func(ctx context.Context, tag pgconn.CommandTag, err error) (ferr error) {
+		clock.n++
+		defer func() { clock.endAttempt(ferr) }()
+		if ferr := p.attempt(ctx, clock.n); ferr != nil {
+			return ferr
+		}
+		return tagFunc(ctx, tag, err)
+	}, sql, arguments...)
+	clock.end(err)
+	done(err)
+	return err
+}
+
+func (p *testerPool) BeginTxFunc(ctx context.Context, txOptions pgx.TxOptions, txFunc func(pgx.Tx) error) error {
+	rp, done := p.enter()
+	ctx, clock := p.startCall(ctx, rp, "")
+	err := rp.BeginTxFunc(ctx, txOptions, func(tx pgx.Tx) (err error) {
+		clock.n++
+		defer func() { clock.endAttempt(err) }() // commit is not part of the attempt's latency
+		if err := p.attempt(ctx, clock.n); err != nil {
+			return err
+		}
+		return txFunc(tx)
+	})
+	clock.end(err)
+	done(err)
+	return err
+}
+
+func (p *testerPool) BeginFunc(ctx context.Context, txFunc func(pgx.Tx) error) error {
+	return p.BeginTxFunc(ctx, pgx.TxOptions{}, txFunc)
+}
+
+// discardRow is a pgx.RowScanner that ignores the row's values.
+type discardRow struct{}
+
+func (discardRow) ScanRow(pgx.Rows) error { return nil }
+
+// poolStat is a JSON-friendly snapshot of pgxpool.Stat.
+type poolStat struct {
+	AcquiredConns        int32         `json:"acquired_conns"`
+	IdleConns            int32         `json:"idle_conns"`
+	ConstructingConns    int32         `json:"constructing_conns"`
+	TotalConns           int32         `json:"total_conns"`
+	MaxConns             int32         `json:"max_conns"`
+	AcquireCount         int64         `json:"acquire_count"`
+	EmptyAcquireCount    int64         `json:"empty_acquire_count"`
+	CanceledAcquireCount int64         `json:"canceled_acquire_count"`
+	AcquireDuration      time.Duration `json:"acquire_duration_ns"`
+	NewConnsCount        int64         `json:"new_conns_count"`
+	MaxLifetimeDestroyed int64         `json:"max_lifetime_destroy_count"`
+	MaxIdleDestroyed     int64         `json:"max_idle_destroy_count"`
+}
+
+func newPoolStat(s *pgxpool.Stat) poolStat {
+	return poolStat{
+		AcquiredConns:        s.AcquiredConns(),
+		IdleConns:            s.IdleConns(),
+		ConstructingConns:    s.ConstructingConns(),
+		TotalConns:           s.TotalConns(),
+		MaxConns:             s.MaxConns(),
+		AcquireCount:         s.AcquireCount(),
+		EmptyAcquireCount:    s.EmptyAcquireCount(),
+		CanceledAcquireCount: s.CanceledAcquireCount(),
+		AcquireDuration:      s.AcquireDuration(),
+		NewConnsCount:        s.NewConnsCount(),
+		MaxLifetimeDestroyed: s.MaxLifetimeDestroyCount(),
+		MaxIdleDestroyed:     s.MaxIdleDestroyCount(),
+	}
+}
+
+// parseReloadSettings applies "key=value" overrides to base. Keys are
+// max-conns, retry-attempts and retry-backoff, optionally prefixed with a
+// pool name ("writer.max-conns=4"); prefixed keys only apply to that pool.
+func parseReloadSettings(pool string, base poolSettings, kvs map[string]string) (poolSettings, error) {
+	s := base
+	apply := func(key, v string) error {
+		switch key {
+		case "max-conns":
+			n, err := strconv.ParseInt(v, 10, 32)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("max-conns must be a positive integer (got %q)", v)
+			}
+			s.MaxConns = int32(n)
+		case "retry-attempts":
+			n, err := strconv.ParseUint(v, 10, 8)
+			if err != nil || n > maxRetryAttempts {
+				return fmt.Errorf("retry-attempts must be 0-254 (got %q)", v)
+			}
+			s.RetryAttempts = uint8(n)
+		case "retry-backoff":
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("retry-backoff must be a positive duration (got %q)", v)
+			}
+			s.RetryBackoff = d
+		default:
+			return fmt.Errorf("unknown setting %q", key)
+		}
+		return nil
+	}
+	// unprefixed keys first so pool-specific keys win
+	for _, prefixed := range []bool{false, true} {
+		for k, v := range kvs {
+			name, key, hasPrefix := strings.Cut(k, ".")
+			if hasPrefix != prefixed {
+				continue
+			}
+			if !hasPrefix {
+				key = k
+			} else if name != pool {
+				continue
+			}
+			if err := apply(key, v); err != nil {
+				return base, err
+			}
+		}
+	}
+	return s, nil
+}
+
+// readReloadFile reads key=value lines (# comments allowed) for SIGHUP reloads.
+func readReloadFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	kvs := map[string]string{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s: invalid line %q (want key=value)", path, line)
+		}
+		kvs[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return kvs, sc.Err()
+}
+
+// reloadPools applies kvs to the named pools (all pools when names is
+// empty). Settings are validated for every pool before any is rebuilt.
+func reloadPools(ctx context.Context, pools map[string]*testerPool, names []string, kvs map[string]string, tl *timeline) error {
+	if len(names) == 0 {
+		for name := range pools {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for k := range kvs {
+		if name, _, ok := strings.Cut(k, "."); ok && pools[name] == nil {
+			return fmt.Errorf("setting %q: unknown pool %q", k, name)
+		}
+	}
+	next := make([]poolSettings, len(names))
+	for i, name := range names {
+		p, ok := pools[name]
+		if !ok {
+			return fmt.Errorf("unknown pool %q", name)
+		}
+		s, err := parseReloadSettings(name, p.settings(), kvs)
+		if err != nil {
+			return err
+		}
+		next[i] = s
+	}
+	for i, name := range names {
+		if err := pools[name].reload(ctx, next[i], tl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
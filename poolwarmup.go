@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMinConnsTimeout = 30 * time.Second
+	poolWarmupTick         = 50 * time.Millisecond
+)
+
+// poolWarmup is how long a pool took to open its MinConns connections, as
+// written to --results-out.
+type poolWarmup struct {
+	MinConns int32         `json:"min_conns"`
+	Conns    int32         `json:"conns"` // open when the warm-up ended
+	Reached  bool          `json:"reached"`
+	Duration time.Duration `json:"duration_ns"` // since the pool was created
+}
+
+// warmPools waits for every pool with a MinConns to have opened that many
+// connections, so the workload doesn't start on cold pools. pgxpool opens
+// them in the background from creation (since), at crdbpool's connect rate.
+// It fails if a pool doesn't get there within timeout.
+func warmPools(ctx context.Context, pools map[string]*testerPool, since time.Time, timeout time.Duration) (map[string]poolWarmup, error) {
+	out := map[string]poolWarmup{}
+	for name, p := range pools {
+		if n := p.pool().MinConns(); n > 0 {
+			out[name] = poolWarmup{MinConns: int32(n)}
+		}
+	}
+	if len(out) == 0 {
+		return nil, nil
+	}
+	slog.Info("warming pools", "timeout", timeout)
+	wctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		pending := 0
+		for name, w := range out {
+			if w.Reached {
+				continue
+			}
+			w.Conns = pools[name].Stat().TotalConns()
+			if w.Conns >= w.MinConns {
+				w.Reached, w.Duration = true, time.Since(since)
+				slog.Info("pool warm", "pool", name, "min_conns", w.MinConns, "duration", w.Duration)
+			} else {
+				pending++
+			}
+			out[name] = w
+		}
+		if pending == 0 {
+			return out, nil
+		}
+		if !sleepCtx(wctx, poolWarmupTick) {
+			break
+		}
+	}
+	if ctx.Err() != nil {
+		return out, ctx.Err()
+	}
+	var cold []string
+	for _, name := range slices.Sorted(maps.Keys(out)) {
+		if w := out[name]; !w.Reached {
+			w.Duration = time.Since(since)
+			out[name] = w
+			cold = append(cold, fmt.Sprintf("%s %d/%d", name, w.Conns, w.MinConns))
+		}
+	}
+	return out, fmt.Errorf("pools not warm after %s: %s", timeout, strings.Join(cold, ", "))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// workloadPreset is a named set of flag values for a standard kind of run.
+// Its flags go before the config file's and the command line's, so any of
+// them can still be changed.
+type workloadPreset struct {
+	summary string
+	args    []string
+}
+
+var presets = map[string]workloadPreset{
+	"smoke": {"about 5 minutes at modest load", []string{
+		"-iterations=5000", "-timeout=7m",
+		"-reader-conc=2", "-writer-conc=1", "-reader-sleep=50ms", "-writer-sleep=50ms",
+		"-keys=100",
+	}},
+	"soak": {"hours at low, steady load with the stall watchdog on", []string{
+		"-iterations=100000", "-timeout=8h",
+		"-reader-conc=2", "-writer-conc=1", "-reader-sleep=250ms", "-writer-sleep=250ms",
+		"-keys=1000", "-stall-timeout=5m",
+	}},
+	"stress": {"as many calls as the pools allow, spread over many rows", []string{
+		"-iterations=20000", "-timeout=15m",
+		"-reader-max-conns=48", "-writer-max-conns=16",
+		"-reader-conc=32", "-writer-conc=16", "-reader-sleep=1ms", "-writer-sleep=1ms",
+		"-keys=100000",
+	}},
+	"contention": {"concurrent writers on a single row, to drive serialization retries", []string{
+		"-iterations=10000", "-timeout=10m",
+		"-writer-max-conns=16", "-reader-conc=2", "-writer-conc=16", "-writer-sleep=1ms",
+		"-keys=1",
+	}},
+}
+
+func lookupPreset(name string) (workloadPreset, error) {
+	p, ok := presets[name]
+	if !ok {
+		return workloadPreset{}, fmt.Errorf("unknown preset %q (want %s)", name, strings.Join(slices.Sorted(maps.Keys(presets)), ", "))
+	}
+	return p, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const proxyProbeInterval = time.Second
+
+// proxyErrorClasses are errors transaction-mode poolers such as PgBouncer
+// cause when a client relies on its session: a prepared statement that
+// isn't on the server connection the transaction landed on (26000), or is
+// already there from another client (42P05), and the protocol violations
+// (08P01) of unsupported startup parameters.
+var proxyErrorClasses = []string{"sqlstate-26000", "sqlstate-42P05", "sqlstate-08P01"}
+
+// proxySessionParams are the startup parameters --via-proxy keeps: poolers
+// pass application_name through, and reject or drop the others.
+var proxySessionParams = []string{"application_name"}
+
+// applyViaProxy turns off what relies on a client connection keeping its
+// server session, which a transaction-mode pooler doesn't guarantee between
+// transactions: prepared statements and their cache (queries run with the
+// extended protocol's unnamed statement instead) and session settings sent
+// at startup. It returns the dropped settings.
+func applyViaProxy(c *pgxpool.Config) []string {
+	c.ConnConfig.DefaultQueryExecMode = pgx.QueryExecModeExec
+	c.ConnConfig.StatementCacheCapacity = 0
+	c.ConnConfig.DescriptionCacheCapacity = 0
+	var dropped []string
+	for k := range c.ConnConfig.RuntimeParams {
+		if !slices.Contains(proxySessionParams, k) {
+			delete(c.ConnConfig.RuntimeParams, k)
+			dropped = append(dropped, k)
+		}
+	}
+	slices.Sort(dropped)
+	return dropped
+}
+
+// proxyProbe measures what differs behind a proxy: whether a connection's
+// transactions still run on the gateway node it reported when it connected.
+// crdbpool attributes calls, balances connections and routes around
+// unhealthy nodes by that node; when a pooler moves transactions between
+// server connections the attribution drifts.
+type proxyProbe struct {
+	pools map[string]*testerPool
+
+	mu     sync.Mutex
+	probes map[string]int
+	drift  map[string]int
+	errs   int
+}
+
+// proxySummary is the probe's verdict, as written to --results-out.
+type proxySummary struct {
+	Dropped      []string          `json:"dropped_session_params,omitempty"`
+	Probes       map[string]int    `json:"probes"`      // per pool
+	NodeDrift    map[string]int    `json:"node_drift"`  // probes on another node than the connection's
+	DriftShare   float64           `json:"drift_share"` // of all probes
+	ProbeErrors  int               `json:"probe_errors,omitempty"`
+	PoolerErrors map[string]uint64 `json:"pooler_errors,omitempty"` // workload errors of proxyErrorClasses
+}
+
+func newProxyProbe(pools map[string]*testerPool) *proxyProbe {
+	return &proxyProbe{pools: pools, probes: map[string]int{}, drift: map[string]int{}}
+}
+
+// run probes every pool each proxyProbeInterval until ctx is done. The
+// probes bypass the tester's instrumentation of the pools, so they don't
+// count as calls in its stats.
+func (pp *proxyProbe) run(ctx context.Context) {
+	t := time.NewTicker(proxyProbeInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		for _, name := range slices.Sorted(maps.Keys(pp.pools)) {
+			pp.probe(ctx, name)
+		}
+	}
+}
+
+func (pp *proxyProbe) probe(ctx context.Context, name string) {
+	var connected, now uint32
+	err := pp.pools[name].pool().BeginTxFunc(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly}, func(tx pgx.Tx) error {
+		connected = connNode(tx.Conn())
+		var node *int64
+		if err := tx.QueryRow(ctx, sqlNodeID).Scan(&node); err != nil {
+			return err
+		}
+		if node != nil {
+			now = uint32(*node)
+		}
+		return nil
+	})
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if err != nil {
+		if ctx.Err() == nil {
+			pp.errs++
+			slog.Debug("proxy probe", "pool", name, "err", err)
+		}
+		return
+	}
+	pp.probes[name]++
+	if connected != 0 && now != connected {
+		pp.drift[name]++
+	}
+}
+
+func (pp *proxyProbe) summary(dropped []string, workloads map[string]opSummary) *proxySummary {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	s := &proxySummary{Dropped: dropped, Probes: maps.Clone(pp.probes), NodeDrift: maps.Clone(pp.drift), ProbeErrors: pp.errs, PoolerErrors: map[string]uint64{}}
+	probes, drift := 0, 0
+	for name, n := range pp.probes {
+		probes, drift = probes+n, drift+pp.drift[name]
+	}
+	if probes > 0 {
+		s.DriftShare = float64(drift) / float64(probes)
+	}
+	for _, w := range workloads {
+		for _, class := range proxyErrorClasses {
+			if n := w.ErrorClasses[class]; n > 0 {
+				s.PoolerErrors[class] += n
+			}
+		}
+	}
+	slog.Info("via proxy", "probes", probes, "node_drift", drift, "drift_share", s.DriftShare, "probe_errors", s.ProbeErrors,
+		"pooler_errors", s.PoolerErrors, "dropped_session_params", strings.Join(dropped, ","))
+	if drift > 0 {
+		slog.Warn("connections don't keep their gateway node behind the proxy: crdbpool's per-node attribution, balancing and health routing follow the node each connected on, not the one serving it",
+			"drift_share", s.DriftShare)
+	}
+	return s
+}
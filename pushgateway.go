@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPushgatewayJob = "crdbpool-tester"
+	pushgatewayTimeout    = 10 * time.Second
+)
+
+// The pushed metric names, which the dashboard command's queries use.
+const (
+	metricQueries           = "crdbpool_tester_queries_total"
+	metricErrors            = "crdbpool_tester_errors_total"
+	metricErrorsByClass     = "crdbpool_tester_errors_by_class_total"
+	metricThroughput        = "crdbpool_tester_throughput_qps"
+	metricQueryDuration     = "crdbpool_tester_query_duration_seconds"
+	metricPoolCalls         = "crdbpool_tester_pool_calls_total"
+	metricPoolRetriedCalls  = "crdbpool_tester_pool_retried_calls_total"
+	metricPoolConns         = "crdbpool_tester_pool_conns"
+	metricPoolMaxConns      = "crdbpool_tester_pool_max_conns"
+	metricHealthyNodes      = "crdbpool_tester_healthy_nodes"
+	metricNodeHealthy       = "crdbpool_tester_node_healthy"
+	metricNodeTransitions   = "crdbpool_tester_node_health_transitions_total"
+	metricLastPushTimestamp = "crdbpool_tester_last_push_timestamp_seconds"
+	metricRunSuccess        = "crdbpool_tester_run_success"
+)
+
+// pushSnapshot is what one push reports.
+type pushSnapshot struct {
+	Workloads map[string]opSummary
+	Retries   map[string]retrySummary
+	Pools     map[string]poolStat
+	Health    healthView
+}
+
+// snapshotPools is the current poolStat of each pool.
+func snapshotPools(pools map[string]*testerPool) map[string]poolStat {
+	out := make(map[string]poolStat, len(pools))
+	for name, p := range pools {
+		out[name] = newPoolStat(p.Stat())
+	}
+	return out
+}
+
+// pushgateway pushes the run's stats to a Prometheus Pushgateway, for runs
+// too short to be scraped. Every push replaces the run's group, keyed by job
+// and run_id, so the final push supersedes the periodic ones.
+type pushgateway struct {
+	endpoint string            // <url>/metrics/job/<job>/run_id/<run id>
+	labels   map[string]string // on every sample
+	client   *http.Client
+}
+
+func newPushgateway(cfg Config, res runResult) *pushgateway {
+	return &pushgateway{
+		endpoint: strings.TrimSuffix(cfg.PushgatewayURL, "/") + "/metrics/job/" + url.PathEscape(cfg.PushgatewayJob) +
+			"/run_id/" + url.PathEscape(res.RunID),
+		labels: map[string]string{
+			"crdbpool":  cmp.Or(res.Components["crdbpool"], "unknown"),
+			"pool_impl": cmp.Or(res.Components["pool-impl"], "unknown"),
+		},
+		client: &http.Client{Timeout: pushgatewayTimeout},
+	}
+}
+
+// validatePushgatewayURL checks --pushgateway-url is an http(s) base URL.
+func validatePushgatewayURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("pushgateway-url %q: want an http(s) URL like http://pushgateway:9091", s)
+	}
+	return nil
+}
+
+// metricWriter renders samples in the Prometheus text exposition format.
+type metricWriter struct {
+	b      bytes.Buffer
+	common map[string]string
+}
+
+func (m *metricWriter) family(name, typ, help string) {
+	fmt.Fprintf(&m.b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes one sample; labels are name, value pairs added to the
+// common ones.
+func (m *metricWriter) sample(name string, v float64, labels ...string) {
+	all := maps.Clone(m.common)
+	for i := 0; i+1 < len(labels); i += 2 {
+		all[labels[i]] = labels[i+1]
+	}
+	pairs := make([]string, 0, len(all))
+	for _, k := range slices.Sorted(maps.Keys(all)) {
+		pairs = append(pairs, k+`="`+escapeLabelValue(all[k])+`"`)
+	}
+	fmt.Fprintf(&m.b, "%s{%s} %s\n", name, strings.Join(pairs, ","), strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// render is the exposition of snap. final adds the run's outcome.
+func (p *pushgateway) render(snap pushSnapshot, final, ok bool) []byte {
+	m := &metricWriter{common: p.labels}
+	workloads := snap.Workloads
+	names := slices.Sorted(maps.Keys(workloads))
+
+	m.family(metricQueries, "counter", "Queries run by the workload, failed ones included.")
+	for _, name := range names {
+		m.sample(metricQueries, float64(workloads[name].Queries), "workload", name)
+	}
+	m.family(metricErrors, "counter", "Failed queries.")
+	for _, name := range names {
+		m.sample(metricErrors, float64(workloads[name].Errors), "workload", name)
+	}
+	m.family(metricErrorsByClass, "counter", "Failed queries by error class.")
+	for _, name := range names {
+		s := workloads[name]
+		for _, class := range slices.Sorted(maps.Keys(s.ErrorClasses)) {
+			m.sample(metricErrorsByClass, float64(s.ErrorClasses[class]), "workload", name, "class", class)
+		}
+	}
+	m.family(metricThroughput, "gauge", "Queries per second over the workload's run time.")
+	for _, name := range names {
+		m.sample(metricThroughput, workloads[name].Throughput, "workload", name)
+	}
+	m.family(metricQueryDuration, "summary", "Query latency.")
+	for _, name := range names {
+		s := workloads[name]
+		for _, q := range []struct {
+			quantile string
+			d        time.Duration
+		}{{"0.5", s.P50}, {"0.95", s.P95}, {"0.99", s.P99}, {"1", s.Max}} {
+			m.sample(metricQueryDuration, q.d.Seconds(), "workload", name, "quantile", q.quantile)
+		}
+		m.sample(metricQueryDuration+"_sum", s.Mean.Seconds()*float64(s.Queries), "workload", name)
+		m.sample(metricQueryDuration+"_count", float64(s.Queries), "workload", name)
+	}
+
+	retries := snap.Retries
+	pools := slices.Sorted(maps.Keys(retries))
+	m.family(metricPoolCalls, "counter", "Logical calls through the pool.")
+	for _, pool := range pools {
+		m.sample(metricPoolCalls, float64(retries[pool].Calls), "pool", pool)
+	}
+	m.family(metricPoolRetriedCalls, "counter", "Calls the pool retried at least once.")
+	for _, pool := range pools {
+		m.sample(metricPoolRetriedCalls, float64(retries[pool].RetriedCalls), "pool", pool)
+	}
+	pools = slices.Sorted(maps.Keys(snap.Pools))
+	m.family(metricPoolConns, "gauge", "The pool's connections by state.")
+	for _, pool := range pools {
+		st := snap.Pools[pool]
+		for _, s := range []struct {
+			state string
+			n     int32
+		}{{"acquired", st.AcquiredConns}, {"idle", st.IdleConns}, {"constructing", st.ConstructingConns}, {"total", st.TotalConns}} {
+			m.sample(metricPoolConns, float64(s.n), "pool", pool, "state", s.state)
+		}
+	}
+	m.family(metricPoolMaxConns, "gauge", "The pool's MaxConns.")
+	for _, pool := range pools {
+		m.sample(metricPoolMaxConns, float64(snap.Pools[pool].MaxConns), "pool", pool)
+	}
+
+	m.family(metricHealthyNodes, "gauge", "Nodes crdbpool's health tracker considers healthy.")
+	m.sample(metricHealthyNodes, float64(snap.Health.HealthyNodes))
+	m.family(metricNodeHealthy, "gauge", "1 if the tracker considers the node healthy.")
+	for _, n := range snap.Health.Nodes {
+		v := 0.0
+		if n.Healthy {
+			v = 1
+		}
+		m.sample(metricNodeHealthy, v, "node", strconv.FormatUint(uint64(n.Node), 10))
+	}
+	m.family(metricNodeTransitions, "counter", "The node's health transitions.")
+	for _, n := range snap.Health.Nodes {
+		m.sample(metricNodeTransitions, float64(n.Transitions), "node", strconv.FormatUint(uint64(n.Node), 10))
+	}
+
+	m.family(metricLastPushTimestamp, "gauge", "When these stats were pushed.")
+	m.sample(metricLastPushTimestamp, float64(time.Now().UnixMilli())/1000)
+	if final {
+		m.family(metricRunSuccess, "gauge", "1 if the run passed, 0 if it failed; only in the final push.")
+		v := 0.0
+		if ok {
+			v = 1
+		}
+		m.sample(metricRunSuccess, v)
+	}
+	return m.b.Bytes()
+}
+
+// push replaces the run's group on the gateway with body.
+func (p *pushgateway) push(ctx context.Context, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, pushgatewayTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, p.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("pushgateway: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("pushgateway: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// watch pushes snapshot's stats every interval until ctx is done.
+func (p *pushgateway) watch(ctx context.Context, interval time.Duration, snapshot func() pushSnapshot) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := p.push(ctx, p.render(snapshot(), false, false)); err != nil && ctx.Err() == nil {
+				slog.Warn("periodic push failed", "err", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// readOnlySessionParam makes every transaction of a session read-only unless
+// it asks otherwise, which the tool's reader queries never do.
+const readOnlySessionParam = "default_transaction_read_only"
+
+// applyReadOnly sets the read-only session default on c's connections, as
+// a startup parameter so it holds from the first query on.
+func applyReadOnly(c *pgxpool.Config) {
+	if c.ConnConfig.RuntimeParams == nil {
+		c.ConnConfig.RuntimeParams = map[string]string{}
+	}
+	c.ConnConfig.RuntimeParams[readOnlySessionParam] = "on"
+}
+
+// validateReadOnly rejects what --read-only can't honor: everything that
+// needs the writer pool or the workload table.
+func validateReadOnly(cfg Config) error {
+	if !cfg.ReadOnly {
+		return nil
+	}
+	if slices.Contains(writerWorkloads, cfg.Workload) {
+		return fmt.Errorf("--read-only has no writer pool for --workload %s", cfg.Workload)
+	}
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{
+		{cfg.WriterDSN != "", "--writer-dsn"},
+		{cfg.VerifyAmbiguous, "--verify-ambiguous"},
+		{cfg.DetectDuplicates, "--detect-duplicates"},
+		{cfg.Ledger != "", "--ledger"},
+		{cfg.KeepTable, "--keep-table"},
+		{cfg.Cleanup, "--cleanup"},
+	} {
+		if f.set {
+			return errors.New("--read-only can't be combined with " + f.name)
+		}
+	}
+	for _, ps := range cfg.Pools {
+		if strings.Contains(ps.SQL, "{table}") {
+			return fmt.Errorf("--read-only creates no workload table for pool %s's {table}", ps.Name)
+		}
+	}
+	return nil
+}
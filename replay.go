@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	crdbpool "github.com/authzed/crdbpool/pkg"
+)
+
+const (
+	defaultReplayConc    = 16
+	defaultReplaySpeed   = 1.0
+	defaultReplayTimeout = 24 * time.Hour
+	// replayMaxLine is the longest log line replay reads; CockroachDB's
+	// execution log puts a statement and its placeholders on one line.
+	replayMaxLine = 16 << 20
+)
+
+// replaySessionVerbs start statements that only make sense on the session
+// they were logged on: replaying them one by one through a pool would run
+// each on whatever connection it gets.
+var replaySessionVerbs = []string{"BEGIN", "START", "COMMIT", "END", "ROLLBACK", "SAVEPOINT", "RELEASE", "PREPARE", "EXECUTE", "DEALLOCATE", "SET", "RESET", "DISCARD"}
+
+// replayReadVerbs start the statements --reads-only replays.
+var replayReadVerbs = []string{"SELECT", "SHOW", "EXPLAIN", "WITH", "TABLE", "VALUES"}
+
+// replayStmt is one statement of a captured log.
+type replayStmt struct {
+	at   time.Time
+	sql  string
+	args []any
+}
+
+// replayEntry is a line of the simple NDJSON format: the statement, its
+// arguments and when it ran, as an RFC 3339 time or Unix seconds.
+type replayEntry struct {
+	TS   json.RawMessage `json:"ts"`
+	SQL  string          `json:"sql"`
+	Args []any           `json:"args"`
+}
+
+// crdbExecEvent is the part of a CockroachDB execution log event
+// (sql_exec channel, query_execute events) that replay uses.
+type crdbExecEvent struct {
+	Timestamp         int64    `json:"Timestamp"` // Unix ns
+	EventType         string   `json:"EventType"`
+	Statement         string   `json:"Statement"`
+	PlaceholderValues []string `json:"PlaceholderValues"`
+	ApplicationName   string   `json:"ApplicationName"`
+}
+
+// replayFilter is what replay leaves out of the log.
+type replayFilter struct {
+	app       string // only this application's statements
+	readsOnly bool
+}
+
+// replayLog holds a parsed log: the statements in the order they ran, and
+// the lines left out, by reason.
+type replayLog struct {
+	stmts   []replayStmt
+	skipped map[string]int
+}
+
+// readReplayLog reads a CockroachDB execution log, in a JSON or crdb-v2
+// log format, or the simple NDJSON format, telling them apart per line.
+func readReplayLog(path string, f replayFilter) (*replayLog, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	rl := &replayLog{skipped: map[string]int{}}
+	sc := bufio.NewScanner(file)
+	sc.Buffer(make([]byte, 64<<10), replayMaxLine)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		st, skip, err := parseReplayLine(line, f)
+		if err != nil {
+			slog.Debug("replay: unreadable line", "line", n, "err", err)
+			skip = "unreadable"
+		}
+		if skip != "" {
+			rl.skipped[skip]++
+			continue
+		}
+		rl.stmts = append(rl.stmts, st)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	// logs collected from several nodes interleave
+	slices.SortStableFunc(rl.stmts, func(a, b replayStmt) int { return a.at.Compare(b.at) })
+	return rl, nil
+}
+
+// parseReplayLine parses one log line, or returns why it is skipped.
+func parseReplayLine(line string, f replayFilter) (replayStmt, string, error) {
+	var st replayStmt
+	if i := strings.IndexByte(line, '{'); i > 0 {
+		line = line[i:] // a crdb-v2 entry: the event follows the header
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(line), &raw); err != nil {
+		return st, "", err
+	}
+	if ev, ok := raw["event"]; ok {
+		raw = nil // a JSON log entry wraps the event
+		if err := json.Unmarshal(ev, &raw); err != nil {
+			return st, "", err
+		}
+	}
+	if _, ok := raw["Statement"]; ok {
+		var ev crdbExecEvent
+		if err := remarshal(raw, &ev); err != nil {
+			return st, "", err
+		}
+		switch {
+		case ev.EventType != "" && ev.EventType != "query_execute":
+			return st, "not-a-query", nil
+		case strings.HasPrefix(ev.ApplicationName, "$ internal"):
+			return st, "internal", nil
+		case f.app != "" && ev.ApplicationName != f.app:
+			return st, "other-app", nil
+		}
+		st.at, st.sql = time.Unix(0, ev.Timestamp), stripRedaction(ev.Statement)
+		for _, v := range ev.PlaceholderValues {
+			st.args = append(st.args, crdbPlaceholder(stripRedaction(v)))
+		}
+	} else {
+		var e replayEntry
+		if err := remarshal(raw, &e); err != nil {
+			return st, "", err
+		}
+		if f.app != "" {
+			return st, "other-app", nil // the simple format has no application
+		}
+		at, err := parseReplayTime(e.TS)
+		if err != nil {
+			return st, "", err
+		}
+		st.at, st.sql, st.args = at, e.SQL, e.Args
+	}
+	words := strings.Fields(st.sql)
+	if len(words) == 0 {
+		return st, "", errors.New("no statement")
+	}
+	verb := strings.ToUpper(words[0])
+	switch {
+	case slices.Contains(replaySessionVerbs, verb):
+		return st, "session", nil
+	case f.readsOnly && !slices.Contains(replayReadVerbs, verb):
+		return st, "write", nil
+	}
+	return st, "", nil
+}
+
+func remarshal(raw map[string]json.RawMessage, v any) error {
+	b, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func parseReplayTime(ts json.RawMessage) (time.Time, error) {
+	var s string
+	if json.Unmarshal(ts, &s) == nil {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("ts %q: want an RFC 3339 time or Unix seconds", s)
+		}
+		return t, nil
+	}
+	var secs float64
+	if err := json.Unmarshal(ts, &secs); err != nil {
+		return time.Time{}, fmt.Errorf("ts %s: want an RFC 3339 time or Unix seconds", ts)
+	}
+	return time.Unix(0, int64(secs*1e9)), nil
+}
+
+// stripRedaction removes the markers CockroachDB puts around sensitive
+// values in its logs (‹...›); a log written with redaction on has them
+// replaced by ‹×› and can't be replayed faithfully.
+func stripRedaction(s string) string {
+	return strings.NewReplacer("‹", "", "›", "").Replace(s)
+}
+
+// crdbPlaceholder turns a logged placeholder value, an SQL literal, into
+// an argument: NULL, or the literal's text, unquoted, for the server to
+// parse as the parameter's type.
+func crdbPlaceholder(v string) any {
+	switch {
+	case strings.EqualFold(v, "NULL"):
+		return nil
+	case len(v) >= 2 && v[0] == '\'' && strings.HasSuffix(v, "'"):
+		return strings.ReplaceAll(v[1:len(v)-1], "''", "'")
+	}
+	if i := strings.Index(v, "':::"); i > 0 && v[0] == '\'' {
+		return strings.ReplaceAll(v[1:i], "''", "'") // a typed literal, 'x':::STRING
+	}
+	return v
+}
+
+// replaySummary is a replay's record, as printed and written to --out.
+type replaySummary struct {
+	File       string            `json:"file"`
+	Statements int               `json:"statements"`
+	Skipped    map[string]int    `json:"skipped,omitempty"` // by reason
+	Speed      float64           `json:"speed"`             // 0: as fast as possible
+	Span       time.Duration     `json:"span_ns"`           // of the log
+	Duration   time.Duration     `json:"duration_ns"`       // of the replay
+	Stats      opSummary         `json:"stats"`
+	Lag        *latencyHistogram `json:"lag"` // how late statements started against the log's schedule
+}
+
+// replayCommand replays a captured statement log through a crdbpool pool,
+// keeping the log's inter-arrival times (scaled by --speed) so the pool
+// sees production's traffic shape, its bursts and lulls included.
+func replayCommand(args []string) error {
+	e := newCommandEnv("replay", "[flags] statements.log")
+	// a replay lasts as long as its log, not the other commands' 30s
+	e.timeout = defaultReplayTimeout
+	e.fs.Lookup("timeout").DefValue = defaultReplayTimeout.String()
+	speed := e.fs.Float64("speed", defaultReplaySpeed, "replay at this multiple of the log's pace (2: twice as fast); 0 replays as fast as --conc allows")
+	conc := e.fs.Int("conc", defaultReplayConc, "statements in flight at most, and the pool's MaxConns")
+	var f replayFilter
+	e.fs.StringVar(&f.app, "app", "", "only replay the statements of this application_name (CockroachDB logs only)")
+	e.fs.BoolVar(&f.readsOnly, "reads-only", false, "skip statements that may write, replaying only SELECT, SHOW, EXPLAIN, WITH, TABLE and VALUES")
+	out := e.fs.String("out", "", "write the replay's summary as JSON to this file")
+	e.retryFlags()
+	ctx, cancel, err := e.parse(args)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	if e.fs.NArg() != 1 {
+		e.fs.Usage()
+		return errors.New("want one statement log")
+	}
+	if *conc <= 0 || *speed < 0 {
+		return withExit(exitConfig, errors.New("conc must be > 0 and speed >= 0"))
+	}
+	attempts, backoff, err := e.retries()
+	if err != nil {
+		return err
+	}
+	rl, err := readReplayLog(e.fs.Arg(0), f)
+	if err != nil {
+		return err
+	}
+	if len(rl.stmts) == 0 {
+		return fmt.Errorf("%s: no statements to replay (skipped: %v)", e.fs.Arg(0), rl.skipped)
+	}
+	span := rl.stmts[len(rl.stmts)-1].at.Sub(rl.stmts[0].at)
+	slog.Info("replay", "file", e.fs.Arg(0), "statements", len(rl.stmts), "skipped", rl.skipped, "span", span, "speed", *speed)
+
+	dsn, err := e.dsn()
+	if err != nil {
+		return err
+	}
+	ht, err := crdbpool.NewNodeHealthChecker(dsn)
+	if err != nil {
+		return fmt.Errorf("create health tracker: %w", err)
+	}
+	go ht.Poll(ctx, defaultHealthInterval)
+	pcfg, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return err
+	}
+	pcfg.MaxConns = int32(*conc)
+	rp, err := crdbpool.NewRetryPool(ctx, "replay", pcfg, ht, attempts, backoff)
+	if err != nil {
+		return fmt.Errorf("create pool: %w", err)
+	}
+	defer rp.Close()
+
+	sum := replayStatements(ctx, rp, rl.stmts, *speed, *conc)
+	sum.File, sum.Skipped, sum.Span = e.fs.Arg(0), rl.skipped, span
+	slog.Info("replay summary", "statements", sum.Statements, "duration", sum.Duration, "span", sum.Span, "lag", sum.Lag, "stats", sum.Stats)
+	if *out != "" {
+		b, err := json.MarshalIndent(sum, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(*out, append(b, '\n'), 0o644); err != nil {
+			return fmt.Errorf("write replay summary: %w", err)
+		}
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("replay stopped after %d of %d statements: %w", sum.Stats.Queries, len(rl.stmts), ctx.Err())
+	}
+	return nil
+}
+
+// replayStatements issues stmts on conc workers, each at its offset into
+// the log divided by speed, or as soon as a worker is free with speed 0. A
+// statement due while every worker is busy starts late, and the lag shows
+// the pool (or the cluster) falling behind the log.
+func replayStatements(ctx context.Context, rp *crdbpool.RetryPool, stmts []replayStmt, speed float64, conc int) *replaySummary {
+	sum := &replaySummary{Statements: len(stmts), Speed: speed, Lag: &latencyHistogram{}}
+	var stats opStats
+	type item struct {
+		st  replayStmt
+		due time.Time
+	}
+	items := make(chan item)
+	var wg sync.WaitGroup
+	for range conc {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for it := range items {
+				sum.Lag.observe(max(0, time.Since(it.due)))
+				start := time.Now()
+				err := rp.QueryFunc(ctx, func(_ context.Context, rows pgx.Rows) error {
+					for rows.Next() {
+					}
+					return rows.Err()
+				}, it.st.sql, it.st.args...)
+				stats.record(time.Since(start), err)
+				if err != nil && ctx.Err() == nil {
+					slog.Debug("replay: statement error", "sql", oneLine(it.st.sql), "err", err)
+				}
+			}
+		}()
+	}
+	start, first := time.Now(), stmts[0].at
+	stats.begin()
+dispatch:
+	for _, st := range stmts {
+		due := time.Now()
+		if speed > 0 {
+			due = start.Add(time.Duration(float64(st.at.Sub(first)) / speed))
+			if !sleepCtx(ctx, time.Until(due)) {
+				break
+			}
+		}
+		select {
+		case items <- item{st, due}:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(items)
+	wg.Wait()
+	stats.end()
+	sum.Duration, sum.Stats = time.Since(start), stats.summary()
+	if len(sum.Stats.ErrorClasses) > 0 {
+		slog.Warn("replay errors", "errors", sum.Stats.Errors, "classes", slices.Sorted(maps.Keys(sum.Stats.ErrorClasses)))
+	}
+	return sum
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const defaultReportThreshold = 0.10
+
+// loadResultFiles reads result files; directories contribute their *.json.
+func loadResultFiles(paths []string) ([]runResult, error) {
+	var files []string
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			files = append(files, p)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(p, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			if !strings.HasSuffix(m, ".manifest.json") {
+				files = append(files, m)
+			}
+		}
+	}
+	results := make([]runResult, 0, len(files))
+	for _, f := range files {
+		res, err := readResults(f)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// versionGroup aggregates the runs that share one component version.
+type versionGroup struct {
+	version   string
+	runs      int
+	first     time.Time
+	workloads map[string]*versionAgg
+}
+
+type versionAgg struct {
+	latency    latencyHistogram
+	queries    uint64
+	errors     uint64
+	throughput float64 // sum over runs; divided by runs when reported
+	runs       int
+}
+
+func (a *versionAgg) errorRate() float64 {
+	if a.queries == 0 {
+		return 0
+	}
+	return float64(a.errors) / float64(a.queries)
+}
+
+func groupByComponent(results []runResult, component string) []*versionGroup {
+	groups := map[string]*versionGroup{}
+	for _, res := range results {
+		version := res.Components[component]
+		if version == "" {
+			version = "(unlabelled)"
+		}
+		g, ok := groups[version]
+		if !ok {
+			g = &versionGroup{version: version, first: res.StartedAt, workloads: map[string]*versionAgg{}}
+			groups[version] = g
+		}
+		g.runs++
+		if res.StartedAt.Before(g.first) {
+			g.first = res.StartedAt
+		}
+		for name, w := range res.Workloads {
+			agg, ok := g.workloads[name]
+			if !ok {
+				agg = &versionAgg{}
+				g.workloads[name] = agg
+			}
+			if w.Latency != nil {
+				agg.latency.merge(w.Latency)
+			}
+			agg.queries += w.Queries
+			agg.errors += w.Errors
+			agg.throughput += w.Throughput
+			agg.runs++
+		}
+	}
+	out := make([]*versionGroup, 0, len(groups))
+	for _, g := range groups {
+		out = append(out, g)
+	}
+	// versions in the order they were first tested
+	sort.Slice(out, func(i, j int) bool { return out[i].first.Before(out[j].first) })
+	return out
+}
+
+// writeVersionReport prints one row per version and workload, annotating
+// metric shifts beyond threshold relative to the previous version.
+func writeVersionReport(w io.Writer, results []runResult, component string, threshold float64) {
+	groups := groupByComponent(results, component)
+	fmt.Fprintf(w, "component %s: %d versions across %d runs (shift threshold %.0f%%)\n\n", component, len(groups), len(results), threshold*100)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tRUNS\tWORKLOAD\tQPS\tERR%\tP50\tP95\tP99\tSHIFTS VS PREVIOUS")
+	var prev *versionGroup
+	for _, g := range groups {
+		names := make([]string, 0, len(g.workloads))
+		for name := range g.workloads {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			agg := g.workloads[name]
+			qps := agg.throughput / float64(agg.runs)
+			var shifts []string
+			if prev != nil {
+				if p, ok := prev.workloads[name]; ok {
+					shifts = metricShifts(p, agg, threshold)
+				}
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%.1f\t%.2f\t%s\t%s\t%s\t%s\n", g.version, g.runs, name, qps, 100*agg.errorRate(),
+				agg.latency.quantile(0.50).Round(time.Microsecond), agg.latency.quantile(0.95).Round(time.Microsecond),
+				agg.latency.quantile(0.99).Round(time.Microsecond), strings.Join(shifts, ", "))
+		}
+		prev = g
+	}
+	tw.Flush()
+}
+
+func metricShifts(prev, cur *versionAgg, threshold float64) []string {
+	var out []string
+	add := func(name string, before, after float64) {
+		if before == 0 {
+			return
+		}
+		if delta := (after - before) / before; delta > threshold || delta < -threshold {
+			out = append(out, fmt.Sprintf("%s %+.1f%%", name, 100*delta))
+		}
+	}
+	add("qps", prev.throughput/float64(prev.runs), cur.throughput/float64(cur.runs))
+	add("p50", float64(prev.latency.quantile(0.50)), float64(cur.latency.quantile(0.50)))
+	add("p99", float64(prev.latency.quantile(0.99)), float64(cur.latency.quantile(0.99)))
+	if pe, ce := prev.errorRate(), cur.errorRate(); pe != ce && (pe == 0 || ce == 0) {
+		out = append(out, fmt.Sprintf("err %.2f%% -> %.2f%%", 100*pe, 100*ce))
+	} else {
+		add("err", pe, ce)
+	}
+	return out
+}
+
+// Tolerances of report compare: relative for latency and throughput,
+// absolute (a share of the queries) for the error rate.
+const (
+	defaultCompareLatencyTolerance    = 0.10
+	defaultCompareThroughputTolerance = 0.10
+	defaultCompareErrorRateTolerance  = 0.001
+)
+
+// compareTolerances are how much worse a metric may get before report
+// compare calls it a regression.
+type compareTolerances struct {
+	latency    float64 // relative p50/p95/p99 increase
+	throughput float64 // relative qps decrease
+	errorRate  float64 // absolute error rate increase
+}
+
+// compareResults prints every workload's metrics in old and new side by
+// side and returns the number of regressions beyond tol.
+func compareResults(w io.Writer, old, cur runResult, tol compareTolerances) int {
+	fmt.Fprintf(w, "old %s (%s), new %s (%s)\n", old.RunID, old.Components["crdbpool"], cur.RunID, cur.Components["crdbpool"])
+	fmt.Fprintf(w, "tolerances: latency +%.0f%%, throughput -%.0f%%, error rate +%s\n\n", 100*tol.latency, 100*tol.throughput, formatRate(tol.errorRate))
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "WORKLOAD\tMETRIC\tOLD\tNEW\tCHANGE\t")
+	names := map[string]bool{}
+	for name := range old.Workloads {
+		names[name] = true
+	}
+	for name := range cur.Workloads {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	regressions := 0
+	for _, name := range sorted {
+		o, okOld := old.Workloads[name]
+		n, okNew := cur.Workloads[name]
+		if !okOld || !okNew {
+			fmt.Fprintf(tw, "%s\t-\t%s\t%s\t\tonly in one run\n", name, presence(okOld), presence(okNew))
+			continue
+		}
+		row := func(metric, before, after, change string, regressed bool) {
+			mark := ""
+			if regressed {
+				mark = "REGRESSION"
+				regressions++
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", name, metric, before, after, change, mark)
+		}
+		row("qps", fmt.Sprintf("%.1f", o.Throughput), fmt.Sprintf("%.1f", n.Throughput), relativeChange(o.Throughput, n.Throughput),
+			o.Throughput > 0 && (o.Throughput-n.Throughput)/o.Throughput > tol.throughput)
+		oe, ne := opErrorRate(o), opErrorRate(n)
+		row("err%", formatRate(oe), formatRate(ne), fmt.Sprintf("%+.3fpp", 100*(ne-oe)), ne-oe > tol.errorRate)
+		for _, q := range []struct {
+			metric      string
+			before, now time.Duration
+		}{{"p50", o.P50, n.P50}, {"p95", o.P95, n.P95}, {"p99", o.P99, n.P99}} {
+			row(q.metric, q.before.Round(time.Microsecond).String(), q.now.Round(time.Microsecond).String(),
+				relativeChange(float64(q.before), float64(q.now)),
+				q.before > 0 && float64(q.now-q.before)/float64(q.before) > tol.latency)
+		}
+	}
+	tw.Flush()
+	return regressions
+}
+
+func relativeChange(before, after float64) string {
+	if before == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%+.1f%%", 100*(after-before)/before)
+}
+
+func presence(ok bool) string {
+	if ok {
+		return "present"
+	}
+	return "-"
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultReproWindow = time.Minute
+	reproBundleFile    = "bundle.json"
+	reproScenarioFile  = "scenario.txt"
+	logRingMaxLines    = 100000
+)
+
+// reproBundle is everything needed to rerun a failed run the same way:
+// the effective flags (defaults included, so a newer build with different
+// defaults still reruns the same thing), the random seed and the scenario
+// file, plus the fault timeline and the last log lines for diagnosis. It is
+// written to <dir>/<run id>/ and rerun with --from-bundle.
+type reproBundle struct {
+	RunID      string            `json:"run_id"`
+	CreatedAt  time.Time         `json:"created_at"`
+	Reason     string            `json:"reason"`
+	Seed       uint64            `json:"seed"`
+	Args       []string          `json:"args"`
+	Target     string            `json:"target"` // redacted DSN info; the DSN itself comes from DATABASE_URL
+	Components map[string]string `json:"components,omitempty"`
+	Scenario   string            `json:"scenario,omitempty"` // file name inside the bundle
+}
+
+// flagAliases maps the short flag names to their long form.
+var flagAliases = map[string]string{
+	"i": "iterations", "t": "timeout", "r": "reader-max-conns", "w": "writer-max-conns",
+	"rs": "reader-sleep", "ws": "writer-sleep",
+}
+
+// reproSkipFlags are never pinned in a bundle: secrets and flags naming this
+// run's own outputs. Short aliases are skipped too; the long name
+// carries the effective value.
+var reproSkipFlags = map[string]bool{
+	"from-bundle": true, "config": true, "preset": true, "version": true, "dsn": true, "reader-dsn": true, "writer-dsn": true, "mirror-dsn": true,
+	"resume": true, "checkpoint": true, "results-out": true, "junit-out": true, "summary-md": true, "pushgateway-url": true, "notify-url": true,
+}
+
+// reproArgs renders the effective configuration as flags. Flags whose value
+// has no string form (the repeatable ones, like --toxic) are taken from the
+// arguments the run was parsed from.
+func reproArgs(fs *flag.FlagSet, cfg Config, parsed []string) []string {
+	effective := map[string]string{
+		"iterations":       strconv.Itoa(cfg.Iterations),
+		"timeout":          cfg.Timeout.String(),
+		"reader-max-conns": strconv.Itoa(cfg.ReaderMax),
+		"writer-max-conns": strconv.Itoa(cfg.WriterMax),
+		"reader-sleep":     cfg.ReaderSleep.String(),
+		"writer-sleep":     cfg.WriterSleep.String(),
+		"reader-conc":      strconv.Itoa(cfg.ReaderConc),
+		"writer-conc":      strconv.Itoa(cfg.WriterConc),
+		"seed":             strconv.FormatUint(cfg.Seed, 10),
+	}
+	var args []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if _, alias := flagAliases[f.Name]; alias || reproSkipFlags[f.Name] {
+			return
+		}
+		v, ok := effective[f.Name]
+		if !ok {
+			v = f.Value.String()
+		}
+		if v != "" {
+			args = append(args, "-"+f.Name+"="+v)
+		}
+	})
+	for i := 0; i < len(parsed); i++ {
+		name, value, hasValue := strings.Cut(strings.TrimLeft(parsed[i], "-"), "=")
+		f := fs.Lookup(name)
+		if !strings.HasPrefix(parsed[i], "-") || f == nil {
+			continue
+		}
+		if !hasValue && !isBoolFlag(f) && i+1 < len(parsed) {
+			i++
+			value = parsed[i]
+		}
+		if ps, err := parsePoolSpec(value); name == "pool" && err == nil {
+			value = ps.String() // without its dsn, which may hold credentials
+		}
+		if f.Value.String() == "" && !reproSkipFlags[name] {
+			args = append(args, "-"+name+"="+value)
+		}
+	}
+	return args
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// scanFlag returns the value of flag name in args without parsing them, for
+// flags that decide how the rest of the command line is parsed.
+func scanFlag(args []string, name string) string {
+	for i, a := range args {
+		if a == "--" {
+			break
+		}
+		if !strings.HasPrefix(a, "-") {
+			continue
+		}
+		k, v, ok := strings.Cut(strings.TrimLeft(a, "-"), "=")
+		if k != name {
+			continue
+		}
+		if ok {
+			return v
+		}
+		if i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// writeReproBundle writes the bundle for a failed run and returns its
+// directory.
+func writeReproBundle(dir string, b reproBundle, cfg Config, res runResult, recent []string) (string, error) {
+	out := filepath.Join(dir, b.RunID)
+	if err := os.MkdirAll(out, 0o755); err != nil {
+		return "", err
+	}
+	if cfg.ScenarioPath != "" {
+		data, err := os.ReadFile(cfg.ScenarioPath)
+		if err != nil {
+			return "", fmt.Errorf("copy scenario: %w", err)
+		}
+		if err := os.WriteFile(filepath.Join(out, reproScenarioFile), data, 0o644); err != nil {
+			return "", err
+		}
+		b.Scenario = reproScenarioFile
+	}
+	if err := writeJSONFile(filepath.Join(out, reproBundleFile), b); err != nil {
+		return "", err
+	}
+	if err := writeJSONFile(filepath.Join(out, "timeline.json"), res.Timeline); err != nil {
+		return "", err
+	}
+	if err := writeResults(filepath.Join(out, "results.json"), res); err != nil {
+		return "", err
+	}
+	events := strings.Join(recent, "")
+	if err := os.WriteFile(filepath.Join(out, "events.log"), []byte(events), 0o644); err != nil {
+		return "", err
+	}
+	return out, nil
+}
+
+func writeJSONFile(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+func readReproBundle(dir string) (*reproBundle, error) {
+	data, err := os.ReadFile(filepath.Join(dir, reproBundleFile))
+	if err != nil {
+		return nil, err
+	}
+	var b reproBundle
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, fmt.Errorf("%s: %w", dir, err)
+	}
+	return &b, nil
+}
+
+// rerunArgs returns the bundle's flags, minus those set in override (which
+// replace them, repeatable flags included), with the scenario pointing at
+// the bundle's copy.
+func (b *reproBundle) rerunArgs(dir string, override []string) []string {
+	args := withoutOverridden(b.Args, override)
+	if b.Scenario != "" && !flagsSet(override)["scenario"] {
+		args = append(args, "-scenario="+filepath.Join(dir, b.Scenario))
+	}
+	return args
+}
+
+// withoutOverridden returns base minus the flags set in override, so a layer
+// of arguments (a bundle, a config file) can go before the command line
+// without the command line's repeatable flags adding to it. A dropped flag
+// takes its value with it, in the -name=value and the -name value forms.
+func withoutOverridden(base, override []string) []string {
+	set := flagsSet(override)
+	var args []string
+	for i := 0; i < len(base); i++ {
+		a := base[i]
+		if a == "--" {
+			return append(args, base[i:]...)
+		}
+		if !strings.HasPrefix(a, "-") || !set[longFlagName(a)] {
+			args = append(args, a)
+			continue
+		}
+		name, _, hasValue := strings.Cut(strings.TrimLeft(a, "-"), "=")
+		if f := flag.CommandLine.Lookup(name); !hasValue && f != nil && !isBoolFlag(f) {
+			i++ // its value
+		}
+	}
+	return args
+}
+
+// flagsSet returns the long names of the flags in args.
+func flagsSet(args []string) map[string]bool {
+	set := map[string]bool{}
+	for _, a := range args {
+		if a == "--" {
+			break
+		}
+		if strings.HasPrefix(a, "-") {
+			set[longFlagName(a)] = true
+		}
+	}
+	return set
+}
+
+// longFlagName returns the long name of the flag in arg ("-t=5s" => "timeout").
+func longFlagName(arg string) string {
+	name, _, _ := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+	if long, ok := flagAliases[name]; ok {
+		return long
+	}
+	return name
+}
+
+// logRing keeps the log lines written in the last window, for repro bundles.
+type logRing struct {
+	window time.Duration
+
+	mu    sync.Mutex
+	lines []logLine
+}
+
+type logLine struct {
+	at   time.Time
+	text string
+}
+
+func newLogRing(window time.Duration) *logRing { return &logRing{window: window} }
+
+// Write implements io.Writer; the slog handlers write one record per call.
+func (r *logRing) Write(p []byte) (int, error) {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lines = append(r.lines, logLine{at: now, text: string(p)})
+	drop := 0
+	for drop < len(r.lines) && (now.Sub(r.lines[drop].at) > r.window || len(r.lines)-drop > logRingMaxLines) {
+		drop++
+	}
+	r.lines = r.lines[drop:]
+	return len(p), nil
+}
+
+func (r *logRing) recent() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cutoff := time.Now().Add(-r.window)
+	var out []string
+	for _, l := range r.lines {
+		if l.at.After(cutoff) {
+			out = append(out, l.text)
+		}
+	}
+	return out
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// runResult is the machine-readable record of one run, written with
+// --results-out and consumed by --report.
+type runResult struct {
+	RunID           string                          `json:"run_id"`
+	StartedAt       time.Time                       `json:"started_at"`
+	EndedAt         time.Time                       `json:"ended_at"`
+	Outcome         string                          `json:"outcome"` // "ok" or the error that ended the run
+	Build           buildInfo                       `json:"build"`
+	Components      map[string]string               `json:"components,omitempty"`
+	Settings        resultSettings                  `json:"settings"`
+	Workloads       map[string]opSummary            `json:"workloads"`
+	Warmup          map[string]opSummary            `json:"warmup,omitempty"`     // per workload, with --warmup: kept out of Workloads
+	Retries         map[string]retrySummary         `json:"retries,omitempty"`    // per pool, current process only
+	Connect         map[string]connectSummary       `json:"connect,omitempty"`    // per pool: dial, TLS, connect and acquire times
+	Statements      map[string]statementSummary     `json:"statements,omitempty"` // per pool, with --prepare or the statement cache flags
+	Acquire         map[string]acquireSummary       `json:"acquire,omitempty"`    // per pool: acquire waits apart from query time
+	Ambiguous       map[string]ambiguousSummary     `json:"ambiguous,omitempty"`  // per pool with 40003 results
+	ByNode          map[string]map[string]opSummary `json:"by_node,omitempty"`    // per pool, then per node of the call's last attempt
+	Timeline        []timelineEvent                 `json:"timeline,omitempty"`
+	Windows         []windowResult                  `json:"windows,omitempty"`
+	Peaks           []peakResult                    `json:"peaks,omitempty"` // conns in use at once: process, then per pool and node
+	Upgrade         *upgradeSummary                 `json:"upgrade,omitempty"`
+	Balance         []balanceResult                 `json:"balance,omitempty"` // per pool, with --verify-balance
+	RetryAssert     *retryAssertSummary             `json:"retry_assert,omitempty"`
+	Churn           map[string]churnSummary         `json:"churn,omitempty"`             // per pool, with --workload conn-churn
+	Exhaustion      *exhaustionSummary              `json:"exhaustion,omitempty"`        // with --workload exhaustion
+	Proxy           *proxySummary                   `json:"proxy,omitempty"`             // with --via-proxy
+	Soak            *soakSummary                    `json:"soak,omitempty"`              // with --soak: the tester's own resources
+	Steps           *stepsSummary                   `json:"steps,omitempty"`             // with --steps
+	Sine            *sineSummary                    `json:"sine,omitempty"`              // with --sine
+	Spikes          []spikeResult                   `json:"spikes,omitempty"`            // with --spike
+	Drain           *drainSummary                   `json:"drain,omitempty"`             // with --drain
+	ReadYourWrites  *rywSummary                     `json:"read_your_writes,omitempty"`  // with --workload read-your-writes
+	Visibility      *visibilitySummary              `json:"visibility,omitempty"`        // with --workload visibility
+	LostUpdate      *lostUpdateSummary              `json:"lost_update,omitempty"`       // with --workload lost-update
+	Bank            *bankSummary                    `json:"bank,omitempty"`              // with --workload bank
+	AmbiguousWrites *ambiguousVerdict               `json:"ambiguous_writes,omitempty"`  // with --verify-ambiguous
+	Duplicates      *duplicateSummary               `json:"duplicates,omitempty"`        // with --detect-duplicates
+	Audit           *auditSummary                   `json:"audit,omitempty"`             // with --ledger
+	Health          *healthView                     `json:"health,omitempty"`            // the node health tracker at the end of the run
+	PoolWarmup      map[string]poolWarmup           `json:"pool_warmup,omitempty"`       // pools with MinConns
+	Leaks           []connLeak                      `json:"leaks,omitempty"`             // with --leak-check
+	Middleware      map[string]opSummary            `json:"middleware,omitempty"`        // per "<pool>.<op>", with --middleware
+	RetryStrategy   map[string]backoffSummary       `json:"retry_strategy,omitempty"`    // per pool, with --middleware: the retries' overhead
+	Breakers        map[string]breakerSummary       `json:"breakers,omitempty"`          // per pool, with --breaker
+	Isolation       *isolationSummary               `json:"isolation,omitempty"`         // with --isolation
+	SLO             *sloResult                      `json:"slo,omitempty"`               // with --max-error-rate, --max-p50/95/99 or --min-throughput
+	Assertions      []assertionResult               `json:"assertions,omitempty"`        // end-of-run checks, in order
+	LogLinesDropped uint64                          `json:"log_lines_dropped,omitempty"` // per-query lines the full log buffer dropped
+}
+
+// resultSettings is the subset of Config recorded with results. It never
+// includes the DSN.
+type resultSettings struct {
+	Iterations        int           `json:"iterations"`
+	Timeout           time.Duration `json:"timeout_ns"`
+	ReaderMax         int           `json:"reader_max_conns"`
+	WriterMax         int32         `json:"writer_max_conns"`
+	ReaderSleep       time.Duration `json:"reader_sleep_ns"`
+	WriterSleep       time.Duration `json:"writer_sleep_ns"`
+	ReaderConc        int           `json:"reader_conc"`
+	WriterConc        int           `json:"writer_conc"`
+	SleepJitter       float64       `json:"sleep_jitter,omitempty"`
+	ThinkDist         string        `json:"think_dist,omitempty"`
+	Keys              int           `json:"keys"`
+	Seed              uint64        `json:"seed"`
+	Preset            string        `json:"preset,omitempty"`
+	Workload          string        `json:"workload,omitempty"`
+	PoolImpl          string        `json:"pool_impl,omitempty"`
+	Pools             []string      `json:"pools,omitempty"` // --pool specs
+	ChurnEvery        int           `json:"churn_every,omitempty"`
+	BankAccounts      int           `json:"bank_accounts,omitempty"`
+	BankBalance       int64         `json:"bank_balance,omitempty"`
+	MinConns          int           `json:"min_conns,omitempty"`
+	MaxConnLifetime   time.Duration `json:"max_conn_lifetime_ns,omitempty"`
+	MaxConnIdleTime   time.Duration `json:"max_conn_idle_time_ns,omitempty"`
+	HealthCheckPeriod time.Duration `json:"health_check_period_ns,omitempty"`
+	Target            string        `json:"target"` // redacted DSN info
+	ReaderDSN         string        `json:"reader_target,omitempty"`
+	WriterDSN         string        `json:"writer_target,omitempty"`
+	SlowQuery         string        `json:"slow_query,omitempty"`
+	ReadOnly          bool          `json:"read_only,omitempty"`
+	ViaProxy          bool          `json:"via_proxy,omitempty"`
+	Dial              string        `json:"dial,omitempty"` // keepalive, connect timeout and IP family flags
+	Statements        string        `json:"statements,omitempty"`
+	LogBuffer         int           `json:"log_buffer"` // 0: synchronous logging
+	Measure           bool          `json:"measure,omitempty"`
+	Warmup            time.Duration `json:"warmup_ns,omitempty"`
+	QueryTimeout      time.Duration `json:"query_timeout_ns,omitempty"`
+	RetryAttempts     int           `json:"retry_attempts"`
+	RetryBackoff      time.Duration `json:"retry_backoff_ns"`         // crdbpool's connect rate interval
+	RetryStrategy     string        `json:"retry_strategy,omitempty"` // the middleware's, with --middleware
+	Breaker           string        `json:"breaker,omitempty"`
+	SessionTimeouts   string        `json:"session_timeouts,omitempty"`
+	Isolation         string        `json:"isolation,omitempty"`
+	Drain             time.Duration `json:"drain_ns,omitempty"`
+	Steps             string        `json:"steps,omitempty"`
+	Sine              string        `json:"sine,omitempty"`
+	Spikes            []string      `json:"spikes,omitempty"`
+	Database          string        `json:"database,omitempty"` // --ephemeral-db's
+	Shard             string        `json:"shard,omitempty"`    // index/count of a --shard-count run
+	KeyBase           int           `json:"key_base,omitempty"` // first of its Keys
+}
+
+func newResultSettings(cfg Config) resultSettings {
+	rs := resultSettings{
+		Iterations:        cfg.Iterations,
+		Timeout:           cfg.Timeout,
+		ReaderMax:         cfg.ReaderMax,
+		WriterMax:         deriveWriterMax(cfg.ReaderMax, cfg.WriterMax),
+		ReaderSleep:       cfg.ReaderSleep,
+		WriterSleep:       cfg.WriterSleep,
+		ReaderConc:        cfg.ReaderConc,
+		WriterConc:        cfg.WriterConc,
+		SleepJitter:       cfg.SleepJitter,
+		ThinkDist:         string(cfg.ThinkDist),
+		Keys:              cfg.Keys,
+		Seed:              cfg.Seed,
+		Preset:            cfg.Preset,
+		Workload:          cfg.Workload,
+		PoolImpl:          cfg.PoolImpl,
+		MinConns:          cfg.MinConns,
+		MaxConnLifetime:   cfg.MaxConnLifetime,
+		MaxConnIdleTime:   cfg.MaxConnIdleTime,
+		HealthCheckPeriod: cfg.HealthCheckPeriod,
+		Target:            redactedDSNInfo(cfg.DSN),
+		ReadOnly:          cfg.ReadOnly,
+		ViaProxy:          cfg.ViaProxy,
+		Dial:              cfg.Dial.String(),
+		Statements:        cfg.Statements.String(),
+		LogBuffer:         cfg.LogBuffer,
+		Measure:           cfg.Measure,
+		Warmup:            cfg.Warmup,
+		QueryTimeout:      cfg.QueryTimeout,
+		RetryAttempts:     cfg.RetryAttempts,
+		RetryBackoff:      cfg.RetryBackoff,
+		Breaker:           cfg.Breaker.String(),
+		SessionTimeouts:   cfg.Session.String(),
+		Isolation:         cfg.Isolation,
+		Drain:             cfg.Drain,
+		Steps:             stepsString(cfg.Steps),
+		Sine:              cfg.Sine.String(),
+	}
+	if cfg.ReaderDSN != "" {
+		rs.ReaderDSN = redactedDSNInfo(cfg.ReaderDSN)
+	}
+	if cfg.WriterDSN != "" {
+		rs.WriterDSN = redactedDSNInfo(cfg.WriterDSN)
+	}
+	if cfg.Workload == workloadConnChurn {
+		rs.ChurnEvery = cfg.ChurnEvery
+	}
+	if cfg.Workload == workloadBank {
+		rs.BankAccounts, rs.BankBalance = cfg.BankAccounts, cfg.BankBalance
+	}
+	for _, ps := range cfg.Pools {
+		rs.Pools = append(rs.Pools, ps.String())
+	}
+	for _, sp := range cfg.Spikes {
+		rs.Spikes = append(rs.Spikes, sp.String())
+	}
+	if cfg.SlowQuery != nil {
+		rs.SlowQuery = cfg.SlowQuery.String()
+	}
+	if cfg.Middleware {
+		rs.RetryStrategy = cfg.RetryStrategy
+	}
+	if cfg.ShardCount > 0 {
+		rs.Shard = fmt.Sprintf("%d/%d", cfg.ShardIndex, cfg.ShardCount)
+	}
+	rs.KeyBase = cfg.keyBase
+	return rs
+}
+
+func writeResults(path string, res runResult) error {
+	b, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0o644)
+}
+
+func readResults(path string) (runResult, error) {
+	var res runResult
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return res, err
+	}
+	if err := json.Unmarshal(b, &res); err != nil {
+		return res, fmt.Errorf("%s: %w", path, err)
+	}
+	return res, nil
+}
+
+// newRunID returns a sortable, unique identifier for a run.
+func newRunID() string {
+	var b [3]byte
+	_, _ = rand.Read(b[:])
+	return time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(b[:])
+}
+
+// parseComponentVersions parses "name=version[,name=version...]" into dst.
+func parseComponentVersions(s string, dst map[string]string) error {
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok || k == "" || v == "" {
+			return fmt.Errorf("invalid component version %q (want name=version)", kv)
+		}
+		dst[k] = v
+	}
+	return nil
+}
+
+// defaultComponentVersions labels the crdbpool and pgx versions compiled into
+// the binary; explicit --component-versions labels take precedence.
+func defaultComponentVersions(labels map[string]string) map[string]string {
+	out := map[string]string{}
+	if v := moduleVersion("github.com/authzed/crdbpool"); v != "" {
+		out["crdbpool"] = v
+	}
+	if v := moduleVersion("github.com/jackc/pgx/v5"); v != "" {
+		out["pgx"] = v
+	}
+	for k, v := range labels {
+		out[k] = v
+	}
+	return out
+}
+
+// moduleVersion returns the version of a dependency from the build info.
+func moduleVersion(path string) string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	for _, dep := range bi.Deps {
+		if dep.Path == path {
+			if dep.Replace != nil {
+				return dep.Replace.Version
+			}
+			return dep.Version
+		}
+	}
+	return ""
+}
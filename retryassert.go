@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	crdbpool "github.com/authzed/crdbpool/pkg"
+)
+
+const (
+	defaultRetryAssertEvery = 10 * time.Second
+	// crdbpool sleeps 25ms << (retry-1) after a retryable error, with 50% jitter
+	retryBackoffBase   = 25 * time.Millisecond
+	retryBackoffJitter = 0.5
+	// allowed on top of the backoff for the tester's own bookkeeping between
+	// the attempt's end and the next statement
+	retryBackoffSlack = 20 * time.Millisecond
+	maxRetryFailures  = 20 // failed probes kept for the results
+)
+
+// retryProbe marks a call as a probe: its first force attempts fail with the
+// force-retry failpoint's error, whatever is armed on the pool, and its
+// attempts are kept for the assertion.
+type retryProbe struct {
+	force    int
+	attempts []attemptRecord
+}
+
+type retryProbeKey struct{}
+
+func withRetryProbe(ctx context.Context, p *retryProbe) context.Context {
+	return context.WithValue(ctx, retryProbeKey{}, p)
+}
+
+func probeFrom(ctx context.Context) *retryProbe {
+	p, _ := ctx.Value(retryProbeKey{}).(*retryProbe)
+	return p
+}
+
+// retryAssert periodically runs a probe call on each pool with a fixed number
+// of forced retries and checks what the RetryPool did with it: as many
+// attempts as forced (or the retry budget, whichever is lower) on the same
+// connection, crdbpool's backoff between them, and success, or a
+// MaxRetryError once the budget is exhausted.
+type retryAssert struct {
+	pools map[string]*testerPool
+	force int
+	every time.Duration
+	tl    *timeline
+
+	mu  sync.Mutex
+	sum retryAssertSummary
+}
+
+// retryAssertSummary is written to --results-out.
+type retryAssertSummary struct {
+	Forced   int                 `json:"forced_retries"`
+	Probes   int                 `json:"probes"`
+	Failed   int                 `json:"failed"`
+	Failures []retryProbeFailure `json:"failures,omitempty"` // the first maxRetryFailures
+}
+
+type retryProbeFailure struct {
+	At       time.Time       `json:"at"`
+	Pool     string          `json:"pool"`
+	Diff     []string        `json:"diff"`
+	Attempts []attemptRecord `json:"attempts"`
+	Err      string          `json:"err,omitempty"`
+}
+
+func newRetryAssert(pools map[string]*testerPool, force int, every time.Duration, tl *timeline) *retryAssert {
+	return &retryAssert{pools: pools, force: force, every: every, tl: tl, sum: retryAssertSummary{Forced: force}}
+}
+
+func (a *retryAssert) run(ctx context.Context) {
+	t := time.NewTicker(a.every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		for _, name := range slices.Sorted(maps.Keys(a.pools)) {
+			a.probe(ctx, a.pools[name])
+		}
+	}
+}
+
+func (a *retryAssert) probe(ctx context.Context, p *testerPool) {
+	budget := int(p.settings().RetryAttempts)
+	pr := &retryProbe{force: a.force}
+	err := p.QueryRowFunc(withRetryProbe(ctx, pr), func(ctx context.Context, row pgx.Row) error {
+		var one int
+		return row.Scan(&one)
+	}, "select 1")
+	if ctx.Err() != nil {
+		return // cut short by the end of the run
+	}
+	diff := retryDiff(pr.attempts, err, a.force, budget)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.sum.Probes++
+	if len(diff) == 0 {
+		slog.Debug("retry probe passed", "pool", p.name, "attempts", len(pr.attempts))
+		return
+	}
+	a.sum.Failed++
+	slog.Error("retry probe failed", "pool", p.name, "forced", a.force, "retry_attempts", budget, "diff", strings.Join(diff, "; "))
+	a.tl.record("retry-assert", "%s: probe failed: %s", p.name, strings.Join(diff, "; "))
+	if len(a.sum.Failures) < maxRetryFailures {
+		f := retryProbeFailure{At: time.Now(), Pool: p.name, Diff: diff, Attempts: pr.attempts}
+		if err != nil {
+			f.Err = err.Error()
+		}
+		a.sum.Failures = append(a.sum.Failures, f)
+	}
+}
+
+// retryDiff compares a probe's attempts and result with what crdbpool should
+// have done, one line per difference.
+func retryDiff(attempts []attemptRecord, err error, force, budget int) []string {
+	var diff []string
+	want := min(force, budget) + 1
+	if len(attempts) != want {
+		diff = append(diff, fmt.Sprintf("attempts: want %d (%d forced retries, retry-attempts %d), got %d", want, force, budget, len(attempts)))
+	}
+	for i := 1; i < len(attempts); i++ {
+		prev, cur := attempts[i-1], attempts[i]
+		if cur.Conn != prev.Conn {
+			diff = append(diff, fmt.Sprintf("attempt %d: want the connection of attempt %d (%s), got %s", i+1, i, prev.Conn, cur.Conn))
+		}
+		lo, hi := retryBackoffWindow(i)
+		if gap := cur.Offset - (prev.Offset + prev.Duration); gap < lo || gap > hi {
+			diff = append(diff, fmt.Sprintf("attempt %d: want a backoff of %s..%s after attempt %d, got %s", i+1, lo, hi, i, gap.Round(time.Microsecond)))
+		}
+	}
+	var maxErr *crdbpool.MaxRetryError
+	switch {
+	case force <= budget && err != nil:
+		diff = append(diff, fmt.Sprintf("result: want success, got %v", err))
+	case force > budget && !errors.As(err, &maxErr):
+		diff = append(diff, fmt.Sprintf("result: want a MaxRetryError after %d retries, got %v", budget, err))
+	}
+	return diff
+}
+
+// retryBackoffWindow is the range crdbpool's sleep after the n-th failed
+// attempt must fall in.
+func retryBackoffWindow(n int) (lo, hi time.Duration) {
+	base := retryBackoffBase << (n - 1)
+	lo = time.Duration(float64(base) * (1 - retryBackoffJitter))
+	hi = time.Duration(float64(base)*(1+retryBackoffJitter)) + retryBackoffSlack
+	return lo, hi
+}
+
+// verdict logs the summary and fails if any probe did; a run too short for
+// a probe is logged, not failed.
+func (a *retryAssert) verdict() (*retryAssertSummary, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	sum := a.sum
+	if sum.Probes == 0 {
+		slog.Warn("retries not verified: the run ended before the first probe", "every", a.every)
+		return &sum, nil
+	}
+	slog.Info("retry assertion", "forced", sum.Forced, "probes", sum.Probes, "failed", sum.Failed)
+	if sum.Failed > 0 {
+		return &sum, fmt.Errorf("retry assertion: %d of %d probes failed", sum.Failed, sum.Probes)
+	}
+	return &sum, nil
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const defaultCredentialsPoll = time.Second
+
+// credentialSource is where a credentialRotator reads the credentials: a
+// password or a full DSN.
+type credentialSource interface {
+	read(ctx context.Context) (string, error)
+	String() string // for logs; never the credentials
+}
+
+// fileSource is a file holding the credentials.
+type fileSource string
+
+func (f fileSource) read(context.Context) (string, error) {
+	b, err := os.ReadFile(string(f))
+	return string(b), err
+}
+
+func (f fileSource) String() string { return string(f) }
+
+// credential is one generation of connection credentials read from the
+// watched source. When the file holds a full DSN, conn carries the target too.
+type credential struct {
+	gen      int
+	password string
+	conn     *pgx.ConnConfig // nil when the file holds only a password
+	since    time.Time
+
+	connects        int // pool connections established with this generation
+	connectFailures int
+	queriesOK       int // queries on connections of this generation
+	queriesErr      int
+	okAfterRotation int // successful queries after a newer generation took over
+}
+
+func (c *credential) user(fallback string) string {
+	if c.conn != nil {
+		return c.conn.User
+	}
+	return fallback
+}
+
+type rotationGenKey struct{}
+
+// credentialRotator watches a source holding a password (or a full DSN)
+// and applies its current contents to every new pool connection via
+// BeforeConnect. As a pgx tracer it attributes connects and queries to the
+// credential generation they used, so a run shows whether new connections
+// authenticate after a rotation while existing ones keep working.
+//
+// With refreshOnConnect set, a connect re-reads the source first if the
+// last read is older than that, so connections re-established after a
+// rotation pick it up without polling.
+type credentialRotator struct {
+	source           credentialSource
+	user             string     // DSN user, for password-only sources
+	tls              tlsOptions // merged into a source's DSN, as into the run's
+	database         string     // kept over a source DSN's; --ephemeral-db's
+	refreshOnConnect time.Duration
+	tl               *timeline
+
+	mu       sync.Mutex
+	raw      string
+	lastRead time.Time
+	gens     []*credential
+	connGen  map[*pgx.Conn]*credential
+}
+
+func newCredentialRotator(ctx context.Context, source credentialSource, dsnUser string, tls tlsOptions, tl *timeline) (*credentialRotator, error) {
+	r := &credentialRotator{source: source, user: dsnUser, tls: tls, tl: tl, connGen: map[*pgx.Conn]*credential{}}
+	if _, err := r.reload(ctx); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload re-reads the source and starts a new generation if its contents
+// changed. It reports whether a rotation happened.
+func (r *credentialRotator) reload(ctx context.Context) (bool, error) {
+	s, err := r.source.read(ctx)
+	if err != nil {
+		return false, err
+	}
+	raw := strings.TrimSpace(s)
+	if raw == "" {
+		return false, fmt.Errorf("credentials in %s are empty", r.source)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastRead = time.Now()
+	if raw == r.raw {
+		return false, nil
+	}
+	c := &credential{gen: len(r.gens) + 1, password: raw, since: time.Now()}
+	if strings.Contains(raw, "://") {
+		cc, err := pgx.ParseConfig(r.tls.apply(raw))
+		if err != nil {
+			return false, fmt.Errorf("parse DSN in %s: %w", r.source, err)
+		}
+		c.password, c.conn = cc.Password, cc
+	}
+	r.raw = raw
+	r.gens = append(r.gens, c)
+	return true, nil
+}
+
+func (r *credentialRotator) current() *credential {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.gens[len(r.gens)-1]
+}
+
+// watch polls the source until ctx is done.
+func (r *credentialRotator) watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		r.check(ctx)
+	}
+}
+
+// check reloads the source, recording a rotation on the timeline. A failed
+// read keeps the current credentials.
+func (r *credentialRotator) check(ctx context.Context) {
+	rotated, err := r.reload(ctx)
+	if err != nil {
+		slog.Warn("credential rotation", "source", r.source.String(), "err", err)
+		return
+	}
+	if rotated {
+		c := r.current()
+		kind := "password"
+		if c.conn != nil {
+			r.mu.Lock()
+			kind = "dsn " + redactedDSNInfo(r.raw)
+			r.mu.Unlock()
+		}
+		r.tl.record("credentials", "rotated to generation %d (%s)", c.gen, kind)
+	}
+}
+
+// beforeConnect is a pgxpool BeforeConnect hook applying the current
+// credentials to a new connection.
+func (r *credentialRotator) beforeConnect(ctx context.Context, cc *pgx.ConnConfig) error {
+	if r.refreshOnConnect > 0 {
+		r.mu.Lock()
+		stale := time.Since(r.lastRead) >= r.refreshOnConnect
+		r.mu.Unlock()
+		if stale {
+			r.check(ctx)
+		}
+	}
+	c := r.current()
+	if c.conn != nil {
+		cc.Host, cc.Port, cc.Database, cc.User = c.conn.Host, c.conn.Port, c.conn.Database, c.conn.User
+		cc.TLSConfig, cc.Fallbacks = c.conn.TLSConfig, c.conn.Fallbacks
+		if r.database != "" {
+			cc.Database = r.database
+		}
+	}
+	cc.Password = c.password
+	return nil
+}
+
+// generation finds the generation a connect attempt is using.
+func (r *credentialRotator) generation(cc *pgx.ConnConfig) *credential {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := len(r.gens) - 1; i >= 0; i-- {
+		if c := r.gens[i]; c.password == cc.Password && c.user(r.user) == cc.User {
+			return c
+		}
+	}
+	return nil
+}
+
+func (r *credentialRotator) TraceConnectStart(ctx context.Context, data pgx.TraceConnectStartData) context.Context {
+	return context.WithValue(ctx, rotationGenKey{}, r.generation(data.ConnConfig))
+}
+
+func (r *credentialRotator) TraceConnectEnd(ctx context.Context, data pgx.TraceConnectEndData) {
+	c, _ := ctx.Value(rotationGenKey{}).(*credential)
+	if c == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if data.Err != nil {
+		c.connectFailures++
+		slog.Warn("connect with rotated credentials failed", "generation", c.gen, "err", data.Err)
+		return
+	}
+	c.connects++
+	r.connGen[data.Conn] = c
+}
+
+func (r *credentialRotator) TraceQueryStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	return ctx
+}
+
+func (r *credentialRotator) TraceQueryEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.connGen[conn]
+	if !ok {
+		return
+	}
+	if data.Err != nil {
+		c.queriesErr++
+		return
+	}
+	c.queriesOK++
+	if c != r.gens[len(r.gens)-1] {
+		c.okAfterRotation++
+	}
+}
+
+// attach installs the rotator's hooks in a pool config, after the tracer
+// and BeforeClose hook already there, if any (--measure runs have no tracer).
+func (r *credentialRotator) attach(c *pgxpool.Config) {
+	c.BeforeConnect = r.beforeConnect
+	beforeClose := c.BeforeClose
+	c.BeforeClose = func(conn *pgx.Conn) {
+		r.forget(conn)
+		if beforeClose != nil {
+			beforeClose(conn)
+		}
+	}
+	if c.ConnConfig.Tracer == nil {
+		c.ConnConfig.Tracer = r
+		return
+	}
+	c.ConnConfig.Tracer = multiTracer{c.ConnConfig.Tracer, r}
+}
+
+// forget drops a closed connection from the generation map (BeforeClose hook).
+func (r *credentialRotator) forget(conn *pgx.Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.connGen, conn)
+}
+
+// logSummary reports per-generation results and whether every rotation was
+// followed by at least one successful authentication with the new credentials.
+func (r *credentialRotator) logSummary() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	slog.Info("credential rotation summary", "generations", len(r.gens))
+	for _, c := range r.gens {
+		slog.Info("credential generation", "generation", c.gen, "since", c.since, "connects", c.connects, "connect_failures", c.connectFailures,
+			"queries_ok", c.queriesOK, "queries_err", c.queriesErr, "ok_after_rotation", c.okAfterRotation)
+	}
+	for _, c := range r.gens[1:] {
+		switch {
+		case c.connects > 0:
+			slog.Info("credential generation verified", "generation", c.gen, "verdict", "PASS", "detail", "new connections authenticated")
+		case c.connectFailures > 0:
+			slog.Error("credential generation verified", "generation", c.gen, "verdict", "FAIL", "detail", fmt.Sprintf("%d connect attempts failed, none succeeded", c.connectFailures))
+		default:
+			slog.Warn("credential generation verified", "generation", c.gen, "verdict", "UNVERIFIED", "detail", "no new connections were opened (lower MaxConnLifetime or add load)")
+		}
+	}
+}
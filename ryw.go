@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	rywLockStripes = 256
+	// how long a bad read-back is retried, to see when the write shows up
+	rywConvergeWait = 5 * time.Second
+	maxRYWAnomalies = 20 // anomalies kept for the results
+)
+
+// readYourWrites checks that a write is visible to the reader pool as soon
+// as it has returned. Each writer call upserts a unique token into a random
+// key, then reads the key back through the reader pool: another token is a
+// stale read, no row a missing one. Calls on the same key are serialized so
+// no other write of this run can land in between. A bad read is retried
+// until the token shows up, to tell how long the write stayed invisible.
+type readYourWrites struct {
+	runID        string
+	upsert, read string
+	reader       querier
+	keys         *lockedRand
+	base         int // first key, set by applyShard
+	nkeys        int
+	tl           *timeline
+
+	seq   atomic.Int64
+	locks [rywLockStripes]sync.Mutex
+
+	mu        sync.Mutex
+	checked   int64
+	stale     int64
+	missing   int64
+	readErrs  int64 // read-backs that failed; their writes are unchecked
+	readBack  latencyHistogram
+	anomalies []rywAnomaly
+}
+
+// rywAnomaly is one stale or missing read-back, as logged and written to
+// --results-out.
+type rywAnomaly struct {
+	Key          int           `json:"key"`
+	Kind         string        `json:"kind"` // "stale" or "missing"
+	Want         string        `json:"want"`
+	Got          string        `json:"got,omitempty"`
+	At           time.Time     `json:"at"`
+	After        time.Duration `json:"after_ns"`                   // from the write's return to the bad read's
+	VisibleAfter time.Duration `json:"visible_after_ns,omitempty"` // until a re-read saw the write; 0 => not within 5s
+}
+
+// rywSummary is written to --results-out.
+type rywSummary struct {
+	Checked    int64             `json:"checked"`
+	Stale      int64             `json:"stale"`
+	Missing    int64             `json:"missing"`
+	ReadErrors int64             `json:"read_errors"`
+	ReadBack   *latencyHistogram `json:"read_back"` // from the write's return to its read-back's
+	Anomalies  []rywAnomaly      `json:"anomalies,omitempty"`
+}
+
+func newReadYourWrites(runID string, table runTable, reader querier, keys *lockedRand, base, nkeys int, tl *timeline) *readYourWrites {
+	return &readYourWrites{
+		runID:  runID,
+		upsert: table.upsertTokenSQL(),
+		read:   table.selectTokenSQL(),
+		reader: reader,
+		keys:   keys,
+		base:   base,
+		nkeys:  nkeys,
+		tl:     tl,
+	}
+}
+
+// query returns the writer query: upsert a fresh token through writer, then
+// read it back through the reader. Only the upsert's error is the call's;
+// read-back errors are counted apart.
+func (r *readYourWrites) query(writer querier) func(ctx context.Context, i int) error {
+	return func(ctx context.Context, i int) error {
+		key := r.base + r.keys.IntN(r.nkeys)
+		token := fmt.Sprintf("%s-%d", r.runID, r.seq.Add(1))
+		lk := &r.locks[key%rywLockStripes]
+		lk.Lock()
+		defer lk.Unlock()
+		var ts time.Time
+		if err := writer.QueryRowFunc(ctx, func(ctx context.Context, row pgx.Row) error { return row.Scan(&ts) }, r.upsert, key, token); err != nil {
+			return err
+		}
+		written := time.Now()
+		logQuery(ctx, "upsert ok", "workload", "writer", "iteration", i+1, "ts", ts.UTC(), "token", token)
+		got, found, err := r.get(ctx, key)
+		after := time.Since(written)
+		if err != nil {
+			slog.WarnContext(ctx, "read-your-writes read-back failed", "key", key, "token", token, "err", err)
+			r.mu.Lock()
+			r.readErrs++
+			r.mu.Unlock()
+			return nil
+		}
+		r.readBack.observe(after)
+		if found && got == token {
+			r.record(nil)
+			return nil
+		}
+		a := rywAnomaly{Key: key, Kind: "stale", Want: token, Got: got, At: time.Now(), After: after}
+		if !found {
+			a.Kind = "missing"
+		}
+		a.VisibleAfter = r.converge(ctx, key, token, written)
+		slog.ErrorContext(ctx, "read-your-writes violation", "kind", a.Kind, "key", key, "want", token, "got", got, "after", after, "visible_after", a.VisibleAfter)
+		r.tl.record("ryw", "%s read of key %d %s after its write (visible after %s)", a.Kind, key, after.Truncate(time.Microsecond), a.VisibleAfter.Truncate(time.Millisecond))
+		r.record(&a)
+		return nil
+	}
+}
+
+// record counts one read-back; a is nil when it saw its write.
+func (r *readYourWrites) record(a *rywAnomaly) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checked++
+	if a == nil {
+		return
+	}
+	if a.Kind == "missing" {
+		r.missing++
+	} else {
+		r.stale++
+	}
+	if len(r.anomalies) < maxRYWAnomalies {
+		r.anomalies = append(r.anomalies, *a)
+	}
+}
+
+// get reads key's token through the reader; found is false when there is no
+// row.
+func (r *readYourWrites) get(ctx context.Context, key int) (token string, found bool, err error) {
+	var got *string
+	err = r.reader.QueryRowFunc(ctx, func(ctx context.Context, row pgx.Row) error { return row.Scan(&got) }, r.read, key)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if got != nil {
+		token = *got
+	}
+	return token, true, nil
+}
+
+// converge re-reads key until it holds token, and returns how long after
+// the write that was; 0 if it never did within rywConvergeWait.
+func (r *readYourWrites) converge(ctx context.Context, key int, token string, written time.Time) time.Duration {
+	for time.Since(written) < rywConvergeWait && sleepCtx(ctx, 50*time.Millisecond) {
+		if got, found, err := r.get(ctx, key); err == nil && found && got == token {
+			return time.Since(written)
+		}
+	}
+	return 0
+}
+
+// verdict logs the summary and fails the run on any stale or missing read.
+func (r *readYourWrites) verdict() (*rywSummary, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := &rywSummary{Checked: r.checked, Stale: r.stale, Missing: r.missing, ReadErrors: r.readErrs, ReadBack: &latencyHistogram{}, Anomalies: r.anomalies}
+	s.ReadBack.merge(&r.readBack)
+	slog.Info("read-your-writes", "checked", s.Checked, "stale", s.Stale, "missing", s.Missing, "read_errors", s.ReadErrors, "read_back", s.ReadBack)
+	if n := s.Stale + s.Missing; n > 0 {
+		return s, violation(fmt.Errorf("read-your-writes: %d of %d read-backs did not see their write (%d stale, %d missing)", n, s.Checked, s.Stale, s.Missing))
+	}
+	return s, nil
+}
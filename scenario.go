@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// scenarioEvent is one timed action from a scenario file, e.g.
+//
+//	at 2m: kill-conns writer
+//	at 5m: pause writer
+//	at 7m: resume
+//	at 8m: note node 3 restarted by hand
+type scenarioEvent struct {
+	At     time.Duration
+	Action string
+	Args   []string
+	Line   int
+}
+
+func (ev scenarioEvent) String() string {
+	return strings.TrimSpace(ev.Action + " " + strings.Join(ev.Args, " "))
+}
+
+// scenarioActions lists the supported actions and whether they take a pool
+// target (reader, writer or all; all when omitted).
+var scenarioActions = map[string]bool{
+	"kill-conns": true,
+	"pause":      true,
+	"resume":     true,
+	"note":       false,
+}
+
+func loadScenario(path string) ([]scenarioEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseScenario(f)
+}
+
+func parseScenario(r io.Reader) ([]scenarioEvent, error) {
+	var events []scenarioEvent
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		when, what, ok := strings.Cut(line, ":")
+		at, found := strings.CutPrefix(strings.TrimSpace(when), "at ")
+		if !ok || !found {
+			return nil, fmt.Errorf("line %d: want 'at <duration>: <action> [args]', got %q", n, line)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(at))
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("line %d: invalid offset %q", n, at)
+		}
+		fields := strings.Fields(what)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("line %d: missing action", n)
+		}
+		ev := scenarioEvent{At: d, Action: fields[0], Args: fields[1:], Line: n}
+		targeted, known := scenarioActions[ev.Action]
+		if !known {
+			return nil, fmt.Errorf("line %d: unknown action %q", n, ev.Action)
+		}
+		if targeted {
+			if len(ev.Args) > 1 {
+				return nil, fmt.Errorf("line %d: %s takes at most one target", n, ev.Action)
+			}
+			if len(ev.Args) == 1 && !validScenarioTarget(ev.Args[0]) {
+				return nil, fmt.Errorf("line %d: unknown target %q (want reader, writer or all)", n, ev.Args[0])
+			}
+		}
+		events = append(events, ev)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].At < events[j].At })
+	return events, nil
+}
+
+func validScenarioTarget(s string) bool {
+	return s == "reader" || s == "writer" || s == "all"
+}
+
+// scenarioTargets is what scenario actions operate on, keyed by pool name.
+type scenarioTargets struct {
+	pools map[string]*testerPool
+	gates map[string]*pauseGate
+}
+
+// names resolves an event's optional target argument to pool names; all
+// is the reader and writer the run has (no writer with --read-only).
+func (t scenarioTargets) names(target string) []string {
+	if target != "" && target != "all" {
+		return []string{target}
+	}
+	var names []string
+	for _, name := range []string{"reader", "writer"} {
+		if t.pools[name] != nil {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// runScenario executes events at their offsets from now, annotating each on
+// the timeline.
+func runScenario(ctx context.Context, events []scenarioEvent, targets scenarioTargets, tl *timeline) {
+	start := time.Now()
+	for _, ev := range events {
+		if !sleepCtx(ctx, time.Until(start.Add(ev.At))) {
+			return
+		}
+		tl.record("scenario", "line %d at %s: %s -> %s", ev.Line, ev.At, ev, targets.apply(ev))
+	}
+}
+
+func (t scenarioTargets) apply(ev scenarioEvent) string {
+	target := ""
+	if len(ev.Args) == 1 {
+		target = ev.Args[0]
+	}
+	switch ev.Action {
+	case "note":
+		return "noted"
+	case "pause", "resume":
+		results, err := setPaused(t.gates, target, ev.Action == "pause")
+		if err != nil {
+			return err.Error()
+		}
+		return strings.Join(results, ", ")
+	}
+	var results []string
+	for _, name := range t.names(target) {
+		p, ok := t.pools[name]
+		if !ok {
+			results = append(results, name+": no such pool")
+			continue
+		}
+		results = append(results, fmt.Sprintf("%s: %d conns killed", name, killConns(p.pool())))
+	}
+	return strings.Join(results, ", ")
+}
+
+// killConns closes the network connection under every pooled connection, so
+// in-flight and subsequent queries on them fail as if the node dropped them.
+// Closing the socket is safe while another goroutine uses the pgx.Conn.
+func killConns(p basePool) int {
+	n := 0
+	p.Range(func(conn *pgx.Conn, _ uint32) {
+		if nc := conn.PgConn().Conn(); nc != nil {
+			_ = nc.Close()
+			n++
+		}
+	})
+	return n
+}
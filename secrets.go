@@ -0,0 +1,174 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	defaultVaultAddr  = "https://127.0.0.1:8200"
+	defaultVaultField = "dsn"
+	vaultTimeout      = 10 * time.Second
+)
+
+// vaultSource reads the credentials, a password or a full DSN, from a field
+// of a Vault secret: a KV version 1 or 2 path as the HTTP API names it
+// (e.g. secret/data/crdb/app for KV v2), or a database secrets engine's
+// static credentials. The token is $VAULT_TOKEN, or the token file (e.g. a
+// Vault Agent sink), re-read on every read as the agent renews it.
+type vaultSource struct {
+	addr      string
+	path      string
+	field     string
+	tokenFile string
+	namespace string
+	http      *http.Client
+}
+
+func newVaultSource(path, field, tokenFile string) *vaultSource {
+	if tokenFile == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			tokenFile = filepath.Join(home, ".vault-token")
+		}
+	}
+	return &vaultSource{
+		addr:      strings.TrimRight(cmp.Or(os.Getenv("VAULT_ADDR"), defaultVaultAddr), "/"),
+		path:      strings.Trim(path, "/"),
+		field:     cmp.Or(field, defaultVaultField),
+		tokenFile: tokenFile,
+		namespace: os.Getenv("VAULT_NAMESPACE"),
+		http:      &http.Client{Timeout: vaultTimeout},
+	}
+}
+
+func (v *vaultSource) String() string { return "vault:" + v.path + "#" + v.field }
+
+func (v *vaultSource) token() (string, error) {
+	if t := os.Getenv("VAULT_TOKEN"); t != "" {
+		return t, nil
+	}
+	b, err := os.ReadFile(v.tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("vault token: $VAULT_TOKEN unset and %w", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func (v *vaultSource) read(ctx context.Context) (string, error) {
+	token, err := v.token()
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.addr+"/v1/"+v.path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+	resp, err := v.http.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", v, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", v, err)
+	}
+	var secret struct {
+		Errors []string                   `json:"errors"`
+		Data   map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil && resp.StatusCode/100 == 2 {
+		return "", fmt.Errorf("%s: %w", v, err)
+	}
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("%s: %s: %s", v, resp.Status, strings.Join(secret.Errors, "; "))
+	}
+	data := secret.Data
+	if inner, ok := data["data"]; ok && data["metadata"] != nil {
+		// KV version 2 wraps the secret's fields with its metadata
+		data = nil
+		if err := json.Unmarshal(inner, &data); err != nil {
+			return "", fmt.Errorf("%s: %w", v, err)
+		}
+	}
+	raw, ok := data[v.field]
+	if !ok {
+		return "", fmt.Errorf("%s: the secret has no field %q", v, v.field)
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return "", fmt.Errorf("%s: field %q is not a string", v, v.field)
+	}
+	return s, nil
+}
+
+// credentialSource is where the run's credentials are read from, if not
+// from DATABASE_URL: --credentials-file, --dsn-file or --vault-path.
+func (cfg Config) credentialSource() credentialSource {
+	switch {
+	case cfg.CredentialsFile != "":
+		return fileSource(cfg.CredentialsFile)
+	case cfg.DSNFile != "":
+		return fileSource(cfg.DSNFile)
+	case cfg.VaultPath != "":
+		return newVaultSource(cfg.VaultPath, cfg.VaultField, cfg.VaultTokenFile)
+	}
+	return nil
+}
+
+// resolveDSN builds or completes cfg.DSN from what isn't a plain DSN: a
+// CockroachDB Cloud cluster, then a --dsn-file or Vault secret holding the
+// DSN, or the password DATABASE_URL leaves out. It runs before validation,
+// which needs the DSN. A coordinator has none; its workers resolve theirs.
+func resolveDSN(ctx context.Context, cfg *Config) error {
+	if cfg.CoordinateAddr != "" {
+		return nil
+	}
+	if cfg.CCloudCluster != "" {
+		if err := resolveCCloud(ctx, cfg); err != nil {
+			return err
+		}
+	}
+	if cfg.DSNFile == "" && cfg.VaultPath == "" {
+		return nil
+	}
+	if len(cfg.Clusters) > 0 {
+		return errors.New("--dsn-file and --vault-path replace the DSN and can't be combined with --dsn")
+	}
+	ctx, cancel := context.WithTimeout(ctx, vaultTimeout)
+	defer cancel()
+	src := cfg.credentialSource()
+	secret, err := src.read(ctx)
+	if err != nil {
+		return err
+	}
+	secret = strings.TrimSpace(secret)
+	switch {
+	case secret == "":
+		return fmt.Errorf("credentials in %s are empty", src)
+	case strings.Contains(secret, "://"):
+		cfg.DSN = secret
+		return nil
+	}
+	// a password, for DATABASE_URL's user
+	u, err := url.Parse(cfg.DSN)
+	if err != nil || cfg.DSN == "" || u.User == nil {
+		return fmt.Errorf("%s holds a password; DATABASE_URL must be a URL with the user it is for", src)
+	}
+	u.User = url.UserPassword(u.User.Username(), secret)
+	cfg.DSN = u.String()
+	return nil
+}
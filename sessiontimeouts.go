@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// sessionTimeouts are the server-side timeouts set as session defaults on
+// every pooled connection, to compare with the client's own deadlines
+// (--query-timeout, --middleware-timeout): the server cancels a statement
+// with SQLSTATE 57014 and keeps the connection, while a cancelled context
+// makes pgx close it.
+type sessionTimeouts struct {
+	Statement time.Duration // statement_timeout; 0 => the cluster's
+	IdleInTx  time.Duration // idle_in_transaction_session_timeout; 0 => the cluster's
+}
+
+func (o *sessionTimeouts) register(fs *flag.FlagSet) {
+	fs.DurationVar(&o.Statement, "statement-timeout", 0, "set statement_timeout on every pooled session (e.g., 2s), so the server cancels slow statements (sqlstate-57014) instead of the client (0 = the cluster's default)")
+	fs.DurationVar(&o.IdleInTx, "idle-in-tx-timeout", 0, "set idle_in_transaction_session_timeout on every pooled session (e.g., 10s), so the server closes sessions left idle inside a transaction (0 = the cluster's default)")
+}
+
+func (o sessionTimeouts) validate() error {
+	if o.Statement < 0 || o.IdleInTx < 0 {
+		return errors.New("statement-timeout and idle-in-tx-timeout must be >= 0")
+	}
+	if o.Statement%time.Millisecond != 0 || o.IdleInTx%time.Millisecond != 0 {
+		return errors.New("statement-timeout and idle-in-tx-timeout are set in whole milliseconds")
+	}
+	return nil
+}
+
+func (o sessionTimeouts) set() bool { return o.Statement > 0 || o.IdleInTx > 0 }
+
+// String summarizes the settings for the results, "" when none is set.
+func (o sessionTimeouts) String() string {
+	var parts []string
+	if o.Statement > 0 {
+		parts = append(parts, fmt.Sprintf("statement_timeout=%s", o.Statement))
+	}
+	if o.IdleInTx > 0 {
+		parts = append(parts, fmt.Sprintf("idle_in_transaction_session_timeout=%s", o.IdleInTx))
+	}
+	return strings.Join(parts, ",")
+}
+
+// apply sets the timeouts on c's connections, as startup parameters like
+// --read-only's, in milliseconds, which CockroachDB and PostgreSQL both read.
+func (o sessionTimeouts) apply(c *pgxpool.Config) {
+	if !o.set() {
+		return
+	}
+	if c.ConnConfig.RuntimeParams == nil {
+		c.ConnConfig.RuntimeParams = map[string]string{}
+	}
+	if o.Statement > 0 {
+		c.ConnConfig.RuntimeParams["statement_timeout"] = strconv.FormatInt(o.Statement.Milliseconds(), 10)
+	}
+	if o.IdleInTx > 0 {
+		c.ConnConfig.RuntimeParams["idle_in_transaction_session_timeout"] = strconv.FormatInt(o.IdleInTx.Milliseconds(), 10)
+	}
+}
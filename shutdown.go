@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const defaultShutdownGrace = 10 * time.Second
+
+// shutdownWatcher turns SIGINT/SIGTERM into a graceful shutdown: the first
+// signal stops the workloads from starting new iterations and gives queries
+// in flight the grace period to finish before they are cancelled; a second
+// signal cancels them right away. Either way the run returns normally, so the
+// summaries, checkpoint and result files are still written. Once the queries
+// have been cancelled the signals are released, so a further signal kills the
+// process.
+type shutdownWatcher struct {
+	mu  sync.Mutex
+	sig os.Signal // first signal received, nil if none
+}
+
+// watchShutdownSignals starts the watcher. stop ends the workloads' loops,
+// kill cancels the context in-flight queries run under.
+func watchShutdownSignals(ctx context.Context, stop, kill context.CancelFunc, grace time.Duration, tl *timeline) *shutdownWatcher {
+	w := &shutdownWatcher{}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		defer signal.Stop(ch)
+		var timer <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer:
+				tl.record("shutdown", "grace period of %s over, cancelling in-flight queries", grace)
+				kill()
+				return
+			case sig := <-ch:
+				w.mu.Lock()
+				first := w.sig == nil
+				if first {
+					w.sig = sig
+				}
+				w.mu.Unlock()
+				if !first {
+					tl.record("shutdown", "second %s: cancelling in-flight queries", sig)
+					kill()
+					return
+				}
+				tl.record("shutdown", "%s: stopping workloads, %s grace for in-flight queries (signal again to cancel them)", sig, grace)
+				stop()
+				timer = time.After(grace)
+			}
+		}
+	}()
+	return w
+}
+
+// signal returns the signal that started the shutdown, or nil.
+func (w *shutdownWatcher) signal() os.Signal {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.sig
+}
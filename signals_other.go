@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import "context"
+
+// watchPauseSignals is a no-op where SIGTSTP/SIGCONT do not exist; use the
+// admin API to pause and resume.
+func watchPauseSignals(ctx context.Context, gates map[string]*pauseGate, tl *timeline) {}
+
+// watchReloadSignal is a no-op where SIGHUP does not exist; use the admin API
+// to reload pools.
+func watchReloadSignal(ctx context.Context, pools map[string]*testerPool, reloadFile string, tl *timeline) {
+}
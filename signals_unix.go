@@ -0,0 +1,56 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// watchPauseSignals pauses every workload on SIGTSTP and resumes them on
+// SIGCONT. Trapping SIGTSTP means Ctrl-Z pauses the workload instead of
+// suspending the process; resume with `kill -CONT <pid>`.
+func watchPauseSignals(ctx context.Context, gates map[string]*pauseGate, tl *timeline) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTSTP, syscall.SIGCONT)
+	defer signal.Stop(ch)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-ch:
+			pause := sig == syscall.SIGTSTP
+			results, _ := setPaused(gates, "all", pause)
+			tl.record("control", "%s: %s", sig, strings.Join(results, ", "))
+		}
+	}
+}
+
+// watchReloadSignal rebuilds the pools on SIGHUP, applying the settings in
+// reloadFile (or the current settings when no file is configured).
+func watchReloadSignal(ctx context.Context, pools map[string]*testerPool, reloadFile string, tl *timeline) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	defer signal.Stop(ch)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ch:
+		}
+		kvs := map[string]string{}
+		if reloadFile != "" {
+			var err error
+			if kvs, err = readReloadFile(reloadFile); err != nil {
+				tl.record("reload-error", "SIGHUP: %v", err)
+				continue
+			}
+		}
+		if err := reloadPools(ctx, pools, nil, kvs, tl); err != nil {
+			tl.record("reload-error", "SIGHUP: %v", err)
+		}
+	}
+}
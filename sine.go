@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSinePeriod    = time.Hour
+	defaultSineAmplitude = 0.5
+	defaultSineInterval  = 10 * time.Second
+	// sineBins are the slices of the period the summary averages over, so
+	// the peak and trough of every cycle fall in the same ones.
+	sineBins = 8
+)
+
+// sineOptions are the --sine flags: every workload's target rate follows a
+// sine wave around a mean, e.g. a day of diurnal traffic compressed into an
+// hour, to see the pools grow into the peaks and reap idle connections in
+// the troughs.
+type sineOptions struct {
+	Rate      float64       // mean queries per second; 0 disables
+	Period    time.Duration // of one cycle
+	Amplitude float64       // of the wave, as a fraction of the mean
+	Interval  time.Duration // between rate changes and pool samples
+}
+
+func (o *sineOptions) register(fs *flag.FlagSet) {
+	fs.Func("sine", "modulate every workload's target rate on a sine wave around this mean, e.g. 200qps, to emulate diurnal traffic; the run lasts one --sine-period unless --iterations or --timeout say otherwise", func(s string) (err error) {
+		o.Rate, err = parseThroughput(s)
+		return err
+	})
+	fs.DurationVar(&o.Period, "sine-period", defaultSinePeriod, "with --sine, the length of one cycle")
+	fs.Float64Var(&o.Amplitude, "sine-amplitude", defaultSineAmplitude, "with --sine, how far the rate swings above and below the mean, as a fraction of it (0.5: from half to one and a half times the mean)")
+	fs.DurationVar(&o.Interval, "sine-interval", defaultSineInterval, "with --sine, how often the target rate is changed and the pools sampled")
+}
+
+func (o sineOptions) validate() error {
+	if o.Rate == 0 {
+		return nil
+	}
+	switch {
+	case o.Period <= 0 || o.Interval <= 0:
+		return errors.New("sine-period and sine-interval must be > 0")
+	case o.Interval*sineBins > o.Period:
+		return fmt.Errorf("sine-interval (%s) must be at most a %dth of sine-period (%s)", o.Interval, sineBins, o.Period)
+	case o.Amplitude <= 0 || o.Amplitude >= 1:
+		return fmt.Errorf("sine-amplitude must be > 0 and < 1 (got %g)", o.Amplitude)
+	}
+	return nil
+}
+
+// String summarizes the settings for the results, "" without --sine.
+func (o sineOptions) String() string {
+	if o.Rate == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%gqps,amplitude=%g,period=%s", o.Rate, o.Amplitude, o.Period)
+}
+
+// at is the target rate at offset into the run.
+func (o sineOptions) at(offset time.Duration) float64 {
+	phase := 2 * math.Pi * float64(offset%o.Period) / float64(o.Period)
+	return o.Rate * (1 + o.Amplitude*math.Sin(phase))
+}
+
+// sineBin accumulates the samples taken in one slice of the period, over
+// every cycle of the run.
+type sineBin struct {
+	samples int
+	target  float64
+	queries map[string]int64 // per workload
+	elapsed time.Duration    // the samples' intervals
+	total   map[string]int64 // per pool, summed total conns
+	idle    map[string]int64 // per pool, summed idle conns
+}
+
+// sineShaper drives the workloads' target rate along the wave and samples
+// the pools as it does.
+type sineShaper struct {
+	o         sineOptions
+	workloads []*workload
+	pools     map[string]*testerPool
+	tl        *timeline
+
+	mu      sync.Mutex
+	start   time.Time
+	bins    [sineBins]sineBin
+	first   map[string]poolStat // per pool, at the start
+	last    map[string]poolStat
+	minConn map[string]int32
+	maxConn map[string]int32
+}
+
+// sinePhase is a slice of the period in the summary, averaged over every
+// cycle that ran through it.
+type sinePhase struct {
+	Offset     time.Duration      `json:"offset_ns"` // of the slice's start into the period
+	Target     float64            `json:"target_qps"`
+	Throughput map[string]float64 `json:"throughput_qps"` // per workload
+	TotalConns map[string]float64 `json:"total_conns"`    // per pool, mean
+	IdleConns  map[string]float64 `json:"idle_conns"`     // per pool, mean
+}
+
+// sinePool is how a pool followed the wave.
+type sinePool struct {
+	MinConns      int32 `json:"min_total_conns"`
+	MaxConns      int32 `json:"max_total_conns"`
+	NewConns      int64 `json:"new_conns"`
+	IdleDestroyed int64 `json:"max_idle_destroyed"`
+	// Shrink is how much fewer connections the pool held in the trough's
+	// slice than in the peak's, as a fraction of the peak's.
+	Shrink float64 `json:"shrink"`
+}
+
+// sineSummary is the wave's record, as written to --results-out.
+type sineSummary struct {
+	Cycles float64             `json:"cycles"`
+	Phases []sinePhase         `json:"phases"`
+	Pools  map[string]sinePool `json:"pools"`
+}
+
+// newSineShaper sets the workloads' rate to the wave's start, so their
+// first batches already follow it.
+func newSineShaper(o sineOptions, workloads []*workload, pools map[string]*testerPool, tl *timeline) *sineShaper {
+	s := &sineShaper{o: o, workloads: workloads, pools: pools, tl: tl, start: time.Now(),
+		first: snapshotPools(pools), minConn: map[string]int32{}, maxConn: map[string]int32{}}
+	s.last = s.first
+	for i := range s.bins {
+		s.bins[i] = sineBin{queries: map[string]int64{}, total: map[string]int64{}, idle: map[string]int64{}}
+	}
+	for _, w := range workloads {
+		w.setRate(o.at(0))
+	}
+	tl.record("sine", "%s", o)
+	return s
+}
+
+// run moves the rate along the wave every interval until ctx is done.
+func (s *sineShaper) run(ctx context.Context) {
+	t := time.NewTicker(s.o.Interval)
+	defer t.Stop()
+	prevAt := s.start
+	prev := map[string]int64{}
+	for _, w := range s.workloads {
+		prev[w.name] = w.completed.Load()
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			s.sample(prevAt, now, prev)
+			prevAt = now
+		}
+	}
+}
+
+// sample records the interval from prevAt to now in the bin it started in,
+// then sets the rate for the next one.
+func (s *sineShaper) sample(prevAt, now time.Time, prev map[string]int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	offset := prevAt.Sub(s.start)
+	b := &s.bins[int(offset%s.o.Period*sineBins/s.o.Period)]
+	b.samples++
+	b.target += s.o.at(offset)
+	b.elapsed += now.Sub(prevAt)
+	for _, w := range s.workloads {
+		n := w.completed.Load()
+		b.queries[w.name] += n - prev[w.name]
+		prev[w.name] = n
+	}
+	s.last = snapshotPools(s.pools)
+	for name, st := range s.last {
+		b.total[name] += int64(st.TotalConns)
+		b.idle[name] += int64(st.IdleConns)
+		if lo, ok := s.minConn[name]; !ok || st.TotalConns < lo {
+			s.minConn[name] = st.TotalConns
+		}
+		s.maxConn[name] = max(s.maxConn[name], st.TotalConns)
+	}
+	rate := s.o.at(now.Sub(s.start))
+	for _, w := range s.workloads {
+		w.setRate(rate)
+	}
+	slog.Debug("sine", "target_qps", rate)
+}
+
+func (s *sineShaper) summary() *sineSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := &sineSummary{Cycles: float64(time.Since(s.start)) / float64(s.o.Period), Pools: map[string]sinePool{}}
+	for i, b := range s.bins {
+		ph := sinePhase{Offset: s.o.Period * time.Duration(i) / sineBins, Throughput: map[string]float64{}, TotalConns: map[string]float64{}, IdleConns: map[string]float64{}}
+		if b.samples > 0 {
+			ph.Target = b.target / float64(b.samples)
+			for name, n := range b.queries {
+				ph.Throughput[name] = float64(n) / b.elapsed.Seconds()
+			}
+			for name, n := range b.total {
+				ph.TotalConns[name] = float64(n) / float64(b.samples)
+				ph.IdleConns[name] = float64(b.idle[name]) / float64(b.samples)
+			}
+		}
+		out.Phases = append(out.Phases, ph)
+	}
+	peak, trough := -1, -1 // the sampled slices of the highest and lowest mean targets
+	for i, b := range s.bins {
+		if b.samples == 0 {
+			continue
+		}
+		if peak < 0 || out.Phases[i].Target > out.Phases[peak].Target {
+			peak = i
+		}
+		if trough < 0 || out.Phases[i].Target < out.Phases[trough].Target {
+			trough = i
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(s.pools)) {
+		sp := sinePool{MinConns: s.minConn[name], MaxConns: s.maxConn[name],
+			NewConns: s.last[name].NewConnsCount - s.first[name].NewConnsCount, IdleDestroyed: s.last[name].MaxIdleDestroyed - s.first[name].MaxIdleDestroyed}
+		if peak >= 0 && out.Phases[peak].TotalConns[name] > 0 {
+			sp.Shrink = 1 - out.Phases[trough].TotalConns[name]/out.Phases[peak].TotalConns[name]
+		}
+		out.Pools[name] = sp
+		slog.Info("sine pool", "pool", name, "min_total_conns", sp.MinConns, "max_total_conns", sp.MaxConns, "new_conns", sp.NewConns, "max_idle_destroyed", sp.IdleDestroyed, "shrink", sp.Shrink)
+	}
+	for _, ph := range out.Phases {
+		slog.Info("sine phase", "offset", ph.Offset, "target_qps", ph.Target, "throughput_qps", ph.Throughput, "total_conns", ph.TotalConns)
+	}
+	slog.Info("sine summary", "cycles", out.Cycles, "wave", s.o.String())
+	return out
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sloThresholds are the --max-*/--min-* pass/fail gates checked against every
+// workload's stats at the end of a run, or the ones in Workloads. A zero
+// limit is off, except MaxErrorRate, which is off below zero.
+type sloThresholds struct {
+	MaxErrorRate  float64       `json:"max_error_rate"` // errors per query; 0.001 = 0.1%
+	MaxP50        time.Duration `json:"max_p50_ns,omitempty"`
+	MaxP95        time.Duration `json:"max_p95_ns,omitempty"`
+	MaxP99        time.Duration `json:"max_p99_ns,omitempty"`
+	MinThroughput float64       `json:"min_throughput_qps,omitempty"`
+	Workloads     []string      `json:"workloads,omitempty"` // empty => all
+}
+
+func (t sloThresholds) set() bool {
+	return t.MaxErrorRate >= 0 || t.MaxP50 > 0 || t.MaxP95 > 0 || t.MaxP99 > 0 || t.MinThroughput > 0
+}
+
+// sloViolation is one breached threshold.
+type sloViolation struct {
+	Workload string `json:"workload"`
+	Metric   string `json:"metric"`
+	Limit    string `json:"limit"`
+	Actual   string `json:"actual"`
+}
+
+// sloResult is written to --results-out when any threshold is set.
+type sloResult struct {
+	Thresholds sloThresholds  `json:"thresholds"`
+	Pass       bool           `json:"pass"`
+	Violations []sloViolation `json:"violations,omitempty"`
+}
+
+// parseRate accepts a percentage ("0.1%") or a fraction ("0.001").
+func parseRate(s string) (float64, error) {
+	pct := strings.HasSuffix(s, "%")
+	v, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("%q: want a percentage like 0.1%% or a fraction like 0.001", s)
+	}
+	if pct {
+		v /= 100
+	}
+	if v > 1 {
+		return 0, fmt.Errorf("%q: rate above 100%%", s)
+	}
+	return v, nil
+}
+
+// parseThroughput accepts queries per second, with or without a "qps" suffix.
+func parseThroughput(s string) (float64, error) {
+	v, err := strconv.ParseFloat(strings.TrimSuffix(s, "qps"), 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("%q: want queries per second like 500qps", s)
+	}
+	return v, nil
+}
+
+// evaluate checks the thresholds against the workloads' summaries, logging
+// each violation, and returns an error naming them if any was breached.
+func (t sloThresholds) evaluate(workloads map[string]opSummary) (*sloResult, error) {
+	res := &sloResult{Thresholds: t}
+	names := t.Workloads
+	if len(names) == 0 {
+		names = slices.Sorted(maps.Keys(workloads))
+	}
+	violate := func(workload, metric, limit, actual string) {
+		slog.Error("SLO violated", "workload", workload, "metric", metric, "limit", limit, "actual", actual)
+		res.Violations = append(res.Violations, sloViolation{Workload: workload, Metric: metric, Limit: limit, Actual: actual})
+	}
+	for _, name := range names {
+		s := workloads[name]
+		if rate := opErrorRate(s); t.MaxErrorRate >= 0 && rate > t.MaxErrorRate {
+			violate(name, "error_rate", formatRate(t.MaxErrorRate), fmt.Sprintf("%s (%d of %d)", formatRate(rate), s.Errors, s.Queries))
+		}
+		for _, q := range []struct {
+			metric       string
+			limit, value time.Duration
+		}{{"p50", t.MaxP50, s.P50}, {"p95", t.MaxP95, s.P95}, {"p99", t.MaxP99, s.P99}} {
+			if q.limit > 0 && q.value > q.limit {
+				violate(name, q.metric, q.limit.String(), q.value.Round(time.Microsecond).String())
+			}
+		}
+		if t.MinThroughput > 0 && s.Throughput < t.MinThroughput {
+			violate(name, "throughput", fmt.Sprintf("%gqps", t.MinThroughput), fmt.Sprintf("%.1fqps", s.Throughput))
+		}
+	}
+	res.Pass = len(res.Violations) == 0
+	if res.Pass {
+		slog.Info("SLO met", "workloads", names)
+		return res, nil
+	}
+	msgs := make([]string, len(res.Violations))
+	for i, v := range res.Violations {
+		msgs[i] = fmt.Sprintf("%s %s %s (limit %s)", v.Workload, v.Metric, v.Actual, v.Limit)
+	}
+	return res, fmt.Errorf("SLO violated: %s", strings.Join(msgs, "; "))
+}
+
+func formatRate(v float64) string {
+	return strconv.FormatFloat(100*v, 'g', 4, 64) + "%"
+}
+
+// validateSLO checks the --slo-workloads names against the run's workloads.
+func validateSLO(t sloThresholds, workloads []string) error {
+	if len(t.Workloads) > 0 && !t.set() {
+		return errors.New("--slo-workloads needs a threshold (--max-error-rate, --max-p50/95/99 or --min-throughput)")
+	}
+	for _, name := range t.Workloads {
+		if !slices.Contains(workloads, name) {
+			return fmt.Errorf("slo-workloads: no workload %q (want one of %s)", name, strings.Join(workloads, ", "))
+		}
+	}
+	return nil
+}
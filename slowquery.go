@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const sqlSleep = "select pg_sleep($1)"
+
+// slowReaderQuery returns a reader query that holds its connection for a
+// duration drawn from dist via pg_sleep, to simulate slow queries and observe
+// pool saturation and acquire-timeout behavior.
+func slowReaderQuery(p querier, mir *mirror, dist durationDist, rng *lockedRand) func(ctx context.Context, i int) error {
+	return func(ctx context.Context, i int) error {
+		d := dist.sample(rng)
+		secs := d.Seconds()
+		var mirrored <-chan mirrorResult
+		if mir != nil {
+			mirrored = mir.start(ctx, sqlSleep, secs)
+		}
+		var slept bool
+		start := time.Now()
+		err := p.QueryRowFunc(ctx, func(ctx context.Context, row pgx.Row) error {
+			return row.Scan(&slept)
+		}, sqlSleep, secs)
+		took := time.Since(start)
+		if mir != nil {
+			primary := mirrorResult{Err: err, Dur: took}
+			if err == nil {
+				primary.Rows = [][]any{{slept}}
+			}
+			mir.compare(fmt.Sprintf("slow %d", i+1), primary, <-mirrored)
+		}
+		if err == nil {
+			logQuery(ctx, "slow query", "workload", "reader", "iteration", i+1, "pg_sleep", d, "duration", took, "overhead", took-d)
+		}
+		return err
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime/metrics"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSoakInterval  = time.Minute
+	defaultSoakWarmup    = 15 * time.Minute
+	defaultSoakWindow    = time.Hour
+	defaultSoakMaxGrowth = 1.0
+	// soakTimeout is --soak's timeout unless -t is set: in effect, until
+	// the run is interrupted.
+	soakTimeout = 10 * 365 * 24 * time.Hour
+)
+
+// soakResources are what the soak monitor tracks of the tester's own
+// process, with the growth above the baseline each needs on top of the
+// relative one before it counts, so a small baseline doesn't alert on noise.
+var soakResources = []struct {
+	name  string
+	slack float64
+}{
+	{"goroutines", 100},
+	{"heap_bytes", 64 << 20},
+	{"open_fds", 50},
+}
+
+// soakOptions are the --soak flags.
+type soakOptions struct {
+	Enabled   bool
+	Interval  time.Duration // between samples
+	Warmup    time.Duration // before the baseline is taken
+	Window    time.Duration // samples the growth is judged over
+	MaxGrowth float64       // growth over the baseline that alerts, 1 = doubling
+	Fail      bool          // fail the run on an alert
+}
+
+func (o *soakOptions) register(fs *flag.FlagSet) {
+	fs.BoolVar(&o.Enabled, "soak", false, "run until interrupted (unless --iterations or --timeout say otherwise) while watching the tester's own goroutines, heap and open file descriptors for unbounded growth, e.g. leaks in crdbpool")
+	fs.DurationVar(&o.Interval, "soak-interval", defaultSoakInterval, "with --soak, how often the tester's resources are sampled")
+	fs.DurationVar(&o.Warmup, "soak-warmup", defaultSoakWarmup, "with --soak, how long the pools and workloads settle before the baseline is taken")
+	fs.DurationVar(&o.Window, "soak-window", defaultSoakWindow, "with --soak, a resource grows when even its lowest sample over this window is above the baseline by --soak-max-growth")
+	fs.Float64Var(&o.MaxGrowth, "soak-max-growth", defaultSoakMaxGrowth, "with --soak, the growth over the baseline that alerts, as a fraction (1 = twice the baseline)")
+	fs.BoolVar(&o.Fail, "soak-fail", false, "with --soak, fail the run when a resource grows instead of only alerting")
+}
+
+func (o soakOptions) validate() error {
+	if !o.Enabled {
+		if o.Fail {
+			return errors.New("--soak-fail requires --soak")
+		}
+		return nil
+	}
+	switch {
+	case o.Interval <= 0:
+		return errors.New("soak-interval must be > 0")
+	case o.Window < o.Interval:
+		return fmt.Errorf("soak-window (%s) must be at least soak-interval (%s)", o.Window, o.Interval)
+	case o.Warmup < 0:
+		return errors.New("soak-warmup must be >= 0")
+	case o.MaxGrowth <= 0:
+		return errors.New("soak-max-growth must be > 0")
+	}
+	return nil
+}
+
+// soakSample is one reading of the tester's resources; a resource that
+// can't be read on the platform (open FDs outside Linux) is -1.
+type soakSample map[string]float64
+
+func readSoakSample() soakSample {
+	ms := []metrics.Sample{{Name: "/sched/goroutines:goroutines"}, {Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(ms)
+	s := soakSample{"goroutines": -1, "heap_bytes": -1, "open_fds": -1}
+	if ms[0].Value.Kind() == metrics.KindUint64 {
+		s["goroutines"] = float64(ms[0].Value.Uint64())
+	}
+	if ms[1].Value.Kind() == metrics.KindUint64 {
+		s["heap_bytes"] = float64(ms[1].Value.Uint64())
+	}
+	if fds, err := os.ReadDir("/proc/self/fd"); err == nil {
+		s["open_fds"] = float64(len(fds))
+	}
+	return s
+}
+
+// soakMonitor samples the tester's own resources for a soak run. After the
+// warmup, the lowest sample of the first window is the baseline; from then
+// on, a resource whose lowest sample over the last window is above the
+// baseline by the max growth (and the resource's slack) grows without bound
+// as far as the run can tell: spikes and sawtooth GC cycles don't count,
+// only a floor that keeps rising. A growing resource is alerted once, as a
+// warning and on the timeline, and with fail set ends the run.
+type soakMonitor struct {
+	o    soakOptions
+	kill context.CancelFunc // cancels the run when failing
+	tl   *timeline
+
+	mu       sync.Mutex
+	window   []soakSample
+	baseline soakSample
+	last     soakSample
+	peak     soakSample
+	samples  int
+	alerted  map[string]bool
+	alerts   []string
+	failed   string
+}
+
+// soakSummary is the monitor's verdict, as written to --results-out.
+type soakSummary struct {
+	Samples  int                `json:"samples"`
+	Baseline map[string]float64 `json:"baseline,omitempty"`
+	Last     map[string]float64 `json:"last"`
+	Peak     map[string]float64 `json:"peak"`
+	Alerts   []string           `json:"alerts,omitempty"`
+}
+
+func newSoakMonitor(o soakOptions, kill context.CancelFunc, tl *timeline) *soakMonitor {
+	return &soakMonitor{o: o, kill: kill, tl: tl, peak: soakSample{}, alerted: map[string]bool{}}
+}
+
+// run samples every interval until ctx is done.
+func (m *soakMonitor) run(ctx context.Context) {
+	start := time.Now()
+	windowLen := int(m.o.Window / m.o.Interval)
+	t := time.NewTicker(m.o.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			if m.sample(readSoakSample(), now.Sub(start) >= m.o.Warmup, windowLen) {
+				m.kill()
+				return
+			}
+		}
+	}
+}
+
+// sample records s and reports whether the run is to fail.
+func (m *soakMonitor) sample(s soakSample, warm bool, windowLen int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.samples++
+	m.last = s
+	for k, v := range s {
+		m.peak[k] = max(m.peak[k], v)
+	}
+	slog.Info("soak", "goroutines", s["goroutines"], "heap_bytes", s["heap_bytes"], "open_fds", s["open_fds"])
+	if !warm {
+		return false
+	}
+	m.window = append(m.window, s)
+	if len(m.window) > windowLen {
+		m.window = m.window[1:]
+	}
+	if len(m.window) < windowLen {
+		return false
+	}
+	floor := soakSample{}
+	for _, r := range soakResources {
+		floor[r.name] = m.window[0][r.name]
+		for _, w := range m.window[1:] {
+			floor[r.name] = min(floor[r.name], w[r.name])
+		}
+	}
+	if m.baseline == nil {
+		m.baseline = floor
+		slog.Info("soak baseline", "goroutines", floor["goroutines"], "heap_bytes", floor["heap_bytes"], "open_fds", floor["open_fds"])
+		m.tl.record("soak", "baseline goroutines=%.0f heap_bytes=%.0f open_fds=%.0f", floor["goroutines"], floor["heap_bytes"], floor["open_fds"])
+		return false
+	}
+	for _, r := range soakResources {
+		base, cur := m.baseline[r.name], floor[r.name]
+		if base < 0 || m.alerted[r.name] || cur <= base*(1+m.o.MaxGrowth)+r.slack {
+			continue
+		}
+		m.alerted[r.name] = true
+		desc := fmt.Sprintf("%s grew from %.0f to at least %.0f over the last %s", r.name, base, cur, m.o.Window)
+		m.alerts = append(m.alerts, desc)
+		slog.Warn("soak: the tester's resources keep growing", "resource", r.name, "baseline", base, "floor", cur, "window", m.o.Window)
+		m.tl.record("soak", "%s", desc)
+		if m.o.Fail && m.failed == "" {
+			m.failed = desc
+		}
+	}
+	return m.failed != ""
+}
+
+// abortReason returns the growth that failed the run, or "".
+func (m *soakMonitor) abortReason() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.failed
+}
+
+func (m *soakMonitor) summary() *soakSummary {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := &soakSummary{Samples: m.samples, Baseline: m.baseline, Last: m.last, Peak: m.peak, Alerts: m.alerts}
+	if s.Last == nil {
+		s.Last = readSoakSample()
+	}
+	slog.Info("soak summary", "samples", s.Samples, "alerts", strings.Join(s.Alerts, "; "))
+	return s
+}
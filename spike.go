@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// spikeTick is the resolution of the spike monitor's latency and
+	// connection samples.
+	spikeTick = time.Second
+	// spikeBaseline is how much of the run before a spike its baseline
+	// p99 is taken over.
+	spikeBaseline = 30 * time.Second
+	// spikeObserve is how long after a spike its recovery is watched for,
+	// unless the next spike starts first.
+	spikeObserve = 5 * time.Minute
+	// spikeRecoveryMargin is how far above the baseline a workload's p99 may
+	// stay and count as recovered, and spikeRecoverySustain how many ticks
+	// in a row it must.
+	spikeRecoveryMargin  = 1.2
+	spikeRecoverySustain = 3
+)
+
+// spikeSpec is one --spike: every workload's concurrency and target rate
+// multiplied by Factor for Duration, Start into the run.
+type spikeSpec struct {
+	Factor   float64
+	Duration time.Duration
+	Start    time.Duration
+}
+
+// parseSpike parses --spike, <factor>x:<duration>@<start>, e.g. 10x:30s@5m.
+func parseSpike(s string) (spikeSpec, error) {
+	var sp spikeSpec
+	spec, start, ok := strings.Cut(strings.TrimSpace(s), "@")
+	if !ok {
+		return sp, fmt.Errorf("spike %q: want <factor>x:<duration>@<start>, e.g. 10x:30s@5m", s)
+	}
+	factor, dur, ok := strings.Cut(spec, ":")
+	if !ok {
+		return sp, fmt.Errorf("spike %q: want <factor>x:<duration>@<start>, e.g. 10x:30s@5m", s)
+	}
+	f, err := strconv.ParseFloat(strings.TrimSuffix(factor, "x"), 64)
+	if err != nil || f <= 1 {
+		return sp, fmt.Errorf("spike %q: want a factor above 1 like 10x", s)
+	}
+	if sp.Duration, err = time.ParseDuration(dur); err != nil || sp.Duration <= 0 {
+		return sp, fmt.Errorf("spike %q: invalid duration %q", s, dur)
+	}
+	if sp.Start, err = time.ParseDuration(start); err != nil || sp.Start < 0 {
+		return sp, fmt.Errorf("spike %q: invalid start %q", s, start)
+	}
+	sp.Factor = f
+	return sp, nil
+}
+
+func (sp spikeSpec) String() string {
+	return fmt.Sprintf("%gx:%s@%s", sp.Factor, sp.Duration, sp.Start)
+}
+
+func (sp spikeSpec) end() time.Duration { return sp.Start + sp.Duration }
+
+// validateSpikes orders the spikes by start and rejects overlapping ones.
+func validateSpikes(spikes []spikeSpec) error {
+	slices.SortFunc(spikes, func(a, b spikeSpec) int { return int(a.Start - b.Start) })
+	for i := 1; i < len(spikes); i++ {
+		if spikes[i].Start < spikes[i-1].end() {
+			return fmt.Errorf("spikes %s and %s overlap", spikes[i-1], spikes[i])
+		}
+	}
+	return nil
+}
+
+// spikesDuration is how long a run needs for its spikes and their recovery.
+func spikesDuration(spikes []spikeSpec) time.Duration {
+	return spikes[len(spikes)-1].end() + spikeObserve
+}
+
+// spikeWorkload is how a workload's latency went through a spike.
+type spikeWorkload struct {
+	BaselineP99 time.Duration `json:"baseline_p99_ns"` // over the spikeBaseline before the spike
+	PeakP99     time.Duration `json:"peak_p99_ns"`     // of the worst tick during or after it
+	Recovered   bool          `json:"recovered"`
+	Recovery    time.Duration `json:"recovery_ns,omitempty"` // from the spike's end to the p99 back near the baseline
+}
+
+// spikePool is how a pool grew and shrank with a spike.
+type spikePool struct {
+	Before int32         `json:"conns_before"`
+	Peak   int32         `json:"conns_peak"`
+	After  int32         `json:"conns_after"` // when the monitor stopped watching
+	Shrunk bool          `json:"shrunk"`
+	Shrink time.Duration `json:"shrink_ns,omitempty"` // from the spike's end to the conns back at Before
+}
+
+// spikeResult is one spike's record, as written to --results-out.
+type spikeResult struct {
+	Factor    float64                  `json:"factor"`
+	Start     time.Duration            `json:"start_ns"` // into the run
+	Duration  time.Duration            `json:"duration_ns"`
+	Observed  time.Duration            `json:"observed_ns"` // after its end
+	Workloads map[string]spikeWorkload `json:"workloads"`
+	Pools     map[string]spikePool     `json:"pools"`
+}
+
+// spikeMonitor runs the --spike schedule and measures each spike: the
+// workloads' p99 per tick against the baseline before it, and the pools'
+// connections. A spike ends, as far as the monitor is concerned, once every
+// workload has recovered and every pool shrunk back, after spikeObserve, or
+// when the next spike starts.
+type spikeMonitor struct {
+	spikes    []spikeSpec
+	workloads []*workload
+	pools     map[string]*testerPool
+	tl        *timeline
+	start     time.Time
+	ticks     map[string]*atomic.Pointer[latencyHistogram] // per workload, the current tick's samples
+
+	// owned by run
+	ring    []map[string]*latencyHistogram // the last spikeBaseline of ticks
+	next    int                            // spike to start next
+	cur     *spikeResult                   // spike in progress or recovering
+	endedAt time.Time                      // of cur's surge; zero while surging
+	sustain map[string]int                 // per workload, ticks in a row near the baseline after cur
+
+	results  atomic.Pointer[[]spikeResult]
+	finished atomic.Bool // the last spike has been watched to its end
+}
+
+func newSpikeMonitor(spikes []spikeSpec, workloads []*workload, pools map[string]*testerPool, tl *timeline) *spikeMonitor {
+	m := &spikeMonitor{spikes: spikes, workloads: workloads, pools: pools, tl: tl, start: time.Now(), ticks: map[string]*atomic.Pointer[latencyHistogram]{}}
+	for _, w := range workloads {
+		p := &atomic.Pointer[latencyHistogram]{}
+		p.Store(&latencyHistogram{})
+		m.ticks[w.name] = p
+		w.spikes = m
+	}
+	m.results.Store(&[]spikeResult{})
+	return m
+}
+
+// record counts a sample of workload in the current tick.
+func (m *spikeMonitor) record(workload string, d time.Duration) {
+	m.ticks[workload].Load().observe(d)
+}
+
+// run samples every spikeTick until ctx is done, starting and ending the
+// spikes on schedule. Once the last spike has been watched it calls stop,
+// if set, to end the workloads.
+func (m *spikeMonitor) run(ctx context.Context, stop context.CancelFunc) {
+	t := time.NewTicker(spikeTick)
+	defer t.Stop()
+	defer m.finish(time.Now())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			m.tick(now)
+		}
+		if m.cur == nil && m.next == len(m.spikes) {
+			m.finished.Store(true)
+			if stop != nil {
+				slog.Info("spikes done: stopping the workloads")
+				stop()
+			}
+			return
+		}
+	}
+}
+
+func (m *spikeMonitor) tick(now time.Time) {
+	tick := map[string]*latencyHistogram{}
+	for name, p := range m.ticks {
+		tick[name] = p.Swap(&latencyHistogram{})
+	}
+	m.ring = append(m.ring, tick)
+	if len(m.ring) > int(spikeBaseline/spikeTick) {
+		m.ring = m.ring[1:]
+	}
+	conns := map[string]int32{}
+	for name, p := range m.pools {
+		conns[name] = p.Stat().TotalConns()
+	}
+	offset := now.Sub(m.start)
+	if m.cur != nil && m.next < len(m.spikes) && offset >= m.spikes[m.next].Start {
+		m.finish(now) // the next spike is due: stop watching this one recover
+	}
+	if m.cur == nil {
+		if m.next < len(m.spikes) && offset >= m.spikes[m.next].Start {
+			m.begin(m.spikes[m.next], conns)
+			m.next++
+		}
+		return
+	}
+	for name, h := range tick {
+		w := m.cur.Workloads[name]
+		w.PeakP99 = max(w.PeakP99, h.quantile(0.99))
+		if !m.endedAt.IsZero() && !w.Recovered && w.BaselineP99 > 0 && h.count() > 0 {
+			if float64(h.quantile(0.99)) <= float64(w.BaselineP99)*spikeRecoveryMargin {
+				m.sustain[name]++
+			} else {
+				m.sustain[name] = 0
+			}
+			if m.sustain[name] >= spikeRecoverySustain {
+				w.Recovered = true
+				w.Recovery = max(0, now.Sub(m.endedAt)-(spikeRecoverySustain-1)*spikeTick)
+			}
+		}
+		m.cur.Workloads[name] = w
+	}
+	for name, n := range conns {
+		p := m.cur.Pools[name]
+		p.Peak, p.After = max(p.Peak, n), n
+		if !m.endedAt.IsZero() && !p.Shrunk && n <= p.Before {
+			p.Shrunk, p.Shrink = true, now.Sub(m.endedAt)
+		}
+		m.cur.Pools[name] = p
+	}
+	if m.endedAt.IsZero() {
+		if offset >= m.cur.Start+m.cur.Duration {
+			m.endedAt = now
+			for _, w := range m.workloads {
+				w.setSurge(0)
+			}
+			m.tl.record("spike", "%gx ended after %s", m.cur.Factor, m.cur.Duration)
+		}
+		return
+	}
+	if now.Sub(m.endedAt) >= spikeObserve || m.settled() {
+		m.finish(now)
+	}
+}
+
+func (m *spikeMonitor) begin(sp spikeSpec, conns map[string]int32) {
+	r := &spikeResult{Factor: sp.Factor, Start: sp.Start, Duration: sp.Duration, Workloads: map[string]spikeWorkload{}, Pools: map[string]spikePool{}}
+	for _, w := range m.workloads {
+		base := &latencyHistogram{}
+		for _, tick := range m.ring {
+			base.merge(tick[w.name])
+		}
+		r.Workloads[w.name] = spikeWorkload{BaselineP99: base.quantile(0.99)}
+	}
+	for name, n := range conns {
+		r.Pools[name] = spikePool{Before: n, Peak: n, After: n}
+	}
+	m.cur, m.endedAt, m.sustain = r, time.Time{}, map[string]int{}
+	for _, w := range m.workloads {
+		w.setSurge(sp.Factor)
+	}
+	slog.Info("spike", "factor", sp.Factor, "duration", sp.Duration)
+	m.tl.record("spike", "%gx for %s", sp.Factor, sp.Duration)
+}
+
+// settled reports whether every workload has recovered from the current
+// spike, but for those without a baseline, and every pool shrunk back.
+func (m *spikeMonitor) settled() bool {
+	for _, w := range m.cur.Workloads {
+		if !w.Recovered && w.BaselineP99 > 0 {
+			return false
+		}
+	}
+	for _, p := range m.cur.Pools {
+		if !p.Shrunk {
+			return false
+		}
+	}
+	return true
+}
+
+// finish records the current spike, ending its surge if the run ends
+// during it.
+func (m *spikeMonitor) finish(now time.Time) {
+	if m.cur == nil {
+		return
+	}
+	if m.endedAt.IsZero() {
+		for _, w := range m.workloads {
+			w.setSurge(0)
+		}
+	} else {
+		m.cur.Observed = now.Sub(m.endedAt)
+	}
+	results := append(slices.Clone(*m.results.Load()), *m.cur)
+	m.results.Store(&results)
+	m.cur = nil
+}
+
+// done reports whether the last spike has been watched to its end.
+func (m *spikeMonitor) done() bool { return m.finished.Load() }
+
+// summary logs and returns the spikes recorded so far.
+func (m *spikeMonitor) summary() []spikeResult {
+	results := *m.results.Load()
+	for _, r := range results {
+		spec := spikeSpec{Factor: r.Factor, Duration: r.Duration, Start: r.Start}.String()
+		for _, name := range slices.Sorted(maps.Keys(r.Workloads)) {
+			w := r.Workloads[name]
+			slog.Info("spike summary", "spike", spec, "workload", name,
+				"baseline_p99", w.BaselineP99, "peak_p99", w.PeakP99, "recovered", w.Recovered, "recovery", w.Recovery)
+			if !w.Recovered && w.BaselineP99 > 0 {
+				slog.Warn("spike: latency did not recover", "spike", spec, "workload", name, "observed", r.Observed)
+			}
+		}
+		for _, name := range slices.Sorted(maps.Keys(r.Pools)) {
+			p := r.Pools[name]
+			slog.Info("spike pool", "spike", spec, "pool", name,
+				"conns_before", p.Before, "conns_peak", p.Peak, "conns_after", p.After, "shrunk", p.Shrunk, "shrink", p.Shrink)
+		}
+	}
+	return results
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"sync"
+	"time"
+)
+
+// stallWatchdog notices workloads that stop completing queries while they
+// are neither paused nor finished. A stall is recorded on the timeline with a
+// goroutine dump written next to it; with abort set the run is cancelled
+// instead of burning the rest of its timeout.
+type stallWatchdog struct {
+	workloads []*workload
+	after     time.Duration
+	abort     bool
+	kill      context.CancelFunc // cancels the run when aborting
+	runID     string
+	tl        *timeline
+
+	mu      sync.Mutex
+	stalled string // description of the stall that aborted the run
+}
+
+func newStallWatchdog(workloads []*workload, after time.Duration, abort bool, kill context.CancelFunc, runID string, tl *timeline) *stallWatchdog {
+	return &stallWatchdog{workloads: workloads, after: after, abort: abort, kill: kill, runID: runID, tl: tl}
+}
+
+// run watches until ctx is done.
+func (s *stallWatchdog) run(ctx context.Context) {
+	type state struct {
+		progress int64
+		since    time.Time
+		stalled  bool
+	}
+	states := make([]state, len(s.workloads))
+	now := time.Now()
+	for i := range states {
+		states[i].since = now
+	}
+	t := time.NewTicker(max(s.after/10, 100*time.Millisecond))
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now = <-t.C:
+		}
+		for i, w := range s.workloads {
+			st := &states[i]
+			progress := w.completed.Load()
+			if progress != st.progress || w.gate.paused() || w.finished.Load() {
+				if st.stalled && progress != st.progress {
+					s.tl.record("stall", "%s: progressing again after %s", w.name, now.Sub(st.since).Round(time.Second))
+				}
+				st.progress, st.since, st.stalled = progress, now, false
+				continue
+			}
+			if st.stalled || now.Sub(st.since) < s.after {
+				continue
+			}
+			st.stalled = true
+			desc := fmt.Sprintf("%s: no completed queries for %s (%d so far)", w.name, now.Sub(st.since).Round(time.Second), progress)
+			path, err := s.dumpGoroutines(w.name)
+			if err != nil {
+				slog.Error("goroutine dump", "err", err)
+			}
+			s.tl.record("stall", "%s; goroutine dump: %s", desc, path)
+			if s.abort {
+				s.mu.Lock()
+				s.stalled = desc
+				s.mu.Unlock()
+				s.kill()
+				return
+			}
+		}
+	}
+}
+
+// dumpGoroutines writes the stacks of every goroutine to a file in the temp
+// directory and returns its path.
+func (s *stallWatchdog) dumpGoroutines(workload string) (string, error) {
+	f, err := os.Create(filepath.Join(os.TempDir(), fmt.Sprintf("crdbpool-tester-stall-%s-%s-%d.txt", s.runID, workload, time.Now().Unix())))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if err := pprof.Lookup("goroutine").WriteTo(f, 2); err != nil {
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// abortReason returns the stall that aborted the run, or "".
+func (s *stallWatchdog) abortReason() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stalled
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// queryExecModes are pgx's query exec modes by their DSN names, in the
+// order of the protocol work they save per query.
+var queryExecModes = []string{"cache_statement", "cache_describe", "describe_exec", "exec", "simple_protocol"}
+
+var queryExecModeValues = map[string]pgx.QueryExecMode{
+	"cache_statement": pgx.QueryExecModeCacheStatement,
+	"cache_describe":  pgx.QueryExecModeCacheDescribe,
+	"describe_exec":   pgx.QueryExecModeDescribeExec,
+	"exec":            pgx.QueryExecModeExec,
+	"simple_protocol": pgx.QueryExecModeSimpleProtocol,
+}
+
+// queryExecModeName is m's DSN name.
+func queryExecModeName(m pgx.QueryExecMode) string {
+	for name, v := range queryExecModeValues {
+		if v == m {
+			return name
+		}
+	}
+	return m.String()
+}
+
+// statementOptions are pgx's query exec mode, its statement caches and
+// --prepare, to see how crdbpool's pools interact with the protocol and
+// prepared statements: every new connection, after a reconnect, a retry on
+// another node or a rebalance, starts with empty caches and none of the
+// statements prepared.
+type statementOptions struct {
+	ExecMode         string // "" => cache_statement or the DSN's default_query_exec_mode
+	Prepare          bool   // prepare the workload statements on every connection
+	StatementCache   int    // prepared statements cached per connection; -1 => pgx's or the DSN's
+	DescriptionCache int    // statement descriptions cached per connection; -1 => pgx's or the DSN's
+}
+
+func (o *statementOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.ExecMode, "query-exec-mode", "", "how pgx runs queries: "+strings.Join(queryExecModes, ", ")+"; exec and simple_protocol never prepare, simple_protocol doesn't use the extended protocol at all (default: cache_statement, or the DSN's default_query_exec_mode)")
+	fs.BoolVar(&o.Prepare, "prepare", false, "prepare the workload's statements explicitly on every connection before its first use, so no query pays for it")
+	fs.IntVar(&o.StatementCache, "statement-cache-capacity", -1, "prepared statements pgx caches per connection for the cache_statement exec mode; 0 disables the cache (-1: pgx's 512 or the DSN's statement_cache_capacity)")
+	fs.IntVar(&o.DescriptionCache, "description-cache-capacity", -1, "statement descriptions pgx caches per connection for the cache_describe exec mode; 0 disables the cache (-1: pgx's 512 or the DSN's description_cache_capacity)")
+}
+
+func (o statementOptions) validate() error {
+	if o.ExecMode != "" && !slices.Contains(queryExecModes, o.ExecMode) {
+		return fmt.Errorf("query-exec-mode must be one of %s (got %q)", strings.Join(queryExecModes, ", "), o.ExecMode)
+	}
+	if o.StatementCache < -1 || o.DescriptionCache < -1 {
+		return errors.New("statement-cache-capacity and description-cache-capacity must be >= 0")
+	}
+	switch {
+	case o.ExecMode == "cache_statement" && o.StatementCache == 0:
+		return errors.New("--query-exec-mode cache_statement needs the statement cache; --statement-cache-capacity 0 disables it")
+	case o.ExecMode == "cache_describe" && o.DescriptionCache == 0:
+		return errors.New("--query-exec-mode cache_describe needs the description cache; --description-cache-capacity 0 disables it")
+	}
+	return nil
+}
+
+func (o statementOptions) set() bool {
+	return o.ExecMode != "" || o.Prepare || o.StatementCache >= 0 || o.DescriptionCache >= 0
+}
+
+// sessionFree reports whether the settings keep nothing prepared on a
+// server session between transactions, as a transaction-mode pooler needs.
+func (o statementOptions) sessionFree() bool {
+	return !o.Prepare && o.StatementCache < 0 && o.DescriptionCache < 0 && (o.ExecMode == "" || o.ExecMode == "exec" || o.ExecMode == "simple_protocol")
+}
+
+// String summarizes the settings for the results, "" for pgx's defaults.
+func (o statementOptions) String() string {
+	var parts []string
+	if o.ExecMode != "" {
+		parts = append(parts, "exec-mode="+o.ExecMode)
+	}
+	if o.Prepare {
+		parts = append(parts, "prepare")
+	}
+	if o.StatementCache >= 0 {
+		parts = append(parts, fmt.Sprintf("statement-cache=%d", o.StatementCache))
+	}
+	if o.DescriptionCache >= 0 {
+		parts = append(parts, fmt.Sprintf("description-cache=%d", o.DescriptionCache))
+	}
+	return strings.Join(parts, ",")
+}
+
+// apply sets the exec mode and cache capacities. pgx fails every query of
+// an exec mode whose cache is disabled, so a disabled cache falls back to
+// the next mode that doesn't need it: cache_statement to cache_describe to
+// describe_exec.
+func (o statementOptions) apply(c *pgxpool.Config) {
+	cc := c.ConnConfig
+	if o.ExecMode != "" {
+		cc.DefaultQueryExecMode = queryExecModeValues[o.ExecMode]
+	}
+	if o.StatementCache >= 0 {
+		cc.StatementCacheCapacity = o.StatementCache
+	}
+	if o.DescriptionCache >= 0 {
+		cc.DescriptionCacheCapacity = o.DescriptionCache
+	}
+	if cc.DefaultQueryExecMode == pgx.QueryExecModeCacheStatement && cc.StatementCacheCapacity == 0 {
+		cc.DefaultQueryExecMode = pgx.QueryExecModeCacheDescribe
+	}
+	if cc.DefaultQueryExecMode == pgx.QueryExecModeCacheDescribe && cc.DescriptionCacheCapacity == 0 {
+		cc.DefaultQueryExecMode = pgx.QueryExecModeDescribeExec
+	}
+}
+
+// statementPreparer prepares --prepare's statements on each connection as
+// it is acquired, once per connection and statement: the statements are
+// added as they become preparable (the writer's once its table exists), and
+// every connection catches up on its next acquire. pgx then runs a query of
+// the same SQL as the prepared statement, whatever the exec mode.
+type statementPreparer struct {
+	mu    sync.Mutex
+	stmts atomic.Pointer[[]string]
+	conns sync.Map // *pgx.Conn => int, the statements prepared on it
+}
+
+func newStatementPreparer() *statementPreparer {
+	sp := &statementPreparer{}
+	sp.stmts.Store(&[]string{})
+	return sp
+}
+
+func (sp *statementPreparer) add(sqls ...string) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	stmts := slices.Clone(*sp.stmts.Load())
+	for _, sql := range sqls {
+		if !slices.Contains(stmts, sql) {
+			stmts = append(stmts, sql)
+		}
+	}
+	sp.stmts.Store(&stmts)
+}
+
+func (sp *statementPreparer) attach(c *pgxpool.Config) {
+	beforeAcquire := c.BeforeAcquire
+	c.BeforeAcquire = func(ctx context.Context, conn *pgx.Conn) bool {
+		sp.prepare(ctx, conn)
+		return beforeAcquire == nil || beforeAcquire(ctx, conn)
+	}
+	beforeClose := c.BeforeClose
+	c.BeforeClose = func(conn *pgx.Conn) {
+		sp.conns.Delete(conn)
+		if beforeClose != nil {
+			beforeClose(conn)
+		}
+	}
+}
+
+// prepare prepares the statements conn doesn't have yet. A statement that
+// fails to prepare is skipped: its queries run as they would without
+// --prepare, and report the error themselves if it is theirs.
+func (sp *statementPreparer) prepare(ctx context.Context, conn *pgx.Conn) {
+	stmts := *sp.stmts.Load()
+	n := 0
+	if v, ok := sp.conns.Load(conn); ok {
+		n = v.(int)
+	}
+	if n == len(stmts) {
+		return
+	}
+	for _, sql := range stmts[n:] {
+		if _, err := conn.Prepare(ctx, sql, sql); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.DebugContext(ctx, "prepare", "sql", oneLine(sql), "conn", safeRemoteAddr(conn), "err", err)
+		}
+	}
+	sp.conns.Store(conn, len(stmts))
+}
+
+// prepareStats meters a pool's statement preparation round trips: the
+// explicit ones of --prepare and those of the statement cache's misses.
+type prepareStats struct {
+	latency latencyHistogram
+	errors  atomic.Uint64
+}
+
+// prepareTracer feeds a pool's prepareStats from pgx's prepare trace hooks.
+type prepareTracer struct{ s *prepareStats }
+
+type prepareStartKey struct{}
+
+func (pt prepareTracer) TracePrepareStart(ctx context.Context, _ *pgx.Conn, _ pgx.TracePrepareStartData) context.Context {
+	return context.WithValue(ctx, prepareStartKey{}, time.Now())
+}
+
+func (pt prepareTracer) TracePrepareEnd(ctx context.Context, _ *pgx.Conn, data pgx.TracePrepareEndData) {
+	start, ok := ctx.Value(prepareStartKey{}).(time.Time)
+	if !ok || data.AlreadyPrepared {
+		return
+	}
+	if data.Err != nil {
+		pt.s.errors.Add(1)
+		return
+	}
+	pt.s.latency.observe(time.Since(start))
+}
+
+func (pt prepareTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, _ pgx.TraceQueryStartData) context.Context {
+	return ctx
+}
+
+func (pt prepareTracer) TraceQueryEnd(context.Context, *pgx.Conn, pgx.TraceQueryEndData) {}
+
+// statementSummary is a pool's prepareStats against its workload's queries,
+// as written to --results-out: what preparing costs each query on average,
+// the latency the statement settings of a run add or save.
+type statementSummary struct {
+	Prepares uint64            `json:"prepares"` // round trips to the server
+	Errors   uint64            `json:"errors,omitempty"`
+	Latency  *latencyHistogram `json:"prepare_latency"`
+	PerQuery time.Duration     `json:"prepare_per_query_ns"` // prepare time over the workload's queries
+	Share    float64           `json:"prepare_share"`        // of the workload's query time
+}
+
+func (s *prepareStats) summary(w opSummary) statementSummary {
+	out := statementSummary{Errors: s.errors.Load(), Latency: &latencyHistogram{}}
+	out.Latency.merge(&s.latency)
+	out.Prepares = out.Latency.count()
+	total := out.Latency.mean() * time.Duration(out.Prepares)
+	if w.Queries > 0 {
+		out.PerQuery = total / time.Duration(w.Queries)
+	}
+	if w.Mean > 0 {
+		out.Share = float64(out.PerQuery) / float64(w.Mean)
+	}
+	return out
+}
+
+func (s statementSummary) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Uint64("prepares", s.Prepares),
+		slog.Uint64("errors", s.Errors),
+		slog.Any("prepare", s.Latency),
+		slog.Duration("per_query", s.PerQuery),
+		slog.Float64("share", s.Share),
+	)
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	// histogram buckets grow geometrically by histGrowth starting at 1µs,
+	// which keeps quantile error around 2% up to ~2h.
+	histGrowth  = 1.04
+	histBuckets = 600
+)
+
+var histLogGrowth = math.Log(histGrowth)
+
+// latencyHistogram is a fixed-bucket, log-scaled latency histogram. It is safe
+// for concurrent use and histograms can be merged bucket-for-bucket. It is
+// lock-free, so workers recording samples never wait for each other; a read
+// racing a sample may see it in some of the fields only.
+type latencyHistogram struct {
+	counts [histBuckets]atomic.Uint64
+	n      atomic.Uint64
+	sum    atomic.Int64 // ns
+	min    atomic.Int64 // ns + 1; 0 => no sample
+	max    atomic.Int64 // ns
+}
+
+func histBucket(d time.Duration) int {
+	us := float64(d) / float64(time.Microsecond)
+	if us < 1 {
+		return 0
+	}
+	i := int(math.Log(us)/histLogGrowth) + 1
+	if i >= histBuckets {
+		return histBuckets - 1
+	}
+	return i
+}
+
+// histBucketUpper returns the upper bound of bucket i.
+func histBucketUpper(i int) time.Duration {
+	return time.Duration(math.Pow(histGrowth, float64(i)) * float64(time.Microsecond))
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	h.counts[histBucket(d)].Add(1)
+	h.sum.Add(int64(d))
+	h.lowerMin(d)
+	h.raiseMax(d)
+	h.n.Add(1)
+}
+
+func (h *latencyHistogram) lowerMin(d time.Duration) {
+	for {
+		cur := h.min.Load()
+		if cur != 0 && cur <= int64(d)+1 {
+			return
+		}
+		if h.min.CompareAndSwap(cur, int64(d)+1) {
+			return
+		}
+	}
+}
+
+func (h *latencyHistogram) raiseMax(d time.Duration) {
+	for {
+		cur := h.max.Load()
+		if cur >= int64(d) {
+			return
+		}
+		if h.max.CompareAndSwap(cur, int64(d)) {
+			return
+		}
+	}
+}
+
+func (h *latencyHistogram) minimum() time.Duration {
+	if v := h.min.Load(); v > 0 {
+		return time.Duration(v - 1)
+	}
+	return 0
+}
+
+func (h *latencyHistogram) count() uint64 {
+	return h.n.Load()
+}
+
+func (h *latencyHistogram) mean() time.Duration {
+	n := h.n.Load()
+	if n == 0 {
+		return 0
+	}
+	return time.Duration(h.sum.Load()) / time.Duration(n)
+}
+
+// quantile returns an estimate of the q-th quantile (0 < q <= 1), clamped to
+// the observed min/max.
+func (h *latencyHistogram) quantile(q float64) time.Duration {
+	n := h.n.Load()
+	if n == 0 {
+		return 0
+	}
+	hmin, hmax := h.minimum(), time.Duration(h.max.Load())
+	rank := uint64(math.Ceil(q * float64(n)))
+	if rank == 0 {
+		rank = 1
+	}
+	var seen uint64
+	for i := range h.counts {
+		seen += h.counts[i].Load()
+		if seen >= rank {
+			return min(max(histBucketUpper(i), hmin), hmax)
+		}
+	}
+	return hmax
+}
+
+func (h *latencyHistogram) merge(o *latencyHistogram) {
+	n := o.n.Load()
+	if n == 0 {
+		return
+	}
+	for i := range o.counts {
+		if c := o.counts[i].Load(); c > 0 {
+			h.counts[i].Add(c)
+		}
+	}
+	h.sum.Add(o.sum.Load())
+	h.lowerMin(o.minimum())
+	h.raiseMax(time.Duration(o.max.Load()))
+	h.n.Add(n)
+}
+
+func (h *latencyHistogram) String() string {
+	if h.count() == 0 {
+		return "n=0"
+	}
+	return fmt.Sprintf("n=%d mean=%s p50=%s p95=%s p99=%s max=%s",
+		h.count(), h.mean().Round(time.Microsecond), h.quantile(0.50).Round(time.Microsecond),
+		h.quantile(0.95).Round(time.Microsecond), h.quantile(0.99).Round(time.Microsecond), h.quantile(1).Round(time.Microsecond))
+}
+
+// histogramJSON is the sparse serialized form of a latencyHistogram.
+type histogramJSON struct {
+	Buckets map[int]uint64 `json:"buckets"` // bucket index -> count
+	Count   uint64         `json:"count"`
+	Sum     time.Duration  `json:"sum_ns"`
+	Min     time.Duration  `json:"min_ns"`
+	Max     time.Duration  `json:"max_ns"`
+}
+
+func (h *latencyHistogram) MarshalJSON() ([]byte, error) {
+	out := histogramJSON{Buckets: map[int]uint64{}, Count: h.n.Load(), Sum: time.Duration(h.sum.Load()), Min: h.minimum(), Max: time.Duration(h.max.Load())}
+	for i := range h.counts {
+		if c := h.counts[i].Load(); c > 0 {
+			out.Buckets[i] = c
+		}
+	}
+	return json.Marshal(out)
+}
+
+func (h *latencyHistogram) UnmarshalJSON(b []byte) error {
+	var in histogramJSON
+	if err := json.Unmarshal(b, &in); err != nil {
+		return err
+	}
+	for i := range h.counts {
+		h.counts[i].Store(0)
+	}
+	for i, c := range in.Buckets {
+		if i < 0 || i >= histBuckets {
+			return fmt.Errorf("histogram bucket %d out of range", i)
+		}
+		h.counts[i].Store(c)
+	}
+	h.n.Store(in.Count)
+	h.sum.Store(int64(in.Sum))
+	h.min.Store(0)
+	if in.Count > 0 {
+		h.min.Store(int64(in.Min) + 1)
+	}
+	h.max.Store(int64(in.Max))
+	return nil
+}
+
+// opStats accumulates outcomes of one kind of operation (a workload's queries).
+// Recording a success takes no lock.
+type opStats struct {
+	latency latencyHistogram
+	ok      atomic.Uint64
+	errs    atomic.Uint64
+
+	mu      sync.Mutex
+	classes map[string]uint64 // error class -> count
+	started time.Time
+	ended   time.Time
+	prior   time.Duration // elapsed time restored from a checkpoint
+}
+
+func (s *opStats) begin() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.started = time.Now()
+}
+
+func (s *opStats) end() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ended = time.Now()
+}
+
+func (s *opStats) record(d time.Duration, err error) {
+	s.latency.observe(d)
+	if err == nil {
+		s.ok.Add(1)
+		return
+	}
+	s.errs.Add(1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.classes == nil {
+		s.classes = map[string]uint64{}
+	}
+	s.classes[errorClass(err)]++
+}
+
+// restore seeds the stats with a summary saved in a checkpoint.
+func (s *opStats) restore(sum opSummary) {
+	if sum.Latency != nil {
+		s.latency.merge(sum.Latency)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ok.Store(sum.Queries - sum.Errors)
+	s.errs.Store(sum.Errors)
+	s.classes = map[string]uint64{}
+	for k, v := range sum.ErrorClasses {
+		s.classes[k] = v
+	}
+	s.prior = sum.Duration
+}
+
+// opSummary is the reportable form of opStats.
+type opSummary struct {
+	Queries      uint64            `json:"queries"`
+	Errors       uint64            `json:"errors"`
+	ErrorClasses map[string]uint64 `json:"error_classes,omitempty"`
+	Duration     time.Duration     `json:"duration_ns"`
+	Throughput   float64           `json:"throughput_qps"`
+	P50          time.Duration     `json:"p50_ns"`
+	P95          time.Duration     `json:"p95_ns"`
+	P99          time.Duration     `json:"p99_ns"`
+	Max          time.Duration     `json:"max_ns"`
+	Mean         time.Duration     `json:"mean_ns"`
+	Latency      *latencyHistogram `json:"latency"`
+}
+
+func (s *opStats) summary() opSummary {
+	s.mu.Lock()
+	ok, errs := s.ok.Load(), s.errs.Load()
+	out := opSummary{Queries: ok + errs, Errors: errs, ErrorClasses: map[string]uint64{}}
+	for k, v := range s.classes {
+		out.ErrorClasses[k] = v
+	}
+	end := s.ended
+	if end.IsZero() {
+		end = time.Now()
+	}
+	out.Duration = s.prior
+	if !s.started.IsZero() {
+		out.Duration += end.Sub(s.started)
+	}
+	s.mu.Unlock()
+	if out.Duration > 0 {
+		out.Throughput = float64(out.Queries) / out.Duration.Seconds()
+	}
+	out.P50, out.P95, out.P99 = s.latency.quantile(0.50), s.latency.quantile(0.95), s.latency.quantile(0.99)
+	out.Max, out.Mean = s.latency.quantile(1), s.latency.mean()
+	out.Latency = &latencyHistogram{}
+	out.Latency.merge(&s.latency)
+	return out
+}
+
+func (o opSummary) errorRate() float64 {
+	if o.Queries == 0 {
+		return 0
+	}
+	return float64(o.Errors) / float64(o.Queries)
+}
+
+func (o opSummary) String() string {
+	classes := make([]string, 0, len(o.ErrorClasses))
+	for k, v := range o.ErrorClasses {
+		classes = append(classes, fmt.Sprintf("%s=%d", k, v))
+	}
+	sort.Strings(classes)
+	return fmt.Sprintf("queries=%d errors=%d (%.2f%%) %v qps=%.1f latency %s",
+		o.Queries, o.Errors, 100*o.errorRate(), classes, o.Throughput, o.Latency)
+}
+
+// errorClass buckets an error for reporting: the SQLSTATE when the server
+// returned one, otherwise a coarse client-side category.
+func errorClass(err error) string {
+	var pgErr *pgconn.PgError
+	switch {
+	case errors.Is(err, errQueryTimeout):
+		return "query-timeout" // whether the server cancelled the statement or pgx gave up first
+	case errors.Is(err, errBreakerOpen):
+		return "breaker-open"
+	case errors.As(err, &pgErr):
+		return "sqlstate-" + pgErr.Code
+	case errors.Is(err, context.DeadlineExceeded):
+		return "deadline-exceeded"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	default:
+		return "other"
+	}
+}
+
+// nodeStats splits a pool's calls by the CockroachDB node their last attempt
+// ran on; node 0 collects calls that never got a connection or whose node is
+// unknown.
+type nodeStats struct {
+	mu    sync.Mutex
+	nodes map[uint32]*opStats
+}
+
+func (s *nodeStats) record(node uint32, d time.Duration, err error) {
+	s.mu.Lock()
+	ns := s.nodes[node]
+	if ns == nil {
+		if s.nodes == nil {
+			s.nodes = map[uint32]*opStats{}
+		}
+		ns = &opStats{}
+		ns.begin()
+		s.nodes[node] = ns
+	}
+	s.mu.Unlock()
+	ns.record(d, err)
+}
+
+// summary returns the per-node summaries keyed "n<id>" ("unknown" for 0).
+func (s *nodeStats) summary() map[string]opSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]opSummary, len(s.nodes))
+	for node, ns := range s.nodes {
+		key := "unknown"
+		if node != 0 {
+			key = "n" + strconv.FormatUint(uint64(node), 10)
+		}
+		out[key] = ns.summary()
+	}
+	return out
+}
+
+// retryStats describes logical calls that may take several attempts: how
+// many attempts each one needed, the latency of the individual attempts, and
+// the wall-clock time of whole calls, retries and backoffs included. The
+// logical latency is what an application sees; per-attempt latency hides the
+// cost of retrying.
+type retryStats struct {
+	attempt latencyHistogram
+	logical latencyHistogram
+	retried latencyHistogram // logical latency of calls that needed >1 attempt
+
+	mu         sync.Mutex
+	byAttempts map[int]uint64 // attempts -> calls
+}
+
+func (s *retryStats) recordAttempt(d time.Duration) { s.attempt.observe(d) }
+
+func (s *retryStats) recordCall(attempts int, d time.Duration) {
+	s.logical.observe(d)
+	if attempts > 1 {
+		s.retried.observe(d)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.byAttempts == nil {
+		s.byAttempts = map[int]uint64{}
+	}
+	s.byAttempts[attempts]++
+}
+
+// retrySummary is the reportable form of retryStats.
+type retrySummary struct {
+	Calls          uint64            `json:"calls"`
+	RetriedCalls   uint64            `json:"retried_calls"`
+	ByAttempts     map[int]uint64    `json:"calls_by_attempts"`
+	Logical        *latencyHistogram `json:"logical_latency"`
+	Attempt        *latencyHistogram `json:"attempt_latency"`
+	RetriedLatency *latencyHistogram `json:"retried_latency"`
+}
+
+func (s *retryStats) summary() retrySummary {
+	out := retrySummary{
+		ByAttempts:     map[int]uint64{},
+		Logical:        &latencyHistogram{},
+		Attempt:        &latencyHistogram{},
+		RetriedLatency: &latencyHistogram{},
+	}
+	s.mu.Lock()
+	for n, c := range s.byAttempts {
+		out.ByAttempts[n] = c
+		out.Calls += c
+		if n > 1 {
+			out.RetriedCalls += c
+		}
+	}
+	s.mu.Unlock()
+	out.Logical.merge(&s.logical)
+	out.Attempt.merge(&s.attempt)
+	out.RetriedLatency.merge(&s.retried)
+	return out
+}
+
+func (r retrySummary) String() string {
+	attempts := make([]int, 0, len(r.ByAttempts))
+	for n := range r.ByAttempts {
+		attempts = append(attempts, n)
+	}
+	sort.Ints(attempts)
+	parts := make([]string, len(attempts))
+	for i, n := range attempts {
+		parts[i] = fmt.Sprintf("%d=%d", n, r.ByAttempts[n])
+	}
+	pct := 0.0
+	if r.Calls > 0 {
+		pct = 100 * float64(r.RetriedCalls) / float64(r.Calls)
+	}
+	return fmt.Sprintf("calls=%d retried=%d (%.2f%%) attempts%v logical %s | per-attempt %s | retried calls %s",
+		r.Calls, r.RetriedCalls, pct, parts, r.Logical, r.Attempt, r.RetriedLatency)
+}
+
+// LogValue renders the histogram as a group of summary statistics.
+func (h *latencyHistogram) LogValue() slog.Value {
+	if h.count() == 0 {
+		return slog.GroupValue(slog.Uint64("n", 0))
+	}
+	return slog.GroupValue(
+		slog.Uint64("n", h.count()),
+		slog.Duration("mean", h.mean()),
+		slog.Duration("p50", h.quantile(0.50)),
+		slog.Duration("p95", h.quantile(0.95)),
+		slog.Duration("p99", h.quantile(0.99)),
+		slog.Duration("max", h.quantile(1)),
+	)
+}
+
+func (o opSummary) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Uint64("queries", o.Queries),
+		slog.Uint64("errors", o.Errors),
+		slog.Float64("error_rate", o.errorRate()),
+		slog.Any("error_classes", o.ErrorClasses),
+		slog.Float64("qps", o.Throughput),
+		slog.Any("latency", o.Latency),
+	)
+}
+
+func (r retrySummary) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Uint64("calls", r.Calls),
+		slog.Uint64("retried_calls", r.RetriedCalls),
+		slog.Any("calls_by_attempts", r.ByAttempts),
+		slog.Any("logical", r.Logical),
+		slog.Any("attempt", r.Attempt),
+		slog.Any("retried", r.RetriedLatency),
+	)
+}
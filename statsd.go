@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	defaultStatsdPrefix   = "crdbpool_tester"
+	defaultStatsdInterval = 10 * time.Second
+	statsdMaxPacket       = 1432 // fits an Ethernet MTU with IP and UDP headers
+	statsdQueue           = 256  // datagrams waiting for the sender, beyond which they're dropped
+	statsdWriteTimeout    = 100 * time.Millisecond
+)
+
+// statsdEmitter sends each call's timer and counters and, every interval,
+// the pools' connection gauges to a DogStatsD agent. Metrics are batched into
+// datagrams of up to statsdMaxPacket bytes, sent by a goroutine of their own
+// so a slow agent or a full Unix socket never blocks the calls: a datagram
+// the sender can't keep up with, or whose send fails, is counted and
+// dropped.
+//
+// Every metric carries run_id, crdbpool and pool_impl tags and the
+// --statsd-tags; calls add pool, node and, for failures, sqlstate and class.
+type statsdEmitter struct {
+	conn   net.Conn
+	prefix string
+	tags   string // the common tags, joined
+
+	out  chan []byte // to the sender
+	done chan struct{}
+
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	dropped int
+	closed  bool
+}
+
+// newStatsdEmitter dials addr: host:port for UDP, or unix:///path for
+// DogStatsD's Unix domain socket.
+func newStatsdEmitter(addr, prefix string, extraTags []string, res runResult) (*statsdEmitter, error) {
+	network := "udp"
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		network, addr = "unixgram", path
+	}
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("statsd-addr: %w", err)
+	}
+	tags := []string{
+		"run_id:" + res.RunID,
+		"crdbpool:" + cmp.Or(res.Components["crdbpool"], "unknown"),
+		"pool_impl:" + cmp.Or(res.Components["pool-impl"], "unknown"),
+	}
+	s := &statsdEmitter{conn: conn, prefix: prefix, tags: strings.Join(append(tags, extraTags...), ","), out: make(chan []byte, statsdQueue), done: make(chan struct{})}
+	go s.send()
+	return s, nil
+}
+
+// send writes the queued datagrams until Close.
+func (s *statsdEmitter) send() {
+	defer close(s.done)
+	for pkt := range s.out {
+		_ = s.conn.SetWriteDeadline(time.Now().Add(statsdWriteTimeout))
+		if _, err := s.conn.Write(pkt); err != nil {
+			s.mu.Lock()
+			s.droppedLocked(err)
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *statsdEmitter) droppedLocked(err error) {
+	if s.dropped == 0 {
+		slog.Warn("statsd send failed; counting dropped datagrams", "err", err)
+	}
+	s.dropped++
+}
+
+// parseStatsdTags checks --statsd-tags are key:value pairs.
+func parseStatsdTags(s string) ([]string, error) {
+	var tags []string
+	for _, t := range strings.Split(s, ",") {
+		t = strings.TrimSpace(t)
+		if k, _, ok := strings.Cut(t, ":"); !ok || k == "" || strings.ContainsAny(t, "|#\n") {
+			return nil, fmt.Errorf("statsd tag %q: want key:value", t)
+		}
+		tags = append(tags, t)
+	}
+	return tags, nil
+}
+
+// metric buffers one metric of type typ (c, g or ms) with the common tags
+// and tags, flushing the buffer first if it wouldn't fit.
+func (s *statsdEmitter) metric(name, value, typ string, tags ...string) {
+	line := s.prefix + "." + name + ":" + value + "|" + typ + "|#" + s.tags
+	if len(tags) > 0 {
+		line += "," + strings.Join(tags, ",")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buf.Len() > 0 && s.buf.Len()+1+len(line) > statsdMaxPacket {
+		s.flushLocked()
+	}
+	if s.buf.Len() > 0 {
+		s.buf.WriteByte('\n')
+	}
+	s.buf.WriteString(line)
+}
+
+func (s *statsdEmitter) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushLocked()
+}
+
+func (s *statsdEmitter) flushLocked() {
+	if s.buf.Len() == 0 || s.closed {
+		return
+	}
+	select {
+	case s.out <- bytes.Clone(s.buf.Bytes()):
+	default:
+		s.droppedLocked(errors.New("send queue full"))
+	}
+	s.buf.Reset()
+}
+
+// call records one logical call through pool: its duration, a count, and
+// its retries and error when it had them. node is the node of its last
+// attempt, 0 if unknown.
+func (s *statsdEmitter) call(pool string, node uint32, d time.Duration, attempts int, err error) {
+	tags := []string{"pool:" + pool, "node:" + statsdNode(node)}
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) {
+			tags = append(tags, "sqlstate:"+pgErr.Code)
+		}
+		tags = append(tags, "class:"+errorClass(err))
+		s.metric("query.errors", "1", "c", tags...)
+	}
+	s.metric("query.duration", strconv.FormatFloat(float64(d.Microseconds())/1000, 'f', 3, 64), "ms", tags...)
+	s.metric("query.count", "1", "c", tags...)
+	if attempts > 1 {
+		s.metric("query.retries", strconv.Itoa(attempts-1), "c", tags...)
+	}
+}
+
+func statsdNode(node uint32) string {
+	if node == 0 {
+		return "unknown"
+	}
+	return strconv.FormatUint(uint64(node), 10)
+}
+
+// gauges sends each pool's connection counts.
+func (s *statsdEmitter) gauges(pools map[string]*testerPool) {
+	for _, name := range slices.Sorted(maps.Keys(pools)) {
+		st := newPoolStat(pools[name].Stat())
+		tag := "pool:" + name
+		for _, g := range []struct {
+			name string
+			v    int32
+		}{{"pool.conns.acquired", st.AcquiredConns}, {"pool.conns.idle", st.IdleConns}, {"pool.conns.constructing", st.ConstructingConns},
+			{"pool.conns.total", st.TotalConns}, {"pool.conns.max", st.MaxConns}} {
+			s.metric(g.name, strconv.Itoa(int(g.v)), "g", tag)
+		}
+	}
+}
+
+// watch sends the pools' gauges and flushes the buffered calls every
+// interval until ctx is done.
+func (s *statsdEmitter) watch(ctx context.Context, pools map[string]*testerPool, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			s.gauges(pools)
+			s.flush()
+		}
+	}
+}
+
+// Close sends the last gauges and whatever is buffered.
+func (s *statsdEmitter) Close(pools map[string]*testerPool) error {
+	s.gauges(pools)
+	s.mu.Lock()
+	s.flushLocked()
+	s.closed = true
+	close(s.out)
+	s.mu.Unlock()
+	<-s.done
+	if s.dropped > 0 {
+		slog.Warn("statsd datagrams dropped", "count", s.dropped)
+	}
+	return s.conn.Close()
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// stepsSetupSlack is what --steps' timeout leaves on top of the steps
+	// for connecting and setting up the workloads, unless -t is set.
+	stepsSetupSlack = time.Minute
+	// stepsKneeShortfall is the share of a step's target rate a workload
+	// must reach; below it, the pool or the cluster can't keep up.
+	stepsKneeShortfall = 0.9
+	// stepsKneeLatency is how many times the first step's p99 a later
+	// step's may reach before the latency curve has turned.
+	stepsKneeLatency = 2.0
+)
+
+// loadStep is one stage of a --steps load profile: every workload targets
+// rate queries per second for duration.
+type loadStep struct {
+	Rate     float64       `json:"target_qps"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+// parseSteps parses --steps, e.g. "100qps:5m,200qps:5m,400qps:5m".
+func parseSteps(s string) ([]loadStep, error) {
+	var steps []loadStep
+	for _, part := range strings.Split(s, ",") {
+		rate, dur, ok := strings.Cut(strings.TrimSpace(part), ":")
+		if !ok {
+			return nil, fmt.Errorf("step %q: want <rate>qps:<duration>, e.g. 100qps:5m", part)
+		}
+		qps, err := parseThroughput(rate)
+		if err != nil {
+			return nil, fmt.Errorf("step %q: %w", part, err)
+		}
+		d, err := time.ParseDuration(dur)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("step %q: want a duration > 0 like 5m", part)
+		}
+		steps = append(steps, loadStep{Rate: qps, Duration: d})
+	}
+	return steps, nil
+}
+
+func stepsString(steps []loadStep) string {
+	parts := make([]string, len(steps))
+	for i, st := range steps {
+		parts[i] = fmt.Sprintf("%gqps:%s", st.Rate, st.Duration)
+	}
+	return strings.Join(parts, ",")
+}
+
+func stepsDuration(steps []loadStep) time.Duration {
+	var total time.Duration
+	for _, st := range steps {
+		total += st.Duration
+	}
+	return total
+}
+
+// stepRunner moves the workloads through a --steps profile: it sets every
+// workload's target rate at the start of each step, counts the samples
+// completed during the step in stats of the step's own, and ends the
+// workloads after the last one.
+type stepRunner struct {
+	steps     []loadStep
+	workloads []*workload
+	tl        *timeline
+
+	mu       sync.Mutex
+	cur      int // index of the current step; len(steps) once done
+	started  []time.Time
+	ended    []time.Time
+	stats    []map[string]*opStats // per step, workload -> stats within the step
+	finished bool                  // the last step ran to its end
+}
+
+// stepResult is the reportable form of a step.
+type stepResult struct {
+	loadStep
+	Step      int                  `json:"step"` // 1-based
+	Start     time.Time            `json:"start"`
+	End       time.Time            `json:"end"`
+	Workloads map[string]opSummary `json:"workloads"`
+}
+
+// stepsSummary is the profile's per-step stats, as written to --results-out,
+// with the first step past the knee of the latency curve.
+type stepsSummary struct {
+	Steps      []stepResult `json:"steps"`
+	Knee       int          `json:"knee,omitempty"` // 1-based step; 0 if none
+	KneeReason string       `json:"knee_reason,omitempty"`
+}
+
+// newStepRunner starts the first step, so the workloads' first batches
+// already run at its rate.
+func newStepRunner(steps []loadStep, workloads []*workload, tl *timeline) *stepRunner {
+	r := &stepRunner{steps: steps, workloads: workloads, tl: tl, cur: -1}
+	r.advance()
+	for _, w := range workloads {
+		w.steps = r
+	}
+	return r
+}
+
+// run advances through the steps until the last one ends, then calls stop
+// to end the workloads, or until ctx is done.
+func (r *stepRunner) run(ctx context.Context, stop context.CancelFunc) {
+	for {
+		r.mu.Lock()
+		if r.cur == len(r.steps) {
+			r.mu.Unlock()
+			return
+		}
+		left := r.steps[r.cur].Duration - time.Since(r.started[r.cur])
+		r.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(left):
+		}
+		if !r.advance() {
+			slog.Info("steps done: stopping the workloads")
+			stop()
+			return
+		}
+	}
+}
+
+// advance ends the current step and starts the next, reporting whether
+// there was one.
+func (r *stepRunner) advance() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cur == len(r.steps) {
+		return false
+	}
+	now := time.Now()
+	if r.cur >= 0 {
+		r.endLocked(now)
+	}
+	r.cur++
+	if r.cur == len(r.steps) {
+		r.finished = true
+		return false
+	}
+	st := r.steps[r.cur]
+	stats := map[string]*opStats{}
+	for _, w := range r.workloads {
+		s := &opStats{}
+		s.begin()
+		stats[w.name] = s
+		w.setRate(st.Rate)
+	}
+	r.started = append(r.started, now)
+	r.stats = append(r.stats, stats)
+	slog.Info("step", "step", r.cur+1, "of", len(r.steps), "target_qps", st.Rate, "duration", st.Duration)
+	r.tl.record("step", "%d/%d: %gqps for %s", r.cur+1, len(r.steps), st.Rate, st.Duration)
+	return true
+}
+
+func (r *stepRunner) endLocked(now time.Time) {
+	for _, s := range r.stats[r.cur] {
+		s.end()
+	}
+	r.ended = append(r.ended, now)
+}
+
+// done reports whether the last step ran to its end, and so ended the
+// workloads.
+func (r *stepRunner) done() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.finished
+}
+
+// record counts a sample of workload in the current step.
+func (r *stepRunner) record(workload string, d time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cur < len(r.steps) {
+		r.stats[r.cur][workload].record(d, err)
+	}
+}
+
+// summary ends the step in progress, if the run ended before the profile
+// did, and reports the steps that ran.
+func (r *stepRunner) summary() *stepsSummary {
+	r.mu.Lock()
+	if r.cur < len(r.steps) {
+		r.endLocked(time.Now())
+		r.cur = len(r.steps)
+	}
+	out := &stepsSummary{}
+	for i, stats := range r.stats {
+		sr := stepResult{loadStep: r.steps[i], Step: i + 1, Start: r.started[i], End: r.ended[i], Workloads: map[string]opSummary{}}
+		for name, s := range stats {
+			sr.Workloads[name] = s.summary()
+		}
+		out.Steps = append(out.Steps, sr)
+	}
+	r.mu.Unlock()
+	out.Knee, out.KneeReason = findKnee(out.Steps)
+	for _, sr := range out.Steps {
+		for _, w := range r.workloads {
+			slog.Info("step summary", "step", sr.Step, "target_qps", sr.Rate, "workload", w.name, "stats", sr.Workloads[w.name])
+		}
+	}
+	if out.Knee > 0 {
+		slog.Warn("steps: latency knee", "step", out.Knee, "target_qps", out.Steps[out.Knee-1].Rate, "reason", out.KneeReason)
+	} else if len(out.Steps) > 0 {
+		slog.Info("steps: no latency knee", "steps", len(out.Steps))
+	}
+	return out
+}
+
+// findKnee returns the first step at which a workload either falls short of
+// the target rate or sees its p99 rise well above the first step's, and
+// why; 0 if the workloads kept up throughout. A step without queries
+// doesn't count either way.
+func findKnee(steps []stepResult) (int, string) {
+	if len(steps) == 0 {
+		return 0, ""
+	}
+	for _, sr := range steps {
+		for _, name := range slices.Sorted(maps.Keys(sr.Workloads)) {
+			s := sr.Workloads[name]
+			if s.Queries == 0 {
+				continue
+			}
+			if s.Throughput < sr.Rate*stepsKneeShortfall {
+				return sr.Step, fmt.Sprintf("%s reached %.1fqps of the %gqps target", name, s.Throughput, sr.Rate)
+			}
+			base := steps[0].Workloads[name].P99
+			if sr.Step > 1 && base > 0 && float64(s.P99) > float64(base)*stepsKneeLatency {
+				return sr.Step, fmt.Sprintf("%s p99 rose to %s from %s at step 1", name, s.P99, base)
+			}
+		}
+	}
+	return 0, ""
+}
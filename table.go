@@ -0,0 +1,343 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	tablePrefix       = "tmp_crush"
+	registryTable     = "crdbpool_tester_tables"
+	tableDropTimeout  = 10 * time.Second
+	sqlEnsureRegistry = "create table if not exists " + registryTable + "(name string primary key, run_id string not null, created_at timestamptz not null default now())"
+	sqlRegisterTable  = "upsert into " + registryTable + " (name, run_id, created_at) values ($1, $2, now())"
+	sqlUnregister     = "delete from " + registryTable + " where name = $1"
+	sqlListRegistered = "select name, run_id, created_at from " + registryTable + " order by created_at"
+	// tables named like workload tables, for those missing from the registry
+	sqlListRunTables = "select table_schema, table_name from information_schema.tables where table_type = 'BASE TABLE' and table_name like $1 || '\\_%' " +
+		"and table_schema not in ('crdb_internal', 'information_schema', 'pg_catalog', 'pg_extension') order by table_schema, table_name"
+)
+
+// runTableNameSuffix is what newRunTable appends to a --table prefix: the
+// run ID's time and random part, and a worker's index.
+var runTableNameSuffix = regexp.MustCompile(`_(\d{8}t\d{6})_[0-9a-f]{6}(_w\d+)?$`)
+
+// runTable is the workload table of one run. Its name embeds the run ID,
+// unless --table-run-suffix=false, so concurrent and crashed runs never
+// share data or DDL; it is listed in the registry table so leftovers from
+// crashed runs can be found and dropped.
+type runTable struct {
+	name  string // schema-qualified when the table has a schema
+	ident string // quoted for use in SQL
+	opts  tableOptions
+}
+
+// tableOptions choose the physical layout of the workload table, so the same
+// workload can probe different layouts.
+type tableOptions struct {
+	Name        string        // the table's name, or with RunSuffix its prefix
+	Schema      string        // created if missing; empty => the database's current schema
+	RunSuffix   bool          // append the run ID to Name
+	Families    bool          // put id and ts in separate column families
+	HashBuckets int           // hash-shard the primary key into this many buckets; 0 => plain
+	Locality    string        // multi-region locality clause, e.g. "regional by row"
+	Storage     []string      // storage parameters as key=value, value a SQL literal
+	RowTTL      time.Duration // expire rows this long after their last write (CockroachDB row-level TTL); 0 => never
+	RowTTLCron  string        // schedule of the TTL deletion job; empty => CockroachDB's default (hourly)
+	Token       bool          // add the token column of --workload read-your-writes, --verify-ambiguous and --ledger
+	Counter     bool          // add the counter column of --workload lost-update and bank
+}
+
+// parseStorageParam validates one key=value storage parameter.
+func parseStorageParam(s string) (string, error) {
+	k, v, ok := strings.Cut(s, "=")
+	k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+	if !ok || k == "" || v == "" || strings.IndexFunc(k, func(r rune) bool { return !(r == '_' || r == '.' || r >= 'a' && r <= 'z') }) >= 0 {
+		return "", fmt.Errorf("table-storage %q: want key=value, e.g. fillfactor=90 or ttl_expire_after='1h'", s)
+	}
+	return k + " = " + v, nil
+}
+
+// validateTableName checks --table and --schema are plain lowercase
+// identifiers, so qualified names split unambiguously at the dot.
+func validateTableName(opts tableOptions) error {
+	ident := func(s string) bool {
+		return s != "" && (s[0] < '0' || s[0] > '9') &&
+			strings.IndexFunc(s, func(r rune) bool { return !(r == '_' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9') }) < 0
+	}
+	if !ident(opts.Name) {
+		return fmt.Errorf("table must be a lowercase identifier: letters, digits and _ (got %q)", opts.Name)
+	}
+	if opts.Schema != "" && !ident(opts.Schema) {
+		return fmt.Errorf("schema must be a lowercase identifier: letters, digits and _ (got %q)", opts.Schema)
+	}
+	return nil
+}
+
+// tableIdent quotes a possibly schema-qualified table name for SQL.
+func tableIdent(name string) string {
+	return pgx.Identifier(strings.Split(name, ".")).Sanitize()
+}
+
+// validateRowTTL checks --row-ttl: whole seconds, and not also set through
+// --table-storage.
+func validateRowTTL(opts tableOptions) error {
+	if opts.RowTTL < 0 || opts.RowTTL%time.Second != 0 {
+		return fmt.Errorf("row-ttl must be a whole number of seconds >= 0 (got %s)", opts.RowTTL)
+	}
+	if opts.RowTTLCron != "" && opts.RowTTL == 0 {
+		return errors.New("--row-ttl-cron requires --row-ttl")
+	}
+	for _, p := range opts.Storage {
+		if opts.RowTTL > 0 && strings.HasPrefix(p, "ttl_") {
+			return fmt.Errorf("--row-ttl sets the TTL storage parameters; drop --table-storage %s", p)
+		}
+	}
+	return nil
+}
+
+// quoteLiteral renders s as a SQL string literal.
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func validateLocality(s string) error {
+	l := strings.ToLower(strings.TrimSpace(s))
+	if l != "" && !strings.HasPrefix(l, "global") && !strings.HasPrefix(l, "regional") {
+		return fmt.Errorf("table-locality must start with global or regional (got %q)", s)
+	}
+	return nil
+}
+
+// newRunTable derives a table name from --table and the run ID, e.g.
+// tmp_crush_20261014t120000_a1b2c3, qualified by --schema.
+func newRunTable(runID string, opts tableOptions) runTable {
+	name := cmp.Or(opts.Name, tablePrefix)
+	if opts.RunSuffix {
+		name += "_" + strings.NewReplacer("-", "_").Replace(strings.ToLower(runID))
+	}
+	if opts.Schema != "" {
+		name = opts.Schema + "." + name
+	}
+	return runTable{name: name, ident: tableIdent(name), opts: opts}
+}
+
+func (t runTable) ensureSQL() string {
+	cols, tsFamily := "id int not null, ts timestamptz", "ts"
+	if t.opts.Token {
+		cols, tsFamily = cols+", token string", tsFamily+", token"
+	}
+	if t.opts.Counter {
+		cols, tsFamily = cols+", n int not null default 0", tsFamily+", n"
+	}
+	cols += ", primary key (id)"
+	if t.opts.HashBuckets > 0 {
+		cols += fmt.Sprintf(" using hash with (bucket_count = %d)", t.opts.HashBuckets)
+	}
+	if t.opts.Families {
+		cols += ", family f_id (id), family f_ts (" + tsFamily + ")"
+	}
+	sql := fmt.Sprintf("create table if not exists %s(%s)", t.ident, cols)
+	storage := t.opts.Storage
+	if t.opts.RowTTL > 0 {
+		storage = append(slices.Clip(storage), fmt.Sprintf("ttl_expire_after = '%d seconds'", int64(t.opts.RowTTL.Seconds())))
+		if t.opts.RowTTLCron != "" {
+			storage = append(storage, "ttl_job_cron = "+quoteLiteral(t.opts.RowTTLCron))
+		}
+	}
+	if len(storage) > 0 {
+		sql += " with (" + strings.Join(storage, ", ") + ")"
+	}
+	if t.opts.Locality != "" {
+		sql += " locality " + t.opts.Locality
+	}
+	return sql
+}
+
+func (t runTable) upsertReturningTSSQL() string {
+	return fmt.Sprintf("insert into %s (id, ts) values ($1, now()) on conflict (id) do update set ts = now() returning ts", t.ident)
+}
+
+func (t runTable) upsertTokenSQL() string {
+	return fmt.Sprintf("insert into %s (id, ts, token) values ($1, now(), $2) on conflict (id) do update set ts = now(), token = $2 returning ts", t.ident)
+}
+
+func (t runTable) insertTokenSQL() string {
+	return fmt.Sprintf("insert into %s (id, ts, token) values (unique_rowid(), now(), $1)", t.ident)
+}
+
+func (t runTable) insertTokenReturningSQL() string {
+	return fmt.Sprintf("insert into %s (id, ts, token) values (unique_rowid(), now(), $1) returning id, ts", t.ident)
+}
+
+// lastTokenSeqSQL takes a pattern matching the run's tokens and the offset
+// of their sequence number.
+func (t runTable) lastTokenSeqSQL() string {
+	return fmt.Sprintf("select coalesce(max(substr(token, $2)::int8), 0) from %s where token ~ $1", t.ident)
+}
+
+func (t runTable) selectTokenSQL() string {
+	return fmt.Sprintf("select token from %s where id = $1", t.ident)
+}
+
+func (t runTable) incrementSQL() string {
+	return fmt.Sprintf("insert into %[1]s (id, ts, n) values ($1, now(), 1) on conflict (id) do update set ts = now(), n = %[1]s.n + 1 returning n", t.ident)
+}
+
+func (t runTable) selectCountersSQL() string {
+	return fmt.Sprintf("select id, n from %s", t.ident)
+}
+
+// create registers the table for cleanup, then creates it, and its schema
+// first if it has one.
+func (t runTable) create(ctx context.Context, p *testerPool, runID string) error {
+	if err := execSQL(ctx, p, sqlEnsureRegistry); err != nil {
+		return fmt.Errorf("create table registry: %w", err)
+	}
+	if err := execSQL(ctx, p, sqlRegisterTable, t.name, runID); err != nil {
+		return fmt.Errorf("register table %s: %w", t.name, err)
+	}
+	if t.opts.Schema != "" {
+		if err := execSQL(ctx, p, "create schema if not exists "+pgx.Identifier{t.opts.Schema}.Sanitize()); err != nil {
+			return fmt.Errorf("create schema %s: %w", t.opts.Schema, err)
+		}
+	}
+	return execSQL(ctx, p, t.ensureSQL())
+}
+
+// drop removes the table and its registry entry. It uses its own context so
+// cleanup still happens after the run context is done.
+func (t runTable) drop(p *testerPool) {
+	ctx, cancel := context.WithTimeout(context.Background(), tableDropTimeout)
+	defer cancel()
+	if err := execSQL(ctx, p, "drop table if exists "+t.ident); err != nil {
+		slog.Warn("drop table failed, left registered for cleanup", "table", t.name, "err", err)
+		return
+	}
+	if err := execSQL(ctx, p, sqlUnregister, t.name); err != nil {
+		slog.Warn("unregister table", "table", t.name, "err", err)
+		return
+	}
+	slog.Info("dropped table", "table", t.name)
+}
+
+// registeredTable is a registry entry, or an unregistered table named like
+// one, as listed by cleanup.
+type registeredTable struct {
+	name       string
+	runID      string // empty when unregistered
+	created    time.Time
+	registered bool
+}
+
+// cleanupOptions choose the tables cleanupTables drops.
+type cleanupOptions struct {
+	olderThan    time.Duration // skip tables created more recently, possibly still in use
+	unregistered bool          // also tables named like prefix's workload tables missing from the registry
+	prefix       string        // --table of the runs that created them
+	dryRun       bool          // only log what would be dropped
+}
+
+// sqlDB is what the table DDL runs through: a pool, or a command's single
+// connection.
+type sqlDB interface {
+	rowsQuerier
+	ExecFunc(ctx context.Context, tagFunc func(ctx context.Context, tag pgconn.CommandTag, err error) error, sql string, arguments ...any) error
+}
+
+// cleanupTables drops the registered tables created more than olderThan ago,
+// the leftovers of crashed or --keep-table runs, and optionally unregistered
+// tables named like them (their run ID tells their age), and returns how
+// many it dropped (or would drop, with dryRun).
+func cleanupTables(ctx context.Context, db sqlDB, opts cleanupOptions) (int, error) {
+	if err := execSQL(ctx, db, sqlEnsureRegistry); err != nil {
+		return 0, fmt.Errorf("create table registry: %w", err)
+	}
+	var tables []registeredTable
+	err := db.QueryFunc(ctx, func(ctx context.Context, rows pgx.Rows) error {
+		var err error
+		tables, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (registeredTable, error) {
+			t := registeredTable{registered: true}
+			err := row.Scan(&t.name, &t.runID, &t.created)
+			return t, err
+		})
+		return err
+	}, sqlListRegistered)
+	if err != nil {
+		return 0, fmt.Errorf("list registered tables: %w", err)
+	}
+	if opts.unregistered {
+		found, err := unregisteredRunTables(ctx, db, opts.prefix, tables)
+		if err != nil {
+			return 0, err
+		}
+		tables = append(tables, found...)
+	}
+	n := 0
+	for _, t := range tables {
+		age := time.Since(t.created).Round(time.Second)
+		if age < opts.olderThan {
+			continue
+		}
+		if opts.dryRun {
+			slog.Info("would drop table", "table", t.name, "run_id", t.runID, "registered", t.registered, "age", age)
+			n++
+			continue
+		}
+		if err := execSQL(ctx, db, "drop table if exists "+tableIdent(t.name)); err != nil {
+			return n, fmt.Errorf("drop table %s: %w", t.name, err)
+		}
+		if t.registered {
+			if err := execSQL(ctx, db, sqlUnregister, t.name); err != nil {
+				return n, fmt.Errorf("unregister table %s: %w", t.name, err)
+			}
+		}
+		slog.Info("dropped table", "table", t.name, "run_id", t.runID, "registered", t.registered, "age", age)
+		n++
+	}
+	return n, nil
+}
+
+// unregisteredRunTables lists the tables named prefix_<run ID> in any schema
+// that aren't in registered, created when their run ID says.
+func unregisteredRunTables(ctx context.Context, db sqlDB, prefix string, registered []registeredTable) ([]registeredTable, error) {
+	known := map[string]bool{}
+	for _, t := range registered {
+		known[t.name] = true
+	}
+	var out []registeredTable
+	err := db.QueryFunc(ctx, func(ctx context.Context, rows pgx.Rows) error {
+		var schema, name string
+		_, err := pgx.ForEachRow(rows, []any{&schema, &name}, func() error {
+			m := runTableNameSuffix.FindStringSubmatch(name)
+			if m == nil || name[:len(name)-len(m[0])] != prefix || known[name] || known[schema+"."+name] {
+				return nil
+			}
+			created, err := time.Parse("20060102t150405", m[1])
+			if err != nil {
+				return nil
+			}
+			out = append(out, registeredTable{name: schema + "." + name, created: created})
+			return nil
+		})
+		return err
+	}, sqlListRunTables, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("list unregistered tables: %w", err)
+	}
+	return out, nil
+}
+
+func execSQL(ctx context.Context, db sqlDB, sql string, args ...any) error {
+	return db.ExecFunc(ctx, func(ctx context.Context, tag pgconn.CommandTag, err error) error { return err }, sql, args...)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// timelineEvent is a single annotated point in time during a run (fault
+// injected, fault removed, ...).
+type timelineEvent struct {
+	At     time.Time `json:"at"`
+	Kind   string    `json:"kind"`
+	Detail string    `json:"detail"`
+}
+
+// timeline collects events so they can be correlated with the workload logs
+// and reported at the end of a run.
+type timeline struct {
+	mu     sync.Mutex
+	start  time.Time
+	events []timelineEvent
+}
+
+func newTimeline(start time.Time) *timeline {
+	return &timeline{start: start}
+}
+
+// record appends an event and logs it immediately.
+func (t *timeline) record(kind string, format string, args ...any) {
+	ev := timelineEvent{At: time.Now(), Kind: kind, Detail: fmt.Sprintf(format, args...)}
+	t.mu.Lock()
+	t.events = append(t.events, ev)
+	t.mu.Unlock()
+	slog.Info("timeline", "offset", t.offset(ev.At), "kind", ev.Kind, "detail", ev.Detail)
+}
+
+// offset returns the time elapsed between the start of the run and at.
+func (t *timeline) offset(at time.Time) time.Duration {
+	return at.Sub(t.start).Truncate(time.Millisecond)
+}
+
+// restore prepends events recorded by an earlier process of the same run.
+func (t *timeline) restore(events []timelineEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.events = append(append([]timelineEvent(nil), events...), t.events...)
+}
+
+// snapshot returns a copy of the recorded events in insertion order.
+func (t *timeline) snapshot() []timelineEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]timelineEvent(nil), t.events...)
+}
+
+func (t *timeline) logSummary() {
+	events := t.snapshot()
+	if len(events) == 0 {
+		return
+	}
+	slog.Info("timeline summary", "events", len(events))
+	for _, ev := range events {
+		slog.Info("timeline summary event", "offset", t.offset(ev.At), "kind", ev.Kind, "detail", ev.Detail)
+	}
+}
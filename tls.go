@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// sslModes are the libpq sslmode values pgx accepts.
+var sslModes = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+
+// tlsOptions are the --sslcert, --sslkey, --sslrootcert and --sslmode
+// flags. They are merged into every DSN of the cluster under test as the
+// libpq parameters of the same names, overriding the DSN's own, so pgx
+// builds the TLS config from them exactly as from a DSN carrying them.
+type tlsOptions struct {
+	Cert     string // client certificate, PEM
+	Key      string // its private key, PEM
+	RootCert string // CA certificates the server's is checked against, PEM
+	Mode     string
+}
+
+func (o *tlsOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.Cert, "sslcert", "", "client certificate file for certificate authentication (with --sslkey), e.g. certs/client.root.crt; overrides the DSN's sslcert")
+	fs.StringVar(&o.Key, "sslkey", "", "private key file of --sslcert, e.g. certs/client.root.key; overrides the DSN's sslkey")
+	fs.StringVar(&o.RootCert, "sslrootcert", "", "CA certificate file the server's certificate is verified against, e.g. certs/ca.crt; overrides the DSN's sslrootcert")
+	fs.StringVar(&o.Mode, "sslmode", "", "sslmode: "+strings.Join(sslModes, ", ")+"; overrides the DSN's")
+}
+
+func (o tlsOptions) set() bool {
+	return o != tlsOptions{}
+}
+
+func (o tlsOptions) params() [][2]string {
+	var ps [][2]string
+	for _, p := range [][2]string{{"sslcert", o.Cert}, {"sslkey", o.Key}, {"sslrootcert", o.RootCert}, {"sslmode", o.Mode}} {
+		if p[1] != "" {
+			ps = append(ps, p)
+		}
+	}
+	return ps
+}
+
+// apply returns dsn with the flags' parameters merged in, in its own
+// format: URL query parameters, or keyword/value pairs appended last, which
+// win over earlier ones. An empty or unparsable dsn is returned as is, for
+// pgx to report.
+func (o tlsOptions) apply(dsn string) string {
+	if dsn == "" || !o.set() {
+		return dsn
+	}
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return dsn
+		}
+		q := u.Query()
+		for _, p := range o.params() {
+			q.Set(p[0], p[1])
+		}
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+	for _, p := range o.params() {
+		dsn += " " + p[0] + "='" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(p[1]) + "'"
+	}
+	return dsn
+}
+
+// validateTLS checks the TLS settings dsn ends up with, flags merged in,
+// so a misconfigured certificate fails at startup with the reason rather
+// than as a handshake or authentication error on the first connection.
+func validateTLS(o tlsOptions, dsn string) error {
+	if o.Mode != "" && !slices.Contains(sslModes, o.Mode) {
+		return fmt.Errorf("sslmode must be one of %s (got %q)", strings.Join(sslModes, ", "), o.Mode)
+	}
+	if dsn == "" {
+		return nil
+	}
+	s := map[string]string{}
+	u, err := url.Parse(dsn)
+	if err == nil {
+		for k := range u.Query() {
+			s[k] = u.Query().Get(k)
+		}
+	}
+	for _, p := range o.params() {
+		s[p[0]] = p[1]
+	}
+	cert, key, root, mode := s["sslcert"], s["sslkey"], s["sslrootcert"], s["sslmode"]
+	switch {
+	case (cert == "") != (key == ""):
+		return errors.New("--sslcert and --sslkey must be set together: certificate authentication needs both the certificate and its key")
+	case mode == "disable" && (cert != "" || root != ""):
+		return errors.New("sslmode=disable never uses --sslcert or --sslrootcert; use sslmode=verify-full for certificate authentication")
+	}
+	if root != "" {
+		if err := checkRootCert(root); err != nil {
+			return err
+		}
+	}
+	var leaf *x509.Certificate
+	if cert != "" {
+		if leaf, err = checkClientCert(cert, key); err != nil {
+			return err
+		}
+	}
+	// what else pgx makes of the settings, e.g. an unknown parameter
+	cc, err := pgx.ParseConfig(o.apply(dsn))
+	if err != nil {
+		if o.set() {
+			return fmt.Errorf("TLS settings: %w", err)
+		}
+		return nil // not the TLS flags' doing; reported when connecting
+	}
+	// CockroachDB authenticates a client certificate as the user in its
+	// common name, unless an identity map says otherwise
+	if user := cc.User; user != "" && leaf != nil && leaf.Subject.CommonName != user {
+		slog.Warn("client certificate's common name isn't the DSN's user; the cluster will reject it unless an identity map maps it",
+			"sslcert", cert, "cn", leaf.Subject.CommonName, "user", user)
+	}
+	return nil
+}
+
+// applyTLS checks the TLS flags against, and merges them into, the DSNs of
+// the cluster under test: DATABASE_URL, the reader's and writer's and the
+// named pools'. --mirror-dsn is another cluster and keeps its own.
+func (cfg *Config) applyTLS() error {
+	dsns := []*string{&cfg.DSN, &cfg.ReaderDSN, &cfg.WriterDSN}
+	for i := range cfg.Pools {
+		dsns = append(dsns, &cfg.Pools[i].DSN)
+	}
+	for _, dsn := range dsns {
+		if err := validateTLS(cfg.TLS, *dsn); err != nil {
+			return err
+		}
+		*dsn = cfg.TLS.apply(*dsn)
+	}
+	return nil
+}
+
+func checkRootCert(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("sslrootcert: %w", err)
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM(b) {
+		return fmt.Errorf("sslrootcert %s: no PEM certificate in it", path)
+	}
+	return nil
+}
+
+// checkClientCert checks the certificate and key files are readable and,
+// unless the key is encrypted (sslpassword), a pair. It returns the
+// certificate, nil for an encrypted key.
+func checkClientCert(certPath, keyPath string) (*x509.Certificate, error) {
+	if _, err := os.ReadFile(certPath); err != nil {
+		return nil, fmt.Errorf("sslcert: %w", err)
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("sslkey: %w", err)
+	}
+	if block, _ := pem.Decode(keyPEM); block == nil {
+		return nil, fmt.Errorf("sslkey %s: no PEM key in it", keyPath)
+	} else if block.Type == "ENCRYPTED PRIVATE KEY" || block.Headers["Proc-Type"] == "4,ENCRYPTED" {
+		return nil, nil
+	}
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("sslcert %s and sslkey %s: %w", certPath, keyPath, err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("sslcert %s: %w", certPath, err)
+	}
+	switch now := time.Now(); {
+	case now.After(leaf.NotAfter):
+		return nil, fmt.Errorf("sslcert %s expired on %s", certPath, leaf.NotAfter.Format(time.RFC3339))
+	case now.Before(leaf.NotBefore):
+		return nil, fmt.Errorf("sslcert %s is not valid before %s", certPath, leaf.NotBefore.Format(time.RFC3339))
+	}
+	return leaf, nil
+}
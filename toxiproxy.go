@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultToxiproxyProxy  = "crdbpool-tester"
+	defaultToxiproxyListen = "127.0.0.1:26258"
+	defaultCRDBPort        = "26257"
+	toxiproxyAPITimeout    = 10 * time.Second
+)
+
+// toxicSchedule is a toxic to apply through Toxiproxy at a given offset from
+// the start of the workload, optionally removed again after Duration.
+//
+// Flag syntax: type[@start][+duration][:key=value,...], e.g.
+//
+//	latency@1m+30s:latency=500,jitter=100
+//	bandwidth@2m+1m:rate=64
+//	reset_peer@3m:timeout=0
+//
+// The keys stream (upstream|downstream) and toxicity (0..1) are toxic options;
+// every other key is passed as an integer toxic attribute.
+type toxicSchedule struct {
+	Type       string
+	Start      time.Duration
+	Duration   time.Duration // 0 => keep until the end of the run
+	Stream     string
+	Toxicity   float64
+	Attributes map[string]int64
+}
+
+func parseToxicSchedule(s string) (toxicSchedule, error) {
+	ts := toxicSchedule{Stream: "downstream", Toxicity: 1, Attributes: map[string]int64{}}
+	spec, attrs, _ := strings.Cut(strings.TrimSpace(s), ":")
+	if rest, dur, ok := strings.Cut(spec, "+"); ok {
+		d, err := time.ParseDuration(dur)
+		if err != nil || d <= 0 {
+			return ts, fmt.Errorf("toxic %q: invalid duration %q", s, dur)
+		}
+		ts.Duration = d
+		spec = rest
+	}
+	if typ, start, ok := strings.Cut(spec, "@"); ok {
+		d, err := time.ParseDuration(start)
+		if err != nil || d < 0 {
+			return ts, fmt.Errorf("toxic %q: invalid start %q", s, start)
+		}
+		ts.Start = d
+		spec = typ
+	}
+	if spec == "" {
+		return ts, fmt.Errorf("toxic %q: missing type", s)
+	}
+	ts.Type = spec
+	if attrs == "" {
+		return ts, nil
+	}
+	for _, kv := range strings.Split(attrs, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return ts, fmt.Errorf("toxic %q: invalid attribute %q (want key=value)", s, kv)
+		}
+		switch k {
+		case "stream":
+			if v != "upstream" && v != "downstream" {
+				return ts, fmt.Errorf("toxic %q: stream must be upstream or downstream", s)
+			}
+			ts.Stream = v
+		case "toxicity":
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || f < 0 || f > 1 {
+				return ts, fmt.Errorf("toxic %q: toxicity must be between 0 and 1", s)
+			}
+			ts.Toxicity = f
+		default:
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return ts, fmt.Errorf("toxic %q: attribute %s must be an integer", s, k)
+			}
+			ts.Attributes[k] = n
+		}
+	}
+	return ts, nil
+}
+
+func (ts toxicSchedule) String() string {
+	s := fmt.Sprintf("%s@%s", ts.Type, ts.Start)
+	if ts.Duration > 0 {
+		s += "+" + ts.Duration.String()
+	}
+	return s
+}
+
+// toxiproxyClient talks to the Toxiproxy HTTP API and tracks the proxy and
+// toxics it created so they can be removed when the run ends.
+type toxiproxyClient struct {
+	base   string
+	proxy  string
+	client *http.Client
+
+	mu     sync.Mutex
+	active map[string]struct{} // toxic names currently applied
+}
+
+func newToxiproxyClient(addr, proxy string) *toxiproxyClient {
+	base := addr
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+	return &toxiproxyClient{
+		base:   strings.TrimRight(base, "/"),
+		proxy:  proxy,
+		client: &http.Client{Timeout: toxiproxyAPITimeout},
+		active: map[string]struct{}{},
+	}
+}
+
+// setup creates (or replaces) the proxy in front of the DSN's host and
+// returns the DSN rewritten to connect through the proxy listener.
+func (c *toxiproxyClient) setup(ctx context.Context, dsn, listen string) (string, error) {
+	u, err := url.Parse(dsn)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("toxiproxy requires a URL-style DATABASE_URL")
+	}
+	upstream := u.Host
+	if _, _, err := net.SplitHostPort(upstream); err != nil {
+		upstream = net.JoinHostPort(upstream, defaultCRDBPort)
+	}
+	body := []map[string]any{{
+		"name":     c.proxy,
+		"listen":   listen,
+		"upstream": upstream,
+		"enabled":  true,
+	}}
+	if err := c.do(ctx, http.MethodPost, "/populate", body); err != nil {
+		return "", fmt.Errorf("create proxy %s: %w", c.proxy, err)
+	}
+	u.Host = listen
+	return u.String(), nil
+}
+
+func (c *toxiproxyClient) addToxic(ctx context.Context, name string, ts toxicSchedule) error {
+	body := map[string]any{
+		"name":       name,
+		"type":       ts.Type,
+		"stream":     ts.Stream,
+		"toxicity":   ts.Toxicity,
+		"attributes": ts.Attributes,
+	}
+	if err := c.do(ctx, http.MethodPost, "/proxies/"+url.PathEscape(c.proxy)+"/toxics", body); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.active[name] = struct{}{}
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *toxiproxyClient) removeToxic(ctx context.Context, name string) error {
+	c.mu.Lock()
+	delete(c.active, name)
+	c.mu.Unlock()
+	return c.do(ctx, http.MethodDelete, "/proxies/"+url.PathEscape(c.proxy)+"/toxics/"+url.PathEscape(name), nil)
+}
+
+// runSchedule applies every toxic at its start offset and removes it after its
+// duration, recording each transition on the timeline. It returns once all
+// toxics have been handled or ctx is done.
+func (c *toxiproxyClient) runSchedule(ctx context.Context, toxics []toxicSchedule, tl *timeline) {
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i, ts := range toxics {
+		name := fmt.Sprintf("%s-%d", ts.Type, i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !sleepCtx(ctx, time.Until(start.Add(ts.Start))) {
+				return
+			}
+			if err := c.addToxic(ctx, name, ts); err != nil {
+				tl.record("toxic-error", "add %s (%s): %v", name, ts, err)
+				return
+			}
+			tl.record("toxic-added", "%s %s stream=%s toxicity=%g attrs=%v", name, ts.Type, ts.Stream, ts.Toxicity, ts.Attributes)
+			if ts.Duration == 0 || !sleepCtx(ctx, ts.Duration) {
+				return
+			}
+			if err := c.removeToxic(ctx, name); err != nil {
+				tl.record("toxic-error", "remove %s: %v", name, err)
+				return
+			}
+			tl.record("toxic-removed", "%s", name)
+		}()
+	}
+	wg.Wait()
+}
+
+// teardown removes any toxics still applied and deletes the proxy. It uses its
+// own context so cleanup still happens after the run context is cancelled.
+func (c *toxiproxyClient) teardown(tl *timeline) {
+	ctx, cancel := context.WithTimeout(context.Background(), toxiproxyAPITimeout)
+	defer cancel()
+	c.mu.Lock()
+	names := make([]string, 0, len(c.active))
+	for name := range c.active {
+		names = append(names, name)
+	}
+	c.mu.Unlock()
+	for _, name := range names {
+		if err := c.removeToxic(ctx, name); err != nil {
+			slog.Warn("toxiproxy: remove toxic", "toxic", name, "err", err)
+			continue
+		}
+		tl.record("toxic-removed", "%s (teardown)", name)
+	}
+	if err := c.do(ctx, http.MethodDelete, "/proxies/"+url.PathEscape(c.proxy), nil); err != nil {
+		slog.Warn("toxiproxy: delete proxy", "proxy", c.proxy, "err", err)
+	}
+}
+
+func (c *toxiproxyClient) do(ctx context.Context, method, path string, body any) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("toxiproxy %s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// sleepCtx sleeps for d and reports whether it completed before ctx was done.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
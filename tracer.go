@@ -2,40 +2,86 @@ package main
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
-	"log"
+	"fmt"
+	"log/slog"
 	"net"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-type simpleTracer struct{}
+// simpleTracer logs every query's start and end, or with a slow threshold
+// only the queries that took at least that long, counting the rest.
+type simpleTracer struct {
+	slow   time.Duration // 0 => log every query
+	redact *argRedactor  // nil => log arguments as JSON
+
+	queries  atomic.Int64
+	slowOnes atomic.Int64
+}
+
+func newSimpleTracer(slow time.Duration, redact *argRedactor) *simpleTracer {
+	return &simpleTracer{slow: slow, redact: redact}
+}
 
 type traceStartKey struct{}
 
 type traceStart struct {
 	Start time.Time
+	SQL   string
+	Args  []any
 }
 
-func (t simpleTracer) TraceQueryStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+func (t *simpleTracer) TraceQueryStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	if !logQueries || !slog.Default().Enabled(ctx, slog.LevelInfo) {
+		return ctx // skip formatting the args for lines nobody will see
+	}
+	if t.slow > 0 {
+		return context.WithValue(ctx, traceStartKey{}, traceStart{Start: time.Now(), SQL: data.SQL, Args: data.Args})
+	}
 	addr := safeRemoteAddr(conn)
-	args := safeArgs(data.Args)
-	log.Printf("[pgx] start sql=%q args=%s conn=%s", oneLine(data.SQL), args, addr)
+	args := safeArgs(data.Args, t.redact)
+	logQuery(ctx, "query start", "sql", oneLine(data.SQL), "args", args, "conn", addr, "node", connNode(conn), "attempt", callAttempt(ctx))
 	return context.WithValue(ctx, traceStartKey{}, traceStart{Start: time.Now()})
 }
 
-func (t simpleTracer) TraceQueryEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData) {
+func (t *simpleTracer) TraceQueryEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData) {
 	v := ctx.Value(traceStartKey{})
-	ts, _ := v.(traceStart)
+	ts, ok := v.(traceStart)
+	if !ok {
+		return
+	}
 	dur := time.Since(ts.Start)
+	if t.slow > 0 {
+		t.queries.Add(1)
+		if dur < t.slow {
+			return
+		}
+		t.slowOnes.Add(1)
+		slog.InfoContext(ctx, "slow query trace", "sql", oneLine(ts.SQL), "args", safeArgs(ts.Args, t.redact), "tag", data.CommandTag.String(),
+			"duration", dur, "err", data.Err, "conn", safeRemoteAddr(conn), "node", connNode(conn), "attempt", callAttempt(ctx))
+		return
+	}
 	addr := safeRemoteAddr(conn)
 	if data.Err != nil {
-		log.Printf("[pgx] end   sql=%q dur=%s err=%v conn=%s", oneLine(data.CommandTag.String()), dur, data.Err, addr)
+		logQuery(ctx, "query end", "tag", data.CommandTag.String(), "duration", dur, "err", data.Err, "conn", addr, "node", connNode(conn), "attempt", callAttempt(ctx))
 		return
 	}
-	log.Printf("[pgx] end   tag=%q rows=%d dur=%s conn=%s", data.CommandTag.String(), data.CommandTag.RowsAffected(), dur, addr)
+	logQuery(ctx, "query end", "tag", data.CommandTag.String(), "rows", data.CommandTag.RowsAffected(), "duration", dur, "conn", addr, "node", connNode(conn), "attempt", callAttempt(ctx))
+}
+
+func (t *simpleTracer) logSummary() {
+	if t.slow > 0 {
+		slog.Info("tracer summary", "queries", t.queries.Load(), "slow", t.slowOnes.Load(), "threshold", t.slow)
+	}
 }
 
 func oneLine(s string) string {
@@ -45,19 +91,62 @@ func oneLine(s string) string {
 	return s
 }
 
-func safeArgs(args []any) string {
+// safeArgs renders query arguments for the log, redacted by r unless it is
+// nil.
+func safeArgs(args []any, r *argRedactor) string {
 	vals := make([]string, len(args))
 	for i, a := range args {
+		if r != nil && r.elide {
+			vals[i] = "<redacted>"
+			continue
+		}
 		b, err := json.Marshal(a)
 		if err != nil {
 			vals[i] = "<unmarshalable>"
 			continue
 		}
+		if r != nil {
+			vals[i] = r.hash(b)
+			continue
+		}
 		vals[i] = string(b)
 	}
 	return "[" + strings.Join(vals, ", ") + "]"
 }
 
+// argRedactor keeps query arguments out of the logs. In hash mode each
+// argument is replaced by a keyed hash of its JSON form: equal values hash
+// the same within a run, so repeated arguments can still be correlated, but
+// the per-run random key keeps short values from being guessed offline.
+type argRedactor struct {
+	elide bool
+	key   []byte
+}
+
+// newArgRedactor returns the redactor for mode "hash" or "elide", or nil for
+// "" (arguments are logged as is).
+func newArgRedactor(mode string) (*argRedactor, error) {
+	switch mode {
+	case "":
+		return nil, nil
+	case "elide":
+		return &argRedactor{elide: true}, nil
+	case "hash":
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		return &argRedactor{key: key}, nil
+	}
+	return nil, fmt.Errorf("redact-args must be hash or elide (got %q)", mode)
+}
+
+func (r *argRedactor) hash(b []byte) string {
+	m := hmac.New(sha256.New, r.key)
+	m.Write(b)
+	return "h:" + hex.EncodeToString(m.Sum(nil)[:8])
+}
+
 func safeRemoteAddr(conn *pgx.Conn) string {
 	if conn == nil {
 		return "<nil>"
@@ -75,3 +164,80 @@ func safeRemoteAddr(conn *pgx.Conn) string {
 	}
 	return "<remote>"
 }
+
+// multiTracer fans pgx trace callbacks out to several tracers. Connect,
+// acquire and release callbacks go to the tracers that implement
+// pgx.ConnectTracer, pgxpool.AcquireTracer and pgxpool.ReleaseTracer.
+type multiTracer []pgx.QueryTracer
+
+func (m multiTracer) TraceQueryStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	for _, t := range m {
+		ctx = t.TraceQueryStart(ctx, conn, data)
+	}
+	return ctx
+}
+
+func (m multiTracer) TraceQueryEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData) {
+	for _, t := range m {
+		t.TraceQueryEnd(ctx, conn, data)
+	}
+}
+
+func (m multiTracer) TracePrepareStart(ctx context.Context, conn *pgx.Conn, data pgx.TracePrepareStartData) context.Context {
+	for _, t := range m {
+		if pt, ok := t.(pgx.PrepareTracer); ok {
+			ctx = pt.TracePrepareStart(ctx, conn, data)
+		}
+	}
+	return ctx
+}
+
+func (m multiTracer) TracePrepareEnd(ctx context.Context, conn *pgx.Conn, data pgx.TracePrepareEndData) {
+	for _, t := range m {
+		if pt, ok := t.(pgx.PrepareTracer); ok {
+			pt.TracePrepareEnd(ctx, conn, data)
+		}
+	}
+}
+
+func (m multiTracer) TraceConnectStart(ctx context.Context, data pgx.TraceConnectStartData) context.Context {
+	for _, t := range m {
+		if ct, ok := t.(pgx.ConnectTracer); ok {
+			ctx = ct.TraceConnectStart(ctx, data)
+		}
+	}
+	return ctx
+}
+
+func (m multiTracer) TraceConnectEnd(ctx context.Context, data pgx.TraceConnectEndData) {
+	for _, t := range m {
+		if ct, ok := t.(pgx.ConnectTracer); ok {
+			ct.TraceConnectEnd(ctx, data)
+		}
+	}
+}
+
+func (m multiTracer) TraceAcquireStart(ctx context.Context, pool *pgxpool.Pool, data pgxpool.TraceAcquireStartData) context.Context {
+	for _, t := range m {
+		if at, ok := t.(pgxpool.AcquireTracer); ok {
+			ctx = at.TraceAcquireStart(ctx, pool, data)
+		}
+	}
+	return ctx
+}
+
+func (m multiTracer) TraceAcquireEnd(ctx context.Context, pool *pgxpool.Pool, data pgxpool.TraceAcquireEndData) {
+	for _, t := range m {
+		if at, ok := t.(pgxpool.AcquireTracer); ok {
+			at.TraceAcquireEnd(ctx, pool, data)
+		}
+	}
+}
+
+func (m multiTracer) TraceRelease(pool *pgxpool.Pool, data pgxpool.TraceReleaseData) {
+	for _, t := range m {
+		if rt, ok := t.(pgxpool.ReleaseTracer); ok {
+			rt.TraceRelease(pool, data)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	sqlCrdbVersion = "show crdb_version"
+	// upgradeDrillTick is how often the drill samples the node versions seen
+	// through the pools' connections.
+	upgradeDrillTick = time.Second
+)
+
+type upgradePhase string
+
+const (
+	phaseBefore upgradePhase = "before" // every node seen still on the first version
+	phaseSkew   upgradePhase = "skew"   // nodes on more than one version
+	phaseAfter  upgradePhase = "after"  // every node seen on a single, newer version
+)
+
+// upgradeDrill follows a rolling CockroachDB upgrade through the pools'
+// connections: each connection reports its node's version when it connects,
+// so sampling the open connections shows which nodes run which version.
+// Calls are counted per phase of the upgrade and per version of the node the
+// last attempt ran on, which ties errors to the skew window and to the
+// nodes being restarted.
+type upgradeDrill struct {
+	tl *timeline
+
+	mu        sync.Mutex
+	initial   string            // first version seen
+	nodes     map[uint32]string // latest version seen per node
+	phase     upgradePhase
+	skewStart time.Time
+	skewTotal time.Duration
+	byPhase   map[upgradePhase]*callCount
+	byVersion map[string]*callCount
+}
+
+type callCount struct {
+	Calls  int64 `json:"calls"`
+	Errors int64 `json:"errors"`
+}
+
+func newUpgradeDrill(tl *timeline) *upgradeDrill {
+	return &upgradeDrill{
+		tl:        tl,
+		nodes:     map[uint32]string{},
+		phase:     phaseBefore,
+		byPhase:   map[upgradePhase]*callCount{},
+		byVersion: map[string]*callCount{},
+	}
+}
+
+// record counts one finished call; version is that of the node its last
+// attempt ran on, empty if it never got a connection.
+func (u *upgradeDrill) record(version string, err error) {
+	if version == "" {
+		version = "unknown"
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	countCall(u.byPhase, u.phase, err)
+	countCall(u.byVersion, version, err)
+}
+
+func countCall[K comparable](m map[K]*callCount, k K, err error) {
+	c := m[k]
+	if c == nil {
+		c = &callCount{}
+		m[k] = c
+	}
+	c.Calls++
+	if err != nil {
+		c.Errors++
+	}
+}
+
+// run samples the node versions seen through pools until ctx is done.
+func (u *upgradeDrill) run(ctx context.Context, pools map[string]*testerPool) {
+	t := time.NewTicker(upgradeDrillTick)
+	defer t.Stop()
+	for {
+		u.sample(pools)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (u *upgradeDrill) sample(pools map[string]*testerPool) {
+	// the newest connection to a node wins: older ones may predate a
+	// restart that pgx has not noticed yet
+	seen := map[uint32]connInfo{}
+	for _, p := range pools {
+		p.pool().Range(func(conn *pgx.Conn, node uint32) {
+			info, ok := lookupConn(conn)
+			if !ok || node == 0 || info.version == "" {
+				return
+			}
+			if cur, ok := seen[node]; !ok || info.born.After(cur.born) {
+				seen[node] = info
+			}
+		})
+	}
+	now := time.Now()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, node := range slices.Sorted(maps.Keys(seen)) {
+		v := seen[node].version
+		if u.initial == "" {
+			u.initial = v
+		}
+		if old, ok := u.nodes[node]; !ok {
+			u.tl.record("upgrade", "node %d on %s", node, shortVersion(v))
+		} else if old != v {
+			u.tl.record("upgrade", "node %d: %s -> %s", node, shortVersion(old), shortVersion(v))
+		}
+		u.nodes[node] = v
+	}
+	versions := u.versions()
+	phase := u.phase
+	switch {
+	case len(versions) > 1:
+		phase = phaseSkew
+	case len(versions) == 1 && versions[0] != u.initial:
+		phase = phaseAfter
+	}
+	if phase == u.phase {
+		return
+	}
+	switch phase {
+	case phaseSkew:
+		u.skewStart = now
+		u.tl.record("version-skew", "nodes on %d versions: %s", len(versions), u.formatNodes())
+	default:
+		if u.phase == phaseSkew {
+			u.skewTotal += now.Sub(u.skewStart)
+		}
+		u.tl.record("version-skew", "all nodes on %s", shortVersion(versions[0]))
+	}
+	u.phase = phase
+}
+
+// versions returns the distinct versions of the known nodes; u.mu is held.
+func (u *upgradeDrill) versions() []string {
+	return slices.Compact(slices.Sorted(maps.Values(u.nodes)))
+}
+
+func (u *upgradeDrill) formatNodes() string {
+	parts := make([]string, 0, len(u.nodes))
+	for _, node := range slices.Sorted(maps.Keys(u.nodes)) {
+		parts = append(parts, fmt.Sprintf("n%d=%s", node, shortVersion(u.nodes[node])))
+	}
+	return strings.Join(parts, " ")
+}
+
+// shortVersion extracts the release ("v23.2.1") from a full build string like
+// "CockroachDB CCL v23.2.1 (x86_64-pc-linux-gnu, built ...)".
+func shortVersion(v string) string {
+	for _, f := range strings.Fields(v) {
+		if strings.HasPrefix(f, "v") && strings.Contains(f, ".") {
+			return f
+		}
+	}
+	return v
+}
+
+// upgradeSummary is the drill's outcome as written to --results-out.
+type upgradeSummary struct {
+	Initial   string               `json:"initial_version"`
+	Final     []string             `json:"final_versions"`
+	Skew      time.Duration        `json:"skew_ns"`
+	Nodes     map[uint32]string    `json:"nodes"`
+	ByPhase   map[string]callCount `json:"by_phase"`
+	ByVersion map[string]callCount `json:"by_version"`
+}
+
+func (u *upgradeDrill) summary() *upgradeSummary {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	s := &upgradeSummary{
+		Initial:   shortVersion(u.initial),
+		Skew:      u.skewTotal,
+		Nodes:     map[uint32]string{},
+		ByPhase:   map[string]callCount{},
+		ByVersion: map[string]callCount{},
+	}
+	if u.phase == phaseSkew {
+		s.Skew += time.Since(u.skewStart)
+	}
+	for _, v := range u.versions() {
+		s.Final = append(s.Final, shortVersion(v))
+	}
+	for node, v := range u.nodes {
+		s.Nodes[node] = shortVersion(v)
+	}
+	for ph, c := range u.byPhase {
+		s.ByPhase[string(ph)] = *c
+	}
+	for v, c := range u.byVersion {
+		s.ByVersion[shortVersion(v)] = *c
+	}
+	return s
+}
+
+func (u *upgradeDrill) logSummary() {
+	s := u.summary()
+	slog.Info("upgrade drill", "initial", s.Initial, "final", strings.Join(s.Final, ","), "skew", s.Skew.Round(time.Millisecond))
+	for _, ph := range []upgradePhase{phaseBefore, phaseSkew, phaseAfter} {
+		if c, ok := s.ByPhase[string(ph)]; ok {
+			slog.Info("upgrade drill phase", "phase", ph, "calls", c.Calls, "errors", c.Errors, "error_rate", errorRate(c))
+		}
+	}
+	for _, v := range slices.Sorted(maps.Keys(s.ByVersion)) {
+		c := s.ByVersion[v]
+		slog.Info("upgrade drill version", "version", v, "calls", c.Calls, "errors", c.Errors, "error_rate", errorRate(c))
+	}
+}
+
+func errorRate(c callCount) float64 {
+	if c.Calls == 0 {
+		return 0
+	}
+	return float64(c.Errors) / float64(c.Calls)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set at build time, e.g.
+//
+//	go build -ldflags "-X main.version=v0.4.0 -X main.gitSHA=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+//
+// Whatever is left unset comes from the build info Go embeds (the module
+// version under go install, the VCS revision and time under go build).
+var (
+	version   = ""
+	gitSHA    = ""
+	buildDate = ""
+)
+
+// buildInfo identifies the binary that produced a run, down to the crdbpool
+// and pgx versions compiled into it.
+type buildInfo struct {
+	Version  string `json:"version"`
+	Commit   string `json:"commit,omitempty"`
+	Date     string `json:"date,omitempty"`
+	Modified bool   `json:"modified,omitempty"` // built from a tree with uncommitted changes
+	Go       string `json:"go"`
+	Crdbpool string `json:"crdbpool"`
+	Pgx      string `json:"pgx"`
+}
+
+func currentBuild() buildInfo {
+	b := buildInfo{
+		Version:  version,
+		Commit:   gitSHA,
+		Date:     buildDate,
+		Go:       runtime.Version(),
+		Crdbpool: moduleVersion("github.com/authzed/crdbpool"),
+		Pgx:      moduleVersion("github.com/jackc/pgx/v5"),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if b.Version == "" && bi.Main.Version != "(devel)" {
+			b.Version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if b.Commit == "" {
+					b.Commit = s.Value
+				}
+			case "vcs.time":
+				if b.Date == "" {
+					b.Date = s.Value
+				}
+			case "vcs.modified":
+				b.Modified = s.Value == "true"
+			}
+		}
+	}
+	if b.Version == "" {
+		b.Version = "dev"
+	}
+	return b
+}
+
+func (b buildInfo) write(w io.Writer) {
+	commit := b.Commit
+	if b.Modified {
+		commit += " (modified)"
+	}
+	fmt.Fprintf(w, "crdbpool-tester %s\n", b.Version)
+	fmt.Fprintf(w, "  commit:   %s\n", commit)
+	fmt.Fprintf(w, "  built:    %s\n", b.Date)
+	fmt.Fprintf(w, "  go:       %s\n", b.Go)
+	fmt.Fprintf(w, "  crdbpool: %s\n", b.Crdbpool)
+	fmt.Fprintf(w, "  pgx:      %s\n", b.Pgx)
+}
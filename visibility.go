@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	defaultVisibilityTimeout = 10 * time.Second
+	defaultVisibilityPoll    = 10 * time.Millisecond
+)
+
+// visibility measures how long a write takes to become visible to readers.
+// Each writer call upserts a unique token into a random key, then every
+// reader polls the key until it holds the token, or until timeout. The
+// readers are the reader pool and any --pool pools named, which may point
+// at nodes in other localities; with follower reads they read as of
+// follower_read_timestamp(), so the times show the follower staleness.
+// Calls on the same key are serialized, as in read-your-writes, so no other
+// write of this run overwrites the token while it is polled for.
+type visibility struct {
+	runID    string
+	upsert   string
+	read     string
+	readers  []*visibilityReader
+	keys     *lockedRand
+	base     int // first key, set by applyShard
+	nkeys    int
+	timeout  time.Duration
+	poll     time.Duration
+	follower bool
+	tl       *timeline
+
+	seq    atomic.Int64
+	writes atomic.Int64
+	locks  [rywLockStripes]sync.Mutex
+}
+
+// visibilityReader is one pool polled for the writes.
+type visibilityReader struct {
+	name string
+	db   querier
+
+	latency  latencyHistogram
+	reads    atomic.Int64
+	timeouts atomic.Int64
+	errs     atomic.Int64
+}
+
+// visibilityPoolSummary is one reader's results.
+type visibilityPoolSummary struct {
+	Visible  *latencyHistogram `json:"visible"` // from the write's return to the first read that saw it
+	Reads    int64             `json:"reads"`
+	Timeouts int64             `json:"timeouts"` // writes not seen within the timeout
+	Errors   int64             `json:"errors"`
+}
+
+// visibilitySummary is logged and written to --results-out.
+type visibilitySummary struct {
+	Writes        int64                            `json:"writes"`
+	FollowerReads bool                             `json:"follower_reads"`
+	Timeout       time.Duration                    `json:"timeout_ns"`
+	Pools         map[string]visibilityPoolSummary `json:"pools"`
+}
+
+func newVisibility(runID string, table runTable, readers map[string]querier, keys *lockedRand, base, nkeys int, timeout, poll time.Duration, follower bool, tl *timeline) *visibility {
+	read := table.selectTokenSQL()
+	if follower {
+		read = fmt.Sprintf("select token from %s as of system time follower_read_timestamp() where id = $1", table.ident)
+	}
+	v := &visibility{
+		runID:    runID,
+		upsert:   table.upsertTokenSQL(),
+		read:     read,
+		keys:     keys,
+		base:     base,
+		nkeys:    nkeys,
+		timeout:  timeout,
+		poll:     poll,
+		follower: follower,
+		tl:       tl,
+	}
+	for _, name := range slices.Sorted(maps.Keys(readers)) {
+		v.readers = append(v.readers, &visibilityReader{name: name, db: readers[name]})
+	}
+	return v
+}
+
+// query returns the writer query: upsert a fresh token through writer, then
+// poll every reader for it. Only the upsert's error is the call's.
+func (v *visibility) query(writer querier) func(ctx context.Context, i int) error {
+	return func(ctx context.Context, i int) error {
+		key := v.base + v.keys.IntN(v.nkeys)
+		token := fmt.Sprintf("%s-%d", v.runID, v.seq.Add(1))
+		lk := &v.locks[key%rywLockStripes]
+		lk.Lock()
+		defer lk.Unlock()
+		var ts time.Time
+		if err := writer.QueryRowFunc(ctx, func(ctx context.Context, row pgx.Row) error { return row.Scan(&ts) }, v.upsert, key, token); err != nil {
+			return err
+		}
+		written := time.Now()
+		v.writes.Add(1)
+		logQuery(ctx, "upsert ok", "workload", "writer", "iteration", i+1, "ts", ts.UTC(), "token", token)
+		var wg sync.WaitGroup
+		for _, r := range v.readers {
+			wg.Go(func() { v.await(ctx, r, key, token, written) })
+		}
+		wg.Wait()
+		return nil
+	}
+}
+
+// await polls r until key holds token, recording how long after written
+// that was.
+func (v *visibility) await(ctx context.Context, r *visibilityReader, key int, token string, written time.Time) {
+	for {
+		var got *string
+		r.reads.Add(1)
+		err := r.db.QueryRowFunc(ctx, func(ctx context.Context, row pgx.Row) error { return row.Scan(&got) }, v.read, key)
+		switch {
+		case err == nil && got != nil && *got == token:
+			r.latency.observe(time.Since(written))
+			return
+		case err != nil && !errors.Is(err, pgx.ErrNoRows):
+			if ctx.Err() != nil {
+				return
+			}
+			r.errs.Add(1)
+		}
+		if time.Since(written) >= v.timeout {
+			r.timeouts.Add(1)
+			slog.WarnContext(ctx, "write not visible", "pool", r.name, "key", key, "token", token, "timeout", v.timeout)
+			v.tl.record("visibility", "write to key %d not visible to %s within %s", key, r.name, v.timeout)
+			return
+		}
+		if !sleepCtx(ctx, v.poll) {
+			return
+		}
+	}
+}
+
+// summary logs and returns the per-reader distributions.
+func (v *visibility) summary() *visibilitySummary {
+	s := &visibilitySummary{Writes: v.writes.Load(), FollowerReads: v.follower, Timeout: v.timeout, Pools: map[string]visibilityPoolSummary{}}
+	for _, r := range v.readers {
+		ps := visibilityPoolSummary{Visible: &latencyHistogram{}, Reads: r.reads.Load(), Timeouts: r.timeouts.Load(), Errors: r.errs.Load()}
+		ps.Visible.merge(&r.latency)
+		s.Pools[r.name] = ps
+		slog.Info("visibility", "pool", r.name, "writes", s.Writes, "follower_reads", v.follower, "visible", ps.Visible,
+			"reads", ps.Reads, "timeouts", ps.Timeouts, "errors", ps.Errors)
+	}
+	return s
+}
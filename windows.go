@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// eventWindow is a named period marked by an operator ("node 3 down",
+// "upgrade in progress"); samples completed while it is open are also
+// counted in its own per-workload stats.
+type eventWindow struct {
+	name   string
+	start  time.Time
+	end    time.Time
+	stats  map[string]*opStats // workload -> stats within the window
+	closed bool
+}
+
+// windowResult is the reportable form of an eventWindow.
+type windowResult struct {
+	Name      string               `json:"name"`
+	Start     time.Time            `json:"start"`
+	End       time.Time            `json:"end"`
+	Workloads map[string]opSummary `json:"workloads"`
+}
+
+// windowTracker holds the open and closed event windows of a run.
+type windowTracker struct {
+	mu      sync.Mutex
+	open    map[string]*eventWindow
+	windows []*eventWindow // every window in open order
+}
+
+func newWindowTracker() *windowTracker {
+	return &windowTracker{open: map[string]*eventWindow{}}
+}
+
+func (t *windowTracker) openWindow(name string, tl *timeline) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.open[name]; ok {
+		return fmt.Errorf("window %q is already open", name)
+	}
+	w := &eventWindow{name: name, start: time.Now(), stats: map[string]*opStats{}}
+	t.open[name] = w
+	t.windows = append(t.windows, w)
+	tl.record("window-open", "%s", name)
+	return nil
+}
+
+func (t *windowTracker) closeWindow(name string, tl *timeline) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	w, ok := t.open[name]
+	if !ok {
+		return fmt.Errorf("window %q is not open", name)
+	}
+	t.closeLocked(w)
+	tl.record("window-close", "%s after %s", name, w.end.Sub(w.start).Truncate(time.Millisecond))
+	return nil
+}
+
+func (t *windowTracker) closeLocked(w *eventWindow) {
+	w.end, w.closed = time.Now(), true
+	for _, s := range w.stats {
+		s.end()
+	}
+	delete(t.open, w.name)
+}
+
+// closeAll closes any windows still open when the run ends.
+func (t *windowTracker) closeAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, w := range t.open {
+		t.closeLocked(w)
+	}
+}
+
+// record counts a sample of workload in every open window.
+func (t *windowTracker) record(workload string, d time.Duration, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, w := range t.open {
+		s, ok := w.stats[workload]
+		if !ok {
+			s = &opStats{}
+			s.begin() // throughput within the window counts from the first sample
+			w.stats[workload] = s
+		}
+		s.record(d, err)
+	}
+}
+
+func (t *windowTracker) names() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]string, 0, len(t.open))
+	for name := range t.open {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (t *windowTracker) results() []windowResult {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]windowResult, 0, len(t.windows))
+	for _, w := range t.windows {
+		r := windowResult{Name: w.name, Start: w.start, End: w.end, Workloads: map[string]opSummary{}}
+		for name, s := range w.stats {
+			r.Workloads[name] = s.summary()
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+func (t *windowTracker) logSummary() {
+	results := t.results()
+	if len(results) == 0 {
+		return
+	}
+	slog.Info("event windows", "windows", len(results))
+	for _, r := range results {
+		slog.Info("event window", "window", r.Name, "start", r.Start, "end", r.End, "duration", r.End.Sub(r.Start).Truncate(time.Millisecond))
+		names := make([]string, 0, len(r.Workloads))
+		for name := range r.Workloads {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			slog.Info("event window summary", "window", r.Name, "workload", name, "stats", r.Workloads[name])
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// workerPool runs a workload's queries on goroutines that live as long as
+// the workload, fed batch by batch through a channel, instead of a new
+// goroutine and errgroup per query and iteration: at high iteration counts
+// those are millions of short-lived allocations, and the scheduling and GC
+// work they cause shows up in the latencies measured.
+type workerPool struct {
+	exec    func(ctx context.Context, iter int, st *scanTargets)
+	rng     *lockedRand // draws the start delays of batches with a spread
+	items   chan workItem
+	workers int
+	batch   sync.WaitGroup // the queries of the batch in flight
+	wg      sync.WaitGroup // the workers
+}
+
+type workItem struct {
+	ctx   context.Context
+	iter  int
+	delay time.Duration // before the query starts
+}
+
+func newWorkerPool(exec func(ctx context.Context, iter int, st *scanTargets)) *workerPool {
+	return &workerPool{exec: exec, items: make(chan workItem)}
+}
+
+// run issues n concurrent calls of exec for iteration iter and waits for
+// them, starting workers as n grows past the ones running. With a spread,
+// each call starts after a delay drawn uniformly from it, so the workers
+// don't all wake at once. Batches are run one at a time.
+func (p *workerPool) run(ctx context.Context, iter, n int, spread time.Duration) {
+	for ; p.workers < n; p.workers++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+	p.batch.Add(n)
+	for range n {
+		it := workItem{ctx: ctx, iter: iter}
+		if spread > 0 {
+			it.delay = time.Duration(p.rng.Float64() * float64(spread))
+		}
+		p.items <- it
+	}
+	p.batch.Wait()
+}
+
+func (p *workerPool) work() {
+	defer p.wg.Done()
+	st := newScanTargets()
+	for it := range p.items {
+		if sleepCtx(it.ctx, it.delay) {
+			p.exec(it.ctx, it.iter, st)
+		}
+		p.batch.Done()
+	}
+}
+
+// close stops the workers once idle.
+func (p *workerPool) close() {
+	close(p.items)
+	p.wg.Wait()
+}
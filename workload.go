@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Workloads --workload selects.
+const (
+	workloadDefault    = "default"          // reader pings, writer upserts
+	workloadConnChurn  = "conn-churn"       // the default queries on constantly recycled connections
+	workloadExhaustion = "exhaustion"       // more concurrent pg_sleep readers than reader connections
+	workloadRYW        = "read-your-writes" // every upsert read back through the reader pool
+	workloadLostUpdate = "lost-update"      // writers increment counters, checked at the end
+	workloadBank       = "bank"             // transfers between accounts with a fixed total
+	workloadVisibility = "visibility"       // every upsert polled for by the readers until visible
+)
+
+var workloadNames = []string{workloadDefault, workloadConnChurn, workloadExhaustion, workloadRYW, workloadLostUpdate, workloadBank, workloadVisibility}
+
+// writerWorkloads replace the writer query.
+var writerWorkloads = []string{workloadRYW, workloadLostUpdate, workloadBank, workloadVisibility}
+
+// workload runs a fixed number of iterations against one pool. Each iteration
+// issues conc concurrent queries, then sleeps before the next batch; with a
+// target rate, batches start conc/rate apart instead, the sleep being
+// whatever is left of that once the batch is done. With a think
+// distribution, either interval is only the mean of the drawn ones.
+type workload struct {
+	name       string
+	iterations int
+	conc       int
+	sleep      time.Duration
+	jitter     float64     // spread of each worker's sleep, as a fraction of it
+	rng        *lockedRand // draws the jitter
+	think      thinkDist   // draws the interval between batches around its mean; "" => fixed
+	thinkRng   *lockedRand
+	gate       *pauseGate
+	windows    *windowTracker // optional: also count samples in open event windows
+	steps      *stepRunner    // optional: also count samples in the current --steps step
+	spikes     *spikeMonitor  // optional: also count samples in --spike's latency buckets
+	// drain, when set, is the context queries run under instead of run's, so
+	// the batch in flight can finish after run's context is cancelled.
+	drain context.Context
+
+	// setup runs once before the first iteration; an error aborts the run.
+	setup func(ctx context.Context) error
+	// query issues one query for iteration iter and returns its error. Query
+	// errors are expected while faults are injected: they are logged and
+	// counted, never abort the loop.
+	query func(ctx context.Context, iter int) error
+	// queryInto, when set, replaces query with --measure: the same query,
+	// scanning into the worker's targets.
+	queryInto func(ctx context.Context, iter int, st *scanTargets) error
+
+	// queryTimeout, when set, bounds each query call on its own, apart
+	// from the run's timeout.
+	queryTimeout time.Duration
+
+	stats opStats
+	// warmup is how long into run the queries started are counted in
+	// warmupStats instead of stats, which begins once it's over.
+	warmup      time.Duration
+	warmupStats opStats
+	warm        atomic.Bool // past the warmup
+
+	paceMu    sync.Mutex   // guards conc, sleep, rate and surge once run has started
+	rate      float64      // target queries per second; 0 => paced by sleep alone
+	surge     float64      // multiplies conc and rate during a --spike; 0 => 1
+	startIter int          // first iteration to run (> 0 when resuming)
+	done      atomic.Int64 // iterations completed, including resumed ones
+	completed atomic.Int64 // queries completed by this process, errors included
+	inFlight  atomic.Int64 // queries running
+	cutOff    atomic.Int64 // queries failed because their context ended: the run's end or a shutdown
+	finished  atomic.Bool  // run has returned
+}
+
+func (w *workload) run(ctx context.Context) error {
+	slog.Info("workload started", "workload", w.name)
+	defer w.finished.Store(true)
+	if w.setup != nil {
+		if err := w.setup(ctx); err != nil {
+			return err
+		}
+	}
+	if w.warmup > 0 {
+		w.warmupStats.begin()
+		t := time.AfterFunc(w.warmup, w.endWarmup)
+		defer func() {
+			if t.Stop() { // the run ended within the warmup
+				w.warmupStats.end()
+			}
+		}()
+	} else {
+		w.stats.begin()
+		w.warm.Store(true)
+	}
+	defer w.stats.end()
+	pool := newWorkerPool(w.exec)
+	pool.rng = w.rng
+	defer pool.close()
+	for i := w.startIter; i < w.iterations; i++ {
+		if err := w.gate.wait(ctx); err != nil {
+			slog.Info("workload stopped", "workload", w.name, "iteration", i+1, "err", err)
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			slog.Info("workload stopped", "workload", w.name, "iteration", i+1, "err", ctx.Err())
+			return ctx.Err()
+		default:
+		}
+		qparent := ctx
+		if w.drain != nil {
+			qparent = w.drain
+		}
+		batchStart := time.Now()
+		conc, sleep, rate := w.pace()
+		interval := sleep
+		if rate > 0 {
+			interval = time.Duration(float64(conc) / rate * float64(time.Second))
+		}
+		if w.think != "" {
+			interval = w.think.sample(w.thinkRng, interval)
+		}
+		// with jitter each query waits up to 2*jitter of the sleep before
+		// it starts and the loop sleeps jitter of it less, so each worker's
+		// sleep falls within sleep*(1±jitter)
+		spread := time.Duration(2 * w.jitter * float64(interval))
+		pool.run(qparent, i, conc, spread)
+		if rate > 0 {
+			sleep = interval - time.Since(batchStart)
+		} else {
+			sleep = interval - spread/2
+		}
+		w.done.Store(int64(i + 1))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(sleep):
+		}
+	}
+	slog.Info("workload done", "workload", w.name)
+	return nil
+}
+
+// errQueryTimeout wraps the error of a query call cut off by --query-timeout.
+var errQueryTimeout = errors.New("query timeout")
+
+// exec issues one query of iteration iter and records it.
+func (w *workload) exec(ctx context.Context, iter int, st *scanTargets) {
+	if !measuring {
+		ctx, _ = withQueryID(ctx)
+	}
+	w.inFlight.Add(1)
+	defer w.inFlight.Add(-1)
+	qctx, cancel := ctx, context.CancelFunc(func() {})
+	if w.queryTimeout > 0 {
+		qctx, cancel = context.WithTimeout(ctx, w.queryTimeout)
+	}
+	warm, start := w.warm.Load(), time.Now()
+	var err error
+	if w.queryInto != nil {
+		err = w.queryInto(qctx, iter, st)
+	} else {
+		err = w.query(qctx, iter)
+	}
+	d := time.Since(start)
+	if err != nil && ctx.Err() == nil && errors.Is(qctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("%w (%s): %w", errQueryTimeout, w.queryTimeout, err)
+	}
+	cancel()
+	if warm {
+		w.stats.record(d, err)
+	} else {
+		w.warmupStats.record(d, err)
+	}
+	w.completed.Add(1)
+	if err != nil && ctx.Err() != nil {
+		w.cutOff.Add(1)
+	}
+	if w.windows != nil {
+		w.windows.record(w.name, d, err)
+	}
+	if w.steps != nil {
+		w.steps.record(w.name, d, err)
+	}
+	if w.spikes != nil {
+		w.spikes.record(w.name, d)
+	}
+	if err != nil && !measuring {
+		slog.WarnContext(ctx, "query error", "workload", w.name, "iteration", iter+1, "duration", d, "err", err)
+	}
+}
+
+// endWarmup moves the samples from the warmup's stats to the run's.
+func (w *workload) endWarmup() {
+	w.warmupStats.end()
+	w.stats.begin()
+	w.warm.Store(true)
+	slog.Info("warmup done", "workload", w.name, "warmup", w.warmup)
+}
+
+// pace returns the concurrency, sleep and target rate of the next batch,
+// as multiplied by a spike in progress.
+func (w *workload) pace() (int, time.Duration, float64) {
+	w.paceMu.Lock()
+	defer w.paceMu.Unlock()
+	if w.surge > 0 {
+		return max(1, int(float64(w.conc)*w.surge)), w.sleep, w.rate * w.surge
+	}
+	return w.conc, w.sleep, w.rate
+}
+
+// setPace changes the concurrency and sleep of the batches after the one in
+// flight; conc 0 or sleep < 0 keeps the current value.
+func (w *workload) setPace(conc int, sleep time.Duration) {
+	w.paceMu.Lock()
+	defer w.paceMu.Unlock()
+	if conc > 0 {
+		w.conc = conc
+	}
+	if sleep >= 0 {
+		w.sleep = sleep
+	}
+}
+
+// setSurge multiplies the concurrency and target rate of the batches after
+// the one in flight by factor; 0 ends the surge.
+func (w *workload) setSurge(factor float64) {
+	w.paceMu.Lock()
+	defer w.paceMu.Unlock()
+	w.surge = factor
+}
+
+// setRate changes the target rate of the batches after the one in flight;
+// 0 goes back to the sleep alone.
+func (w *workload) setRate(qps float64) {
+	w.paceMu.Lock()
+	defer w.paceMu.Unlock()
+	w.rate = qps
+}
+
+// pauseGate lets a workload loop be paused between iterations without
+// tearing anything down. The zero value is an open (running) gate.
+type pauseGate struct {
+	mu      sync.Mutex
+	resumed chan struct{} // non-nil while paused; closed on resume
+}
+
+// pause closes the gate and reports whether it was running before.
+func (g *pauseGate) pause() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resumed != nil {
+		return false
+	}
+	g.resumed = make(chan struct{})
+	return true
+}
+
+// resume opens the gate and reports whether it was paused before.
+func (g *pauseGate) resume() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resumed == nil {
+		return false
+	}
+	close(g.resumed)
+	g.resumed = nil
+	return true
+}
+
+func (g *pauseGate) paused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.resumed != nil
+}
+
+// wait blocks while the gate is paused.
+func (g *pauseGate) wait(ctx context.Context) error {
+	g.mu.Lock()
+	ch := g.resumed
+	g.mu.Unlock()
+	if ch == nil {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-ch:
+		return nil
+	}
+}
+
+// setPaused pauses or resumes the target workload ("all" or empty for every
+// workload) and returns one "name: state" entry per affected workload.
+func setPaused(gates map[string]*pauseGate, target string, pause bool) ([]string, error) {
+	var names []string
+	if target == "" || target == "all" {
+		for name := range gates {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	} else {
+		if _, ok := gates[target]; !ok {
+			return nil, fmt.Errorf("unknown workload %q", target)
+		}
+		names = []string{target}
+	}
+	results := make([]string, 0, len(names))
+	for _, name := range names {
+		var state string
+		switch {
+		case pause && gates[name].pause():
+			state = "paused"
+		case pause:
+			state = "already paused"
+		case gates[name].resume():
+			state = "resumed"
+		default:
+			state = "not paused"
+		}
+		results = append(results, name+": "+state)
+	}
+	return results, nil
+}